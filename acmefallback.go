@@ -0,0 +1,163 @@
+package enclaveutils
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// LetsEncryptStagingURL is the directory URL of Let's Encrypt's staging
+// environment, whose rate limits are far more generous than production's.
+// Its certificates aren't trusted by browsers.  It's meant to be used as
+// Config.ACMEDirectoryURL for tests, or as Config.ACMEFallbackDirectoryURL.
+const LetsEncryptStagingURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+// fallbackCachePrefix is the prefix of the names of the fallback CA's entries
+// in the host's certificate cache, which keeps them apart from the primary
+// CA's entries.
+const fallbackCachePrefix = "fallback/"
+
+// getCertificateFunc is the type of tls.Config.GetCertificate.
+type getCertificateFunc func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+// acmeFallback obtains certificates from the primary ACME CA until the CA
+// rate-limits us.  From then on, it obtains certificates from the fallback
+// that Config.ACMEFallbackDirectoryURL or Config.ACMEFallbackSelfSigned
+// determine.
+type acmeFallback struct {
+	e       *Enclave
+	primary getCertificateFunc
+	once    sync.Once
+	// active is set to 1 once we switched to the fallback.
+	active   uint32
+	fallback getCertificateFunc
+	// fallbackHTTP serves the HTTP-01 challenge of the fallback CA.  It's
+	// nil if we fall back to self-signed certificates.
+	fallbackHTTP http.Handler
+	// cache is the primary CA's certificate cache.  If it's the host's
+	// cache, the fallback CA caches its certificates there, too, in
+	// fallbackCache.
+	cache         autocert.Cache
+	fallbackCache autocert.Cache
+	err           error
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+func (f *acmeFallback) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if atomic.LoadUint32(&f.active) == 1 {
+		return f.fallback(hello)
+	}
+	cert, err := f.primary(hello)
+	if err == nil || !isACMERateLimit(err) {
+		return cert, err
+	}
+	f.once.Do(func() { f.err = f.activate(err) })
+	if f.err != nil {
+		return nil, err
+	}
+	return f.fallback(hello)
+}
+
+// httpHandler returns the handler for our HTTP-01 listener, which serves the
+// challenges of the fallback CA once we switched to it, and those of the
+// given primary handler before.
+func (f *acmeFallback) httpHandler(primary http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadUint32(&f.active) == 1 && f.fallbackHTTP != nil {
+			f.fallbackHTTP.ServeHTTP(w, r)
+			return
+		}
+		primary.ServeHTTP(w, r)
+	})
+}
+
+// activate switches to the fallback after the primary CA rate-limited us with
+// the given error.
+func (f *acmeFallback) activate(rateLimitErr error) error {
+	e := f.e
+	if url := e.cfg.ACMEFallbackDirectoryURL; url != "" {
+		e.logError("ACME CA rate-limited certificate issuance (%v).  Falling back to ACME directory %s; "+
+			"clients may not trust the enclave's certificate.", rateLimitErr, url)
+		// The enclave's file system doesn't survive restarts, so we cache
+		// the certificates on the host if we can.
+		var cache autocert.Cache = autocert.DirCache(filepath.Join(acmeCertCacheDir, "fallback"))
+		if c, ok := f.cache.(*vsockCache); ok {
+			cache = c.withPrefix(fallbackCachePrefix)
+		}
+		f.fallbackCache = cache
+		certManager := &autocert.Manager{
+			Cache:      cache,
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(e.fqdns()...),
+			Client:     e.newACMEClient(url),
+		}
+		f.fallbackHTTP = certManager.HTTPHandler(nil)
+		f.fallback = certManager.GetCertificate
+		go e.waitForCachedCert(cache, e.cfg.FQDN, &e.certFpr)
+		if e.cfg.AttestationFQDN != "" {
+			go e.waitForCachedCert(cache, e.cfg.AttestationFQDN, &e.attCertFpr)
+		}
+	} else {
+		e.logError("ACME CA rate-limited certificate issuance (%v).  Falling back to self-signed certificates; "+
+			"clients will not trust the enclave's certificate.", rateLimitErr)
+		cert, _, fpr, err := e.newSelfSignedCert(e.cfg.FQDN, e.cfg.SANs)
+		e.recordCertRotation(cert.Leaf, err)
+		if err != nil {
+			e.logError("Failed to create fallback certificate: %v", err)
+			return err
+		}
+		e.setFingerprint(&e.certFpr, fpr)
+		attCert := cert
+		if e.cfg.AttestationFQDN != "" {
+			var attFpr [sha256.Size]byte
+			attCert, _, attFpr, err = e.newSelfSignedCert(e.cfg.AttestationFQDN, nil)
+			e.recordCertRotation(attCert.Leaf, err)
+			if err != nil {
+				e.logError("Failed to create fallback certificate: %v", err)
+				return err
+			}
+			e.setFingerprint(&e.attCertFpr, attFpr)
+		}
+		f.fallback = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if e.cfg.AttestationFQDN != "" && strings.EqualFold(hello.ServerName, e.cfg.AttestationFQDN) {
+				return &attCert, nil
+			}
+			return &cert, nil
+		}
+	}
+	atomic.StoreUint32(&f.active, 1)
+	return nil
+}
+
+// isACMERateLimit returns true if the given error is an ACME CA's rate-limit
+// error.  autocert doesn't always wrap the CA's errors, so we fall back to
+// looking for the problem type in the error message.
+func isACMERateLimit(err error) bool {
+	var acmeErr *acme.Error
+	if errors.As(err, &acmeErr) {
+		_, ok := acme.RateLimit(acmeErr)
+		return ok
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "error:ratelimited")
+}
+
+// checkACMEFallback returns an error if the ACME fallback configuration is
+// invalid.
+func (cfg *Config) checkACMEFallback() error {
+	if cfg.ACMEFallbackDirectoryURL != "" && cfg.ACMEFallbackSelfSigned {
+		return errors.New("ACME fallback must be either a directory or self-signed certificates, not both")
+	}
+	if (cfg.ACMEFallbackDirectoryURL != "" || cfg.ACMEFallbackSelfSigned) && !cfg.UseACME {
+		return errors.New("ACME fallback requires ACME")
+	}
+	return nil
+}
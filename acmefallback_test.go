@@ -0,0 +1,177 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var errRateLimited = &acme.Error{
+	StatusCode:  http.StatusTooManyRequests,
+	ProblemType: "urn:ietf:params:acme:error:rateLimited",
+	Detail:      "too many certificates already issued",
+}
+
+func TestIsACMERateLimit(t *testing.T) {
+	for err, expected := range map[error]bool{
+		errRateLimited: true,
+		fmt.Errorf("wrapped: %w", errRateLimited):                                                             true,
+		fmt.Errorf("flattened: %v", errRateLimited):                                                           true,
+		&acme.Error{StatusCode: http.StatusForbidden, ProblemType: "urn:ietf:params:acme:error:unauthorized"}: false,
+		errors.New("connection refused"):                                                                      false,
+	} {
+		if got := isACMERateLimit(err); got != expected {
+			t.Fatalf("expected %v for %q but got %v", expected, err, got)
+		}
+	}
+}
+
+func TestACMEFallbackSelfSigned(t *testing.T) {
+	logger := &fakeLogger{}
+	e := NewEnclave(&Config{
+		FQDN:                   "example.com",
+		AttestationFQDN:        "attest.example.com",
+		UseACME:                true,
+		ACMEFallbackSelfSigned: true,
+		Logger:                 logger,
+	})
+	primaryErr := errors.New("connection refused")
+	calls := 0
+	f := &acmeFallback{e: e, primary: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		calls++
+		return nil, primaryErr
+	}}
+
+	// Errors other than rate limits don't trigger the fallback.
+	if _, err := f.getCertificate(&tls.ClientHelloInfo{ServerName: "example.com"}); err != primaryErr {
+		t.Fatalf("expected primary's error but got %v", err)
+	}
+
+	// A rate limit switches to self-signed certificates for good.
+	primaryErr = fmt.Errorf("acme/autocert: %v", errRateLimited)
+	cert, err := f.getCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	if err != nil {
+		t.Fatalf("expected fallback certificate but got: %v", err)
+	}
+	if fpr, ok := e.CertificateFingerprint(); !ok || fpr != sha256.Sum256(cert.Certificate[0]) {
+		t.Fatal("expected fingerprint of fallback certificate")
+	}
+	attCert, err := f.getCertificate(&tls.ClientHelloInfo{ServerName: "attest.example.com"})
+	if err != nil {
+		t.Fatalf("expected fallback certificate but got: %v", err)
+	}
+	if sha256.Sum256(attCert.Certificate[0]) != e.attCertFpr {
+		t.Fatal("expected fingerprint of fallback attestation certificate")
+	}
+	if calls != 2 {
+		t.Fatalf("expected primary to be called twice but got %d calls", calls)
+	}
+
+	logger.Lock()
+	defer logger.Unlock()
+	found := false
+	for i, msg := range logger.msgs {
+		if logger.levels[i] == LevelError && strings.Contains(msg, "self-signed") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected fallback to be logged as error")
+	}
+}
+
+func TestACMEFallbackDirectory(t *testing.T) {
+	e := NewEnclave(&Config{
+		FQDN:                     "example.com",
+		UseACME:                  true,
+		ACMEFallbackDirectoryURL: LetsEncryptStagingURL,
+		Logger:                   &fakeLogger{},
+	})
+	defer e.Close()
+	f := &acmeFallback{e: e, primary: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return nil, errRateLimited
+	}}
+	primaryHTTP := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := f.httpHandler(primaryHTTP)
+	challenge := func() int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/.well-known/acme-challenge/token", nil))
+		return rec.Result().StatusCode
+	}
+	if code := challenge(); code != http.StatusTeapot {
+		t.Fatalf("expected primary to serve challenges but got status code %d", code)
+	}
+
+	// After the switch, the fallback CA's manager handles certificate
+	// requests and challenges.  It rejects hosts that we don't serve
+	// without contacting the CA.
+	if _, err := f.getCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil ||
+		!strings.Contains(err.Error(), "not configured") {
+		t.Fatalf("expected fallback manager's host policy error but got: %v", err)
+	}
+	if challenge() == http.StatusTeapot {
+		t.Fatal("expected fallback to serve challenges")
+	}
+}
+
+func TestACMEFallbackDirectoryCache(t *testing.T) {
+	e := NewEnclave(&Config{
+		FQDN:                     "example.com",
+		UseACME:                  true,
+		ACMEFallbackDirectoryURL: LetsEncryptStagingURL,
+		Logger:                   &fakeLogger{},
+	})
+	defer e.Close()
+	host := &fakeCacheHost{entries: make(map[string][]byte)}
+	cache, err := newVsockCache("3:8001", bytes.Repeat([]byte{0x42}, 32))
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	cache.client.Transport = host
+	f := &acmeFallback{e: e, cache: cache}
+	if err := f.activate(errRateLimited); err != nil {
+		t.Fatalf("failed to activate fallback: %v", err)
+	}
+
+	// The fallback CA's certificates survive restarts because they're
+	// cached on the host, apart from the primary CA's.
+	ctx := context.Background()
+	if err := f.fallbackCache.Put(ctx, "example.com", []byte("fallback certificate")); err != nil {
+		t.Fatalf("failed to put entry: %v", err)
+	}
+	if _, exists := host.entries["/"+fallbackCachePrefix+"example.com"]; !exists {
+		t.Fatal("expected fallback certificate to be cached on the host")
+	}
+	if _, err := cache.Get(ctx, "example.com"); err != autocert.ErrCacheMiss {
+		t.Fatalf("expected fallback certificate not to collide with primary but got: %v", err)
+	}
+	if got, err := f.fallbackCache.Get(ctx, "example.com"); err != nil || string(got) != "fallback certificate" {
+		t.Fatalf("expected fallback certificate but got %q: %v", got, err)
+	}
+}
+
+func TestCheckACMEFallback(t *testing.T) {
+	for cfg, valid := range map[*Config]bool{
+		{}: true,
+		{UseACME: true, ACMEFallbackSelfSigned: true}:                                        true,
+		{UseACME: true, ACMEFallbackDirectoryURL: LetsEncryptStagingURL}:                     true,
+		{UseACME: true, ACMEFallbackSelfSigned: true, ACMEFallbackDirectoryURL: "https://x"}: false,
+		{ACMEFallbackSelfSigned: true}:                                                       false,
+	} {
+		if err := cfg.checkACMEFallback(); (err == nil) != valid {
+			t.Fatalf("expected valid=%v for %+v but got: %v", valid, cfg, err)
+		}
+	}
+}
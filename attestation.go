@@ -1,101 +1,525 @@
 package enclaveutils
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"mime"
 	"net/http"
 	"regexp"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/hf/nsm"
 	"github.com/hf/nsm/request"
 )
 
 const (
-	nonceLen = 40 // The number of hex digits in a nonce.
+	nonceLen = 40 // The default number of hex digits in a nonce.
+	// minNonceBytes and maxNonceBytes bound the nonce lengths that can be
+	// configured.  The NSM accepts nonces of up to 512 bytes.
+	minNonceBytes   = 8
+	maxNonceBytes   = 512
+	nonceEchoHeader = "X-Attestation-Nonce"
+	// maxUserDataLen is the maximum size of an attestation document's user
+	// data that the NSM device accepts.
+	maxUserDataLen = 512
+	// maxAttestationBody is the maximum size of the JSON body of a POST
+	// request to the attestation endpoint.
+	maxAttestationBody = 4096
+	// cborContentType is the content type of raw attestation documents.
+	cborContentType = "application/cbor"
 )
 
 var (
-	errMethodNotGET      = "only HTTP GET requests are allowed"
+	errMethodNotAllowed  = "only HTTP GET and POST requests are allowed"
 	errBadForm           = "failed to parse POST form data"
+	errBadContentType    = "POST requests must have content type application/json"
+	errBadJSON           = "failed to parse JSON request body"
+	errNoNonceInBody     = "could not find nonce in request body"
+	errNonceInQuery      = "POST requests must provide the nonce in the request body"
+	errUserDataInQuery   = "user data must be provided in the body of a POST request"
+	errLowEntropyNonce   = "nonce has too little entropy; use a random nonce"
+	errUserDataTooLong   = fmt.Sprintf("user data exceeds maximum size of %d bytes", maxUserDataLen)
 	errNoNonce           = "could not find nonce in URL query parameters"
-	errBadNonceFormat    = fmt.Sprintf("unexpected nonce format; must be %d-digit hex string", nonceLen)
+	errBadNonceFormat    = badNonceFormat(nonceLen, nonceLen).Error()
 	errFailedAttestation = "failed to obtain attestation document from hypervisor"
-	nonceRegExp          = fmt.Sprintf("[a-f0-9]{%d}", nonceLen)
+	errFailedTransform   = "failed to transform attestation document"
+	errNoNSM             = "attestation unavailable: not running in a Nitro enclave"
 )
 
-// getAttestationHandler takes as input a SHA-256 hash over an HTTPS
-// certificate and returns a HandlerFunc.  This HandlerFunc expects a nonce in
-// the URL query parameters and subsequently asks its hypervisor for an
-// attestation document that contains both the nonce and the certificate hash.
-// The resulting Base64-encoded attestation document is then returned to the
-// requester.
-func getAttestationHandler(certHash [32]byte) http.HandlerFunc {
+// Errors that the enclave's attestation functions return, possibly wrapped,
+// which callers can tell apart with errors.Is.  The attestation endpoint maps
+// them to HTTP status codes.  See also ErrEmptyUserData and
+// ErrCertificateNotReady.
+var (
+	ErrNoNonce         = errors.New(errNoNonce)
+	ErrBadNonceFormat  = errors.New("unexpected nonce format")
+	ErrLowEntropyNonce = errors.New(errLowEntropyNonce)
+	ErrUserDataTooLong = errors.New(errUserDataTooLong)
+	// ErrAttestationFailed means that the hypervisor didn't produce an
+	// attestation document.  The error that wraps it also wraps the
+	// underlying cause, e.g., a syscall.Errno of the NSM device.
+	ErrAttestationFailed = errors.New(errFailedAttestation)
+)
+
+// attestationError wraps the error of a failed request for an attestation
+// document.  It matches ErrAttestationFailed, and unwraps to its cause.
+type attestationError struct {
+	err error
+}
+
+func (e *attestationError) Error() string {
+	return fmt.Sprintf("%s: %v", errFailedAttestation, e.err)
+}
+
+func (e *attestationError) Unwrap() error {
+	return e.err
+}
+
+func (e *attestationError) Is(target error) bool {
+	return target == ErrAttestationFailed
+}
+
+// attester abstracts the Nitro hypervisor, which allows tests to replace it
+// with a fake.
+type attester interface {
+	attest(nonce, userData, publicKey []byte) ([]byte, error)
+}
+
+// nsmAttester obtains attestation documents from the NSM device.  Errors that
+// don't affect the document go to the given logger.
+type nsmAttester struct {
+	logger Logger
+}
+
+func (a nsmAttester) attest(nonce, userData, publicKey []byte) ([]byte, error) {
+	return attest(a.logger, nonce, userData, publicKey)
+}
+
+// attestationRequest represents the JSON body of a POST request to the
+// attestation endpoint.  The nonce is hex-encoded, like in GET requests.  The
+// optional user data is Base64-encoded, and is appended to the enclave's own
+// user data in the attestation document.  The optional key ID refers to a key
+// exchange that was prepared by PrepareKeyExchange.
+type attestationRequest struct {
+	Nonce    string `json:"nonce"`
+	UserData []byte `json:"user_data"`
+	KeyID    string `json:"key_id"`
+}
+
+// getAttestationHandler returns a HandlerFunc that embeds the enclave's user
+// data (typically a SHA-256 hash over its HTTPS certificate) in attestation
+// documents.  For GET requests, this HandlerFunc expects a nonce in the URL
+// query parameters.  For POST requests, it expects an attestationRequest as
+// JSON body, which may also contain user data of the client's choosing.  The
+// HandlerFunc subsequently asks its hypervisor for an attestation document
+// that contains both the nonce and the user data.  The resulting
+// Base64-encoded attestation document is then returned to the requester,
+// followed by a newline.  Clients that send "Accept: application/cbor" or the
+// URL query parameter "format=raw" get the raw document instead.
+//
+// If Config.InformationalAttestation is set, GET requests may omit the nonce.
+// See the option's documentation for how these requests are cached.
+func (e *Enclave) getAttestationHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, errMethodNotGET, http.StatusMethodNotAllowed)
+		e.metrics.IncCounter(MetricAttestationRequests)
+		var (
+			nonce         string
+			rawNonce      []byte
+			clientData    []byte
+			keyID         string
+			informational bool
+			err           error
+		)
+		switch r.Method {
+		case http.MethodGet:
+			if err = r.ParseForm(); err != nil {
+				http.Error(w, errBadForm, http.StatusBadRequest)
+				return
+			}
+			if r.URL.Query().Has("user_data") {
+				http.Error(w, errUserDataInQuery, http.StatusBadRequest)
+				return
+			}
+			keyID = r.URL.Query().Get("key_id")
+			if e.cfg.InformationalAttestation && !r.URL.Query().Has("nonce") {
+				informational = true
+			} else {
+				nonce, rawNonce, err = e.parseNonce(r)
+			}
+		case http.MethodPost:
+			if r.URL.Query().Has("nonce") {
+				http.Error(w, errNonceInQuery, http.StatusBadRequest)
+				return
+			}
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if mediaType != "application/json" {
+				http.Error(w, errBadContentType, http.StatusUnsupportedMediaType)
+				return
+			}
+			var req attestationRequest
+			if err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAttestationBody)).Decode(&req); err != nil {
+				http.Error(w, errBadJSON, http.StatusBadRequest)
+				return
+			}
+			if req.Nonce == "" {
+				http.Error(w, errNoNonceInBody, http.StatusBadRequest)
+				return
+			}
+			nonce, clientData, keyID = req.Nonce, req.UserData, req.KeyID
+			rawNonce, err = e.validateNonce(nonce)
+		default:
+			http.Error(w, errMethodNotAllowed, http.StatusMethodNotAllowed)
 			return
 		}
-		if err := r.ParseForm(); err != nil {
-			http.Error(w, errBadForm, http.StatusBadRequest)
-			return
+		if err == nil && !informational {
+			err = e.checkNonceEntropy(rawNonce)
 		}
-
-		nonce := r.URL.Query().Get("nonce")
-		if nonce == "" {
-			http.Error(w, errNoNonce, http.StatusBadRequest)
+		span := spanFromContext(r.Context())
+		if err == nil {
+			span.SetAttribute(AttrNonceLength, len(rawNonce))
+		}
+		if err != nil {
+			e.metrics.IncCounter(MetricAttestationBadNonces)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if valid, _ := regexp.MatchString(nonceRegExp, nonce); !valid {
-			http.Error(w, errBadNonceFormat, http.StatusBadRequest)
+		publicKey, err := e.preparedPublicKey(keyID)
+		if err != nil {
+			http.Error(w, errUnknownKeyID, http.StatusBadRequest)
 			return
 		}
-		// Decode hex-encoded nonce.
-		rawNonce, err := hex.DecodeString(nonce)
+		// If the client got our attestation certificate, that's the one we
+		// bind to the document.
+		docData, err := e.readyUserData(e.isAttestationFQDN(r))
 		if err != nil {
-			http.Error(w, errBadNonceFormat, http.StatusBadRequest)
+			writeAttestationError(w, err)
+			return
+		}
+		// Documents with a counter or a prepared key differ each time, so
+		// they don't get an ETag.
+		if informational && !e.cfg.CounterInUserData && publicKey == nil {
+			etag := attestationETag(docData)
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Vary", "Accept")
+			if etagMatches(r.Header.Get("If-None-Match"), etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		if e.cfg.CounterInUserData {
+			docData = append(docData, e.nextCounter()...)
+		}
+		if len(docData)+len(clientData) > maxUserDataLen {
+			http.Error(w, errUserDataTooLong, http.StatusBadRequest)
 			return
 		}
 
-		rawDoc, err := attest(rawNonce, certHash[:], nil)
+		start := time.Now()
+		rawDoc, err := e.attestDoc(rawNonce, append(docData, clientData...), publicKey)
+		latency := time.Since(start).Seconds()
+		span.SetAttribute(AttrNSMLatency, latency)
+		e.observeHistogram(MetricNSMLatency, latency)
 		if err != nil {
-			http.Error(w, errFailedAttestation, http.StatusInternalServerError)
+			e.metrics.IncCounter(MetricAttestationNSMErrors)
+			if e.cfg.Transport == TransportTCP && errors.Is(err, syscall.ENOENT) {
+				http.Error(w, errNoNSM, http.StatusNotImplemented)
+				return
+			}
+			writeAttestationError(w, err)
 			return
 		}
-		b64Doc := base64.StdEncoding.EncodeToString(rawDoc)
-		fmt.Fprintln(w, b64Doc)
+		if e.cfg.DocumentTransform != nil {
+			rawDoc, err = e.cfg.DocumentTransform(rawDoc)
+			if err == nil && len(rawDoc) == 0 {
+				err = errors.New("transform returned empty document")
+			}
+			if err != nil {
+				e.logError("Failed to transform attestation document: %v", err)
+				http.Error(w, errFailedTransform, http.StatusInternalServerError)
+				return
+			}
+		}
+		if e.cfg.EchoNonce {
+			w.Header().Set(nonceEchoHeader, nonce)
+		}
+		if wantsRawDocument(r) {
+			w.Header().Set("Content-Type", cborContentType)
+			_, err = w.Write(rawDoc)
+		} else {
+			_, err = fmt.Fprintln(w, base64.StdEncoding.EncodeToString(rawDoc))
+		}
+		if err != nil {
+			e.logError("Failed to write attestation response to %s: %v", r.RemoteAddr, err)
+			e.metrics.IncCounter(MetricAttestationWriteErrors)
+		}
+	}
+}
+
+// wantsRawDocument returns true if the given request asks for the raw
+// attestation document rather than its Base64 encoding, either via
+// "Accept: application/cbor" or via the URL query parameter "format=raw".
+func wantsRawDocument(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "raw" {
+		return true
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+			if err == nil && mediaType == cborContentType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// attestationETag returns the ETag of informational attestation documents
+// with the given user data.  Such documents only differ in their timestamp
+// as long as the user data, which starts with the fingerprint of the
+// enclave's certificate, stays the same.
+func attestationETag(userData []byte) string {
+	hash := sha256.Sum256(userData)
+	return fmt.Sprintf(`"%x"`, hash[:16])
+}
+
+// etagMatches returns true if the given If-None-Match header matches the given
+// ETag, using weak comparison as RFC 7232 requires.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// nonceRegExp matches lowercase hex strings.  It's anchored, so strings that
+// merely contain hex digits are rejected.  The length of nonces is checked
+// separately because Go's regular expressions allow at most 1000 repetitions,
+// which is less than the maximum nonce length.
+var nonceRegExp = regexp.MustCompile("^[a-f0-9]+$")
+
+// nonceFormat determines which hex-encoded nonces the enclave accepts.
+type nonceFormat struct {
+	minDigits, maxDigits int
+	err                  error
+}
+
+// newNonceFormat returns the nonce format that accepts between the given
+// minimum and maximum number of lowercase hex digits.
+func newNonceFormat(minDigits, maxDigits int) *nonceFormat {
+	return &nonceFormat{
+		minDigits: minDigits,
+		maxDigits: maxDigits,
+		err:       badNonceFormat(minDigits, maxDigits),
+	}
+}
+
+// match returns true if the given nonce has an even number of lowercase hex
+// digits within the format's bounds.
+func (f *nonceFormat) match(nonce string) bool {
+	return len(nonce)%2 == 0 && len(nonce) >= f.minDigits && len(nonce) <= f.maxDigits &&
+		nonceRegExp.MatchString(nonce)
+}
+
+// defaultNonceFormat accepts nonces of exactly nonceLen hex digits.
+var defaultNonceFormat = newNonceFormat(nonceLen, nonceLen)
+
+// badNonceFormat returns the error for nonces that are not between the given
+// minimum and maximum number of hex digits.  It wraps ErrBadNonceFormat.
+func badNonceFormat(minDigits, maxDigits int) error {
+	if minDigits == maxDigits {
+		return fmt.Errorf("%w; must be %d-digit hex string", ErrBadNonceFormat, minDigits)
+	}
+	return fmt.Errorf("%w; must be hex string of %d to %d digits", ErrBadNonceFormat, minDigits, maxDigits)
+}
+
+// nonceRange returns the configured minimum and maximum nonce length in bytes,
+// or an error if the configuration is invalid.
+func (cfg *Config) nonceRange() (int, int, error) {
+	min, max := cfg.MinNonceBytes, cfg.MaxNonceBytes
+	if min == 0 {
+		min = nonceLen / 2
+	}
+	if max == 0 {
+		max = nonceLen / 2
+		if min > max {
+			max = min
+		}
+	}
+	if min < minNonceBytes || max > maxNonceBytes || min > max {
+		return 0, 0, fmt.Errorf("nonce length must be between %d and %d bytes, with minimum not exceeding maximum",
+			minNonceBytes, maxNonceBytes)
+	}
+	return min, max, nil
+}
+
+// parseNonce extracts the hex-encoded nonce from the given request's URL query
+// parameters.  If the nonce is present and well-formed, it is returned in both
+// its hex-encoded and its raw form.
+func (e *Enclave) parseNonce(r *http.Request) (string, []byte, error) {
+	nonce := r.URL.Query().Get("nonce")
+	rawNonce, err := e.validateNonce(nonce)
+	if err != nil {
+		return "", nil, err
 	}
+	return nonce, rawNonce, nil
+}
+
+// validateNonce checks if the given hex-encoded nonce is present and
+// well-formed, and returns its raw form.
+func (e *Enclave) validateNonce(nonce string) ([]byte, error) {
+	if nonce == "" {
+		return nil, ErrNoNonce
+	}
+	f := e.nonceFormat
+	if !f.match(nonce) {
+		return nil, f.err
+	}
+	// Decode hex-encoded nonce.
+	rawNonce, err := hex.DecodeString(nonce)
+	if err != nil {
+		return nil, f.err
+	}
+	return rawNonce, nil
+}
+
+// isAttestationFQDN returns true if the given request asked for our
+// attestation FQDN via SNI, i.e., was served using our attestation
+// certificate.
+func (e *Enclave) isAttestationFQDN(r *http.Request) bool {
+	return e.cfg.AttestationFQDN != "" && r.TLS != nil &&
+		strings.EqualFold(r.TLS.ServerName, e.cfg.AttestationFQDN)
+}
+
+// checkNonceEntropy returns an error if the given raw nonce has fewer distinct
+// bytes than configured in Config.MinNonceDistinctBytes.  This catches
+// all-zero and other trivial nonces, which undermine the freshness of
+// attestation documents.
+func (e *Enclave) checkNonceEntropy(rawNonce []byte) error {
+	if e.cfg.MinNonceDistinctBytes == 0 {
+		return nil
+	}
+	distinct := make(map[byte]bool)
+	for _, b := range rawNonce {
+		distinct[b] = true
+	}
+	if len(distinct) < e.cfg.MinNonceDistinctBytes {
+		return ErrLowEntropyNonce
+	}
+	return nil
+}
+
+// AttestUserData asks the hypervisor for an attestation document that contains
+// the given nonce and user data, which lets applications bind their own data
+// (e.g., a commitment to a request) to the enclave.  The document's user data
+// consists of the enclave's own user data, i.e., the SHA-256 fingerprint of
+// its certificate, followed by the given user data, so clients can still tie
+// the document to the enclave's certificate.  The raw document is returned.
+//
+// The NSM accepts at most 512 bytes of user data, so the given user data must
+// not exceed 512 bytes minus the size of the enclave's user data, i.e., 480
+// bytes, or 432 bytes if Config.BinaryHashInUserData is set.  The NSM also
+// accepts nonces of up to 512 bytes, and public keys of up to 1024 bytes.
+//
+// With ACME, AttestUserData returns ErrCertificateNotReady until the
+// enclave's certificate is provisioned.  The same goes for AttestDetailed and
+// AttestDHValue.
+func (e *Enclave) AttestUserData(nonce, userData []byte) ([]byte, error) {
+	docData, err := e.readyUserData(false)
+	if err != nil {
+		return nil, err
+	}
+	docData = append(docData, userData...)
+	if len(docData) > maxUserDataLen {
+		return nil, ErrUserDataTooLong
+	}
+	return e.attestDoc(nonce, docData, nil)
+}
+
+// AttestationOutput is an attestation document together with the claims that
+// AttestDetailed decoded from it.
+type AttestationOutput struct {
+	// Document is the raw attestation document.
+	Document  []byte
+	ModuleID  string
+	Digest    string
+	Timestamp time.Time
+	PCRs      map[uint][]byte
+}
+
+// AttestDetailed works like AttestUserData, but additionally binds the given
+// public key, which may be nil, and returns the document's module ID,
+// timestamp, and PCRs alongside the raw document, which saves applications
+// that log or index their attestations a second decoding step.  The document
+// is decoded but not verified; clients must still verify it.
+func (e *Enclave) AttestDetailed(nonce, userData, publicKey []byte) (*AttestationOutput, error) {
+	docData, err := e.readyUserData(false)
+	if err != nil {
+		return nil, err
+	}
+	docData = append(docData, userData...)
+	if len(docData) > maxUserDataLen {
+		return nil, ErrUserDataTooLong
+	}
+	doc, err := e.attestDoc(nonce, docData, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	_, payload, err := decodeDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &AttestationOutput{
+		Document:  doc,
+		ModuleID:  payload.ModuleID,
+		Digest:    payload.Digest,
+		Timestamp: payload.timestamp(),
+		PCRs:      payload.PCRs,
+	}, nil
 }
 
 // attest takes as input a nonce, user-provided data and a public key, and then
 // asks the Nitro hypervisor to return a signed attestation document that
-// contains all three values.
-func attest(nonce, userData, publicKey []byte) ([]byte, error) {
+// contains all three values.  Failure to close the NSM session is reported to
+// the given logger.
+func attest(logger Logger, nonce, userData, publicKey []byte) ([]byte, error) {
 	s, err := nsm.OpenDefaultSession()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to open NSM session: %w", err)
 	}
 	defer func() {
 		if err = s.Close(); err != nil {
-			log.Printf("Failed to close default NSM session: %s", err)
+			logger.Log(LevelError, fmt.Sprintf("Failed to close default NSM session: %s", err))
 		}
 	}()
 
-	// We ignore the error because of a bug that will return an error despite
-	// having obtained an attestation document:
+	// We don't return the error right away because of a bug that will return
+	// an error despite having obtained an attestation document:
 	// https://github.com/hf/nsm/issues/2
-	res, _ := s.Send(&request.Attestation{
+	if publicKey == nil {
+		publicKey = []byte{}
+	}
+	res, sendErr := s.Send(&request.Attestation{
 		Nonce:     nonce,
 		UserData:  userData,
-		PublicKey: []byte{},
+		PublicKey: publicKey,
 	})
 	if res.Error != "" {
-		return nil, errors.New(string(res.Error))
+		return nil, &nsmError{code: res.Error}
 	}
 
 	if res.Attestation == nil || res.Attestation.Document == nil {
+		if sendErr != nil {
+			return nil, fmt.Errorf("NSM device did not return an attestation: %w", sendErr)
+		}
 		return nil, errors.New("NSM device did not return an attestation")
 	}
 
@@ -1,10 +1,20 @@
 package enclaveutils
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"regexp"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 )
 
@@ -29,8 +39,31 @@ func expect(t *testing.T, resp *http.Response, statusCode int, errMsg string) {
 	}
 }
 
+// fakeAttester returns a canned attestation document (or error) instead of
+// asking the Nitro hypervisor.
+type fakeAttester struct {
+	doc       []byte
+	err       error
+	nonce     []byte
+	userData  []byte
+	publicKey []byte
+}
+
+func (f *fakeAttester) attest(nonce, userData, publicKey []byte) ([]byte, error) {
+	f.nonce = nonce
+	f.userData = userData
+	f.publicKey = publicKey
+	return f.doc, f.err
+}
+
+func newFakeEnclave(cfg *Config) *Enclave {
+	e := NewEnclave(cfg)
+	e.attester = &fakeAttester{doc: []byte("attestation document")}
+	return e
+}
+
 func testReq(t *testing.T, req *http.Request, statusCode int, errMsg string) {
-	attestationHandler := getAttestationHandler([32]byte{})
+	attestationHandler := newFakeEnclave(&Config{}).getAttestationHandler()
 	rec := httptest.NewRecorder()
 	attestationHandler(rec, req)
 	expect(t, rec.Result(), statusCode, errMsg)
@@ -39,7 +72,7 @@ func testReq(t *testing.T, req *http.Request, statusCode int, errMsg string) {
 func TestAttestationHandler(t *testing.T) {
 
 	testReq(t,
-		httptest.NewRequest(http.MethodPost, "/attestation", nil),
+		httptest.NewRequest(http.MethodPut, "/attestation", nil),
 		http.StatusMethodNotAllowed,
 		"",
 	)
@@ -56,6 +89,510 @@ func TestAttestationHandler(t *testing.T) {
 		errBadNonceFormat,
 	)
 
-	// We are unable to test the successful issuing of an attestation document
-	// on a non-Nitro system.
+	// Nonces must consist of exactly nonceLen lowercase hex digits, and
+	// nothing else.
+	valid := strings.Repeat("a", nonceLen)
+	for _, nonce := range []string{
+		valid + "aaaa",
+		valid + "zz",
+		"zz" + valid,
+		valid + "%0A",
+		strings.ToUpper(valid),
+	} {
+		testReq(t,
+			httptest.NewRequest(http.MethodGet, "/attestation?nonce="+nonce, nil),
+			http.StatusBadRequest,
+			errBadNonceFormat,
+		)
+		if defaultNonceFormat.match(nonce) {
+			t.Fatalf("expected nonce format to reject %q", nonce)
+		}
+	}
+
+	// With a well-formed nonce, the document makes it to the client.
+	testReq(t,
+		httptest.NewRequest(http.MethodGet, "/attestation?nonce="+valid, nil),
+		http.StatusOK,
+		base64.StdEncoding.EncodeToString([]byte("attestation document")),
+	)
+
+	// NSM failures result in a 500.
+	e := NewEnclave(&Config{})
+	e.attester = &fakeAttester{err: errors.New("NSM failure")}
+	rec := httptest.NewRecorder()
+	e.getAttestationHandler()(rec, httptest.NewRequest(http.MethodGet, "/attestation?nonce="+valid, nil))
+	expect(t, rec.Result(), http.StatusInternalServerError, errFailedAttestation)
+}
+
+func TestACMECertificateNotReady(t *testing.T) {
+	e := NewEnclave(&Config{FQDN: "example.com", UseACME: true})
+	e.attester = &switchableAttester{doc: []byte("attestation document")}
+	handler := e.getAttestationHandler()
+	target := "/attestation?nonce=" + strings.Repeat("a", nonceLen)
+
+	// Until the ACME certificate is fingerprinted, clients are told to retry.
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	expect(t, rec.Result(), http.StatusServiceUnavailable, ErrCertificateNotReady.Error())
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatal("expected Retry-After header")
+	}
+
+	// Requests race with the goroutine that sets the fingerprint, which
+	// the race detector keeps an eye on.
+	fpr := [sha256.Size]byte{1}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			if rec.Code != http.StatusOK && rec.Code != http.StatusServiceUnavailable {
+				t.Errorf("unexpected status code %d", rec.Code)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		e.setFingerprint(&e.certFpr, fpr)
+	}()
+	wg.Wait()
+
+	// The handler that was registered early binds the fingerprint now.
+	att := &fakeAttester{doc: []byte("attestation document")}
+	e.attester = att
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	expect(t, rec.Result(), http.StatusOK, "")
+	if !bytes.HasPrefix(att.userData, fpr[:]) {
+		t.Fatal("expected certificate fingerprint in user data")
+	}
+}
+
+func TestCertificateNotReadyAPIs(t *testing.T) {
+	e := NewEnclave(&Config{FQDN: "example.com", AttestationFQDN: "attestation.example.com", UseACME: true})
+	e.attester = &fakeAttester{doc: []byte("attestation document")}
+	nonce := make([]byte, nonceLen/2)
+
+	checkNotReady := func() {
+		if _, err := e.AttestUserData(nonce, nil); !errors.Is(err, ErrCertificateNotReady) {
+			t.Errorf("expected AttestUserData to fail with %v but got %v", ErrCertificateNotReady, err)
+		}
+		if _, err := e.AttestDetailed(nonce, nil, nil); !errors.Is(err, ErrCertificateNotReady) {
+			t.Errorf("expected AttestDetailed to fail with %v but got %v", ErrCertificateNotReady, err)
+		}
+		if _, _, err := e.AttestDHValue(nonce, ""); !errors.Is(err, ErrCertificateNotReady) {
+			t.Errorf("expected AttestDHValue to fail with %v but got %v", ErrCertificateNotReady, err)
+		}
+	}
+	checkNotReady()
+
+	// Once the main certificate is ready, the APIs work, but requests via
+	// the attestation FQDN must wait for its own certificate.
+	fpr, attFpr := [sha256.Size]byte{1}, [sha256.Size]byte{2}
+	e.setFingerprint(&e.certFpr, fpr)
+	if _, err := e.AttestUserData(nonce, nil); err != nil {
+		t.Fatalf("failed to attest user data: %v", err)
+	}
+	handler := e.getAttestationHandler()
+	req := httptest.NewRequest(http.MethodGet, "/attestation?nonce="+strings.Repeat("a", nonceLen), nil)
+	req.TLS = &tls.ConnectionState{ServerName: "attestation.example.com"}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	expect(t, rec.Result(), http.StatusServiceUnavailable, ErrCertificateNotReady.Error())
+
+	e.setFingerprint(&e.attCertFpr, attFpr)
+	att := &fakeAttester{doc: []byte("attestation document")}
+	e.attester = att
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	expect(t, rec.Result(), http.StatusOK, "")
+	if !bytes.HasPrefix(att.userData, attFpr[:]) {
+		t.Fatal("expected attestation certificate's fingerprint in user data")
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	e := newFakeEnclave(&Config{MinNonceDistinctBytes: 4})
+	for nonce, expected := range map[string]error{
+		"":                              ErrNoNonce,
+		"foobar":                        ErrBadNonceFormat,
+		strings.Repeat("a", nonceLen):   nil,
+		strings.Repeat("a", nonceLen+2): ErrBadNonceFormat,
+	} {
+		if _, err := e.validateNonce(nonce); !errors.Is(err, expected) {
+			t.Fatalf("expected %v for nonce %q but got %v", expected, nonce, err)
+		}
+	}
+	if _, err := e.validateNonce("foobar"); err.Error() != errBadNonceFormat {
+		t.Fatalf("expected message %q but got %q", errBadNonceFormat, err)
+	}
+	if err := e.checkNonceEntropy(make([]byte, nonceLen/2)); !errors.Is(err, ErrLowEntropyNonce) {
+		t.Fatalf("expected %v but got %v", ErrLowEntropyNonce, err)
+	}
+
+	nonce := []byte("nonce")
+	if _, err := e.AttestUserData(nonce, make([]byte, maxUserDataLen)); !errors.Is(err, ErrUserDataTooLong) {
+		t.Fatalf("expected %v but got %v", ErrUserDataTooLong, err)
+	}
+	if _, err := e.AttestDetailed(nonce, make([]byte, maxUserDataLen), nil); !errors.Is(err, ErrUserDataTooLong) {
+		t.Fatalf("expected %v but got %v", ErrUserDataTooLong, err)
+	}
+
+	// Attestation failures keep their cause.
+	e.attester = &fakeAttester{err: syscall.EBUSY}
+	_, err := e.AttestUserData(nonce, nil)
+	if !errors.Is(err, ErrAttestationFailed) || !errors.Is(err, syscall.EBUSY) {
+		t.Fatalf("expected %v caused by %v but got %v", ErrAttestationFailed, syscall.EBUSY, err)
+	}
+	if _, _, err = e.AttestDHValue(nonce, DHGroupX25519); !errors.Is(err, ErrAttestationFailed) {
+		t.Fatalf("expected %v but got %v", ErrAttestationFailed, err)
+	}
+
+	e = newFakeEnclave(&Config{EmptyUserData: RejectEmptyUserData})
+	if _, err = e.AttestDetailed(nonce, nil, nil); !errors.Is(err, ErrEmptyUserData) {
+		t.Fatalf("expected %v but got %v", ErrEmptyUserData, err)
+	}
+}
+
+func TestEchoNonce(t *testing.T) {
+	nonce := strings.Repeat("a", nonceLen)
+	req := httptest.NewRequest(http.MethodGet, "/attestation?nonce="+nonce, nil)
+
+	rec := httptest.NewRecorder()
+	newFakeEnclave(&Config{EchoNonce: true}).getAttestationHandler()(rec, req)
+	resp := rec.Result()
+	expect(t, resp, http.StatusOK, "")
+	if got := resp.Header.Get(nonceEchoHeader); got != nonce {
+		t.Fatalf("expected nonce header %q but got %q", nonce, got)
+	}
+
+	// The header is off by default.
+	rec = httptest.NewRecorder()
+	newFakeEnclave(&Config{}).getAttestationHandler()(rec, req)
+	resp = rec.Result()
+	expect(t, resp, http.StatusOK, "")
+	if got := resp.Header.Get(nonceEchoHeader); got != "" {
+		t.Fatalf("expected no nonce header but got %q", got)
+	}
+}
+
+func TestAttestationPOST(t *testing.T) {
+	nonce := strings.Repeat("a", nonceLen)
+	post := func(target, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		e := newFakeEnclave(&Config{})
+		e.getAttestationHandler()(rec, req)
+		return rec
+	}
+
+	// GET with the nonce in the query keeps working, and user data is the
+	// enclave's own.
+	e := newFakeEnclave(&Config{})
+	rec := httptest.NewRecorder()
+	e.getAttestationHandler()(rec, httptest.NewRequest(http.MethodGet, "/attestation?nonce="+nonce, nil))
+	expect(t, rec.Result(), http.StatusOK, "")
+	if !bytes.Equal(e.attester.(*fakeAttester).userData, e.userData()) {
+		t.Fatal("expected user data to be the enclave's user data")
+	}
+
+	// POST with a JSON body, with the client's user data appended to ours.
+	e = newFakeEnclave(&Config{})
+	req := httptest.NewRequest(http.MethodPost, "/attestation",
+		strings.NewReader(`{"nonce":"`+nonce+`","user_data":"Zm9v"}`))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	rec = httptest.NewRecorder()
+	e.getAttestationHandler()(rec, req)
+	expect(t, rec.Result(), http.StatusOK, "")
+	if !bytes.Equal(e.attester.(*fakeAttester).userData, append(e.userData(), []byte("foo")...)) {
+		t.Fatal("expected user data to contain the client's user data")
+	}
+
+	// Invalid combinations.
+	expect(t, post("/attestation?nonce="+nonce, "application/json", `{"nonce":"`+nonce+`"}`).Result(),
+		http.StatusBadRequest, errNonceInQuery)
+	expect(t, post("/attestation", "application/x-www-form-urlencoded", "nonce="+nonce).Result(),
+		http.StatusUnsupportedMediaType, errBadContentType)
+	expect(t, post("/attestation", "application/json", `{"user_data":"Zm9v"}`).Result(),
+		http.StatusBadRequest, errNoNonceInBody)
+	expect(t, post("/attestation", "application/json", `{"nonce":"foobar"}`).Result(),
+		http.StatusBadRequest, errBadNonceFormat)
+	expect(t, post("/attestation", "application/json", `{"nonce":`).Result(),
+		http.StatusBadRequest, errBadJSON)
+	expect(t, post("/attestation", "application/json",
+		`{"nonce":"`+nonce+`","user_data":"`+base64.StdEncoding.EncodeToString(make([]byte, maxUserDataLen))+`"}`).Result(),
+		http.StatusBadRequest, errUserDataTooLong)
+	testReq(t,
+		httptest.NewRequest(http.MethodGet, "/attestation?nonce="+nonce+"&user_data=Zm9v", nil),
+		http.StatusBadRequest,
+		errUserDataInQuery,
+	)
+}
+
+func TestNonceEntropy(t *testing.T) {
+	get := func(cfg *Config, nonce string) *http.Response {
+		rec := httptest.NewRecorder()
+		newFakeEnclave(cfg).getAttestationHandler()(rec, httptest.NewRequest(http.MethodGet, "/attestation?nonce="+nonce, nil))
+		return rec.Result()
+	}
+	cfg := &Config{MinNonceDistinctBytes: 8}
+
+	for _, nonce := range []string{
+		strings.Repeat("0", nonceLen),
+		strings.Repeat("a", nonceLen),
+		strings.Repeat("0102", nonceLen/4),
+		strings.Repeat("0123456789abcd", 3)[:nonceLen],
+	} {
+		expect(t, get(cfg, nonce), http.StatusBadRequest, errLowEntropyNonce)
+	}
+
+	nonce, _, err := GenerateNonce()
+	if err != nil {
+		t.Fatalf("failed to generate nonce: %v", err)
+	}
+	expect(t, get(cfg, nonce), http.StatusOK, "")
+	expect(t, get(cfg, "000102030405060708090a0b0c0d0e0f10111213"), http.StatusOK, "")
+
+	// The check is off by default.
+	expect(t, get(&Config{}, strings.Repeat("0", nonceLen)), http.StatusOK, "")
+}
+
+func TestInformationalAttestationETag(t *testing.T) {
+	e := newFakeEnclave(&Config{InformationalAttestation: true})
+	handler := e.getAttestationHandler()
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/attestation", nil))
+	expect(t, rec.Result(), http.StatusOK, "")
+	etag := rec.Result().Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("expected ETag for informational document")
+	}
+	if nonce := e.attester.(*fakeAttester).nonce; nonce != nil {
+		t.Fatalf("expected no nonce in informational document but got %x", nonce)
+	}
+
+	// A matching If-None-Match header yields a 304 without attesting.
+	e.attester = &fakeAttester{err: errors.New("should not be called")}
+	req := httptest.NewRequest(http.MethodGet, "/attestation", nil)
+	req.Header.Set("If-None-Match", `"foo", W/`+etag)
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	expect(t, rec.Result(), http.StatusNotModified, "")
+
+	// Responses to requests with nonce are always fresh.
+	e.attester = &fakeAttester{doc: []byte("attestation document")}
+	req = httptest.NewRequest(http.MethodGet, "/attestation?nonce="+strings.Repeat("a", nonceLen), nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	expect(t, rec.Result(), http.StatusOK, "")
+	if rec.Result().Header.Get("ETag") != "" {
+		t.Fatal("expected no ETag for document with nonce")
+	}
+
+	// Without the option, the nonce remains mandatory.
+	testReq(t, httptest.NewRequest(http.MethodGet, "/attestation", nil), http.StatusBadRequest, errNoNonce)
+}
+
+func TestAttestUserData(t *testing.T) {
+	e := newFakeEnclave(&Config{})
+	e.certFpr = [32]byte{1, 2, 3}
+	if _, err := e.AttestUserData([]byte("nonce"), []byte("commitment")); err != nil {
+		t.Fatalf("failed to attest user data: %v", err)
+	}
+	userData := e.attester.(*fakeAttester).userData
+	if !bytes.HasPrefix(userData, e.certFpr[:]) || !bytes.HasSuffix(userData, []byte("commitment")) {
+		t.Fatalf("expected certificate fingerprint followed by user data but got %x", userData)
+	}
+
+	if _, err := e.AttestUserData([]byte("nonce"), make([]byte, maxUserDataLen-len(e.certFpr)+1)); err == nil {
+		t.Fatal("expected error for too much user data")
+	}
+}
+
+func TestAttestDetailed(t *testing.T) {
+	pki := newTestPKI(t)
+	e := NewEnclave(&Config{})
+	e.attester = &pkiAttester{t: t, pki: pki}
+	e.certFpr = [32]byte{1, 2, 3}
+
+	out, err := e.AttestDetailed([]byte("nonce"), []byte("commitment"), nil)
+	if err != nil {
+		t.Fatalf("failed to attest: %v", err)
+	}
+	res, err := Verify(out.Document, VerifyOptions{Roots: pki.roots})
+	if err != nil {
+		t.Fatalf("failed to verify returned document: %v", err)
+	}
+	if out.ModuleID != res.ModuleID || out.Digest != res.Digest || !out.Timestamp.Equal(res.Timestamp) {
+		t.Fatalf("expected decoded claims to match document but got %+v", out)
+	}
+	if !reflect.DeepEqual(out.PCRs, res.PCRs) {
+		t.Fatal("expected decoded PCRs to match document")
+	}
+	if !bytes.HasPrefix(res.UserData, e.certFpr[:]) || !bytes.HasSuffix(res.UserData, []byte("commitment")) {
+		t.Fatalf("expected certificate fingerprint followed by user data but got %x", res.UserData)
+	}
+
+	// Documents that fail to decode result in an error.
+	e.attester = &fakeAttester{doc: []byte("attestation document")}
+	if _, err := e.AttestDetailed([]byte("nonce"), nil, nil); err == nil {
+		t.Fatal("expected error for undecodable document")
+	}
+}
+
+func TestDocumentTransform(t *testing.T) {
+	nonce := strings.Repeat("a", nonceLen)
+	for _, test := range []struct {
+		transform  func([]byte) ([]byte, error)
+		statusCode int
+		expected   string
+	}{
+		{func(doc []byte) ([]byte, error) { return doc, nil }, http.StatusOK, "attestation document"},
+		{func(doc []byte) ([]byte, error) {
+			return append([]byte("envelope:"), doc...), nil
+		}, http.StatusOK, "envelope:attestation document"},
+		{func(doc []byte) ([]byte, error) { return nil, errors.New("failed") }, http.StatusInternalServerError, ""},
+		{func(doc []byte) ([]byte, error) { return nil, nil }, http.StatusInternalServerError, ""},
+	} {
+		e := newFakeEnclave(&Config{DocumentTransform: test.transform, Logger: &fakeLogger{}})
+		rec := httptest.NewRecorder()
+		e.getAttestationHandler()(rec, httptest.NewRequest(http.MethodGet, "/attestation?nonce="+nonce, nil))
+		resp := rec.Result()
+		if resp.StatusCode != test.statusCode {
+			t.Fatalf("expected status code %d but got %d", test.statusCode, resp.StatusCode)
+		}
+		if test.statusCode != http.StatusOK {
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		doc, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+		if err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if string(doc) != test.expected {
+			t.Fatalf("expected document %q but got %q", test.expected, doc)
+		}
+	}
+}
+
+func TestRawAttestationDocument(t *testing.T) {
+	e := newFakeEnclave(&Config{})
+	handler := e.getAttestationHandler()
+	target := "/attestation?nonce=" + strings.Repeat("a", nonceLen)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, target+"&format=raw", nil),
+		func() *http.Request {
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			req.Header.Set("Accept", "text/plain;q=0.5, application/cbor")
+			return req
+		}(),
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		resp := rec.Result()
+		expect(t, resp, http.StatusOK, "")
+		if ct := resp.Header.Get("Content-Type"); ct != cborContentType {
+			t.Fatalf("expected content type %q but got %q", cborContentType, ct)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != "attestation document" {
+			t.Fatalf("expected raw document but got %q", body)
+		}
+	}
+
+	// Base64 remains the default.
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	body, _ := ioutil.ReadAll(rec.Result().Body)
+	if expected := base64.StdEncoding.EncodeToString([]byte("attestation document")) + "\n"; string(body) != expected {
+		t.Fatalf("expected %q but got %q", expected, body)
+	}
+}
+
+func TestConfigurableNonceLength(t *testing.T) {
+	e := newFakeEnclave(&Config{MinNonceBytes: 16, MaxNonceBytes: 64})
+	handler := e.getAttestationHandler()
+	for length, statusCode := range map[int]int{
+		30:  http.StatusBadRequest,
+		32:  http.StatusOK,
+		40:  http.StatusOK,
+		33:  http.StatusBadRequest, // Odd number of hex digits.
+		128: http.StatusOK,
+		130: http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/attestation?nonce="+strings.Repeat("a", length), nil))
+		if rec.Result().StatusCode != statusCode {
+			t.Fatalf("expected status code %d for nonce of %d digits but got %d", statusCode, length, rec.Result().StatusCode)
+		}
+		if statusCode == http.StatusBadRequest {
+			body, _ := ioutil.ReadAll(rec.Result().Body)
+			if !strings.Contains(string(body), "32 to 128 digits") {
+				t.Fatalf("expected error message to state the accepted range but got %q", body)
+			}
+		}
+	}
+
+	// The maximum nonce length exceeds the repetition limit of Go's regular
+	// expressions.
+	e = newFakeEnclave(&Config{MaxNonceBytes: maxNonceBytes})
+	handler = e.getAttestationHandler()
+	for length, statusCode := range map[int]int{
+		2 * maxNonceBytes:       http.StatusOK,
+		2*maxNonceBytes + 2:     http.StatusBadRequest,
+		2*maxNonceBytes - 1:     http.StatusBadRequest,
+		2 * (minNonceBytes - 1): http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/attestation?nonce="+strings.Repeat("a", length), nil))
+		if rec.Result().StatusCode != statusCode {
+			t.Fatalf("expected status code %d for nonce of %d digits but got %d", statusCode, length, rec.Result().StatusCode)
+		}
+	}
+
+	for _, cfg := range []*Config{
+		{MinNonceBytes: 4},
+		{MaxNonceBytes: 1024},
+		{MinNonceBytes: 32, MaxNonceBytes: 16},
+	} {
+		if _, _, err := cfg.nonceRange(); err == nil {
+			t.Fatalf("expected error for nonce range %d to %d", cfg.MinNonceBytes, cfg.MaxNonceBytes)
+		}
+	}
+	if min, max, err := (&Config{MinNonceBytes: 32}).nonceRange(); err != nil || min != 32 || max != 32 {
+		t.Fatalf("expected nonce range 32 to 32 but got %d to %d: %v", min, max, err)
+	}
+}
+
+// BenchmarkValidateNonce measures nonce validation with the precompiled
+// regular expression that the attestation handler uses.  Compare with
+// BenchmarkValidateNonceUncompiled, which compiles the expression per call as
+// regexp.MatchString does.
+func BenchmarkValidateNonce(b *testing.B) {
+	e := NewEnclave(&Config{})
+	nonce := strings.Repeat("a", nonceLen)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := e.validateNonce(nonce); err != nil {
+			b.Fatalf("failed to validate nonce: %v", err)
+		}
+	}
+}
+
+func BenchmarkValidateNonceUncompiled(b *testing.B) {
+	nonce := strings.Repeat("a", nonceLen)
+	expr := fmt.Sprintf("^[a-f0-9]{%d}$", nonceLen)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if ok, err := regexp.MatchString(expr, nonce); !ok || err != nil {
+			b.Fatalf("failed to match nonce: %v", err)
+		}
+	}
 }
@@ -0,0 +1,59 @@
+package enclaveutils
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var errNoAttestationKey = errors.New("enclave has no generated attestation key")
+
+// attestationKey is the enclave's long-term X25519 key pair, which
+// Config.GenerateAttestationKey asks for.  It's generated on first use.
+type attestationKey struct {
+	once      sync.Once
+	priv, pub []byte
+	err       error
+}
+
+// get returns the key pair, generating it if necessary.
+func (k *attestationKey) get() ([]byte, []byte, error) {
+	k.once.Do(func() {
+		k.priv, k.pub, k.err = GenerateDHKey(DHGroupX25519)
+		if k.err != nil {
+			k.err = fmt.Errorf("failed to generate attestation key: %v", k.err)
+		}
+	})
+	return k.priv, k.pub, k.err
+}
+
+// PublicKey returns the public key that the enclave binds to the public_key
+// field of its attestation documents, i.e., Config.AttestationPublicKey or the
+// public value of the key pair that Config.GenerateAttestationKey asks for.
+// Without either, the function returns nil.
+func (e *Enclave) PublicKey() ([]byte, error) {
+	if len(e.cfg.AttestationPublicKey) > 0 {
+		return e.cfg.AttestationPublicKey, nil
+	}
+	if !e.cfg.GenerateAttestationKey {
+		return nil, nil
+	}
+	_, pub, err := e.attKey.get()
+	return pub, err
+}
+
+// DeriveAttestationKey derives a key from the private value of the key pair
+// that Config.GenerateAttestationKey asks for and the client's public value,
+// like DeriveDHKey does.  Clients that verified the enclave's attestation
+// document call DeriveDHKey with the document's public key and their own
+// private value, and arrive at the same key.
+func (e *Enclave) DeriveAttestationKey(peerPub []byte) ([]byte, error) {
+	if !e.cfg.GenerateAttestationKey || len(e.cfg.AttestationPublicKey) > 0 {
+		return nil, errNoAttestationKey
+	}
+	priv, _, err := e.attKey.get()
+	if err != nil {
+		return nil, err
+	}
+	return DeriveDHKey(DHGroupX25519, priv, peerPub)
+}
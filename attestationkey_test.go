@@ -0,0 +1,82 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// attestWith requests an attestation document from the enclave's attestation
+// handler, using the given query string.
+func attestWith(t *testing.T, e *Enclave, query string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	e.getAttestationHandler()(rec, httptest.NewRequest(http.MethodGet, "/attestation?"+query, nil))
+	expect(t, rec.Result(), http.StatusOK, "")
+}
+
+func TestAttestationPublicKey(t *testing.T) {
+	nonce := strings.Repeat("a", nonceLen)
+	e := newFakeEnclave(&Config{})
+	if pub, err := e.PublicKey(); err != nil || pub != nil {
+		t.Fatalf("expected no public key but got %x (%v)", pub, err)
+	}
+	if _, err := e.DeriveAttestationKey(nil); err != errNoAttestationKey {
+		t.Fatalf("expected error %v but got %v", errNoAttestationKey, err)
+	}
+
+	// A configured public key is bound to documents.
+	configured := []byte("application key")
+	e = newFakeEnclave(&Config{AttestationPublicKey: configured})
+	attestWith(t, e, "nonce="+nonce)
+	if !bytes.Equal(e.attester.(*fakeAttester).publicKey, configured) {
+		t.Fatal("expected configured public key in document")
+	}
+
+	// So is a generated one, which stays the same across documents.
+	e = newFakeEnclave(&Config{GenerateAttestationKey: true})
+	pub, err := e.PublicKey()
+	if err != nil {
+		t.Fatalf("failed to get public key: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		attestWith(t, e, "nonce="+nonce)
+		if !bytes.Equal(e.attester.(*fakeAttester).publicKey, pub) {
+			t.Fatal("expected generated public key in document")
+		}
+	}
+
+	// A prepared key exchange takes precedence.
+	id, prepared, err := e.PrepareKeyExchange()
+	if err != nil {
+		t.Fatalf("failed to prepare key exchange: %v", err)
+	}
+	attestWith(t, e, "nonce="+nonce+"&key_id="+id)
+	if !bytes.Equal(e.attester.(*fakeAttester).publicKey, prepared) {
+		t.Fatal("expected prepared public value in document")
+	}
+
+	// Clients derive the same key as the enclave.
+	clientPriv, clientPub, err := GenerateDHKey(DHGroupX25519)
+	if err != nil {
+		t.Fatalf("failed to generate client key: %v", err)
+	}
+	enclaveKey, err := e.DeriveAttestationKey(clientPub)
+	if err != nil {
+		t.Fatalf("failed to derive key: %v", err)
+	}
+	clientKey, err := DeriveDHKey(DHGroupX25519, clientPriv, pub)
+	if err != nil {
+		t.Fatalf("failed to derive client key: %v", err)
+	}
+	if !bytes.Equal(enclaveKey, clientKey) {
+		t.Fatal("expected enclave and client to derive the same key")
+	}
+
+	e = NewEnclave(&Config{AttestationPublicKey: configured, GenerateAttestationKey: true})
+	if err := e.Start(); err == nil {
+		t.Fatal("expected error when setting and generating an attestation key")
+	}
+}
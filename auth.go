@@ -0,0 +1,80 @@
+package enclaveutils
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	errBadToken         = "missing or invalid bearer token"
+	errUnauthorizedPeer = "peer not authorized to request attestation"
+)
+
+// requireBearerToken returns a middleware that rejects requests whose
+// Authorization header doesn't contain the given bearer token.  We compare
+// hashes of the tokens, which keeps the comparison constant-time even if the
+// tokens differ in length.
+func requireBearerToken(token string) func(http.Handler) http.Handler {
+	expected := sha256.Sum256([]byte(token))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			const prefix = "Bearer "
+			auth := r.Header.Get("Authorization")
+			if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, errBadToken, http.StatusUnauthorized)
+				return
+			}
+			got := sha256.Sum256([]byte(auth[len(prefix):]))
+			if subtle.ConstantTimeCompare(got[:], expected[:]) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, errBadToken, http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// PeerCID returns the vsock context ID of the peer that sent the given
+// request, or false if the request didn't arrive over vsock.  The context ID
+// is taken from the request's RemoteAddr, which the HTTP server sets to the
+// connection's remote address, e.g., "vm(3):1234" or "host(2):1234".
+func PeerCID(r *http.Request) (uint32, bool) {
+	addr := r.RemoteAddr
+	start, end := strings.IndexByte(addr, '('), strings.IndexByte(addr, ')')
+	if start <= 0 || end < start || !strings.HasPrefix(addr[end:], "):") {
+		return 0, false
+	}
+	cid, err := strconv.ParseUint(addr[start+1:end], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(cid), true
+}
+
+// authorizePeer is a middleware that rejects requests that
+// Config.AttestationAuthorizer doesn't authorize.
+func (e *Enclave) authorizePeer(next http.Handler) http.Handler {
+	status := e.cfg.AttestationDeniedStatus
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cid, ok := PeerCID(r)
+		if !ok {
+			e.log("Denied attestation request from non-vsock peer %s.", r.RemoteAddr)
+			http.Error(w, errUnauthorizedPeer, status)
+			return
+		}
+		if err := e.cfg.AttestationAuthorizer(cid, r); err != nil {
+			e.log("Denied attestation request from CID %d: %v", cid, err)
+			http.Error(w, errUnauthorizedPeer, status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
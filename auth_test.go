@@ -0,0 +1,106 @@
+package enclaveutils
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mdlayher/vsock"
+)
+
+func TestAttestationToken(t *testing.T) {
+	e := NewEnclave(&Config{AttestationToken: "secret"})
+	if err := e.AddRoute(http.MethodGet, "/app", func(w http.ResponseWriter, r *http.Request) {}); err != nil {
+		t.Fatalf("failed to add route: %v", err)
+	}
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	get := func(target, auth string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		e.router.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+
+	resp := get("/attestation", "")
+	if resp.Header.Get("WWW-Authenticate") != "Bearer" {
+		t.Fatal("expected WWW-Authenticate header")
+	}
+	expect(t, resp, http.StatusUnauthorized, errBadToken)
+	expect(t, get("/attestation", "Bearer wrong"), http.StatusUnauthorized, errBadToken)
+	expect(t, get("/attestation", "Bearer secretsecret"), http.StatusUnauthorized, errBadToken)
+	expect(t, get("/attestation", "Basic secret"), http.StatusUnauthorized, errBadToken)
+	// With the right token, the request makes it to the attestation handler.
+	expect(t, get("/attestation", "Bearer secret"), http.StatusBadRequest, errNoNonce)
+	expect(t, get("/attestation", "bearer secret"), http.StatusBadRequest, errNoNonce)
+	// Application routes are unaffected.
+	expect(t, get("/app", ""), http.StatusOK, "")
+}
+
+func TestPeerCID(t *testing.T) {
+	for remoteAddr, expected := range map[string]uint32{
+		(&vsock.Addr{ContextID: 16, Port: 1234}).String():       16,
+		(&vsock.Addr{ContextID: vsock.Host, Port: 80}).String(): vsock.Host,
+		"vm(4294967295):1": 4294967295,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		if cid, ok := PeerCID(req); !ok || cid != expected {
+			t.Fatalf("expected CID %d for %q but got %d", expected, remoteAddr, cid)
+		}
+	}
+	for _, remoteAddr := range []string{"192.0.2.1:1234", "[::1]:1234", "vm(x):1", "vm(4294967296):1", "(3):1", ""} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		if _, ok := PeerCID(req); ok {
+			t.Fatalf("expected no CID for %q", remoteAddr)
+		}
+	}
+}
+
+func TestAttestationAuthorizer(t *testing.T) {
+	authorizer := func(peerCID uint32, r *http.Request) error {
+		if peerCID != vsock.Host {
+			return errors.New("unknown peer")
+		}
+		return nil
+	}
+	get := func(e *Enclave, target string, cid uint32) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = (&vsock.Addr{ContextID: cid, Port: 1234}).String()
+		rec := httptest.NewRecorder()
+		e.router.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+
+	e := NewEnclave(&Config{AttestationAuthorizer: authorizer, EnableCompactProof: true})
+	if err := e.AddRoute(http.MethodGet, "/app", func(w http.ResponseWriter, r *http.Request) {}); err != nil {
+		t.Fatalf("failed to add route: %v", err)
+	}
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	// The authorized host agent makes it to the attestation handler.
+	expect(t, get(e, "/attestation", vsock.Host), http.StatusBadRequest, errNoNonce)
+	expect(t, get(e, "/attestation", 16), http.StatusForbidden, errUnauthorizedPeer)
+	expect(t, get(e, "/attestation/compact", 16), http.StatusForbidden, errUnauthorizedPeer)
+	// Requests that didn't arrive over vsock are denied.
+	req := httptest.NewRequest(http.MethodGet, "/attestation", nil)
+	rec := httptest.NewRecorder()
+	e.router.ServeHTTP(rec, req)
+	expect(t, rec.Result(), http.StatusForbidden, errUnauthorizedPeer)
+	// Application routes are unaffected.
+	expect(t, get(e, "/app", 16), http.StatusOK, "")
+
+	// The status code of denied requests is configurable.
+	e = NewEnclave(&Config{AttestationAuthorizer: authorizer, AttestationDeniedStatus: http.StatusNotFound})
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	expect(t, get(e, "/attestation", 16), http.StatusNotFound, errUnauthorizedPeer)
+}
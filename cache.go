@@ -0,0 +1,97 @@
+package enclaveutils
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// defaultCacheTTL is the time for which a VerifierCache trusts a verified
+// certificate unless configured otherwise.
+const defaultCacheTTL = 5 * time.Minute
+
+// VerifierCache remembers the fingerprints of enclave certificates whose
+// attestation documents passed verification.  Clients that repeatedly
+// connect to the same enclave set VerifyOptions.Cache, which makes
+// DialAndVerify skip the attestation request if the enclave presents a
+// certificate that was verified less than TTL ago.  An enclave that presents
+// a different certificate, e.g., after a restart, is attested again.
+//
+// The cache keeps the verified attestation documents, and a cache hit
+// verifies the cached document again with the caller's VerifyOptions, so
+// callers may share a cache even if their options differ.  The hit skips the
+// attestation request but not the verification.  The result's nonce and
+// timestamp are those of the original document, so VerifyOptions.MaxAge
+// limits how long a document is served from the cache, in addition to TTL.
+//
+// A VerifierCache is safe for concurrent use.
+type VerifierCache struct {
+	// TTL is the time for which a verified certificate is trusted.  If zero,
+	// the TTL defaults to five minutes.
+	TTL time.Duration
+	// Now returns the current time.  If nil, time.Now is used.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*cacheEntry
+}
+
+type cacheEntry struct {
+	doc     []byte
+	expires time.Time
+}
+
+// lookup returns the cached attestation document for the certificate with the
+// given fingerprint, or nil if there is none or it has expired.
+func (c *VerifierCache) lookup(certFpr [sha256.Size]byte) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, exists := c.entries[certFpr]
+	if !exists {
+		return nil
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, certFpr)
+		return nil
+	}
+	return entry.doc
+}
+
+// add caches the given verified attestation document for the certificate
+// with the given fingerprint, and prunes expired entries while at it.
+func (c *VerifierCache) add(certFpr [sha256.Size]byte, doc []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[[sha256.Size]byte]*cacheEntry)
+	}
+	now := c.now()
+	for fpr, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, fpr)
+		}
+	}
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = defaultCacheTTL
+	}
+	c.entries[certFpr] = &cacheEntry{doc: doc, expires: now.Add(ttl)}
+}
+
+// Invalidate removes the certificate with the given SHA-256 fingerprint from
+// the cache, which forces the next connection to an enclave that presents the
+// certificate to be attested again.
+func (c *VerifierCache) Invalidate(certFpr [sha256.Size]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, certFpr)
+}
+
+func (c *VerifierCache) now() time.Time {
+	if c.Now == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
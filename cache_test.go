@@ -0,0 +1,111 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestVerifierCache(t *testing.T) {
+	now := time.Now()
+	c := &VerifierCache{TTL: time.Minute, Now: func() time.Time { return now }}
+	fpr1, fpr2 := sha256.Sum256([]byte("cert1")), sha256.Sum256([]byte("cert2"))
+	doc := []byte("attestation document")
+
+	if c.lookup(fpr1) != nil {
+		t.Fatal("expected cache miss for empty cache")
+	}
+	c.add(fpr1, doc)
+	if !bytes.Equal(c.lookup(fpr1), doc) {
+		t.Fatal("expected cache hit")
+	}
+	// A different certificate must not hit the cache.
+	if c.lookup(fpr2) != nil {
+		t.Fatal("expected cache miss for different certificate")
+	}
+
+	now = now.Add(time.Minute)
+	if c.lookup(fpr1) != nil {
+		t.Fatal("expected cache miss after TTL expired")
+	}
+
+	c.add(fpr1, doc)
+	c.Invalidate(fpr1)
+	if c.lookup(fpr1) != nil {
+		t.Fatal("expected cache miss after invalidation")
+	}
+}
+
+func TestDialAndVerifyCache(t *testing.T) {
+	pki := newTestPKI(t)
+	e := newTestEnclave(t)
+	e.attester = &pkiAttester{t: t, pki: pki}
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		_ = e.httpSrv.ServeTLS(l, "", "")
+	}()
+	defer func() {
+		_ = e.httpSrv.Close()
+	}()
+	origDial := dialVsock
+	defer func() { dialVsock = origDial }()
+	dialVsock = func(contextID, port uint32) (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	opts := VerifyOptions{Roots: pki.roots, Cache: &VerifierCache{}}
+	conn, res, err := DialAndVerify(ctx, 16, 8443, opts)
+	if err != nil {
+		t.Fatalf("failed to dial and verify: %v", err)
+	}
+	_ = conn.Close()
+
+	// With the enclave unable to attest, only a cache hit succeeds.
+	e.attester = &fakeAttester{err: errors.New("NSM unavailable")}
+	conn, cached, err := DialAndVerify(ctx, 16, 8443, opts)
+	if err != nil {
+		t.Fatalf("expected cache hit but got: %v", err)
+	}
+	_ = conn.Close()
+	if !bytes.Equal(cached.Nonce, res.Nonce) {
+		t.Fatal("expected cached result")
+	}
+
+	// Cached documents must pass the caller's current options, too.
+	strict := opts
+	strict.ExpectedPublicKey = []byte("public key")
+	if _, _, err := DialAndVerify(ctx, 16, 8443, strict); err == nil {
+		t.Fatal("expected error for cached document without expected public key")
+	}
+	strict = opts
+	strict.MaxAge = time.Minute
+	strict.Now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if _, _, err := DialAndVerify(ctx, 16, 8443, strict); err == nil {
+		t.Fatal("expected error for cached document older than MaxAge")
+	}
+	strict = opts
+	strict.AllowedAlgorithms = []int{COSEAlgES512}
+	if _, _, err := DialAndVerify(ctx, 16, 8443, strict); err == nil {
+		t.Fatal("expected error for cached document with disallowed algorithm")
+	}
+	if _, _, err := DialAndVerify(ctx, 16, 8443, opts); err != nil {
+		t.Fatalf("expected cache hit with original options but got: %v", err)
+	}
+
+	opts.Cache.Invalidate(e.certFpr)
+	if _, _, err := DialAndVerify(ctx, 16, 8443, opts); err == nil {
+		t.Fatal("expected error after invalidation")
+	}
+}
@@ -0,0 +1,67 @@
+package enclaveutils
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Capabilities is returned by the /attestation/capabilities endpoint.  It
+// describes the attestation features that the enclave supports, so clients
+// can adapt to the enclave's configuration.
+type Capabilities struct {
+	// Methods contains the HTTP methods that the attestation endpoint
+	// accepts.  It is empty if the endpoint is disabled.
+	Methods []string `json:"methods"`
+	// Formats contains the formats in which the attestation endpoint returns
+	// documents: "base64" and "cbor".
+	Formats []string `json:"formats"`
+	// MinNonceBytes and MaxNonceBytes bound the accepted nonce length.
+	MinNonceBytes int `json:"min_nonce_bytes"`
+	MaxNonceBytes int `json:"max_nonce_bytes"`
+	// Informational is true if documents without nonce are available.
+	Informational bool `json:"informational"`
+	// KeyExchange is true if the attestation endpoint accepts key IDs from
+	// PrepareKeyExchange.
+	KeyExchange  bool `json:"key_exchange"`
+	Sessions     bool `json:"sessions"`
+	CompactProof bool `json:"compact_proof"`
+	// Counter is true if documents contain an attestation counter.
+	Counter bool `json:"counter"`
+	// BinaryHash is true if documents contain the hash of the enclave's
+	// binary.
+	BinaryHash bool `json:"binary_hash"`
+	// TokenRequired is true if the attestation endpoints require a bearer
+	// token.
+	TokenRequired bool `json:"token_required"`
+}
+
+// capabilities derives the enclave's Capabilities from its configuration.
+func (e *Enclave) capabilities() Capabilities {
+	c := Capabilities{
+		Methods:       []string{},
+		Formats:       []string{"base64", "cbor"},
+		MinNonceBytes: e.nonceFormat.minDigits / 2,
+		MaxNonceBytes: e.nonceFormat.maxDigits / 2,
+		Informational: e.cfg.InformationalAttestation,
+		Sessions:      e.cfg.EnableSessions,
+		CompactProof:  e.cfg.EnableCompactProof,
+		Counter:       e.cfg.CounterInUserData,
+		BinaryHash:    e.cfg.BinaryHashInUserData,
+		TokenRequired: e.cfg.AttestationToken != "",
+	}
+	if !e.cfg.DisableAttestation {
+		c.Methods = []string{http.MethodGet, http.MethodPost}
+		c.KeyExchange = true
+	}
+	return c
+}
+
+// getCapabilitiesHandler returns a HandlerFunc that responds with the
+// enclave's Capabilities in JSON.
+func (e *Enclave) getCapabilitiesHandler() http.HandlerFunc {
+	c := e.capabilities()
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(c)
+	}
+}
@@ -0,0 +1,78 @@
+package enclaveutils
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	for _, test := range []struct {
+		cfg      *Config
+		expected Capabilities
+	}{
+		{
+			&Config{EnableCapabilities: true},
+			Capabilities{
+				Methods:       []string{http.MethodGet, http.MethodPost},
+				Formats:       []string{"base64", "cbor"},
+				MinNonceBytes: 20,
+				MaxNonceBytes: 20,
+				KeyExchange:   true,
+			},
+		},
+		{
+			&Config{
+				EnableCapabilities:       true,
+				MinNonceBytes:            16,
+				MaxNonceBytes:            64,
+				InformationalAttestation: true,
+				EnableSessions:           true,
+				CounterInUserData:        true,
+				AttestationToken:         "secret",
+			},
+			Capabilities{
+				Methods:       []string{http.MethodGet, http.MethodPost},
+				Formats:       []string{"base64", "cbor"},
+				MinNonceBytes: 16,
+				MaxNonceBytes: 64,
+				Informational: true,
+				KeyExchange:   true,
+				Sessions:      true,
+				Counter:       true,
+				TokenRequired: true,
+			},
+		},
+		{
+			&Config{EnableCapabilities: true, DisableAttestation: true},
+			Capabilities{
+				Methods:       []string{},
+				Formats:       []string{"base64", "cbor"},
+				MinNonceBytes: 20,
+				MaxNonceBytes: 20,
+			},
+		},
+	} {
+		e := NewEnclave(test.cfg)
+		if err := e.registerSystemRoutes(); err != nil {
+			t.Fatalf("failed to register system routes: %v", err)
+		}
+		// The endpoint requires no token, even if attestation does.
+		resp := serve(e, http.MethodGet, "/attestation/capabilities")
+		expect(t, resp, http.StatusOK, "")
+		var c Capabilities
+		if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+			t.Fatalf("failed to decode capabilities: %v", err)
+		}
+		if !reflect.DeepEqual(c, test.expected) {
+			t.Fatalf("expected capabilities %+v but got %+v", test.expected, c)
+		}
+	}
+
+	e := NewEnclave(&Config{})
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	expect(t, serve(e, http.MethodGet, "/attestation/capabilities"), http.StatusNotFound, "")
+}
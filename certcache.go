@@ -0,0 +1,154 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// maxCachedCertSize is the maximum size of an entry that we accept from the
+// host's certificate cache.
+const maxCachedCertSize = 1 << 20
+
+// vsockCache is an autocert.Cache that persists certificates to a key-value
+// service on the host, which the enclave reaches via vsock; see
+// Config.CertCacheProxy.  Entries are encrypted and authenticated with
+// AES-GCM, so the host can neither read the certificates' private keys nor
+// tamper with or swap entries.  Entry names are prefixed with the cache's
+// prefix, which lets several caches share the service.
+type vsockCache struct {
+	client *http.Client
+	aead   cipher.AEAD
+	prefix string
+}
+
+// newVsockCache returns a vsockCache that talks to the service at the given
+// vsock address of the form "<context ID>:<port>", and encrypts entries with
+// the given 32-byte key.
+func newVsockCache(addr string, key []byte) (*vsockCache, error) {
+	cid, port, err := parseVsockAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("certificate cache key must be 32 bytes but is %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialVsock(cid, port)
+		},
+	}
+	return &vsockCache{client: &http.Client{Transport: transport}, aead: aead}, nil
+}
+
+// withPrefix returns a copy of the cache whose entry names are prefixed with
+// the given prefix, so its entries don't collide with the original cache's.
+func (c *vsockCache) withPrefix(prefix string) *vsockCache {
+	return &vsockCache{client: c.client, aead: c.aead, prefix: c.prefix + prefix}
+}
+
+// parseVsockAddr parses a vsock address of the form "<context ID>:<port>".
+func parseVsockAddr(addr string) (uint32, uint32, error) {
+	parts := strings.Split(addr, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("vsock address %q is not of the form <context ID>:<port>", addr)
+	}
+	cid, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid context ID in vsock address %q: %v", addr, err)
+	}
+	port, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port in vsock address %q: %v", addr, err)
+	}
+	return uint32(cid), uint32(port), nil
+}
+
+// url returns the URL of the entry with the given name.  The host part is
+// irrelevant because we always dial the configured vsock address.
+func (c *vsockCache) url(name string) string {
+	return "http://cert-cache/" + url.PathEscape(name)
+}
+
+// do sends a request with the given method and body for the entry with the
+// given name, and returns the response body if the status code is 200.
+func (c *vsockCache) do(ctx context.Context, method, name string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url(name), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach certificate cache: %v", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, autocert.ErrCacheMiss
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("certificate cache returned status code %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxCachedCertSize))
+}
+
+// Get implements autocert.Cache.
+func (c *vsockCache) Get(ctx context.Context, name string) ([]byte, error) {
+	name = c.prefix + name
+	sealed, err := c.do(ctx, http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := c.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, errors.New("certificate cache entry is too short")
+	}
+	// The entry's name is authenticated, so the host can't swap entries.
+	data, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt certificate cache entry: %v", err)
+	}
+	return data, nil
+}
+
+// Put implements autocert.Cache.
+func (c *vsockCache) Put(ctx context.Context, name string, data []byte) error {
+	name = c.prefix + name
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	_, err := c.do(ctx, http.MethodPut, name, c.aead.Seal(nonce, nonce, data, []byte(name)))
+	return err
+}
+
+// Delete implements autocert.Cache.  Deleting a missing entry is not an error.
+func (c *vsockCache) Delete(ctx context.Context, name string) error {
+	name = c.prefix + name
+	if _, err := c.do(ctx, http.MethodDelete, name, nil); err != nil && err != autocert.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package enclaveutils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxAttestationResponseSize is the maximum size of a response that we accept
+// from the enclave's attestation endpoint.  Base64-encoded attestation
+// documents are a few kilobytes in size.
+const maxAttestationResponseSize = 1 << 20
+
+// GenerateNonce returns a random nonce in the format that the enclave's
+// attestation endpoint expects, i.e., as hex-encoded string, and in its raw
+// form.  The nonce is obtained from crypto/rand.
+func GenerateNonce() (string, []byte, error) {
+	rawNonce := make([]byte, nonceLen/2)
+	if _, err := rand.Read(rawNonce); err != nil {
+		return "", nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	return hex.EncodeToString(rawNonce), rawNonce, nil
+}
+
+// AttestOverConn takes as input a connection to an enclave (e.g., a vsock
+// connection that the caller already dialed) and a nonce.  The function then
+// establishes a TLS session over the connection, requests an attestation
+// document for the given nonce, and verifies the document using AWS's root
+// certificate.  On success, the verified raw document is returned.
+//
+// The document's nonce must match the given nonce, and the document's user
+// data must start with the SHA-256 fingerprint of the certificate that the
+// enclave presented during the TLS handshake.  Callers that need to check the
+// document's PCRs can do so by passing the document to Verify.
+func AttestOverConn(conn net.Conn, nonce []byte) ([]byte, error) {
+	return attestOverConn(conn, nonce, VerifyOptions{})
+}
+
+func attestOverConn(conn net.Conn, nonce []byte, opts VerifyOptions) ([]byte, error) {
+	// We don't verify the enclave's certificate because it's typically
+	// self-signed.  Instead, we rely on the attestation document, which binds
+	// the certificate's fingerprint to the enclave.
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("failed to complete TLS handshake: %v", err)
+	}
+	doc, _, err := attestTLSConn(tlsConn, nonce, opts)
+	return doc, err
+}
+
+// DialAndVerify dials the enclave at the given vsock context ID and port,
+// establishes a TLS session, and requests and verifies an attestation
+// document for a freshly generated nonce.  The document's user data must
+// start with the SHA-256 fingerprint of the certificate that the enclave
+// presented during the TLS handshake, and its PCRs must match
+// opts.ExpectedPCRs.  On success, the function returns the TLS connection,
+// which the caller can use to send further HTTP requests to the attested
+// enclave, and the verification result.  The given context bounds the time
+// until the attestation is verified; it has no effect on the returned
+// connection.
+//
+// If opts.Cache is set and the enclave presents a certificate that the cache
+// contains, the function skips the attestation request and verifies the
+// cached document with opts instead.  If the cached document fails
+// verification, e.g., because it's older than opts.MaxAge, the enclave is
+// attested again.
+func DialAndVerify(ctx context.Context, cid, port uint32, opts VerifyOptions) (*tls.Conn, *AttestationResult, error) {
+	_, nonce, err := GenerateNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := dialVsock(cid, port)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to dial enclave: %v", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, nil, fmt.Errorf("failed to complete TLS handshake: %v", err)
+	}
+
+	var certFpr [sha256.Size]byte
+	if peerCerts := tlsConn.ConnectionState().PeerCertificates; len(peerCerts) > 0 {
+		certFpr = sha256.Sum256(peerCerts[0].Raw)
+	}
+	if opts.Cache != nil {
+		// The cached document was bound to the certificate, but it must
+		// also pass the caller's current options.
+		if doc := opts.Cache.lookup(certFpr); doc != nil {
+			if res, err := Verify(doc, opts); err == nil {
+				_ = conn.SetDeadline(time.Time{})
+				return tlsConn, res, nil
+			}
+		}
+	}
+
+	doc, res, err := attestTLSConn(tlsConn, nonce, opts)
+	if err != nil {
+		_ = tlsConn.Close()
+		return nil, nil, err
+	}
+	if opts.Cache != nil {
+		opts.Cache.add(certFpr, doc)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tlsConn, res, nil
+}
+
+// attestTLSConn requests an attestation document for the given nonce over the
+// given TLS connection, whose handshake must be complete, and verifies the
+// document.  The raw document and the verification result are returned.
+func attestTLSConn(tlsConn *tls.Conn, nonce []byte, opts VerifyOptions) ([]byte, *AttestationResult, error) {
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil, nil, errors.New("enclave presented no certificate")
+	}
+	certFpr := sha256.Sum256(state.PeerCertificates[0].Raw)
+
+	req, err := http.NewRequest(http.MethodGet, "/attestation?nonce="+hex.EncodeToString(nonce), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Host = "enclave"
+	if err := req.Write(tlsConn); err != nil {
+		return nil, nil, fmt.Errorf("failed to send attestation request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read attestation response: %v", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	// The enclave isn't attested yet, so we don't trust it to send a
+	// reasonably-sized response.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxAttestationResponseSize+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read attestation response body: %v", err)
+	}
+	if len(body) > maxAttestationResponseSize {
+		return nil, nil, fmt.Errorf("attestation response exceeds %d bytes", maxAttestationResponseSize)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("enclave returned status code %d: %s", resp.StatusCode, body)
+	}
+
+	doc, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode attestation document: %v", err)
+	}
+	res, err := Verify(doc, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(res.Nonce, nonce) {
+		return nil, nil, errors.New("document's nonce does not match our nonce")
+	}
+	if !bytes.HasPrefix(res.UserData, certFpr[:]) {
+		return nil, nil, errors.New("document's user data does not match enclave's certificate")
+	}
+
+	return doc, res, nil
+}
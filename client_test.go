@@ -0,0 +1,283 @@
+package enclaveutils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockEnclave serves a single attestation request over the given connection.
+// The attestation document contains the requested nonce and the given user
+// data, and is signed by the given PKI.
+func mockEnclave(t *testing.T, e *Enclave, pki *testPKI, conn net.Conn, userData []byte) {
+	tlsConn := tls.Server(conn, e.httpSrv.TLSConfig)
+	defer func() {
+		_ = tlsConn.Close()
+	}()
+
+	req, err := http.ReadRequest(bufio.NewReader(tlsConn))
+	if err != nil {
+		t.Errorf("failed to read request: %v", err)
+		return
+	}
+	nonce, err := hex.DecodeString(req.URL.Query().Get("nonce"))
+	if err != nil {
+		t.Errorf("failed to decode nonce: %v", err)
+		return
+	}
+	doc := newTestDocument()
+	doc.Nonce = nonce
+	doc.UserData = userData
+	body := base64.StdEncoding.EncodeToString(pki.sign(t, doc)) + "\n"
+
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+	}
+	if err := resp.Write(tlsConn); err != nil {
+		t.Errorf("failed to write response: %v", err)
+	}
+}
+
+func newTestEnclave(t *testing.T) *Enclave {
+	e := NewEnclave(&Config{FQDN: "example.com"})
+	if err := e.genSelfSignedCert(); err != nil {
+		t.Fatalf("failed to create self-signed certificate: %v", err)
+	}
+	return e
+}
+
+func TestAttestOverConn(t *testing.T) {
+	pki := newTestPKI(t)
+	e := newTestEnclave(t)
+	nonce := bytes.Repeat([]byte{0x42}, 20)
+
+	clientConn, serverConn := net.Pipe()
+	go mockEnclave(t, e, pki, serverConn, e.certFpr[:])
+	doc, err := attestOverConn(clientConn, nonce, VerifyOptions{Roots: pki.roots})
+	if err != nil {
+		t.Fatalf("failed to attest over connection: %v", err)
+	}
+	res, err := Verify(doc, VerifyOptions{Roots: pki.roots})
+	if err != nil {
+		t.Fatalf("failed to verify returned document: %v", err)
+	}
+	if !bytes.Equal(res.Nonce, nonce) {
+		t.Fatal("expected returned document to contain our nonce")
+	}
+
+	// The enclave binds a fingerprint that doesn't match its certificate.
+	clientConn, serverConn = net.Pipe()
+	go mockEnclave(t, e, pki, serverConn, make([]byte, 32))
+	if _, err := attestOverConn(clientConn, nonce, VerifyOptions{Roots: pki.roots}); err == nil {
+		t.Fatal("expected error for mismatching certificate fingerprint")
+	}
+
+	// The document isn't signed by a trusted PKI.
+	clientConn, serverConn = net.Pipe()
+	go mockEnclave(t, e, newTestPKI(t), serverConn, e.certFpr[:])
+	if _, err := attestOverConn(clientConn, nonce, VerifyOptions{Roots: pki.roots}); err == nil {
+		t.Fatal("expected error for untrusted document")
+	}
+
+	// The enclave sends an unreasonably large response.
+	clientConn, serverConn = net.Pipe()
+	defer func() {
+		_ = clientConn.Close()
+	}()
+	go func() {
+		tlsConn := tls.Server(serverConn, e.httpSrv.TLSConfig)
+		defer func() {
+			_ = tlsConn.Close()
+		}()
+		if _, err := http.ReadRequest(bufio.NewReader(tlsConn)); err != nil {
+			return
+		}
+		body := strings.Repeat("A", maxAttestationResponseSize+1)
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			ContentLength: int64(len(body)),
+			Body:          ioutil.NopCloser(strings.NewReader(body)),
+		}
+		_ = resp.Write(tlsConn)
+	}()
+	_, err = attestOverConn(clientConn, nonce, VerifyOptions{Roots: pki.roots})
+	if err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("expected error for oversized response but got %v", err)
+	}
+}
+
+func TestGenerateNonce(t *testing.T) {
+	nonce, rawNonce, err := GenerateNonce()
+	if err != nil {
+		t.Fatalf("failed to generate nonce: %v", err)
+	}
+	if len(nonce) != nonceLen {
+		t.Fatalf("expected nonce of length %d but got %d", nonceLen, len(nonce))
+	}
+	if hex.EncodeToString(rawNonce) != nonce {
+		t.Fatal("expected hex-encoded nonce to match raw nonce")
+	}
+
+	// The enclave must accept the nonce.
+	req := httptest.NewRequest(http.MethodGet, "/attestation?nonce="+nonce, nil)
+	if _, parsedNonce, err := NewEnclave(&Config{}).parseNonce(req); err != nil || !bytes.Equal(parsedNonce, rawNonce) {
+		t.Fatalf("expected enclave to accept nonce but got: %v", err)
+	}
+
+	otherNonce, _, err := GenerateNonce()
+	if err != nil {
+		t.Fatalf("failed to generate nonce: %v", err)
+	}
+	if nonce == otherNonce {
+		t.Fatal("expected two nonces to differ")
+	}
+}
+
+func TestAttestationFQDN(t *testing.T) {
+	e := NewEnclave(&Config{FQDN: "example.com", AttestationFQDN: "attest.example.com"})
+	e.attester = &fakeAttester{doc: []byte("attestation document")}
+	if err := e.genSelfSignedCert(); err != nil {
+		t.Fatalf("failed to create self-signed certificates: %v", err)
+	}
+	if e.certFpr == e.attCertFpr {
+		t.Fatal("expected two different certificates")
+	}
+
+	// The certificate that the enclave presents depends on the requested
+	// server name.
+	for serverName, expected := range map[string][sha256.Size]byte{
+		"example.com":        e.certFpr,
+		"attest.example.com": e.attCertFpr,
+		"":                   e.certFpr,
+	} {
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			_ = tls.Server(serverConn, e.httpSrv.TLSConfig).Handshake()
+			_ = serverConn.Close()
+		}()
+		tlsConn := tls.Client(clientConn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatalf("failed to complete TLS handshake: %v", err)
+		}
+		if fpr := sha256.Sum256(tlsConn.ConnectionState().PeerCertificates[0].Raw); fpr != expected {
+			t.Fatalf("unexpected certificate for server name %q", serverName)
+		}
+		_ = tlsConn.Close()
+	}
+
+	// The attestation document contains the fingerprint of the certificate
+	// that the client got.
+	target := "/attestation?nonce=" + strings.Repeat("a", nonceLen)
+	for serverName, expected := range map[string][sha256.Size]byte{
+		"example.com":        e.certFpr,
+		"attest.example.com": e.attCertFpr,
+	} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.TLS = &tls.ConnectionState{ServerName: serverName}
+		rec := httptest.NewRecorder()
+		e.getAttestationHandler()(rec, req)
+		expect(t, rec.Result(), http.StatusOK, "")
+		if !bytes.Equal(e.attester.(*fakeAttester).userData, expected[:]) {
+			t.Fatalf("unexpected user data for server name %q", serverName)
+		}
+	}
+}
+
+// pkiAttester issues attestation documents that are signed by a test PKI.
+type pkiAttester struct {
+	t   *testing.T
+	pki *testPKI
+}
+
+func (a *pkiAttester) attest(nonce, userData, publicKey []byte) ([]byte, error) {
+	doc := newTestDocument()
+	doc.Nonce = nonce
+	doc.UserData = userData
+	return a.pki.sign(a.t, doc), nil
+}
+
+func TestDialAndVerify(t *testing.T) {
+	pki := newTestPKI(t)
+	e := newTestEnclave(t)
+	e.attester = &pkiAttester{t: t, pki: pki}
+	if err := e.AddRoute(http.MethodGet, "/app", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}); err != nil {
+		t.Fatalf("failed to add route: %v", err)
+	}
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		_ = e.httpSrv.ServeTLS(l, "", "")
+	}()
+	defer func() {
+		_ = e.httpSrv.Close()
+	}()
+
+	var gotCID, gotPort uint32
+	origDial := dialVsock
+	defer func() { dialVsock = origDial }()
+	dialVsock = func(contextID, port uint32) (net.Conn, error) {
+		gotCID, gotPort = contextID, port
+		return net.Dial("tcp", l.Addr().String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	opts := VerifyOptions{Roots: pki.roots, ExpectedPCRs: newTestDocument().PCRs}
+	conn, res, err := DialAndVerify(ctx, 16, 8443, opts)
+	if err != nil {
+		t.Fatalf("failed to dial and verify: %v", err)
+	}
+	if gotCID != 16 || gotPort != 8443 {
+		t.Fatalf("expected dial to 16:8443 but got %d:%d", gotCID, gotPort)
+	}
+	if !bytes.HasPrefix(res.UserData, e.certFpr[:]) {
+		t.Fatal("expected user data to start with enclave's certificate fingerprint")
+	}
+
+	// The connection remains usable for application requests.
+	req, _ := http.NewRequest(http.MethodGet, "/app", nil)
+	req.Host = "enclave"
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "hello" {
+		t.Fatalf("expected response %q but got %q", "hello", body)
+	}
+	_ = conn.Close()
+
+	// Unexpected PCRs must be rejected.
+	opts.ExpectedPCRs = map[uint][]byte{0: bytes.Repeat([]byte{0xff}, 48)}
+	if _, _, err := DialAndVerify(ctx, 16, 8443, opts); err == nil {
+		t.Fatal("expected error for unexpected PCRs")
+	}
+}
@@ -0,0 +1,51 @@
+package enclaveutils
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// tlsVersionNames maps TLS versions to human-readable names.
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// logClientHello is used as the TLS configuration's GetConfigForClient
+// callback if Config.LogClientHellos is set.  It logs the server name,
+// supported versions, and cipher suites of the given ClientHello, which helps
+// diagnose clients that fail to complete the handshake.  It returns no
+// configuration, so the handshake proceeds with the server's configuration.
+func (e *Enclave) logClientHello(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	versions := make([]string, len(hello.SupportedVersions))
+	for i, v := range hello.SupportedVersions {
+		versions[i] = tlsVersionName(v)
+	}
+	suites := make([]string, len(hello.CipherSuites))
+	for i, s := range hello.CipherSuites {
+		suites[i] = tls.CipherSuiteName(s)
+	}
+	e.logger.Log(LevelDebug, fmt.Sprintf("TLS ClientHello: remote_addr=%s sni=%q versions=[%s] cipher_suites=[%s]",
+		remoteAddr(hello), hello.ServerName, strings.Join(versions, ","), strings.Join(suites, ",")))
+	return nil, nil
+}
+
+// tlsVersionName returns the name of the given TLS version, or its hex
+// representation if the version is unknown, e.g., a GREASE value.
+func tlsVersionName(v uint16) string {
+	if name, exists := tlsVersionNames[v]; exists {
+		return name
+	}
+	return fmt.Sprintf("0x%04X", v)
+}
+
+// remoteAddr returns the client's address, if known.
+func remoteAddr(hello *tls.ClientHelloInfo) string {
+	if hello.Conn == nil {
+		return "unknown"
+	}
+	return hello.Conn.RemoteAddr().String()
+}
@@ -0,0 +1,53 @@
+package enclaveutils
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestLogClientHello(t *testing.T) {
+	logger := &fakeLogger{}
+	e := NewEnclave(&Config{FQDN: "example.com", Logger: logger, LogClientHellos: true})
+	if err := e.genSelfSignedCert(); err != nil {
+		t.Fatalf("Failed to create self-signed certificate: %v", err)
+	}
+	e.httpSrv.TLSConfig.GetConfigForClient = e.logClientHello
+
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		_ = tls.Server(serverConn, e.httpSrv.TLSConfig).Handshake()
+		_ = serverConn.Close()
+	}()
+	client := tls.Client(clientConn, &tls.Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("Failed to complete TLS handshake: %v", err)
+	}
+	_ = client.Close()
+
+	logger.Lock()
+	defer logger.Unlock()
+	if len(logger.msgs) != 1 || logger.levels[0] != LevelDebug {
+		t.Fatalf("Expected one debug message but got: %v", logger.msgs)
+	}
+	msg := logger.msgs[0]
+	for _, expected := range []string{
+		`sni="example.com"`,
+		"TLS 1.2",
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+		"remote_addr=pipe",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("Expected %q in log message but got: %s", expected, msg)
+		}
+	}
+	if strings.Contains(msg, "TLS 1.3") {
+		t.Errorf("Expected no TLS 1.3 in log message but got: %s", msg)
+	}
+}
@@ -0,0 +1,117 @@
+package enclaveutils
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	errNoSigningKey = "enclave has no key to sign compact proofs"
+	errFailedSign   = "failed to sign compact proof"
+)
+
+// CompactProof is returned by the compact attestation endpoint.  It is meant
+// for constrained clients (e.g., IoT devices) that cannot parse and verify
+// COSE-signed CBOR documents themselves.
+//
+// Note that compact proofs come with a weaker trust model than attestation
+// documents.  The enclave verifies its own attestation document and signs a
+// summary of the result using the private key of its TLS certificate.  A
+// client that relies on the summary therefore trusts the enclave's TLS key and
+// the enclave's verification code instead of AWS's PKI.  This is only
+// meaningful if the client has pinned the enclave's certificate by other
+// means, e.g., after a one-time full verification of an attestation document.
+type CompactProof struct {
+	// Document is the Base64-encoded attestation document, for clients that
+	// want to verify it after all.
+	Document string `json:"document"`
+	// Summary is the Base64-encoded JSON serialization of a ProofSummary.
+	Summary string `json:"summary"`
+	// Signature is the Base64-encoded signature over the SHA-256 hash of the
+	// (decoded) summary, made with the private key of the enclave's TLS
+	// certificate.  For ECDSA keys, the signature is ASN.1-encoded; for RSA
+	// keys, it's a PKCS #1 v1.5 signature.
+	Signature string `json:"signature"`
+}
+
+// ProofSummary contains the result of the enclave's verification of its own
+// attestation document.  Binary values are hex-encoded.
+type ProofSummary struct {
+	Verified  bool            `json:"verified"`
+	Error     string          `json:"error,omitempty"`
+	ModuleID  string          `json:"module_id,omitempty"`
+	Timestamp int64           `json:"timestamp,omitempty"`
+	PCRs      map[uint]string `json:"pcrs,omitempty"`
+	Nonce     string          `json:"nonce,omitempty"`
+	UserData  string          `json:"user_data,omitempty"`
+}
+
+// getCompactProofHandler returns a HandlerFunc that works like the handler
+// returned by getAttestationHandler, but responds with a CompactProof instead
+// of a bare attestation document.
+func (e *Enclave) getCompactProofHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, rawNonce, err := e.parseNonce(r)
+		if err == nil {
+			err = e.checkNonceEntropy(rawNonce)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if e.tlsKey == nil {
+			http.Error(w, errNoSigningKey, http.StatusNotImplemented)
+			return
+		}
+
+		userData, err := e.readyUserData(false)
+		if err != nil {
+			writeAttestationError(w, err)
+			return
+		}
+		rawDoc, err := e.attestDoc(rawNonce, userData, nil)
+		if err != nil {
+			writeAttestationError(w, err)
+			return
+		}
+
+		summary := ProofSummary{}
+		res, err := Verify(rawDoc, e.verifyOpts)
+		if err != nil {
+			summary.Error = err.Error()
+		} else {
+			summary.Verified = true
+			summary.ModuleID = res.ModuleID
+			summary.Timestamp = res.Timestamp.UnixNano() / 1e6
+			summary.Nonce = hex.EncodeToString(res.Nonce)
+			summary.UserData = hex.EncodeToString(res.UserData)
+			summary.PCRs = make(map[uint]string)
+			for index, value := range res.PCRs {
+				summary.PCRs[index] = hex.EncodeToString(value)
+			}
+		}
+		rawSummary, err := json.Marshal(summary)
+		if err != nil {
+			http.Error(w, errFailedSign, http.StatusInternalServerError)
+			return
+		}
+		hash := sha256.Sum256(rawSummary)
+		sig, err := e.tlsKey.Sign(rand.Reader, hash[:], crypto.SHA256)
+		if err != nil {
+			http.Error(w, errFailedSign, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(CompactProof{
+			Document:  base64.StdEncoding.EncodeToString(rawDoc),
+			Summary:   base64.StdEncoding.EncodeToString(rawSummary),
+			Signature: base64.StdEncoding.EncodeToString(sig),
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package enclaveutils
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func getCompactProof(t *testing.T, e *Enclave, nonce string) *ProofSummary {
+	resp := serve(e, http.MethodGet, "/attestation/compact?nonce="+nonce)
+	expect(t, resp, http.StatusOK, "")
+
+	var proof CompactProof
+	if err := json.NewDecoder(resp.Body).Decode(&proof); err != nil {
+		t.Fatalf("failed to decode compact proof: %v", err)
+	}
+	rawSummary, err := base64.StdEncoding.DecodeString(proof.Summary)
+	if err != nil {
+		t.Fatalf("failed to decode summary: %v", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(proof.Signature)
+	if err != nil {
+		t.Fatalf("failed to decode signature: %v", err)
+	}
+
+	// Verify the summary's signature using the public key of the enclave's
+	// certificate.
+	cert, err := x509.ParseCertificate(e.httpSrv.TLSConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse enclave's certificate: %v", err)
+	}
+	hash := sha256.Sum256(rawSummary)
+	if !ecdsa.VerifyASN1(cert.PublicKey.(*ecdsa.PublicKey), hash[:], sig) {
+		t.Fatal("expected valid signature over summary")
+	}
+
+	var summary ProofSummary
+	if err := json.Unmarshal(rawSummary, &summary); err != nil {
+		t.Fatalf("failed to decode summary: %v", err)
+	}
+	return &summary
+}
+
+func TestCompactProof(t *testing.T) {
+	pki := newTestPKI(t)
+	nonce := strings.Repeat("ab", nonceLen/2)
+	rawNonce, _ := hex.DecodeString(nonce)
+	doc := newTestDocument()
+	doc.Nonce = rawNonce
+
+	e := newTestEnclave(t)
+	e.cfg.EnableCompactProof = true
+	e.verifyOpts.Roots = pki.roots
+	e.attester = &fakeAttester{doc: pki.sign(t, doc)}
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+
+	summary := getCompactProof(t, e, nonce)
+	if !summary.Verified {
+		t.Fatalf("expected verified summary but got error: %s", summary.Error)
+	}
+	if summary.ModuleID != doc.ModuleID {
+		t.Fatalf("expected module ID %q but got %q", doc.ModuleID, summary.ModuleID)
+	}
+	if summary.Nonce != nonce {
+		t.Fatalf("expected nonce %q but got %q", nonce, summary.Nonce)
+	}
+	if summary.PCRs[1] != hex.EncodeToString(doc.PCRs[1]) {
+		t.Fatalf("expected PCR 1 to be %x but got %s", doc.PCRs[1], summary.PCRs[1])
+	}
+
+	// A document that doesn't verify results in a signed negative summary.
+	e.attester = &fakeAttester{doc: newTestPKI(t).sign(t, doc)}
+	summary = getCompactProof(t, e, nonce)
+	if summary.Verified || summary.Error == "" {
+		t.Fatal("expected unverified summary with error")
+	}
+
+	// Without a key, we cannot sign compact proofs.
+	e.tlsKey = nil
+	expect(t, serve(e, http.MethodGet, "/attestation/compact?nonce="+nonce), http.StatusNotImplemented, errNoSigningKey)
+
+	// The endpoint is disabled by default.
+	e = newFakeEnclave(&Config{})
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	expect(t, serve(e, http.MethodGet, "/attestation/compact?nonce="+nonce), http.StatusNotFound, "")
+}
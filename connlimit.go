@@ -0,0 +1,81 @@
+package enclaveutils
+
+import (
+	"net"
+	"sync"
+)
+
+// limitListener wraps a net.Listener and caps the number of connections that
+// are open at the same time.  Once the cap is reached, the listener either
+// stops accepting connections until one closes, or accepts and immediately
+// closes excess connections, depending on reject.
+type limitListener struct {
+	net.Listener
+	sem      chan struct{}
+	reject   bool
+	onReject func()
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newLimitListener returns a listener that allows at most max concurrent
+// connections.  onReject is called for each connection that is rejected.
+func newLimitListener(l net.Listener, max int, reject bool, onReject func()) *limitListener {
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, max),
+		reject:   reject,
+		onReject: onReject,
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		if !l.reject {
+			// Wait for a free slot before accepting, which leaves excess
+			// connections in the kernel's backlog.
+			select {
+			case l.sem <- struct{}{}:
+			case <-l.done:
+				return nil, net.ErrClosed
+			}
+		}
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if !l.reject {
+				<-l.sem
+			}
+			return nil, err
+		}
+		if l.reject {
+			select {
+			case l.sem <- struct{}{}:
+			default:
+				l.onReject()
+				_ = c.Close()
+				continue
+			}
+		}
+		return &limitConn{Conn: c, release: func() { <-l.sem }}, nil
+	}
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// limitConn frees its slot in the limitListener once it's closed.
+type limitConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
@@ -0,0 +1,103 @@
+package enclaveutils
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// acceptAll accepts connections on the given listener and sends them to the
+// returned channel until the listener is closed.
+func acceptAll(l net.Listener) <-chan net.Conn {
+	conns := make(chan net.Conn)
+	go func() {
+		defer close(conns)
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- c
+		}
+	}()
+	return conns
+}
+
+func newLimitedListener(t *testing.T, cfg *Config) (net.Listener, *fakeMetrics) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	metrics := newFakeMetrics()
+	cfg.Metrics = metrics
+	l := NewEnclave(cfg).limitConnections(tcpListener)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	return l, metrics
+}
+
+func dial(t *testing.T, addr net.Addr) net.Conn {
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = c.Close()
+	})
+	return c
+}
+
+func TestConnectionLimitDelays(t *testing.T) {
+	l, _ := newLimitedListener(t, &Config{MaxConnections: 1})
+	conns := acceptAll(l)
+
+	dial(t, l.Addr())
+	first := <-conns
+	dial(t, l.Addr())
+	select {
+	case <-conns:
+		t.Fatal("Expected connection beyond the cap to wait.")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Closing the first connection frees a slot for the second.
+	_ = first.Close()
+	select {
+	case second := <-conns:
+		_ = second.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected waiting connection to be accepted.")
+	}
+}
+
+func TestConnectionLimitRejects(t *testing.T) {
+	l, metrics := newLimitedListener(t, &Config{MaxConnections: 1, RejectExcessConnections: true})
+	conns := acceptAll(l)
+
+	dial(t, l.Addr())
+	first := <-conns
+	defer first.Close()
+
+	// The excess connection is closed by the enclave.
+	c := dial(t, l.Addr())
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected rejected connection to be closed but got: %v", err)
+	}
+	if n := metrics.counter(MetricRejectedConnections); n != 1 {
+		t.Fatalf("Expected 1 rejected connection but got %d.", n)
+	}
+}
+
+func TestNoConnectionLimit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	if NewEnclave(&Config{}).limitConnections(l) != l {
+		t.Fatal("Expected listener to be unchanged without a limit.")
+	}
+}
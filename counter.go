@@ -0,0 +1,72 @@
+package enclaveutils
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// counterLen is the size of the attestation counter in user data, in bytes.
+const counterLen = 8
+
+// nextCounter increments the enclave's attestation counter and returns its
+// new value, encoded as big-endian uint64.
+func (e *Enclave) nextCounter() []byte {
+	counter := make([]byte, counterLen)
+	binary.BigEndian.PutUint64(counter, atomic.AddUint64(&e.counter, 1))
+	return counter
+}
+
+// CounterVerifier checks that the attestation counters in documents from the
+// same enclave strictly increase, which lets clients detect replayed
+// documents without relying on clocks or nonces.  Enclaves embed the counter
+// if Config.CounterInUserData is set.
+//
+// The enclave keeps its counter in memory only, so the counter starts over at
+// 1 whenever the enclave restarts.  We track counters per module ID and per
+// user data that precedes the counter (i.e., the enclave's certificate
+// fingerprint), so a restarted enclave, which has a new module ID, starts a
+// new sequence.  The flip side is that the verifier cannot tell a legitimate
+// restart from an attacker that presents documents of a different enclave
+// with the same image; use nonces if that matters.
+//
+// A CounterVerifier is safe for concurrent use.
+type CounterVerifier struct {
+	// Offset is the position of the counter in the document's user data.
+	// If zero, the counter is expected right after the SHA-256 fingerprint
+	// of the enclave's certificate, i.e., at offset 32.  Set it to 80 if the
+	// enclave also embeds the hash of its binary.
+	Offset int
+
+	mu   sync.Mutex
+	last map[string]uint64
+}
+
+// Check extracts the counter from the given verified document and returns an
+// error if the counter isn't larger than the counter of the last document
+// that passed the check for the same enclave.
+func (v *CounterVerifier) Check(res *AttestationResult) error {
+	offset := v.Offset
+	if offset == 0 {
+		offset = 32
+	}
+	if len(res.UserData) < offset+counterLen {
+		return errors.New("document's user data contains no counter")
+	}
+	counter := binary.BigEndian.Uint64(res.UserData[offset : offset+counterLen])
+	key := res.ModuleID + "/" + hex.EncodeToString(res.UserData[:offset])
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.last == nil {
+		v.last = make(map[string]uint64)
+	}
+	if last, exists := v.last[key]; exists && counter <= last {
+		return fmt.Errorf("document's counter %d does not exceed last seen counter %d", counter, last)
+	}
+	v.last[key] = counter
+	return nil
+}
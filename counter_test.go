@@ -0,0 +1,49 @@
+package enclaveutils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	e := newFakeEnclave(&Config{CounterInUserData: true})
+	a := e.attester.(*fakeAttester)
+	target := "/attestation?nonce=" + strings.Repeat("a", nonceLen)
+
+	// Obtain the user data of a few consecutive documents.
+	var results []*AttestationResult
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		e.getAttestationHandler()(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		expect(t, rec.Result(), http.StatusOK, "")
+		results = append(results, &AttestationResult{ModuleID: "enclave", UserData: a.userData})
+	}
+
+	v := &CounterVerifier{}
+	for i, res := range results {
+		if err := v.Check(res); err != nil {
+			t.Fatalf("expected counter of document %d to be accepted: %v", i, err)
+		}
+	}
+
+	// Replayed and out-of-order documents must be rejected.
+	if err := v.Check(results[2]); err == nil {
+		t.Fatal("expected replayed document to be rejected")
+	}
+	if err := v.Check(results[0]); err == nil {
+		t.Fatal("expected older document to be rejected")
+	}
+
+	// Another enclave has its own sequence.
+	other := &AttestationResult{ModuleID: "other enclave", UserData: results[0].UserData}
+	if err := v.Check(other); err != nil {
+		t.Fatalf("expected first document of another enclave to be accepted: %v", err)
+	}
+
+	// Documents without a counter are rejected.
+	if err := v.Check(&AttestationResult{ModuleID: "enclave", UserData: e.userData()}); err == nil {
+		t.Fatal("expected document without counter to be rejected")
+	}
+}
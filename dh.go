@@ -0,0 +1,133 @@
+package enclaveutils
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Diffie-Hellman groups that AttestDHValue supports.
+const (
+	DHGroupX25519 = "X25519"
+	DHGroupP256   = "P-256"
+	DHGroupP384   = "P-384"
+)
+
+// dhKDFInfo is the HKDF info parameter that DeriveDHKey uses, which separates
+// our keys from keys that are derived from the same secret elsewhere.
+const dhKDFInfo = "nitro-enclave-utils DH key v1"
+
+var errUnknownDHGroup = errors.New("unknown Diffie-Hellman group")
+
+// AttestDHValue generates an ephemeral Diffie-Hellman key pair in the given
+// group (DHGroupX25519 if empty), and asks the hypervisor for an attestation
+// document that contains the given nonce, the enclave's user data, and the
+// public value in the document's public_key field.  The document and the
+// private value are returned.  The caller derives a shared key from the
+// private value and the client's public value using DeriveDHKey, and must
+// discard the private value afterwards, which makes the resulting channel
+// forward-secure.
+//
+// X25519 public values are 32 raw bytes.  P-256 and P-384 public values are
+// uncompressed points as returned by elliptic.Marshal, and private values are
+// big-endian scalars.
+func (e *Enclave) AttestDHValue(nonce []byte, group string) (doc []byte, priv []byte, err error) {
+	userData, err := e.readyUserData(false)
+	if err != nil {
+		return nil, nil, err
+	}
+	priv, pub, err := GenerateDHKey(group)
+	if err != nil {
+		return nil, nil, err
+	}
+	doc, err = e.attestDoc(nonce, userData, pub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to attest Diffie-Hellman value: %w", err)
+	}
+	return doc, priv, nil
+}
+
+// DeriveDHKey computes the Diffie-Hellman shared secret of the given private
+// value and the peer's public value in the given group (DHGroupX25519 if
+// empty), and derives a 32-byte key from it.  The key derivation function is
+// HKDF with SHA-256, no salt, and the info string "nitro-enclave-utils DH key
+// v1".  Both the enclave and the client use this function, so they arrive at
+// the same key.
+func DeriveDHKey(group string, priv, peerPub []byte) ([]byte, error) {
+	secret, err := dhSharedSecret(group, priv, peerPub)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(dhKDFInfo)), key); err != nil {
+		return nil, fmt.Errorf("failed to derive key: %v", err)
+	}
+	return key, nil
+}
+
+// GenerateDHKey generates a Diffie-Hellman key pair in the given group
+// (DHGroupX25519 if empty) and returns the private and the public value.
+// Clients use it to create the public value that they send to the enclave.
+func GenerateDHKey(group string) (priv, pub []byte, err error) {
+	if group == "" || group == DHGroupX25519 {
+		priv = make([]byte, curve25519.ScalarSize)
+		if _, err := rand.Read(priv); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate private value: %v", err)
+		}
+		pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to compute public value: %v", err)
+		}
+		return priv, pub, nil
+	}
+
+	curve, err := dhCurve(group)
+	if err != nil {
+		return nil, nil, err
+	}
+	priv, x, y, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	return priv, elliptic.Marshal(curve, x, y), nil
+}
+
+func dhSharedSecret(group string, priv, peerPub []byte) ([]byte, error) {
+	if group == "" || group == DHGroupX25519 {
+		// X25519 rejects all-zero outputs, i.e., low-order peer values.
+		secret, err := curve25519.X25519(priv, peerPub)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute shared secret: %v", err)
+		}
+		return secret, nil
+	}
+
+	curve, err := dhCurve(group)
+	if err != nil {
+		return nil, err
+	}
+	x, y := elliptic.Unmarshal(curve, peerPub)
+	if x == nil {
+		return nil, errors.New("peer's public value is not a valid point")
+	}
+	sx, _ := curve.ScalarMult(x, y, priv)
+	byteLen := (curve.Params().BitSize + 7) / 8
+	return sx.FillBytes(make([]byte, byteLen)), nil
+}
+
+func dhCurve(group string) (elliptic.Curve, error) {
+	switch group {
+	case DHGroupP256:
+		return elliptic.P256(), nil
+	case DHGroupP384:
+		return elliptic.P384(), nil
+	default:
+		return nil, errUnknownDHGroup
+	}
+}
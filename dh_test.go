@@ -0,0 +1,63 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAttestDHValue(t *testing.T) {
+	nonce := []byte("nonce")
+	for _, group := range []string{"", DHGroupX25519, DHGroupP256, DHGroupP384} {
+		e := newFakeEnclave(&Config{})
+		doc, priv, err := e.AttestDHValue(nonce, group)
+		if err != nil {
+			t.Fatalf("%q: failed to attest DH value: %v", group, err)
+		}
+		if len(doc) == 0 {
+			t.Fatalf("%q: expected attestation document", group)
+		}
+
+		// The attested public value must belong to the returned private
+		// value, which we confirm by having a client derive the same key.
+		encPub := e.attester.(*fakeAttester).publicKey
+		clientPriv, clientPub, err := GenerateDHKey(group)
+		if err != nil {
+			t.Fatalf("%q: failed to generate client key: %v", group, err)
+		}
+		encKey, err := DeriveDHKey(group, priv, clientPub)
+		if err != nil {
+			t.Fatalf("%q: failed to derive enclave's key: %v", group, err)
+		}
+		clientKey, err := DeriveDHKey(group, clientPriv, encPub)
+		if err != nil {
+			t.Fatalf("%q: failed to derive client's key: %v", group, err)
+		}
+		if !bytes.Equal(encKey, clientKey) {
+			t.Fatalf("%q: expected enclave and client to derive the same key", group)
+		}
+		if len(encKey) != 32 {
+			t.Fatalf("%q: expected 32-byte key but got %d bytes", group, len(encKey))
+		}
+
+		// A fresh key pair must result in a different key.
+		_, otherPub, _ := GenerateDHKey(group)
+		otherKey, err := DeriveDHKey(group, priv, otherPub)
+		if err != nil {
+			t.Fatalf("%q: failed to derive key: %v", group, err)
+		}
+		if bytes.Equal(otherKey, encKey) {
+			t.Fatalf("%q: expected different peers to result in different keys", group)
+		}
+	}
+
+	e := newFakeEnclave(&Config{})
+	if _, _, err := e.AttestDHValue(nonce, "ffdhe2048"); err == nil {
+		t.Fatal("expected error for unknown group")
+	}
+	if _, err := DeriveDHKey(DHGroupP256, []byte("priv"), []byte("not a point")); err == nil {
+		t.Fatal("expected error for invalid public value")
+	}
+	if _, err := DeriveDHKey(DHGroupX25519, make([]byte, 32), make([]byte, 32)); err == nil {
+		t.Fatal("expected error for low-order public value")
+	}
+}
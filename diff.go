@@ -0,0 +1,81 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// ClaimDiff describes a claim whose value differs between two attestation
+// documents.  Binary values are hex-encoded.  A and B are empty if the claim
+// is absent from the respective document.
+type ClaimDiff struct {
+	// Claim is the name of the claim, e.g., "module_id" or "pcr 3".
+	Claim string
+	A, B  string
+}
+
+func (d ClaimDiff) String() string {
+	return fmt.Sprintf("%s: %q != %q", d.Claim, d.A, d.B)
+}
+
+// DiffDocuments decodes the given raw attestation documents and returns the
+// claims whose values differ: module_id, digest, each PCR, public_key,
+// user_data, and nonce.  The timestamp, the certificates, and the signature
+// are ignored because they differ between any two documents.  The documents
+// are not verified, so callers who don't trust their origin must call Verify
+// first.  Two enclaves that run the same image have identical PCRs, so
+// operators use this function to detect drift between enclaves.
+func DiffDocuments(a, b []byte) ([]ClaimDiff, error) {
+	_, docA, err := decodeDocument(a)
+	if err != nil {
+		return nil, fmt.Errorf("first document: %v", err)
+	}
+	_, docB, err := decodeDocument(b)
+	if err != nil {
+		return nil, fmt.Errorf("second document: %v", err)
+	}
+
+	var diffs []ClaimDiff
+	if docA.ModuleID != docB.ModuleID {
+		diffs = append(diffs, ClaimDiff{"module_id", docA.ModuleID, docB.ModuleID})
+	}
+	if docA.Digest != docB.Digest {
+		diffs = append(diffs, ClaimDiff{"digest", docA.Digest, docB.Digest})
+	}
+
+	indices := make(map[uint]bool)
+	for i := range docA.PCRs {
+		indices[i] = true
+	}
+	for i := range docB.PCRs {
+		indices[i] = true
+	}
+	sorted := make([]uint, 0, len(indices))
+	for i := range indices {
+		sorted = append(sorted, i)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for _, i := range sorted {
+		if !bytes.Equal(docA.PCRs[i], docB.PCRs[i]) {
+			diffs = append(diffs, ClaimDiff{fmt.Sprintf("pcr %d", i),
+				hex.EncodeToString(docA.PCRs[i]), hex.EncodeToString(docB.PCRs[i])})
+		}
+	}
+
+	for _, claim := range []struct {
+		name string
+		a, b []byte
+	}{
+		{"public_key", docA.PublicKey, docB.PublicKey},
+		{"user_data", docA.UserData, docB.UserData},
+		{"nonce", docA.Nonce, docB.Nonce},
+	} {
+		if !bytes.Equal(claim.a, claim.b) {
+			diffs = append(diffs, ClaimDiff{claim.name,
+				hex.EncodeToString(claim.a), hex.EncodeToString(claim.b)})
+		}
+	}
+	return diffs, nil
+}
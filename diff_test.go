@@ -0,0 +1,53 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDiffDocuments(t *testing.T) {
+	pki := newTestPKI(t)
+	docA := newTestDocument()
+	rawA := pki.sign(t, docA)
+
+	// Documents that only differ in their timestamp and signature are
+	// identical.
+	docB := newTestDocument()
+	docB.Timestamp++
+	diffs, err := DiffDocuments(rawA, pki.sign(t, docB))
+	if err != nil {
+		t.Fatalf("failed to diff documents: %v", err)
+	}
+	if len(diffs) != 0 {
+		t.Fatalf("expected no differences but got: %v", diffs)
+	}
+
+	docB.PCRs[1] = bytes.Repeat([]byte{0xff}, 48)
+	docB.PCRs[4] = bytes.Repeat([]byte{0x04}, 48)
+	docB.ModuleID = "i-other"
+	docB.UserData = []byte("other user data")
+	diffs, err = DiffDocuments(rawA, pki.sign(t, docB))
+	if err != nil {
+		t.Fatalf("failed to diff documents: %v", err)
+	}
+	var claims []string
+	for _, d := range diffs {
+		claims = append(claims, d.Claim)
+	}
+	expected := []string{"module_id", "pcr 1", "pcr 4", "user_data"}
+	if len(claims) != len(expected) {
+		t.Fatalf("expected differing claims %v but got %v", expected, claims)
+	}
+	for i := range expected {
+		if claims[i] != expected[i] {
+			t.Fatalf("expected differing claims %v but got %v", expected, claims)
+		}
+	}
+	if diffs[2].A != "" {
+		t.Fatalf("expected PCR 4 to be absent from first document but got %q", diffs[2].A)
+	}
+
+	if _, err := DiffDocuments(rawA, []byte("not a document")); err == nil {
+		t.Fatal("expected error for malformed document")
+	}
+}
@@ -0,0 +1,404 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// acmeAccountKeyName is the cache entry of the ACME account key.  It's
+	// the same entry that autocert uses, so switching between HTTP-01 and
+	// DNS-01 keeps the account.
+	acmeAccountKeyName = "acme_account+key"
+	// dns01RenewBefore is how long before their expiry we renew
+	// certificates, which matches autocert's default.
+	dns01RenewBefore = 30 * 24 * time.Hour
+	// dns01Timeout bounds the time it takes to obtain a certificate.
+	dns01Timeout = 10 * time.Minute
+	// dns01MinRetry and dns01MaxRetry bound the exponential backoff after
+	// failed attempts to obtain certificates.
+	dns01MinRetry = time.Minute
+	dns01MaxRetry = time.Hour
+	// dns01CleanUpTimeout bounds the time it takes to remove a TXT record,
+	// so a hung solver can't block renewals.
+	dns01CleanUpTimeout = time.Minute
+)
+
+// DNSSolver publishes the TXT records that ACME's DNS-01 challenge asks for;
+// see Config.ACMEDNSSolver.  Implementations must be safe for concurrent
+// use.
+type DNSSolver interface {
+	// Present publishes a TXT record with the given name, e.g.,
+	// "_acme-challenge.example.com", and value.  When it returns, the
+	// record should be visible to the CA, so implementations may have to
+	// wait for the record to propagate.
+	Present(ctx context.Context, name, value string) error
+	// CleanUp removes the TXT record that Present published.
+	CleanUp(ctx context.Context, name, value string) error
+}
+
+// dns01Issuer obtains and renews certificates from an ACME CA via the DNS-01
+// challenge.  Certificates are kept in the enclave's certificate cache in
+// the same format as autocert's: the PEM-encoded private key, followed by
+// the PEM-encoded certificate chain.
+type dns01Issuer struct {
+	e      *Enclave
+	cache  autocert.Cache
+	solver DNSSolver
+	client *acme.Client
+
+	sync.RWMutex
+	certs map[string]*tls.Certificate
+	err   error
+}
+
+func newDNS01Issuer(e *Enclave, cache autocert.Cache) *dns01Issuer {
+	return &dns01Issuer{
+		e:      e,
+		cache:  cache,
+		solver: e.cfg.ACMEDNSSolver,
+		client: e.newACMEClient(e.acmeDirectoryURL()),
+		certs:  make(map[string]*tls.Certificate),
+	}
+}
+
+// getCertificate returns the certificate for the requested server name.
+// Until the first certificate is obtained, it returns the error of the last
+// attempt, which lets acmeFallback detect rate limits.
+func (d *dns01Issuer) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	fqdn := d.e.cfg.FQDN
+	if d.e.cfg.AttestationFQDN != "" && strings.EqualFold(hello.ServerName, d.e.cfg.AttestationFQDN) {
+		fqdn = d.e.cfg.AttestationFQDN
+	}
+	d.RLock()
+	defer d.RUnlock()
+	if cert, exists := d.certs[fqdn]; exists {
+		return cert, nil
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return nil, ErrCertificateNotReady
+}
+
+// run obtains the enclave's certificates and renews them before they expire,
+// until the enclave is closed.  The function blocks, so it's meant to run in
+// a goroutine.
+func (d *dns01Issuer) run() {
+	retry := dns01MinRetry
+	for {
+		wait, err := d.renew()
+		d.Lock()
+		d.err = err
+		d.Unlock()
+		if err != nil {
+			d.e.logError("Failed to obtain certificate via DNS-01 challenge: %v", err)
+			wait = retry
+			if retry *= 2; retry > dns01MaxRetry {
+				retry = dns01MaxRetry
+			}
+		} else {
+			retry = dns01MinRetry
+		}
+		select {
+		case <-d.e.done:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// renew makes sure that each of the enclave's FQDNs has a certificate that
+// isn't due for renewal, and returns the time until the next renewal.
+func (d *dns01Issuer) renew() (time.Duration, error) {
+	next := time.Duration(math.MaxInt64)
+	for _, fqdn := range d.e.fqdns() {
+		d.RLock()
+		cert := d.certs[fqdn]
+		d.RUnlock()
+		if cert == nil {
+			cert = d.load(fqdn)
+		}
+		if cert == nil || time.Until(cert.Leaf.NotAfter) < dns01RenewBefore {
+			var err error
+			if cert, err = d.obtain(fqdn); err != nil {
+				return 0, fmt.Errorf("failed to obtain certificate for %s: %v", fqdn, err)
+			}
+		}
+		d.set(fqdn, cert)
+		if wait := time.Until(cert.Leaf.NotAfter) - dns01RenewBefore; wait < next {
+			next = wait
+		}
+	}
+	if next < dns01MinRetry {
+		next = dns01MinRetry
+	}
+	return next, nil
+}
+
+// set makes the given certificate the one for the given FQDN, and updates the
+// fingerprint that the enclave binds to its attestation documents.
+func (d *dns01Issuer) set(fqdn string, cert *tls.Certificate) {
+	d.Lock()
+	old := d.certs[fqdn]
+	d.certs[fqdn] = cert
+	d.Unlock()
+	if old == cert {
+		return
+	}
+	fpr := &d.e.certFpr
+	if fqdn == d.e.cfg.AttestationFQDN {
+		fpr = &d.e.attCertFpr
+	}
+	certFpr := sha256.Sum256(cert.Leaf.Raw)
+	d.e.recordCertRotation(cert.Leaf, nil)
+	d.e.setFingerprint(fpr, certFpr)
+	d.e.log("Set SHA-256 fingerprint of %s's certificate to: %x", fqdn, certFpr[:])
+}
+
+// load returns the cached certificate for the given FQDN, or nil if there is
+// none or it's unusable.
+func (d *dns01Issuer) load(fqdn string) *tls.Certificate {
+	ctx, cancel := context.WithTimeout(context.Background(), dns01Timeout)
+	defer cancel()
+	rawData, err := d.cache.Get(ctx, fqdn)
+	if err != nil {
+		if err != autocert.ErrCacheMiss {
+			d.e.logError("Failed to get certificate for %s from cache: %v", fqdn, err)
+		}
+		return nil
+	}
+	cert, err := parseCachedCert(rawData)
+	if err != nil {
+		d.e.logError("Ignoring unusable cached certificate for %s: %v", fqdn, err)
+		return nil
+	}
+	return cert
+}
+
+// obtain requests a new certificate for the given FQDN from the ACME CA, and
+// caches it.
+func (d *dns01Issuer) obtain(fqdn string) (*tls.Certificate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dns01Timeout)
+	defer cancel()
+	if err := d.register(ctx); err != nil {
+		return nil, err
+	}
+	order, err := d.client.AuthorizeOrder(ctx, acme.DomainIDs(fqdn))
+	if err != nil {
+		return nil, err
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err = d.authorize(ctx, authzURL); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = d.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+
+	key, err := generateKey(d.e.cfg.KeyType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{fqdn}}, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate request: %v", err)
+	}
+	chain, _, err := d.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	rawKey, err := marshalPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal private key: %v", err)
+	}
+	var buf bytes.Buffer
+	_ = pem.Encode(&buf, &pem.Block{Type: "PRIVATE KEY", Bytes: rawKey})
+	for _, der := range chain {
+		_ = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	cert, err := parseCachedCert(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("CA issued unusable certificate: %v", err)
+	}
+	if err = d.cache.Put(ctx, fqdn, buf.Bytes()); err != nil {
+		// The certificate is still good for this run.
+		d.e.logError("Failed to cache certificate for %s: %v", fqdn, err)
+	}
+	d.e.log("Obtained certificate for %s via DNS-01 challenge.", fqdn)
+	return cert, nil
+}
+
+// register sets up the ACME account, unless that's done already.  The account
+// key is cached, so the enclave keeps its account across restarts.
+func (d *dns01Issuer) register(ctx context.Context) error {
+	if d.client.Key != nil {
+		return nil
+	}
+	var key crypto.Signer
+	if rawData, err := d.cache.Get(ctx, acmeAccountKeyName); err == nil {
+		if block, _ := pem.Decode(rawData); block != nil {
+			key, _ = x509.ParseECPrivateKey(block.Bytes)
+		}
+	}
+	if key == nil {
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return fmt.Errorf("failed to generate account key: %v", err)
+		}
+		rawKey, err := x509.MarshalECPrivateKey(ecKey)
+		if err != nil {
+			return fmt.Errorf("failed to marshal account key: %v", err)
+		}
+		rawData := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey})
+		if err = d.cache.Put(ctx, acmeAccountKeyName, rawData); err != nil {
+			return fmt.Errorf("failed to cache account key: %v", err)
+		}
+		key = ecKey
+	}
+	d.client.Key = key
+	acct := &acme.Account{}
+	if d.e.cfg.ACMEEmail != "" {
+		acct.Contact = []string{"mailto:" + d.e.cfg.ACMEEmail}
+	}
+	if _, err := d.client.Register(ctx, acct, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		d.client.Key = nil
+		return fmt.Errorf("failed to register ACME account: %v", err)
+	}
+	return nil
+}
+
+// authorize fulfills the DNS-01 challenge of the given authorization, unless
+// the authorization is valid already.
+func (d *dns01Issuer) authorize(ctx context.Context, authzURL string) error {
+	authz, err := d.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("CA offered no DNS-01 challenge for %s", authz.Identifier.Value)
+	}
+	value, err := d.client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	// The record name omits the wildcard label of wildcard certificates,
+	// which the identifier's value doesn't contain either.
+	name := "_acme-challenge." + authz.Identifier.Value
+	if err = d.solver.Present(ctx, name, value); err != nil {
+		return fmt.Errorf("failed to publish TXT record %s: %v", name, err)
+	}
+	defer func() {
+		// We clean up even if the challenge's context expired.
+		ctx, cancel := context.WithTimeout(context.Background(), dns01CleanUpTimeout)
+		defer cancel()
+		if err := d.solver.CleanUp(ctx, name, value); err != nil {
+			d.e.logError("Failed to remove TXT record %s: %v", name, err)
+		}
+	}()
+	if _, err = d.client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = d.client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// parseCachedCert parses a certificate in autocert's cache format, and
+// rejects expired certificates.
+func parseCachedCert(rawData []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(rawData, rawData)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return nil, errors.New("certificate expired")
+	}
+	return &cert, nil
+}
+
+// vsockDNSSolver is a DNSSolver that forwards TXT records to a service on
+// the host, which the enclave reaches via vsock.
+type vsockDNSSolver struct {
+	client *http.Client
+}
+
+// NewVsockDNSSolver returns a DNSSolver that asks a service on the parent EC2
+// instance to publish TXT records, at the vsock address of the form
+// "<context ID>:<port>".  The solver sends PUT requests to publish records
+// and DELETE requests to remove them.  Each request's path is the record's
+// name, and its body is the record's value.  The service responds with a
+// 2xx status code once the record is published or removed.
+func NewVsockDNSSolver(addr string) (DNSSolver, error) {
+	cid, port, err := parseVsockAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialVsock(cid, port)
+		},
+	}
+	return &vsockDNSSolver{client: &http.Client{Transport: transport}}, nil
+}
+
+// do sends a request with the given method for the given record.
+func (s *vsockDNSSolver) do(ctx context.Context, method, name, value string) error {
+	req, err := http.NewRequestWithContext(ctx, method, "http://dns-solver/"+url.PathEscape(name), strings.NewReader(value))
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach DNS solver: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("DNS solver returned status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Present implements DNSSolver.
+func (s *vsockDNSSolver) Present(ctx context.Context, name, value string) error {
+	return s.do(ctx, http.MethodPut, name, value)
+}
+
+// CleanUp implements DNSSolver.
+func (s *vsockDNSSolver) CleanUp(ctx context.Context, name, value string) error {
+	return s.do(ctx, http.MethodDelete, name, value)
+}
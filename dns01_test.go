@@ -0,0 +1,279 @@
+package enclaveutils
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// fakeDNSSolver records the TXT records that are currently published, and
+// whether a record was cleaned up without a deadline.
+type fakeDNSSolver struct {
+	sync.Mutex
+	records   map[string]string
+	published []string
+	unbounded bool
+}
+
+func (s *fakeDNSSolver) Present(ctx context.Context, name, value string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.records[name] = value
+	s.published = append(s.published, value)
+	return nil
+}
+
+func (s *fakeDNSSolver) CleanUp(ctx context.Context, name, value string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := ctx.Deadline(); !ok {
+		s.unbounded = true
+	}
+	delete(s.records, name)
+	return nil
+}
+
+// newFakeACMEServer returns a minimal RFC 8555 CA that issues a certificate
+// for a single wildcard order once the DNS-01 challenge's TXT record is
+// published.  The CA trusts the solver instead of resolving the record.
+func newFakeACMEServer(t *testing.T, solver *fakeDNSSolver) (*httptest.Server, *int) {
+	caKey := newTestKey(t)
+	caCert := newTestCert(t, "fake ACME CA", true, caKey, caKey, nil)
+	orders := 0
+	validated := false
+	var srv *httptest.Server
+
+	respond := func(w http.ResponseWriter, status int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(v)
+	}
+	payload := func(r *http.Request, v interface{}) {
+		var jws struct{ Payload string }
+		if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+			t.Errorf("failed to decode JWS: %v", err)
+			return
+		}
+		raw, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+		_ = json.Unmarshal(raw, v)
+	}
+	order := func(status string) map[string]interface{} {
+		return map[string]interface{}{
+			"status":         status,
+			"identifiers":    []map[string]string{{"type": "dns", "value": "*.example.com"}},
+			"authorizations": []string{srv.URL + "/authz"},
+			"finalize":       srv.URL + "/finalize",
+			"certificate":    srv.URL + "/cert",
+		}
+	}
+
+	var issued []byte
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dir", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, http.StatusOK, map[string]string{
+			"newNonce":   srv.URL + "/nonce",
+			"newAccount": srv.URL + "/account",
+			"newOrder":   srv.URL + "/order",
+		})
+	})
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", srv.URL+"/account/1")
+		respond(w, http.StatusCreated, map[string]string{"status": "valid"})
+	})
+	mux.HandleFunc("/order", func(w http.ResponseWriter, r *http.Request) {
+		orders++
+		w.Header().Set("Location", srv.URL+"/order/1")
+		respond(w, http.StatusCreated, order("pending"))
+	})
+	mux.HandleFunc("/order/1", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, http.StatusOK, order("ready"))
+	})
+	mux.HandleFunc("/authz", func(w http.ResponseWriter, r *http.Request) {
+		status := "pending"
+		if validated {
+			status = "valid"
+		}
+		respond(w, http.StatusOK, map[string]interface{}{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": "example.com"},
+			"wildcard":   true,
+			"challenges": []map[string]string{
+				{"type": "http-01", "url": srv.URL + "/chal/http", "token": "http-token", "status": "pending"},
+				{"type": "dns-01", "url": srv.URL + "/chal/dns", "token": "dns-token", "status": status},
+			},
+		})
+	})
+	mux.HandleFunc("/chal/dns", func(w http.ResponseWriter, r *http.Request) {
+		solver.Lock()
+		_, validated = solver.records["_acme-challenge.example.com"]
+		solver.Unlock()
+		respond(w, http.StatusOK, map[string]string{
+			"type": "dns-01", "url": srv.URL + "/chal/dns", "token": "dns-token", "status": "valid",
+		})
+	})
+	mux.HandleFunc("/finalize", func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ CSR string }
+		payload(r, &req)
+		rawCSR, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(rawCSR)
+		if err != nil {
+			t.Errorf("failed to parse CSR: %v", err)
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, csr.PublicKey, caKey)
+		if err != nil {
+			t.Errorf("failed to issue certificate: %v", err)
+			return
+		}
+		issued = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})...)
+		w.Header().Set("Location", srv.URL+"/order/1")
+		respond(w, http.StatusOK, order("valid"))
+	})
+	mux.HandleFunc("/cert", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(issued)
+	})
+
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+		mux.ServeHTTP(w, r)
+	}))
+	return srv, &orders
+}
+
+func TestDNS01Issuer(t *testing.T) {
+	solver := &fakeDNSSolver{records: make(map[string]string)}
+	srv, orders := newFakeACMEServer(t, solver)
+	defer srv.Close()
+
+	cfg := &Config{
+		FQDN:             "*.example.com",
+		UseACME:          true,
+		ACMEDirectoryURL: srv.URL + "/dir",
+		ACMEDNSSolver:    solver,
+		Logger:           &fakeLogger{},
+	}
+	cache := autocert.DirCache(t.TempDir())
+	d := newDNS01Issuer(NewEnclave(cfg), cache)
+	hello := &tls.ClientHelloInfo{ServerName: "foo.example.com"}
+	if _, err := d.getCertificate(hello); err != ErrCertificateNotReady {
+		t.Fatalf("expected error %v but got %v", ErrCertificateNotReady, err)
+	}
+
+	wait, err := d.renew()
+	if err != nil {
+		t.Fatalf("failed to obtain certificate: %v", err)
+	}
+	if wait < 59*24*time.Hour {
+		t.Fatalf("expected renewal in about 60 days but got %s", wait)
+	}
+	expected, err := d.client.DNS01ChallengeRecord("dns-token")
+	if err != nil {
+		t.Fatalf("failed to compute challenge record: %v", err)
+	}
+	if len(solver.published) != 1 || solver.published[0] != expected || len(solver.records) != 0 {
+		t.Fatalf("expected TXT record %q that was cleaned up, but got %q published and %v left",
+			expected, solver.published, solver.records)
+	}
+	if solver.unbounded {
+		t.Fatal("expected TXT record to be cleaned up with a deadline")
+	}
+	cert, err := d.getCertificate(hello)
+	if err != nil {
+		t.Fatalf("failed to get certificate: %v", err)
+	}
+	if cert.Leaf.DNSNames[0] != "*.example.com" {
+		t.Fatalf("expected certificate for *.example.com but got %v", cert.Leaf.DNSNames)
+	}
+	fpr, ok := d.e.CertificateFingerprint()
+	if !ok || fpr != sha256.Sum256(cert.Leaf.Raw) {
+		t.Fatal("expected fingerprint of issued certificate")
+	}
+
+	// A restarted enclave picks up the cached certificate and account.
+	d = newDNS01Issuer(NewEnclave(cfg), cache)
+	if _, err = d.renew(); err != nil {
+		t.Fatalf("failed to load certificate: %v", err)
+	}
+	if *orders != 1 {
+		t.Fatalf("expected a single order but got %d", *orders)
+	}
+	if _, err = d.getCertificate(hello); err != nil {
+		t.Fatalf("failed to get cached certificate: %v", err)
+	}
+	if rawKey, err := cache.Get(context.Background(), acmeAccountKeyName); err != nil || !strings.Contains(string(rawKey), "EC PRIVATE KEY") {
+		t.Fatalf("expected cached account key but got: %v", err)
+	}
+}
+
+func TestVsockDNSSolver(t *testing.T) {
+	records := make(map[string]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch r.Method {
+		case http.MethodPut:
+			records[strings.TrimPrefix(r.URL.Path, "/")] = string(body)
+		case http.MethodDelete:
+			if records[strings.TrimPrefix(r.URL.Path, "/")] != string(body) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(records, strings.TrimPrefix(r.URL.Path, "/"))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	origDial := dialVsock
+	defer func() { dialVsock = origDial }()
+	dialVsock = func(contextID, port uint32) (net.Conn, error) {
+		return net.Dial("tcp", srv.Listener.Addr().String())
+	}
+
+	solver, err := NewVsockDNSSolver("3:8000")
+	if err != nil {
+		t.Fatalf("failed to create solver: %v", err)
+	}
+	ctx := context.Background()
+	if err = solver.Present(ctx, "_acme-challenge.example.com", "value"); err != nil {
+		t.Fatalf("failed to present record: %v", err)
+	}
+	if records["_acme-challenge.example.com"] != "value" {
+		t.Fatalf("expected record to be published but got %v", records)
+	}
+	if err = solver.CleanUp(ctx, "_acme-challenge.example.com", "other value"); err == nil {
+		t.Fatal("expected error for failed clean-up")
+	}
+	if err = solver.CleanUp(ctx, "_acme-challenge.example.com", "value"); err != nil {
+		t.Fatalf("failed to clean up record: %v", err)
+	}
+	if _, err = NewVsockDNSSolver("3"); err == nil {
+		t.Fatal("expected error for invalid vsock address")
+	}
+}
@@ -0,0 +1,127 @@
+package enclaveutils
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// defaultDocCacheSize is the number of attestation documents that a
+// docCache holds unless configured otherwise.
+const defaultDocCacheSize = 1024
+
+// docCache is an attester that remembers the attestation documents of the
+// wrapped attester for a short while, so that clients that retry with the
+// same nonce and user data don't make us ask the NSM again.  Failed requests
+// aren't cached.
+//
+// All entries share the same TTL, so the entries expire in the order in which
+// they were added.  The cache keeps them in a queue in that order, which
+// makes it cheap to prune expired entries and, once the cache is full, to
+// evict the oldest ones.
+type docCache struct {
+	sync.Mutex
+	inner   attester
+	ttl     time.Duration
+	size    int
+	now     func() time.Time
+	entries map[[sha256.Size]byte]*list.Element
+	queue   *list.List
+}
+
+type docCacheEntry struct {
+	key     [sha256.Size]byte
+	doc     []byte
+	expires time.Time
+}
+
+// newDocCache returns a docCache that holds up to the given number of
+// documents (defaultDocCacheSize if not positive) for the given TTL.
+func newDocCache(inner attester, ttl time.Duration, size int) *docCache {
+	if size <= 0 {
+		size = defaultDocCacheSize
+	}
+	return &docCache{
+		inner:   inner,
+		ttl:     ttl,
+		size:    size,
+		now:     time.Now,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		queue:   list.New(),
+	}
+}
+
+func (c *docCache) attest(nonce, userData, publicKey []byte) ([]byte, error) {
+	key := docCacheKey(nonce, userData, publicKey)
+	if doc := c.lookup(key); doc != nil {
+		return doc, nil
+	}
+	doc, err := c.inner.attest(nonce, userData, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	c.add(key, doc)
+	return doc, nil
+}
+
+// lookup returns the cached document for the given key, or nil if there is
+// none or it has expired.
+func (c *docCache) lookup(key [sha256.Size]byte) []byte {
+	c.Lock()
+	defer c.Unlock()
+	c.prune(c.now())
+	if elem, exists := c.entries[key]; exists {
+		return elem.Value.(*docCacheEntry).doc
+	}
+	return nil
+}
+
+// add caches the given document, evicting the oldest documents if the cache
+// is full.
+func (c *docCache) add(key [sha256.Size]byte, doc []byte) {
+	c.Lock()
+	defer c.Unlock()
+	now := c.now()
+	c.prune(now)
+	if elem, exists := c.entries[key]; exists {
+		// A concurrent request for the same key beat us to it.
+		c.remove(elem)
+	}
+	for c.queue.Len() >= c.size {
+		c.remove(c.queue.Front())
+	}
+	c.entries[key] = c.queue.PushBack(&docCacheEntry{key: key, doc: doc, expires: now.Add(c.ttl)})
+}
+
+// prune removes the entries that have expired.
+func (c *docCache) prune(now time.Time) {
+	for elem := c.queue.Front(); elem != nil; elem = c.queue.Front() {
+		if now.Before(elem.Value.(*docCacheEntry).expires) {
+			return
+		}
+		c.remove(elem)
+	}
+}
+
+func (c *docCache) remove(elem *list.Element) {
+	delete(c.entries, elem.Value.(*docCacheEntry).key)
+	c.queue.Remove(elem)
+}
+
+// docCacheKey returns the cache key of the given request.  The fields are
+// length-prefixed, so different requests can't share a key by moving bytes
+// from one field to another.
+func docCacheKey(nonce, userData, publicKey []byte) [sha256.Size]byte {
+	h := sha256.New()
+	for _, field := range [][]byte{nonce, userData, publicKey} {
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(len(field)))
+		h.Write(length[:])
+		h.Write(field)
+	}
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
@@ -0,0 +1,100 @@
+package enclaveutils
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// countingAttester returns a new attestation document for each request.
+type countingAttester struct {
+	calls int
+	err   error
+}
+
+func (a *countingAttester) attest(nonce, userData, publicKey []byte) ([]byte, error) {
+	a.calls++
+	if a.err != nil {
+		return nil, a.err
+	}
+	return []byte(fmt.Sprintf("attestation document %d", a.calls)), nil
+}
+
+func TestDocCache(t *testing.T) {
+	now := time.Now()
+	a := &countingAttester{}
+	c := newDocCache(a, 5*time.Second, 2)
+	c.now = func() time.Time { return now }
+
+	attest := func(nonce, userData string) string {
+		doc, err := c.attest([]byte(nonce), []byte(userData), nil)
+		if err != nil {
+			t.Fatalf("failed to attest: %v", err)
+		}
+		return string(doc)
+	}
+
+	doc := attest("nonce", "user data")
+	if attest("nonce", "user data") != doc || a.calls != 1 {
+		t.Fatal("expected cache hit for identical request")
+	}
+	// Moving bytes between fields must not result in the same key.
+	if attest("nonceuser", " data") == doc || attest("nonce", "other data") == doc {
+		t.Fatal("expected cache miss for different request")
+	}
+	// The cache holds two documents, so the first one was evicted.
+	if a.calls != 3 || len(c.entries) != 2 || c.queue.Len() != 2 {
+		t.Fatalf("expected two cached documents after three requests but got %d", len(c.entries))
+	}
+	if attest("nonce", "user data") == doc {
+		t.Fatal("expected oldest document to be evicted")
+	}
+
+	now = now.Add(5 * time.Second)
+	calls := a.calls
+	attest("nonce", "other data")
+	if a.calls != calls+1 || len(c.entries) != 1 {
+		t.Fatal("expected cache miss after TTL expired")
+	}
+
+	// Errors aren't cached.
+	a.err = errors.New("NSM failure")
+	if _, err := c.attest([]byte("new nonce"), nil, nil); err == nil {
+		t.Fatal("expected error")
+	}
+	a.err = nil
+	if _, err := c.attest([]byte("new nonce"), nil, nil); err != nil {
+		t.Fatalf("expected failed request to be retried but got: %v", err)
+	}
+}
+
+func TestDocCacheConfig(t *testing.T) {
+	if _, ok := NewEnclave(&Config{}).attester.(*docCache); ok {
+		t.Fatal("expected caching to be disabled by default")
+	}
+	e := NewEnclave(&Config{AttestationCacheTTL: time.Second})
+	c, ok := e.attester.(*docCache)
+	if !ok || c.ttl != time.Second || c.size != defaultDocCacheSize {
+		t.Fatal("expected cache with default size")
+	}
+}
+
+func BenchmarkDocCache(b *testing.B) {
+	nonce := make([]byte, nonceLen)
+	userData := make([]byte, 64)
+
+	b.Run("hit", func(b *testing.B) {
+		c := newDocCache(&countingAttester{}, time.Hour, 0)
+		for i := 0; i < b.N; i++ {
+			_, _ = c.attest(nonce, userData, nil)
+		}
+	})
+	b.Run("miss", func(b *testing.B) {
+		c := newDocCache(&countingAttester{}, time.Hour, 0)
+		for i := 0; i < b.N; i++ {
+			nonce[0], nonce[1], nonce[2] = byte(i), byte(i>>8), byte(i>>16)
+			_, _ = c.attest(nonce, userData, nil)
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package enclaveutils
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/proxy"
+)
+
+var errNoPinnedCert = errors.New("upstream presented no pinned certificate")
+
+// HTTPClient returns an HTTP client for the enclave's outbound requests.  The
+// client sends its requests via the configured SOCKS proxy, and verifies
+// upstream servers according to Config.OutboundTLSConfig and
+// Config.OutboundPinnedCerts.  Because the proxy runs outside the enclave,
+// it can see and tamper with outbound connections, so TLS verification is all
+// that protects the enclave's egress; pinning critical upstreams therefore
+// protects against a compromised proxy or a misissued certificate.
+func (e *Enclave) HTTPClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+	if e.cfg.OutboundTLSConfig != nil {
+		tlsConfig = e.cfg.OutboundTLSConfig.Clone()
+	}
+	if tlsConfig.InsecureSkipVerify {
+		return nil, errors.New("outbound TLS configuration must not skip verification")
+	}
+	if len(e.cfg.OutboundPinnedCerts) > 0 {
+		tlsConfig.VerifyConnection = verifyPinnedCerts(e.cfg.OutboundPinnedCerts, tlsConfig.VerifyConnection)
+	}
+
+	if _, err := e.proxy(nil); err != nil {
+		return nil, err
+	}
+	transport := e.outboundTransport()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// outboundTransport returns an HTTP transport that sends requests via the
+// configured SOCKS proxy.  Unlike http.DefaultTransport, the transport
+// ignores the HTTP_PROXY and HTTPS_PROXY environment variables.
+func (e *Enclave) outboundTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = e.proxy
+	return transport
+}
+
+// proxy implements http.Transport.Proxy.  It returns the URL of the
+// configured SOCKS proxy, or nil if there is none.
+func (e *Enclave) proxy(*http.Request) (*url.URL, error) {
+	if e.cfg.SOCKSProxy == "" {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(e.cfg.SOCKSProxy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SOCKS proxy URL: %v", err)
+	}
+	return proxyURL, nil
+}
+
+// Dialer returns a dialer for the enclave's outbound TCP connections, e.g.,
+// to databases or custom protocols, which HTTPClient doesn't cover.  The
+// dialer connects via the configured SOCKS proxy, which must therefore be a
+// SOCKS5 proxy, i.e., have the scheme socks5 or socks5h.  Without a
+// configured proxy, the dialer connects directly, which only works outside an
+// enclave.  The dialer also implements proxy.ContextDialer.
+func (e *Enclave) Dialer() (proxy.Dialer, error) {
+	proxyURL, err := e.proxy(nil)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return proxy.Direct, nil
+	}
+	if proxyURL.Scheme != "socks5" && proxyURL.Scheme != "socks5h" {
+		return nil, fmt.Errorf("SOCKS proxy URL %q must have the scheme socks5 or socks5h", e.cfg.SOCKSProxy)
+	}
+	return proxy.FromURL(proxyURL, proxy.Direct)
+}
+
+// DialContext connects to the given address via the dialer that Dialer
+// returns.  Its signature matches net.Dialer's DialContext, so it can be
+// used, e.g., as gRPC's context dialer:
+//
+//	grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+//		return e.DialContext(ctx, "tcp", addr)
+//	})
+func (e *Enclave) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d, err := e.Dialer()
+	if err != nil {
+		return nil, err
+	}
+	return d.(proxy.ContextDialer).DialContext(ctx, network, addr)
+}
+
+// newACMEClient returns an ACME client for the given directory that talks to
+// the CA via the configured SOCKS proxy.  Outbound TLS settings don't apply,
+// as they are meant for the application's upstream servers.
+func (e *Enclave) newACMEClient(directoryURL string) *acme.Client {
+	return &acme.Client{
+		DirectoryURL: directoryURL,
+		HTTPClient:   &http.Client{Transport: e.outboundTransport()},
+	}
+}
+
+// verifyPinnedCerts returns a tls.Config.VerifyConnection callback that
+// requires one of the certificates that the server presented to have one of
+// the given SHA-256 fingerprints.  The callback runs after regular chain
+// verification, and calls next, if set, afterwards.
+func verifyPinnedCerts(pins [][sha256.Size]byte, next func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if !hasPinnedCert(state, pins) {
+			return errNoPinnedCert
+		}
+		if next != nil {
+			return next(state)
+		}
+		return nil
+	}
+}
+
+func hasPinnedCert(state tls.ConnectionState, pins [][sha256.Size]byte) bool {
+	for _, cert := range state.PeerCertificates {
+		fpr := sha256.Sum256(cert.Raw)
+		for _, pin := range pins {
+			if fpr == pin {
+				return true
+			}
+		}
+	}
+	return false
+}
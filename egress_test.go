@@ -0,0 +1,218 @@
+package enclaveutils
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPClientPinning(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	srvFpr := sha256.Sum256(srv.Certificate().Raw)
+
+	get := func(cfg *Config) error {
+		client, err := NewEnclave(cfg).HTTPClient()
+		if err != nil {
+			t.Fatalf("failed to create HTTP client: %v", err)
+		}
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+
+	// The upstream's certificate is unknown without custom roots.
+	if err := get(&Config{}); err == nil {
+		t.Fatal("expected error for untrusted upstream")
+	}
+	tlsConfig := &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	if err := get(&Config{OutboundTLSConfig: tlsConfig}); err != nil {
+		t.Fatalf("expected trusted upstream to succeed but got: %v", err)
+	}
+	if err := get(&Config{
+		OutboundTLSConfig:   tlsConfig,
+		OutboundPinnedCerts: [][sha256.Size]byte{{}, srvFpr},
+	}); err != nil {
+		t.Fatalf("expected pinned upstream to succeed but got: %v", err)
+	}
+	err := get(&Config{
+		OutboundTLSConfig:   tlsConfig,
+		OutboundPinnedCerts: [][sha256.Size]byte{sha256.Sum256([]byte("other cert"))},
+	})
+	if err == nil || !strings.Contains(err.Error(), errNoPinnedCert.Error()) {
+		t.Fatalf("expected pinning error but got: %v", err)
+	}
+
+	if _, err := NewEnclave(&Config{
+		OutboundTLSConfig: &tls.Config{InsecureSkipVerify: true},
+	}).HTTPClient(); err == nil {
+		t.Fatal("expected error for configuration that skips verification")
+	}
+}
+
+func TestOutboundProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+	}))
+	defer proxy.Close()
+	// The environment must not affect the enclave's clients.
+	t.Setenv("HTTP_PROXY", "http://127.0.0.1:1")
+
+	e := NewEnclave(&Config{SOCKSProxy: proxy.URL})
+	client, err := e.HTTPClient()
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	for _, c := range []*http.Client{client, e.newACMEClient("http://acme.example.com/directory").HTTPClient} {
+		resp, err := c.Get("http://upstream.example.com/")
+		if err != nil {
+			t.Fatalf("failed to make request via proxy: %v", err)
+		}
+		resp.Body.Close()
+	}
+	if len(proxied) != 2 || proxied[0] != "http://upstream.example.com/" {
+		t.Fatalf("expected two requests via the proxy but got %v", proxied)
+	}
+
+	if _, err = NewEnclave(&Config{SOCKSProxy: "socks5://[::1"}).HTTPClient(); err == nil {
+		t.Fatal("expected error for invalid proxy URL")
+	}
+}
+
+// serveSOCKS5 accepts connections on the given listener and handles them as
+// a SOCKS5 proxy that supports CONNECT requests without authentication, for
+// IPv4 and domain name destinations.  It sends each destination to the
+// given channel.
+func serveSOCKS5(l net.Listener, dests chan<- string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			// Greeting: version, number of methods, and methods.
+			buf := make([]byte, 262)
+			if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+				return
+			}
+			if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte{5, 0})
+			// Request: version, command, reserved, address type, address,
+			// and port.
+			if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+				return
+			}
+			var host string
+			switch buf[3] {
+			case 1:
+				if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+					return
+				}
+				host = net.IP(buf[:4]).String()
+			case 3:
+				if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+					return
+				}
+				n := buf[0]
+				if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+					return
+				}
+				host = string(buf[:n])
+			default:
+				return
+			}
+			if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+				return
+			}
+			dest := net.JoinHostPort(host, fmt.Sprint(binary.BigEndian.Uint16(buf[:2])))
+			dests <- dest
+			upstream, err := net.Dial("tcp", dest)
+			if err != nil {
+				_, _ = conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+				return
+			}
+			defer upstream.Close()
+			_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			go func() { _, _ = io.Copy(upstream, conn) }()
+			_, _ = io.Copy(conn, upstream)
+		}()
+	}
+}
+
+func TestDialer(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	socks, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer socks.Close()
+	dests := make(chan string, 2)
+	go serveSOCKS5(socks, dests)
+
+	e := NewEnclave(&Config{SOCKSProxy: "socks5://" + socks.Addr().String()})
+	d, err := e.Dialer()
+	if err != nil {
+		t.Fatalf("failed to create dialer: %v", err)
+	}
+	roundTrip := func(conn net.Conn, err error) {
+		if err != nil {
+			t.Fatalf("failed to dial via proxy: %v", err)
+		}
+		defer conn.Close()
+		if _, err = conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		buf := make([]byte, 4)
+		if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("expected echo but got %q: %v", buf, err)
+		}
+		if dest := <-dests; dest != echo.Addr().String() {
+			t.Fatalf("expected proxy to connect to %s but got %s", echo.Addr(), dest)
+		}
+	}
+	roundTrip(d.Dial("tcp", echo.Addr().String()))
+	roundTrip(e.DialContext(context.Background(), "tcp", echo.Addr().String()))
+
+	// Without a proxy, the dialer connects directly.
+	conn, err := NewEnclave(&Config{}).DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial directly: %v", err)
+	}
+	conn.Close()
+	if _, err = NewEnclave(&Config{SOCKSProxy: "http://127.0.0.1:8080"}).Dialer(); err == nil {
+		t.Fatal("expected error for non-SOCKS5 proxy")
+	}
+}
@@ -0,0 +1,141 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+const (
+	eifMaxSections = 32
+	// eifHeaderLen is the size of an EIF's header, in bytes.
+	eifHeaderLen = 548
+	// eifSectionHeaderLen is the size of a section's header, in bytes.
+	eifSectionHeaderLen = 12
+
+	eifSectionKernel  = 1
+	eifSectionCmdline = 2
+	eifSectionRamdisk = 3
+)
+
+var eifMagic = []byte(".eif")
+
+// eifHeader represents the header of an enclave image file, as defined in
+// AWS's aws-nitro-enclaves-image-format crate.  All integers are big-endian.
+type eifHeader struct {
+	Magic          [4]byte
+	Version        uint16
+	Flags          uint16
+	DefaultMem     uint64
+	DefaultCPUs    uint64
+	Reserved       uint16
+	NumSections    uint16
+	SectionOffsets [eifMaxSections]uint64
+	SectionSizes   [eifMaxSections]uint64
+	Unused         uint32
+	CRC32          uint32
+}
+
+// eifSectionHeader precedes each of an EIF's sections.
+type eifSectionHeader struct {
+	Type  uint16
+	Flags uint16
+	Size  uint64
+}
+
+// MeasureEIF computes the PCRs 0, 1, and 2 that an enclave started from the
+// enclave image file (EIF) at the given path will have.  The result can be
+// used as VerifyOptions.ExpectedPCRs, which saves operators from running
+// nitro-cli describe-eif.
+//
+// The measurement follows nitro-cli's: each PCR is the result of extending an
+// all-zero PCR once with the SHA-384 hash over a number of the EIF's
+// sections, i.e., PCR = SHA-384(0^48 || SHA-384(sections)).  PCR0 covers the
+// kernel, the kernel command line, and all ramdisks, in the order in which
+// they appear in the EIF.  PCR1 covers the kernel, the kernel command line,
+// and the first ramdisk, which contains the bootstrap code.  PCR2 covers the
+// remaining ramdisks, which contain the application.  Signature and metadata
+// sections are not covered.  PCR8, which covers the EIF's signing
+// certificate, is not computed.
+func MeasureEIF(path string) (map[uint][]byte, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open EIF: %v", err)
+	}
+	defer func() {
+		_ = fd.Close()
+	}()
+
+	return measureEIF(fd)
+}
+
+// measureEIF computes the PCRs of the EIF that the given reader provides.
+func measureEIF(r io.ReaderAt) (map[uint][]byte, error) {
+	var hdr eifHeader
+	if err := binary.Read(io.NewSectionReader(r, 0, eifHeaderLen), binary.BigEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("failed to read EIF header: %v", err)
+	}
+	if !bytes.Equal(hdr.Magic[:], eifMagic) {
+		return nil, errors.New("file is not an EIF")
+	}
+	if hdr.NumSections > eifMaxSections {
+		return nil, fmt.Errorf("EIF has too many sections: %d", hdr.NumSections)
+	}
+
+	image, bootstrap, app := sha512.New384(), sha512.New384(), sha512.New384()
+	numRamdisks := 0
+	for i := 0; i < int(hdr.NumSections); i++ {
+		offset := int64(hdr.SectionOffsets[i])
+		var secHdr eifSectionHeader
+		if err := binary.Read(io.NewSectionReader(r, offset, eifSectionHeaderLen), binary.BigEndian, &secHdr); err != nil {
+			return nil, fmt.Errorf("failed to read header of EIF section %d: %v", i, err)
+		}
+		if secHdr.Size != hdr.SectionSizes[i] {
+			return nil, fmt.Errorf("size of EIF section %d is inconsistent", i)
+		}
+
+		var w io.Writer
+		switch secHdr.Type {
+		case eifSectionKernel, eifSectionCmdline:
+			w = io.MultiWriter(image, bootstrap)
+		case eifSectionRamdisk:
+			if numRamdisks == 0 {
+				w = io.MultiWriter(image, bootstrap)
+			} else {
+				w = io.MultiWriter(image, app)
+			}
+			numRamdisks++
+		default:
+			continue
+		}
+
+		data := io.NewSectionReader(r, offset+eifSectionHeaderLen, int64(secHdr.Size))
+		n, err := io.Copy(w, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read EIF section %d: %v", i, err)
+		}
+		if n != int64(secHdr.Size) {
+			return nil, fmt.Errorf("EIF section %d is truncated", i)
+		}
+	}
+
+	return map[uint][]byte{
+		0: eifPCR(image),
+		1: eifPCR(bootstrap),
+		2: eifPCR(app),
+	}, nil
+}
+
+// eifPCR returns the value of an all-zero PCR after extending it with the
+// given hash's digest.
+func eifPCR(h hash.Hash) []byte {
+	pcr := sha512.New384()
+	pcr.Write(make([]byte, sha512.Size384))
+	pcr.Write(h.Sum(nil))
+	return pcr.Sum(nil)
+}
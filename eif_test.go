@@ -0,0 +1,97 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+type testSection struct {
+	typ  uint16
+	data []byte
+}
+
+// newTestEIF assembles an EIF that consists of the given sections.
+func newTestEIF(t *testing.T, sections []testSection) []byte {
+	var hdr eifHeader
+	copy(hdr.Magic[:], eifMagic)
+	hdr.Version = 4
+	hdr.NumSections = uint16(len(sections))
+
+	body := new(bytes.Buffer)
+	for i, s := range sections {
+		hdr.SectionOffsets[i] = uint64(eifHeaderLen + body.Len())
+		hdr.SectionSizes[i] = uint64(len(s.data))
+		secHdr := eifSectionHeader{Type: s.typ, Size: uint64(len(s.data))}
+		if err := binary.Write(body, binary.BigEndian, secHdr); err != nil {
+			t.Fatalf("failed to write section header: %v", err)
+		}
+		body.Write(s.data)
+	}
+
+	eif := new(bytes.Buffer)
+	if err := binary.Write(eif, binary.BigEndian, hdr); err != nil {
+		t.Fatalf("failed to write EIF header: %v", err)
+	}
+	eif.Write(body.Bytes())
+	return eif.Bytes()
+}
+
+func expectedPCR(data ...[]byte) []byte {
+	digest := sha512.Sum384(bytes.Join(data, nil))
+	pcr := sha512.Sum384(append(make([]byte, sha512.Size384), digest[:]...))
+	return pcr[:]
+}
+
+func TestMeasureEIF(t *testing.T) {
+	if size := binary.Size(eifHeader{}); size != eifHeaderLen {
+		t.Fatalf("expected EIF header of %d bytes but got %d", eifHeaderLen, size)
+	}
+
+	kernel := []byte("kernel image")
+	cmdline := []byte("reboot=k panic=30 pci=off console=ttyS0")
+	bootstrap := []byte("bootstrap ramdisk")
+	app := []byte("application ramdisk")
+	raw := newTestEIF(t, []testSection{
+		{eifSectionKernel, kernel},
+		{eifSectionCmdline, cmdline},
+		{eifSectionRamdisk, bootstrap},
+		{eifSectionRamdisk, app},
+		{4, []byte("signature")},
+	})
+	path := filepath.Join(t.TempDir(), "enclave.eif")
+	if err := ioutil.WriteFile(path, raw, 0600); err != nil {
+		t.Fatalf("failed to write EIF: %v", err)
+	}
+
+	pcrs, err := MeasureEIF(path)
+	if err != nil {
+		t.Fatalf("failed to measure EIF: %v", err)
+	}
+	expected := map[uint][]byte{
+		0: expectedPCR(kernel, cmdline, bootstrap, app),
+		1: expectedPCR(kernel, cmdline, bootstrap),
+		2: expectedPCR(app),
+	}
+	for index, value := range expected {
+		if !bytes.Equal(pcrs[index], value) {
+			t.Fatalf("expected PCR %d to be %x but got %x", index, value, pcrs[index])
+		}
+	}
+
+	// Corrupt or truncated files must be rejected.
+	if _, err := measureEIF(bytes.NewReader([]byte("not an EIF"))); err == nil {
+		t.Fatal("expected error when measuring a short file")
+	}
+	bad := append([]byte{}, raw...)
+	copy(bad, "abcd")
+	if _, err := measureEIF(bytes.NewReader(bad)); err == nil {
+		t.Fatal("expected error when measuring a file with a bad magic value")
+	}
+	if _, err := measureEIF(bytes.NewReader(raw[:len(raw)-20])); err == nil {
+		t.Fatal("expected error when measuring a truncated EIF")
+	}
+}
@@ -2,9 +2,9 @@ package enclaveutils
 
 import (
 	"context"
-	"crypto/ecdsa"
-	"crypto/elliptic"
+	"crypto"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
@@ -12,56 +12,606 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"math/big"
 	"net"
 	"net/http"
+	"net/mail"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/mdlayher/vsock"
+	"github.com/prometheus/client_golang/prometheus"
 
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
 
 const (
-	acmeCertCacheDir    = "cert-cache"
-	certificateOrg      = "Brave Software"
-	certificateValidity = time.Hour * 24 * 356
+	acmeCertCacheDir = "cert-cache"
+	certificateOrg   = "Brave Software"
+	// defaultCertValidity is the validity period of self-signed
+	// certificates, unless configured otherwise.
+	defaultCertValidity = time.Hour * 24 * 356
+	// defaultACMEPort is the vsock port of the HTTP-01 challenge listener,
+	// unless configured otherwise.
+	defaultACMEPort = 80
+	// defaultMaxPEMBlocks is the number of PEM blocks in a certificate bundle
+	// that we parse before giving up, unless configured otherwise.
+	defaultMaxPEMBlocks = 100
+	// The defaults of the Web server's timeouts, unless configured
+	// otherwise.  They are generous enough for attestation requests and
+	// typical API calls, but keep slow clients from holding on to
+	// connections indefinitely.
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 30 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
 )
 
+// marshalPrivateKey encodes the private keys of self-signed certificates.
+// Tests override this variable to simulate failures.
+var marshalPrivateKey = x509.MarshalPKCS8PrivateKey
+
+// defaultAllowedMethods contains the HTTP methods that AddRoute accepts
+// unless configured otherwise.  CONNECT and TRACE are missing on purpose
+// because they are rarely needed and widen the attack surface.
+var defaultAllowedMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodOptions,
+}
+
 // Enclave represents a service running inside an AWS Nitro Enclave.
 type Enclave struct {
 	cfg     *Config
 	httpSrv http.Server
 	router  *chi.Mux
+	// fprLock protects certFpr and attCertFpr, which the ACME goroutines
+	// set.
+	fprLock sync.RWMutex
 	certFpr [sha256.Size]byte
+	// attCertFpr is the fingerprint of the certificate for
+	// Config.AttestationFQDN, if configured.
+	attCertFpr [sha256.Size]byte
+	binHash    []byte
+	mws        []func(http.Handler) http.Handler
+	sysMws     []func(http.Handler) http.Handler
+	attMws     []func(http.Handler) http.Handler
+	routes     map[string]bool
+	tlsKey     crypto.Signer
+	// verifyOpts determines how the enclave verifies its own attestation
+	// documents.  Tests replace the roots.
+	verifyOpts VerifyOptions
+	// attester and pcrs abstract the NSM.  Tests replace them with fakes.
+	attester attester
+	pcrs     pcrDevice
+	watchers pcrWatchers
+	sessions sessionStore
+	keys     keyStore
+	attKey   attestationKey
+	// nonceFormat determines which nonces the attestation endpoints accept.
+	nonceFormat *nonceFormat
+	logger      Logger
+	metrics     Metrics
+	// metricsErr is set if the enclave failed to set up its Prometheus
+	// metrics, which makes Start fail.
+	metricsErr error
+	// ready is set to 1 once the enclave produced a valid attestation
+	// document, and back to 0 if a periodic self-check fails to obtain one.
+	ready uint32
+	// lastReadinessAttempt is the time, in nanoseconds since the epoch, at
+	// which the readiness endpoint last tried to obtain an attestation
+	// document; see readinessRetryInterval.
+	lastReadinessAttempt int64
+	// readinessChecks contains the checks that were added via
+	// AddReadinessCheck.
+	readinessLock   sync.Mutex
+	readinessChecks []readinessCheck
+	// selfCheckFailed is set to 1 once a periodic self-check obtained a
+	// document that doesn't verify, which permanently marks the enclave as
+	// not ready.
+	selfCheckFailed uint32
+	// counter is the number of attestation requests so far; see
+	// Config.CounterInUserData.
+	counter uint64
+	// bgErr is the last error that a background goroutine encountered.
+	bgErrLock sync.Mutex
+	bgErr     error
+	// done is closed by Close, which stops our background goroutines.
+	done      chan struct{}
+	closeOnce sync.Once
+	// acmeSrv serves the HTTP-01 challenge, if we use ACME.
+	acmeSrvLock sync.Mutex
+	acmeSrv     *http.Server
+	// resolver is used by the ACME pre-flight check.  Tests replace it.
+	resolver hostResolver
 }
 
 // Config represents the configuration of our enclave service.
 type Config struct {
+	// SOCKSProxy is the URL of the proxy on the parent EC2 instance, e.g.,
+	// socks5://127.0.0.1:1080, through which the enclave makes outbound
+	// requests, e.g., to its ACME CA.  The enclave doesn't modify the
+	// process's environment, so applications should make their own outbound
+	// requests via the client that HTTPClient returns.
 	SOCKSProxy string
 	FQDN       string
 	Port       int
 	UseACME    bool
 	Debug      bool
+
+	// BinaryHashPCR, if non-zero, makes Start extend the PCR at the given
+	// index with the SHA-384 hash of the running binary.  Note that PCRs 0 to
+	// 15 are reserved, so the index should be in the range 16 to 31.
+	BinaryHashPCR uint16
+	// BinaryHashInUserData makes the attestation endpoint append the SHA-384
+	// hash of the running binary to the certificate's fingerprint in the
+	// attestation document's user data.
+	BinaryHashInUserData bool
+
+	// SystemPrefix, if set, makes the enclave mount its built-in endpoints
+	// (e.g., /attestation) under the given prefix (e.g., /system), keeping
+	// them separate from application routes.
+	SystemPrefix string
+
+	// EchoNonce makes the attestation endpoint set the X-Attestation-Nonce
+	// response header to the nonce that the client provided, which makes it
+	// easy for clients to correlate responses with requests.
+	EchoNonce bool
+
+	// RootResponse, if set, determines the response to requests for "/".  If
+	// unset, such requests result in a 404.
+	RootResponse *RootResponse
+
+	// EnableCompactProof registers the /attestation/compact endpoint, which
+	// returns a CompactProof for constrained clients.  Note that compact
+	// proofs come with a weaker trust model than attestation documents; see
+	// CompactProof for details.  Compact proofs are signed with the key of
+	// our self-signed certificate and are therefore unavailable with ACME.
+	EnableCompactProof bool
+
+	// ContextID, if non-zero, makes the enclave's listeners bind to the given
+	// vsock context ID instead of the enclave's local context ID.  This
+	// matters if multiple services share the vsock namespace.  The reserved
+	// context IDs 1 (local) and 2 (host) are rejected.
+	ContextID uint32
+
+	// LoopbackAddrs are the addresses in CIDR notation that Start assigns
+	// to the loopback interface.  If unset, Start assigns 127.0.0.1/8.  Add
+	// "::1/128" for services that bind to the IPv6 loopback address.
+	// LoopbackMTU, if non-zero, is the MTU that Start sets for the loopback
+	// interface.  Configuring the interface requires CAP_NET_ADMIN.  See
+	// ConfigureLoopback.
+	LoopbackAddrs []string
+	LoopbackMTU   int
+
+	// SkipNSMPreflight makes Start skip its check that the NSM device is
+	// present and produces attestation documents.  The check makes a broken
+	// enclave fail at startup instead of serving a broken attestation
+	// endpoint, so only set this for local development with TransportTCP,
+	// where there's no NSM device.
+	SkipNSMPreflight bool
+
+	// ACMEPort is the vsock port on which the enclave serves the ACME
+	// HTTP-01 challenge, which the host must forward port 80 to.  It
+	// defaults to 80, and must differ from Port.
+	ACMEPort int
+
+	// KeyType determines the key algorithm of self-signed certificates.  It
+	// defaults to KeyECDSAP256.  Use an RSA key type for clients and
+	// middleboxes that don't support ECDSA.
+	KeyType KeyType
+
+	// Transport determines whether the enclave listens on vsock, which is
+	// the default, or on TCP.  TransportTCP lets the enclave's code run
+	// outside an enclave, e.g., on a developer's machine or in CI.  In this
+	// mode, Start skips the enclave-specific bootstrap steps, ContextID is
+	// ignored, and the attestation endpoint responds with 501 if there's no
+	// NSM device.
+	Transport Transport
+
+	// EnableSessions registers the /attestation/session endpoint, which
+	// returns a Session whose HMAC key is bound to the attestation document.
+	// Clients use the key to authenticate requests to routes that are
+	// protected by RequireSession, without re-attesting the enclave.
+	EnableSessions bool
+	// SessionLifetime determines how long session keys remain valid.  If
+	// unset, session keys expire after one hour.
+	SessionLifetime time.Duration
+
+	// Logger, if set, receives the enclave's log messages instead of the
+	// standard library's log package.  Use NewJSONLogger for machine-parseable
+	// output.  Note that log messages are only emitted if Debug is set.
+	Logger Logger
+
+	// EnableReadiness registers the /readyz and /healthz endpoints.  /readyz
+	// only returns 200 once the enclave's certificate is provisioned, the
+	// enclave has obtained and verified its own attestation document, and
+	// the checks that were added via AddReadinessCheck pass.  Until then,
+	// it returns 503.  Either way, the JSON body contains the status of each
+	// check; see ReadinessStatus.  This catches NSM problems and slow ACME
+	// provisioning before the enclave receives traffic.  /healthz always
+	// returns 200, which tells orchestrators that the enclave is serving.
+	EnableReadiness bool
+
+	// AttestationToken, if set, makes the attestation endpoints require the
+	// given token in the request's Authorization header, i.e.,
+	// "Authorization: Bearer <token>".  Requests without the token result in
+	// a 401.  This is useful if the enclave is behind a gateway that injects
+	// the token.
+	AttestationToken string
+
+	// AttestationAuthorizer, if set, is called before the attestation
+	// endpoints generate a document, with the vsock context ID of the
+	// requesting peer; see PeerCID.  If it returns an error, the request
+	// fails with AttestationDeniedStatus, which defaults to 403.  This lets
+	// deployments restrict the NSM-backed endpoints to specific host
+	// agents.  Requests whose peer CID cannot be determined, e.g., because
+	// they didn't arrive over vsock, are denied without calling the
+	// authorizer.
+	AttestationAuthorizer   func(peerCID uint32, r *http.Request) error
+	AttestationDeniedStatus int
+
+	// AttestationPublicKey, if set, is bound to the public_key field of
+	// the enclave's attestation documents, so clients can set up an
+	// encrypted channel that is bound to the attestation, e.g., with a key
+	// that the application obtained from KMS.  Alternatively,
+	// GenerateAttestationKey makes the enclave generate a long-term X25519
+	// key pair, whose public value is bound instead; see PublicKey and
+	// DeriveAttestationKey.  Key exchanges that were prepared with
+	// PrepareKeyExchange take precedence for the requests that refer to
+	// them.  Either way, the user data still starts with the fingerprint of
+	// the enclave's certificate: the fingerprint binds the TLS session to
+	// the enclave, while the public key lets clients encrypt to the enclave
+	// regardless of who terminates TLS.
+	AttestationPublicKey   []byte
+	GenerateAttestationKey bool
+
+	// AttestationRateLimit, if set, limits the rate of requests to the
+	// attestation endpoints, which are expensive because each document
+	// takes a round trip to the NSM.  Requests that exceed the limit get a
+	// 429 and a Retry-After header.  AttestationRateLimiter, if set,
+	// replaces the built-in token bucket limiter, e.g., with one that
+	// distinguishes clients by an API key.  Rate limiting applies after the
+	// bearer token and AttestationAuthorizer checks, so rejected requests
+	// don't take tokens.
+	AttestationRateLimit   *RateLimit
+	AttestationRateLimiter RateLimiter
+
+	// ACMEDNSSolver, if set, makes the enclave obtain its ACME certificates
+	// by solving the DNS-01 challenge instead of the HTTP-01 challenge,
+	// using the solver to publish the challenge's TXT records.  The enclave
+	// then doesn't listen on ACMEPort, which suits enclaves that can't be
+	// reached from the Internet, and FQDN may be a wildcard name like
+	// "*.example.com".  The enclave renews its certificates 30 days before
+	// they expire.  See NewVsockDNSSolver for a solver that forwards the
+	// records to the parent EC2 instance.
+	ACMEDNSSolver DNSSolver
+
+	// Tracer, if set, makes the enclave record a span for each request to
+	// the /attestation endpoint, continuing the trace that the request's
+	// headers carry.  The spans have the attributes AttrNonceLength,
+	// AttrNSMLatency, AttrResult, and AttrStatusCode.  Use
+	// enclaveotel.NewTracer to export the spans via OpenTelemetry.
+	Tracer Tracer
+
+	// EnableVersion registers the /version endpoint, which returns the
+	// versions of this package, of Go, and of the application in JSON.
+	EnableVersion bool
+	// AppMetadata, if set, is included in the response of the /version
+	// endpoint.
+	AppMetadata *AppMetadata
+
+	// MaxPEMBlocks limits the number of PEM blocks that the enclave parses
+	// when looking for its certificate in a certificate bundle, which bounds
+	// the work that a pathological bundle causes.  If unset, the limit is
+	// 100.
+	MaxPEMBlocks int
+
+	// Metrics, if set, receives the enclave's metrics.  See the Metric*
+	// constants for the metrics that the enclave records.
+	Metrics Metrics
+	// MetricsEnabled exposes the enclave's metrics in Prometheus's
+	// exposition format on the system route /metrics.  Unless Metrics is
+	// set, the enclave records its metrics in a new PrometheusMetrics, whose
+	// collectors are registered on MetricsRegisterer, or on a private
+	// registry if MetricsRegisterer is unset.  Applications set
+	// MetricsRegisterer to share a registry with the enclave; to be served,
+	// it must also implement prometheus.Gatherer, which *prometheus.Registry
+	// does.  If Metrics is set, it must implement http.Handler, which serves
+	// the metrics.
+	MetricsEnabled    bool
+	MetricsRegisterer prometheus.Registerer
+
+	// NSMWorkers, if non-zero, makes the enclave obtain attestation
+	// documents via a pool of the given number of workers, which caps the
+	// number of concurrent NSM requests.  Requests that don't obtain a
+	// document within NSMTimeout (ten seconds if unset) fail with a 503.
+	NSMWorkers int
+	NSMTimeout time.Duration
+
+	// AttestationCacheTTL, if positive, makes the enclave reuse attestation
+	// documents for requests with the same nonce, user data, and public key
+	// that arrive within the given duration, which spares the NSM from
+	// clients that retry rapidly.  Cached documents are as old as the TTL,
+	// so it should be a few seconds at most.  The cache holds up to
+	// AttestationCacheSize documents (1024 if unset) and evicts the oldest
+	// ones once it's full.  Caching is disabled by default.
+	AttestationCacheTTL  time.Duration
+	AttestationCacheSize int
+
+	// ReadHeaderTimeout, ReadTimeout, WriteTimeout, and IdleTimeout are the
+	// timeouts of the enclave's Web servers; see http.Server for their
+	// meaning.  Unset timeouts default to 10 seconds for reading request
+	// headers, 30 seconds for reading requests and writing responses, and
+	// two minutes for idle keep-alive connections.  Negative timeouts
+	// disable the respective timeout, e.g., for routes that stream
+	// responses.  Without timeouts, slow clients can exhaust the enclave's
+	// connections.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// EnableHTTP2 makes the enclave's Web server offer HTTP/2 in addition to
+	// HTTP/1.1 via TLS's ALPN extension, which some clients (e.g., gRPC)
+	// require.  If unset, the Web server only speaks HTTP/1.1.
+	EnableHTTP2 bool
+
+	// AllowedMethods restricts the HTTP methods that AddRoute accepts.  If
+	// unset, all methods except CONNECT and TRACE are allowed.
+	AllowedMethods []string
+
+	// CounterInUserData makes the attestation endpoint append a counter to
+	// the enclave's user data, which increases with each attestation request.
+	// The counter is an 8-byte big-endian integer that precedes any user data
+	// that the client provides.  Clients use CounterVerifier to detect
+	// replayed documents.
+	CounterInUserData bool
+
+	// MinNonceDistinctBytes, if non-zero, makes the attestation endpoints
+	// reject nonces that consist of fewer distinct bytes than the given
+	// number, e.g., all-zero nonces.  Nonces are 20 bytes long, and random
+	// nonces almost always have at least 14 distinct bytes, so values up to
+	// 10 are safe.
+	MinNonceDistinctBytes int
+
+	// AttestationFQDN, if set, makes the enclave provision a second
+	// certificate for the given FQDN, which it serves to clients that ask for
+	// the FQDN via SNI.  Clients that use this FQDN get attestation
+	// documents that contain the fingerprint of the second certificate
+	// instead of the first.
+	AttestationFQDN string
+
+	// EmptyUserData determines what happens if the enclave is about to
+	// request an attestation document that binds neither user data nor a
+	// public key.  DefaultUserData is used with DefaultEmptyUserData.
+	EmptyUserData   EmptyUserDataPolicy
+	DefaultUserData []byte
+
+	// ACMEPreflight makes the enclave check that its FQDNs resolve to
+	// publicly routable addresses before it requests certificates via ACME.
+	// If they don't, Start fails with a descriptive error instead of ACME
+	// failing later with an opaque one.  Note that the check requires DNS
+	// to work inside the enclave.
+	ACMEPreflight bool
+
+	// ACMEDirectoryURL is the directory of the ACME CA that the enclave
+	// obtains its certificates from, e.g., LetsEncryptStagingURL for tests,
+	// which avoids Let's Encrypt's production rate limits, or the directory
+	// of a private CA like step-ca.  If unset, the enclave uses Let's
+	// Encrypt's production directory.
+	ACMEDirectoryURL string
+
+	// ACMEEmail, if set, is the contact address of the enclave's ACME
+	// account, to which the CA sends notifications, e.g., about expiring
+	// certificates or problems with the account.
+	ACMEEmail string
+
+	// ACMEFallbackDirectoryURL and ACMEFallbackSelfSigned determine what
+	// the enclave does if the ACME CA refuses to issue a certificate
+	// because of rate limits, which Let's Encrypt does to enclaves that
+	// restart often.  With ACMEFallbackDirectoryURL (e.g.,
+	// LetsEncryptStagingURL), the enclave requests its certificates from
+	// the given ACME directory instead; with ACMEFallbackSelfSigned, it uses
+	// self-signed certificates.  Either way, the enclave keeps serving with
+	// degraded trust instead of failing TLS handshakes, and logs the switch
+	// as an error.  The two options are mutually exclusive.  By default,
+	// there is no fallback.
+	ACMEFallbackDirectoryURL string
+	ACMEFallbackSelfSigned   bool
+
+	// CertCacheProxy, if set, is the vsock address, of the form
+	// "<context ID>:<port>", of a key-value service on the host in which
+	// the enclave caches its ACME certificates across restarts.  The
+	// service speaks HTTP: GET /<name> returns the entry's body or 404, PUT
+	// /<name> stores the request body, and DELETE /<name> removes the
+	// entry.  Entries are encrypted with CertCacheKey, which must be 32
+	// bytes and the same across restarts, e.g., because the application
+	// obtains it from KMS, so the host can't read the certificates' private
+	// keys.  Certificates of ACMEFallbackDirectoryURL's CA are cached there,
+	// too, under names with the prefix "fallback/".
+	CertCacheProxy string
+	CertCacheKey   []byte
+
+	// ShutdownGracePeriod is how long Run lets in-flight requests finish
+	// after receiving SIGTERM or SIGINT before it forcibly closes their
+	// connections.  It defaults to ten seconds and is capped at five
+	// minutes.
+	ShutdownGracePeriod time.Duration
+
+	// LogClientHellos makes the enclave log the server name, supported TLS
+	// versions, and cipher suites of each incoming TLS ClientHello at debug
+	// level, which helps diagnose clients that fail to connect.
+	LogClientHellos bool
+
+	// InformationalAttestation makes the attestation endpoint answer GET
+	// requests without nonce with an attestation document that contains no
+	// nonce.  Such documents don't prove freshness, but they are useful for
+	// informational purposes, e.g., to display the enclave's PCRs.  These
+	// responses carry an ETag derived from the document's user data, and
+	// requests whose If-None-Match header matches the ETag get a 304.
+	InformationalAttestation bool
+
+	// MaxConnections, if non-zero, caps the number of concurrent
+	// connections to the enclave's Web server, which prevents connection
+	// floods from exhausting the enclave's memory.  Once the cap is reached,
+	// the enclave stops accepting connections until one closes, so excess
+	// connections wait in the listen backlog.  If RejectExcessConnections is
+	// set, the enclave instead accepts and immediately closes excess
+	// connections.
+	MaxConnections          int
+	RejectExcessConnections bool
+
+	// DisableAttestation stops the enclave from registering its attestation
+	// endpoint, e.g., because the application provides attestation through
+	// a different mechanism.  Requests to the endpoint's path are then
+	// handled like requests to any other unknown path, and the application
+	// is free to register its own route for the path.  Optional endpoints
+	// like the compact proof endpoint are unaffected.
+	DisableAttestation bool
+
+	// CertValidity is the validity period of the enclave's self-signed
+	// certificate.  If zero, it defaults to 356 days.  Start fails if it's
+	// negative.
+	CertValidity time.Duration
+
+	// OutboundTLSConfig, if set, is the TLS configuration of the client
+	// that HTTPClient returns, e.g., to set custom root certificates or a
+	// minimum TLS version.  OutboundPinnedCerts, if set, contains SHA-256
+	// fingerprints of certificates, one of which must be among the
+	// certificates that an upstream server presents.
+	OutboundTLSConfig   *tls.Config
+	OutboundPinnedCerts [][sha256.Size]byte
+
+	// SANs contains additional subject alternative names for the enclave's
+	// self-signed certificate, e.g., an internal name in addition to FQDN,
+	// which is always included.  SANs that are IP addresses are added as IP
+	// SANs.
+	SANs []string
+
+	// FingerprintFile and FingerprintSink, if set, receive the SHA-256
+	// fingerprint of the enclave's certificate in the given format as soon
+	// as the certificate is provisioned, including asynchronously via ACME,
+	// and again whenever the certificate changes.  This lets the host pin
+	// the certificate without parsing attestation documents.  The file is
+	// replaced atomically, whereas the sink, e.g., a vsock connection to the
+	// host, receives one line per fingerprint.
+	FingerprintFile   string
+	FingerprintSink   io.Writer
+	FingerprintFormat FingerprintFormat
+
+	// DocumentTransform, if set, is applied to each raw attestation document
+	// that the attestation endpoint returns, before the document is Base64
+	// encoded, e.g., to wrap the document in an application envelope or to
+	// add a detached signature.  Clients then receive the transform's output
+	// instead of the document, so they must undo the transform before they
+	// call Verify.  If the transform fails or returns no data, the endpoint
+	// responds with a 500.
+	DocumentTransform func(doc []byte) ([]byte, error)
+
+	// ExpectedPCRs, if set, contains the PCR values that the enclave's own
+	// attestation documents must contain for the readiness checks to pass.
+	// SelfCheckInterval, if non-zero, makes the enclave obtain and verify an
+	// attestation document at the given interval for as long as it runs.
+	// Once a document fails to verify, e.g., because a PCR changed
+	// unexpectedly, the readiness endpoint returns 503 for good, which
+	// detects tampering over the enclave's lifetime.  If the enclave fails to
+	// obtain a document, e.g., because the NSM is busy, the endpoint returns
+	// 503 until a later check succeeds.  Both options require
+	// EnableReadiness.
+	ExpectedPCRs      map[uint][]byte
+	SelfCheckInterval time.Duration
+
+	// MinNonceBytes and MaxNonceBytes determine the length of the nonces
+	// that the attestation endpoints accept, in bytes, i.e., half the number
+	// of hex digits.  Both default to 20.  Nonces must be between 8 and 512
+	// bytes long; Start fails if the configuration permits otherwise.
+	MinNonceBytes int
+	MaxNonceBytes int
+
+	// EnableCapabilities registers the /attestation/capabilities endpoint,
+	// which describes the enclave's attestation features in JSON; see
+	// Capabilities.  The endpoint requires no token.
+	EnableCapabilities bool
+}
+
+// RootResponse represents the response to requests for the root path "/",
+// e.g., a banner that identifies the service, or a redirect to its
+// documentation.
+type RootResponse struct {
+	// StatusCode defaults to 200 if unset.
+	StatusCode  int
+	ContentType string
+	Body        string
+	// Location, if set, is returned in the Location header, which is useful
+	// for redirects.
+	Location string
 }
 
 // NewEnclave creates and returns a new enclave with the given config.
+// NewEnclave doesn't validate the config; Start does.  Call Config.Validate
+// to detect invalid configs before that.
 func NewEnclave(cfg *Config) *Enclave {
 	r := chi.NewRouter()
 	e := &Enclave{
-		cfg:    cfg,
-		router: r,
+		cfg:      cfg,
+		router:   r,
+		routes:   make(map[string]bool),
+		logger:   stdLogger{},
+		metrics:  noopMetrics{},
+		pcrs:     nsmPCRDevice{},
+		done:     make(chan struct{}),
+		resolver: net.DefaultResolver,
+		verifyOpts: VerifyOptions{
+			ExpectedPCRs: cfg.ExpectedPCRs,
+		},
 		httpSrv: http.Server{
 			Addr:    fmt.Sprintf(":%d", cfg.Port),
 			Handler: r,
 		},
 	}
+	e.setTimeouts(&e.httpSrv)
+	e.nonceFormat = defaultNonceFormat
+	if min, max, err := cfg.nonceRange(); err == nil {
+		e.nonceFormat = newNonceFormat(2*min, 2*max)
+	}
+	if cfg.Logger != nil {
+		e.logger = cfg.Logger
+	}
+	e.attester = nsmAttester{logger: e.logger}
+	if cfg.Metrics != nil {
+		e.metrics = cfg.Metrics
+	} else if cfg.MetricsEnabled {
+		if m, err := NewPrometheusMetrics(cfg.MetricsRegisterer); err != nil {
+			e.metricsErr = fmt.Errorf("failed to register metrics: %w", err)
+		} else {
+			e.metrics = m
+		}
+	}
+	if cfg.NSMWorkers > 0 {
+		e.attester = newAttesterPool(e.attester, cfg.NSMWorkers, cfg.NSMTimeout, e.done)
+	}
+	if cfg.AttestationCacheTTL > 0 {
+		e.attester = newDocCache(e.attester, cfg.AttestationCacheTTL, cfg.AttestationCacheSize)
+	}
 	if cfg.Debug {
-		e.router.Use(middleware.Logger)
+		if cfg.Logger != nil {
+			e.router.Use(middleware.RequestLogger(&middleware.DefaultLogFormatter{
+				Logger:  requestLogger{cfg.Logger},
+				NoColor: true,
+			}))
+		} else {
+			e.router.Use(middleware.Logger)
+		}
 	}
 
 	return e
@@ -71,16 +621,84 @@ func NewEnclave(cfg *Config) *Enclave {
 // won't return because it starts an HTTPS server.  If something goes wrong,
 // the function returns an error.
 func (e *Enclave) Start() error {
+	return e.StartContext(context.Background())
+}
+
+// StartContext works like Start, but also shuts down the enclave once the
+// given context is done.  The shutdown is graceful and drains in-flight
+// requests for up to Config.ShutdownGracePeriod, just like Run does upon
+// receiving a signal.  StartContext then returns nil if all requests
+// finished in time, and an error otherwise.
+func (e *Enclave) StartContext(ctx context.Context) error {
+	if ctx.Done() == nil {
+		return e.start()
+	}
+
+	started := make(chan struct{})
+	stopErr := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stopErr <- e.shutdown(fmt.Sprintf("Context done (%v)", ctx.Err()))
+		case <-started:
+			stopErr <- nil
+		}
+	}()
+
+	err := e.start()
+	close(started)
+	shutdownErr := <-stopErr
+	if ctx.Err() != nil && (err == nil || errors.Is(err, http.ErrServerClosed)) {
+		return shutdownErr
+	}
+	return err
+}
+
+// start implements Start.
+func (e *Enclave) start() error {
 	var err error
 	errPrefix := "failed to start Nitro Enclave"
-	if err = seedEntropyPool(); err != nil {
-		return fmt.Errorf("%s: %v", errPrefix, err)
+	if err = e.cfg.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", errPrefix, err)
+	}
+	if e.cfg.Transport == TransportTCP {
+		// Outside an enclave, the system takes care of entropy and the
+		// loopback interface.
+		e.logError("Listening on TCP instead of vsock.  This is meant for local development only.")
+	} else {
+		if err = SeedEntropyPool(); err != nil {
+			return fmt.Errorf("%s: %w", errPrefix, err)
+		}
+		e.log("Seeded system entropy pool.")
+		if err = ConfigureLoopback(e.cfg.loopbackAddrs(), e.cfg.LoopbackMTU); err != nil {
+			return fmt.Errorf("%s: %w", errPrefix, err)
+		}
+		e.log("Configured lo interface.")
+	}
+
+	if !e.cfg.SkipNSMPreflight {
+		if err = e.checkNSMPreflight(); err != nil {
+			return fmt.Errorf("%s: %w", errPrefix, err)
+		}
+		e.log("NSM pre-flight check succeeded.")
+	}
+
+	// Measure the running binary if requested.
+	if e.cfg.BinaryHashPCR != 0 || e.cfg.BinaryHashInUserData {
+		if e.binHash, err = MeasureBinary(); err != nil {
+			return fmt.Errorf("%s: %w", errPrefix, err)
+		}
+		e.log("Measured running binary: %x", e.binHash)
 	}
-	e.log("Seeded system entropy pool.")
-	if err = assignLoAddr(); err != nil {
-		return fmt.Errorf("%s: %v", errPrefix, err)
+	if e.cfg.BinaryHashPCR != 0 {
+		if _, err = e.ExtendPCR(e.cfg.BinaryHashPCR, e.binHash); err != nil {
+			return fmt.Errorf("%s: %w", errPrefix, err)
+		}
+		e.log("Extended PCR %d with hash of running binary.", e.cfg.BinaryHashPCR)
+	}
+	if e.cfg.Debug {
+		e.logImagePCRs()
 	}
-	e.log("Assigned address to lo interface.")
 
 	// Get an HTTPS certificate.
 	if e.cfg.UseACME {
@@ -89,25 +707,35 @@ func (e *Enclave) Start() error {
 		err = e.genSelfSignedCert()
 	}
 	if err != nil {
-		return fmt.Errorf("%s: %v", errPrefix, err)
+		return fmt.Errorf("%s: %w", errPrefix, err)
 	}
-	e.router.Get("/attestation", getAttestationHandler(e.certFpr))
-
-	// Tell Go's HTTP library to use SOCKS proxy for both HTTP and HTTPS.
-	if err := os.Setenv("HTTP_PROXY", e.cfg.SOCKSProxy); err != nil {
-		return fmt.Errorf("%s: %v", errPrefix, err)
+	e.setNextProtos()
+	if e.cfg.LogClientHellos {
+		e.httpSrv.TLSConfig.GetConfigForClient = e.logClientHello
+	}
+	if err = e.registerSystemRoutes(); err != nil {
+		return fmt.Errorf("%s: %w", errPrefix, err)
 	}
-	if err := os.Setenv("HTTPS_PROXY", e.cfg.SOCKSProxy); err != nil {
-		return fmt.Errorf("%s: %v", errPrefix, err)
+	e.httpSrv.Handler = e.handler()
+	if e.cfg.EnableReadiness {
+		if err = e.selfAttest(); err != nil {
+			e.log("Initial self-attestation failed: %v", err)
+		} else {
+			e.log("Initial self-attestation succeeded.")
+		}
+		if e.cfg.SelfCheckInterval > 0 {
+			go e.runSelfChecks(e.cfg.SelfCheckInterval)
+		}
 	}
 
 	// Finally, start the Web server, using a vsock-enabled listener.
 	e.log("Starting Web server on port %s.", e.httpSrv.Addr)
 	var l net.Listener
-	l, err = vsock.Listen(uint32(e.cfg.Port))
+	l, err = e.listen(uint32(e.cfg.Port))
 	if err != nil {
-		return fmt.Errorf("%s: %v", errPrefix, err)
+		return fmt.Errorf("%s: %w", errPrefix, err)
 	}
+	l = e.limitConnections(l)
 	defer func() {
 		_ = l.Close()
 	}()
@@ -115,26 +743,323 @@ func (e *Enclave) Start() error {
 	return e.httpSrv.ServeTLS(l, "", "")
 }
 
+// registerSystemRoutes registers the enclave's built-in endpoints.  If the
+// configuration contains a system prefix, the endpoints are mounted on a
+// sub-router under the given prefix.  Either way, the endpoints use the
+// middlewares that were set via UseOnSystem.
+func (e *Enclave) registerSystemRoutes() error {
+	var r chi.Router
+	prefix := strings.TrimSuffix(e.cfg.SystemPrefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("system prefix %q must start with a slash", prefix)
+	}
+	if !e.cfg.DisableAttestation {
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			if err := e.claimRoute(method, prefix+"/attestation"); err != nil {
+				return err
+			}
+		}
+	}
+	if e.cfg.EnableCompactProof {
+		if err := e.claimRoute(http.MethodGet, prefix+"/attestation/compact"); err != nil {
+			return err
+		}
+	}
+	if e.cfg.EnableReadiness {
+		if err := e.claimRoute(http.MethodGet, prefix+"/readyz"); err != nil {
+			return err
+		}
+		if err := e.claimRoute(http.MethodGet, prefix+"/healthz"); err != nil {
+			return err
+		}
+	}
+	if e.cfg.EnableVersion {
+		if err := e.claimRoute(http.MethodGet, prefix+"/version"); err != nil {
+			return err
+		}
+	}
+	if e.cfg.EnableCapabilities {
+		if err := e.claimRoute(http.MethodGet, prefix+"/attestation/capabilities"); err != nil {
+			return err
+		}
+	}
+	if e.cfg.EnableSessions {
+		if err := e.claimRoute(http.MethodGet, prefix+"/attestation/session"); err != nil {
+			return err
+		}
+	}
+	var metricsHandler http.Handler
+	if e.cfg.MetricsEnabled {
+		if e.metricsErr != nil {
+			return e.metricsErr
+		}
+		var ok bool
+		if metricsHandler, ok = e.metrics.(http.Handler); !ok {
+			return errors.New("metrics must implement http.Handler to be served")
+		}
+		if m, ok := e.metrics.(*PrometheusMetrics); ok && m.gatherer == nil {
+			return errors.New(errMetricsNotGatherable)
+		}
+		if err := e.claimRoute(http.MethodGet, prefix+"/metrics"); err != nil {
+			return err
+		}
+	}
+
+	if prefix != "" {
+		sub := chi.NewRouter()
+		sub.Use(e.sysMws...)
+		e.router.Mount(prefix, sub)
+		r = sub
+	} else {
+		r = e.router.With(e.sysMws...)
+	}
+
+	if e.cfg.EnableReadiness {
+		r.Get("/readyz", e.getReadinessHandler())
+		r.Get("/healthz", e.getLivenessHandler())
+	}
+	if e.cfg.EnableVersion {
+		r.Get("/version", e.getVersionHandler())
+	}
+	if e.cfg.EnableCapabilities {
+		r.Get("/attestation/capabilities", e.getCapabilitiesHandler())
+	}
+	if metricsHandler != nil {
+		r.Method(http.MethodGet, "/metrics", metricsHandler)
+	}
+	r.Group(func(r chi.Router) {
+		if e.cfg.AttestationToken != "" {
+			r.Use(requireBearerToken(e.cfg.AttestationToken))
+		}
+		if e.cfg.AttestationAuthorizer != nil {
+			r.Use(e.authorizePeer)
+		}
+		if limiter := e.rateLimiter(); limiter != nil {
+			r.Use(limitRate(limiter))
+		}
+		r.Use(e.attMws...)
+		if !e.cfg.DisableAttestation {
+			attestationHandler := e.traceAttestation(e.getAttestationHandler())
+			r.Get("/attestation", attestationHandler)
+			r.Post("/attestation", attestationHandler)
+		}
+		if e.cfg.EnableCompactProof {
+			r.Get("/attestation/compact", e.getCompactProofHandler())
+		}
+		if e.cfg.EnableSessions {
+			r.Get("/attestation/session", e.getSessionHandler())
+		}
+	})
+
+	if e.cfg.RootResponse != nil {
+		if err := e.claimRoute(http.MethodGet, "/"); err != nil {
+			return err
+		}
+		e.router.Get("/", getRootHandler(e.cfg.RootResponse))
+	}
+	return nil
+}
+
+// getRootHandler returns a HandlerFunc that responds with the given response.
+func getRootHandler(resp *RootResponse) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if resp.ContentType != "" {
+			w.Header().Set("Content-Type", resp.ContentType)
+		}
+		if resp.Location != "" {
+			w.Header().Set("Location", resp.Location)
+		}
+		statusCode := resp.StatusCode
+		if statusCode == 0 {
+			statusCode = http.StatusOK
+		}
+		w.WriteHeader(statusCode)
+		fmt.Fprint(w, resp.Body)
+	}
+}
+
+// claimRoute records that the given method and pattern are taken, and returns
+// an error if they were taken before.  Chi would otherwise silently replace
+// the existing handler, which can be confusing if an application route
+// collides with one of our built-in routes.
+func (e *Enclave) claimRoute(method, pattern string) error {
+	key := method + " " + pattern
+	if e.routes[key] {
+		return fmt.Errorf("route %s %s is already registered", method, pattern)
+	}
+	e.routes[key] = true
+	return nil
+}
+
+// Use adds middlewares that apply to all requests, i.e., to application
+// routes and the enclave's built-in endpoints alike, e.g., for CORS or rate
+// limiting.  They run before the router, so they also see requests that
+// don't match any route.  Unlike the Use method of chi's router, the function
+// may be called after routes were added, but it must be called before Start.
+func (e *Enclave) Use(middlewares ...func(http.Handler) http.Handler) {
+	e.mws = append(e.mws, middlewares...)
+}
+
+// handler returns the enclave's router, wrapped in the middlewares that were
+// added via Use.
+func (e *Enclave) handler() http.Handler {
+	if len(e.mws) == 0 {
+		return e.router
+	}
+	return chi.Chain(e.mws...).Handler(e.router)
+}
+
+// Router returns the router that serves the enclave's routes, which lets
+// applications compose middleware chains, route groups, and sub-routers that
+// AddRoute can't express.  The enclave registers its built-in endpoints on
+// the same router in Start.  Note that routes that are registered directly on
+// the router bypass AddRoute's checks, i.e., Config.AllowedMethods doesn't
+// apply to them, and collisions with built-in endpoints go unnoticed.  Also
+// note that chi's router panics if its Use method is called after routes were
+// added; Enclave.Use doesn't have this restriction.
+func (e *Enclave) Router() chi.Router {
+	return e.router
+}
+
+// UseOnSystem adds middlewares that only apply to the enclave's built-in
+// endpoints, and not to application routes.  The function must be called
+// before Start.
+func (e *Enclave) UseOnSystem(middlewares ...func(http.Handler) http.Handler) {
+	e.sysMws = append(e.sysMws, middlewares...)
+}
+
+// UseOnAttestation adds middlewares that only apply to the attestation
+// endpoints, e.g., to add authentication to these sensitive endpoints.  The
+// function must be called before Start.
+func (e *Enclave) UseOnAttestation(middlewares ...func(http.Handler) http.Handler) {
+	e.attMws = append(e.attMws, middlewares...)
+}
+
+// userData returns the user data that we embed in attestation documents.  It
+// consists of the SHA-256 fingerprint of our certificate, optionally followed
+// by the SHA-384 hash of the running binary.
+func (e *Enclave) userData() []byte {
+	e.fprLock.RLock()
+	fpr := e.certFpr
+	e.fprLock.RUnlock()
+	return e.userDataFor(fpr)
+}
+
+// userDataFor returns the user data for the certificate with the given
+// fingerprint.
+func (e *Enclave) userDataFor(fpr [sha256.Size]byte) []byte {
+	userData := append([]byte{}, fpr[:]...)
+	if e.cfg.BinaryHashInUserData {
+		userData = append(userData, e.binHash...)
+	}
+	return userData
+}
+
+// readyUserData returns the enclave's user data like userData does, or
+// ErrCertificateNotReady if the enclave uses ACME and its certificate isn't
+// fingerprinted yet.  With ACME, the certificate is provisioned in the
+// background, and documents without its fingerprint can't be bound to the
+// certificate that clients see.  If attestationFQDN is true, the user data
+// contains the fingerprint of the certificate for Config.AttestationFQDN
+// instead, which is provisioned separately.
+func (e *Enclave) readyUserData(attestationFQDN bool) ([]byte, error) {
+	e.fprLock.RLock()
+	fpr := e.certFpr
+	if attestationFQDN {
+		fpr = e.attCertFpr
+	}
+	e.fprLock.RUnlock()
+	if fpr == ([sha256.Size]byte{}) && e.cfg.UseACME {
+		return nil, ErrCertificateNotReady
+	}
+	return e.userDataFor(fpr), nil
+}
+
+// listen returns a listener for the given port.  A vsock listener is bound to
+// the configured context ID, or the enclave's local context ID if none is
+// configured.  With TransportTCP, the listener is a TCP listener on all
+// interfaces.
+func (e *Enclave) listen(port uint32) (net.Listener, error) {
+	if e.cfg.Transport == TransportTCP {
+		return listenTCP(port)
+	}
+	return listenVsock(e.cfg.ContextID, port)
+}
+
+// limitConnections applies the configured connection limit, if any, to the
+// given listener.
+func (e *Enclave) limitConnections(l net.Listener) net.Listener {
+	if e.cfg.MaxConnections <= 0 {
+		return l
+	}
+	return newLimitListener(l, e.cfg.MaxConnections, e.cfg.RejectExcessConnections, func() {
+		e.metrics.IncCounter(MetricRejectedConnections)
+	})
+}
+
 func (e *Enclave) log(format string, d ...interface{}) {
 	if e.cfg.Debug {
-		log.Printf(format, d...)
+		e.logger.Log(LevelInfo, fmt.Sprintf(format, d...))
 	}
 }
 
-// genSelfSignedCert creates and returns a self-signed TLS certificate based on
-// the given FQDN.  Some of the code below was taken from:
-// https://eli.thegreenplace.net/2021/go-https-servers-with-tls/
+// logError logs the given error message, regardless of whether debug mode is
+// enabled.
+func (e *Enclave) logError(format string, d ...interface{}) {
+	e.logger.Log(LevelError, fmt.Sprintf(format, d...))
+}
+
+// genSelfSignedCert creates a self-signed TLS certificate based on the
+// configured FQDN, and a second one for the attestation FQDN if configured.
 func (e *Enclave) genSelfSignedCert() error {
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert, privateKey, fpr, err := e.newSelfSignedCert(e.cfg.FQDN, e.cfg.SANs)
+	e.recordCertRotation(cert.Leaf, err)
 	if err != nil {
 		return err
 	}
+	e.setFingerprint(&e.certFpr, fpr)
+	e.log("Set SHA-256 fingerprint of server's certificate to: %x", fpr[:])
+
+	e.httpSrv.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	e.tlsKey = privateKey
+
+	if e.cfg.AttestationFQDN != "" {
+		attCert, _, attFpr, err := e.newSelfSignedCert(e.cfg.AttestationFQDN, nil)
+		e.recordCertRotation(attCert.Leaf, err)
+		if err != nil {
+			return err
+		}
+		e.setFingerprint(&e.attCertFpr, attFpr)
+		e.log("Set SHA-256 fingerprint of attestation certificate to: %x", attFpr[:])
+		e.httpSrv.TLSConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if strings.EqualFold(hello.ServerName, e.cfg.AttestationFQDN) {
+				return &attCert, nil
+			}
+			return &cert, nil
+		}
+	}
+
+	return nil
+}
+
+// newSelfSignedCert creates and returns a self-signed TLS certificate for the
+// given FQDN and additional subject alternative names, together with its
+// private key and SHA-256 fingerprint.  Some of the code below was taken from:
+// https://eli.thegreenplace.net/2021/go-https-servers-with-tls/
+func (e *Enclave) newSelfSignedCert(fqdn string, sans []string) (tls.Certificate, crypto.Signer, [sha256.Size]byte, error) {
+	var fpr [sha256.Size]byte
+	privateKey, err := generateKey(e.cfg.KeyType)
+	if err != nil {
+		return tls.Certificate{}, nil, fpr, err
+	}
 	e.log("Generated private key for self-signed certificate.")
 
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		return err
+		return tls.Certificate{}, nil, fpr, err
 	}
 	e.log("Generated serial number for self-signed certificate.")
 
@@ -143,136 +1068,459 @@ func (e *Enclave) genSelfSignedCert() error {
 		Subject: pkix.Name{
 			Organization: []string{certificateOrg},
 		},
-		DNSNames:              []string{e.cfg.FQDN},
 		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(certificateValidity),
+		NotAfter:              time.Now().Add(e.certValidity()),
 		KeyUsage:              x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 	}
+	if _, isRSA := privateKey.(*rsa.PrivateKey); isRSA {
+		// RSA keys may be used for key exchange in TLS 1.2.
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	template.DNSNames, template.IPAddresses = subjectAltNames(fqdn, sans)
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, privateKey.Public(), privateKey)
 	if err != nil {
-		return err
+		return tls.Certificate{}, nil, fpr, err
 	}
 	e.log("Created certificate from template.")
 
 	pemCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
 	if pemCert == nil {
-		return errors.New("failed to encode certificate to PEM")
+		return tls.Certificate{}, nil, fpr, errors.New("failed to encode certificate to PEM")
 	}
-	// Determine and set the certificate's fingerprint because we need to add
-	// the fingerprint to our Nitro attestation document.
-	if err := e.setCertFingerprint(pemCert); err != nil {
-		return err
+	// Determine the certificate's fingerprint because we need to add the
+	// fingerprint to our Nitro attestation document.
+	if fpr, err = e.certFingerprint(pemCert); err != nil {
+		return tls.Certificate{}, nil, fpr, err
 	}
 
-	privBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	privBytes, err := marshalPrivateKey(privateKey)
 	if err != nil {
-		log.Fatalf("Unable to marshal private key: %v", err)
+		return tls.Certificate{}, nil, fpr, fmt.Errorf("failed to marshal private key: %v", err)
 	}
 	pemKey := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes})
 	if pemKey == nil {
-		log.Fatal("Failed to encode key to PEM.")
+		return tls.Certificate{}, nil, fpr, errors.New("failed to encode key to PEM")
 	}
 
 	cert, err := tls.X509KeyPair(pemCert, pemKey)
 	if err != nil {
-		return err
+		return tls.Certificate{}, nil, fpr, err
 	}
-
-	e.httpSrv.TLSConfig = &tls.Config{
-		Certificates: []tls.Certificate{cert},
+	if cert.Leaf, err = x509.ParseCertificate(derBytes); err != nil {
+		return tls.Certificate{}, nil, fpr, err
 	}
-
-	return nil
+	return cert, privateKey, fpr, nil
 }
 
 // setupAcme attempts to retrieve an HTTPS certificate from Let's Encrypt for
-// the given FQDN.  Note that we are unable to cache certificates across
-// enclave restarts, so the enclave requests a new certificate each time it
-// starts.  If the restarts happen often, we may get blocked by Let's Encrypt's
-// rate limiter for a while.
+// the given FQDN.  The enclave's file system doesn't survive restarts, so
+// unless Config.CertCacheProxy is set, the enclave requests a new certificate
+// each time it starts.  If the restarts happen often, we may get blocked by
+// Let's Encrypt's rate limiter for a while.
 func (e *Enclave) setupAcme() error {
 	var err error
 
 	e.log("ACME hostname set to %s.", e.cfg.FQDN)
+	if e.cfg.ACMEPreflight {
+		for _, fqdn := range e.fqdns() {
+			if err = e.checkACMEPreflight(fqdn); err != nil {
+				return err
+			}
+		}
+	}
 	var cache autocert.Cache
-	if err = os.MkdirAll(acmeCertCacheDir, 0700); err != nil {
-		return fmt.Errorf("Failed to create cache directory: %v", err)
+	if e.cfg.CertCacheProxy != "" {
+		if cache, err = newVsockCache(e.cfg.CertCacheProxy, e.cfg.CertCacheKey); err != nil {
+			return fmt.Errorf("failed to set up certificate cache: %v", err)
+		}
+		e.log("Caching certificates on the host at %s.", e.cfg.CertCacheProxy)
+	} else {
+		if err = os.MkdirAll(acmeCertCacheDir, 0700); err != nil {
+			return fmt.Errorf("Failed to create cache directory: %v", err)
+		}
+		cache = autocert.DirCache(acmeCertCacheDir)
+	}
+	if e.cfg.ACMEDNSSolver != nil {
+		// The DNS-01 issuer sets our fingerprints itself, and there's no
+		// HTTP-01 listener.
+		e.log("Solving ACME's DNS-01 challenge.")
+		d := newDNS01Issuer(e, cache)
+		go d.run()
+		getCertificate := getCertificateFunc(d.getCertificate)
+		if e.cfg.ACMEFallbackDirectoryURL != "" || e.cfg.ACMEFallbackSelfSigned {
+			f := &acmeFallback{e: e, primary: getCertificate, cache: cache}
+			getCertificate = f.getCertificate
+		}
+		e.httpSrv.TLSConfig = &tls.Config{GetCertificate: getCertificate}
+		return nil
+	}
+
+	certManager := e.newCertManager(cache)
+	getCertificate, handler := getCertificateFunc(certManager.GetCertificate), certManager.HTTPHandler(nil)
+	if e.cfg.ACMEFallbackDirectoryURL != "" || e.cfg.ACMEFallbackSelfSigned {
+		f := &acmeFallback{e: e, primary: getCertificate, cache: cache}
+		getCertificate, handler = f.getCertificate, f.httpHandler(handler)
+	}
+	acmeSrv := &http.Server{Handler: handler}
+	e.setTimeouts(acmeSrv)
+	e.acmeSrvLock.Lock()
+	e.acmeSrv = acmeSrv
+	e.acmeSrvLock.Unlock()
+	go e.serveHTTP01(acmeSrv)
+	e.httpSrv.TLSConfig = &tls.Config{GetCertificate: getCertificate}
+
+	go e.waitForCachedCert(cache, e.cfg.FQDN, &e.certFpr)
+	if e.cfg.AttestationFQDN != "" {
+		go e.waitForCachedCert(cache, e.cfg.AttestationFQDN, &e.attCertFpr)
 	}
-	cache = autocert.DirCache(acmeCertCacheDir)
-	certManager := autocert.Manager{
+	return nil
+}
+
+// newCertManager returns the autocert manager that obtains our certificates
+// via the HTTP-01 challenge, and keeps them in the given cache.
+func (e *Enclave) newCertManager(cache autocert.Cache) *autocert.Manager {
+	return &autocert.Manager{
 		Cache:      cache,
 		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist([]string{e.cfg.FQDN}...),
+		HostPolicy: autocert.HostWhitelist(e.fqdns()...),
+		Client:     e.newACMEClient(e.acmeDirectoryURL()),
+		Email:      e.cfg.ACMEEmail,
 	}
-	go func() {
-		// Let's Encrypt's HTTP-01 challenge requires a listener on port 80:
-		// https://letsencrypt.org/docs/challenge-types/#http-01-challenge
-		l, err := vsock.Listen(uint32(80))
-		if err != nil {
-			log.Fatalf("Failed to listen for HTTP-01 challenge: %s", err)
+}
+
+// validateEmail returns an error if the given string isn't a bare email
+// address like "admin@example.com".
+func validateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return fmt.Errorf("%q is not a valid email address", email)
+	}
+	return nil
+}
+
+// acmeDirectoryURL returns the directory of the ACME CA that we obtain our
+// certificates from.
+func (e *Enclave) acmeDirectoryURL() string {
+	if e.cfg.ACMEDirectoryURL == "" {
+		return acme.LetsEncryptURL
+	}
+	return e.cfg.ACMEDirectoryURL
+}
+
+// acmePort returns the vsock port of the HTTP-01 challenge listener.
+func (e *Enclave) acmePort() int {
+	if e.cfg.ACMEPort == 0 {
+		return defaultACMEPort
+	}
+	return e.cfg.ACMEPort
+}
+
+// fqdns returns the FQDNs that we need certificates for.
+func (e *Enclave) fqdns() []string {
+	if e.cfg.AttestationFQDN != "" {
+		return []string{e.cfg.FQDN, e.cfg.AttestationFQDN}
+	}
+	return []string{e.cfg.FQDN}
+}
+
+// waitForCachedCert waits until the certificate for the given FQDN shows up
+// in the given cache, and then sets the given fingerprint to the
+// certificate's fingerprint.  The function blocks, so it's meant to run in a
+// goroutine.
+func (e *Enclave) waitForCachedCert(cache autocert.Cache, fqdn string, fpr *[sha256.Size]byte) {
+	// Wait until the HTTP-01 listener returned and then check if our new
+	// certificate is cached.
+	var rawData []byte
+	var err error
+	for {
+		// Get the SHA-1 hash over our leaf certificate.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		rawData, err = cache.Get(ctx, fqdn)
+		cancel()
+		if err == nil {
+			e.log("Got certificates from cache.  Proceeding with start.")
+			break
+		}
+		select {
+		case <-e.done:
+			return
+		case <-time.After(5 * time.Second):
 		}
-		defer func() {
-			_ = l.Close()
-		}()
+	}
+	cert, err := e.leafCert(rawData)
+	e.recordCertRotation(cert, err)
+	if err != nil {
+		e.setBackgroundError(fmt.Errorf("failed to set certificate fingerprint: %v", err))
+		return
+	}
+	certFpr := sha256.Sum256(cert.Raw)
+	e.setFingerprint(fpr, certFpr)
+	e.log("Set SHA-256 fingerprint of %s's certificate to: %x", fqdn, certFpr[:])
+}
 
-		e.log("Starting autocert listener.")
-		_ = http.Serve(l, certManager.HTTPHandler(nil))
+// serveHTTP01 runs the given server on port 80, for Let's Encrypt's HTTP-01
+// challenge:
+// https://letsencrypt.org/docs/challenge-types/#http-01-challenge
+// The function blocks, so it's meant to run in a goroutine.  Errors are
+// reported via setBackgroundError.
+func (e *Enclave) serveHTTP01(srv *http.Server) {
+	l, err := e.listen(uint32(e.acmePort()))
+	if err != nil {
+		e.setBackgroundError(fmt.Errorf("failed to listen for HTTP-01 challenge: %v", err))
+		return
+	}
+	defer func() {
+		_ = l.Close()
 	}()
-	e.httpSrv.TLSConfig = &tls.Config{GetCertificate: certManager.GetCertificate}
 
-	go func() {
-		// Wait until the HTTP-01 listener returned and then check if our new
-		// certificate is cached.
-		var rawData []byte
-		for {
-			// Get the SHA-1 hash over our leaf certificate.
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
-			defer cancel()
-			rawData, err = cache.Get(ctx, e.cfg.FQDN)
-			if err != nil {
-				time.Sleep(5 * time.Second)
-			} else {
-				e.log("Got certificates from cache.  Proceeding with start.")
-				break
-			}
+	e.log("Starting autocert listener.")
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		e.setBackgroundError(fmt.Errorf("autocert listener failed: %v", err))
+	}
+}
+
+// Close tears down whatever the enclave set up, regardless of whether Start
+// succeeded, failed partway, or was never called: it stops the Web server,
+// the ACME listener, and the enclave's background goroutines.  Close is safe
+// to call multiple times and concurrently with Start, which then returns
+// http.ErrServerClosed.  After Shutdown, Close closes the connections that
+// Shutdown left open.  A closed enclave cannot be restarted.
+func (e *Enclave) Close() error {
+	var err error
+	closed := true
+	e.closeOnce.Do(func() {
+		closed = false
+		e.stopBackground()
+		err = e.httpSrv.Close()
+	})
+	if closed {
+		// Shutdown may have left connections open.
+		return e.httpSrv.Close()
+	}
+	return err
+}
+
+// Shutdown gracefully shuts down the enclave: it stops the ACME listener and
+// the enclave's background goroutines, closes the Web server's listener, and
+// waits for in-flight requests to finish or for the given context to expire,
+// whichever comes first.  In the latter case, the context's error is
+// returned, and the caller may call Close to close the remaining
+// connections.  Like Close, Shutdown is safe to call if Start was never
+// called, and only the first call to either of them has an effect.
+func (e *Enclave) Shutdown(ctx context.Context) error {
+	var err error
+	e.closeOnce.Do(func() {
+		e.stopBackground()
+		if err = e.httpSrv.Shutdown(ctx); err != nil {
+			err = fmt.Errorf("failed to shut down Web server: %w", err)
 		}
-		e.setCertFingerprint(rawData)
-	}()
-	return nil
+	})
+	return err
+}
+
+// stopBackground stops the ACME listener and the enclave's background
+// goroutines, and closes the channels of PCR watchers.
+func (e *Enclave) stopBackground() {
+	close(e.done)
+	e.watchers.closeAll()
+	e.acmeSrvLock.Lock()
+	if e.acmeSrv != nil {
+		_ = e.acmeSrv.Close()
+	}
+	e.acmeSrvLock.Unlock()
+}
+
+// setBackgroundError logs and records the given error, which a background
+// goroutine encountered.
+func (e *Enclave) setBackgroundError(err error) {
+	e.logError("Background error: %v", err)
+	e.bgErrLock.Lock()
+	defer e.bgErrLock.Unlock()
+	e.bgErr = err
+}
+
+// LastBackgroundError returns the last error that one of the enclave's
+// background goroutines encountered (e.g., while provisioning an ACME
+// certificate), or nil if there was none.
+func (e *Enclave) LastBackgroundError() error {
+	e.bgErrLock.Lock()
+	defer e.bgErrLock.Unlock()
+	return e.bgErr
+}
+
+// subjectAltNames returns the DNS names and IP addresses of a certificate for
+// the given FQDN and additional subject alternative names.  SANs that are IP
+// addresses end up in the latter, and duplicates are removed.
+func subjectAltNames(fqdn string, sans []string) ([]string, []net.IP) {
+	dnsNames := []string{fqdn}
+	var ips []net.IP
+	seen := map[string]bool{strings.ToLower(fqdn): true}
+	for _, san := range sans {
+		if seen[strings.ToLower(san)] {
+			continue
+		}
+		seen[strings.ToLower(san)] = true
+		if ip := net.ParseIP(san); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			dnsNames = append(dnsNames, san)
+		}
+	}
+	return dnsNames, ips
+}
+
+// certValidity returns the validity period of self-signed certificates.
+func (e *Enclave) certValidity() time.Duration {
+	if e.cfg.CertValidity == 0 {
+		return defaultCertValidity
+	}
+	return e.cfg.CertValidity
+}
+
+// setTimeouts applies the configured timeouts, or their defaults, to the
+// given server.
+func (e *Enclave) setTimeouts(srv *http.Server) {
+	srv.ReadHeaderTimeout = timeout(e.cfg.ReadHeaderTimeout, defaultReadHeaderTimeout)
+	srv.ReadTimeout = timeout(e.cfg.ReadTimeout, defaultReadTimeout)
+	srv.WriteTimeout = timeout(e.cfg.WriteTimeout, defaultWriteTimeout)
+	srv.IdleTimeout = timeout(e.cfg.IdleTimeout, defaultIdleTimeout)
+}
+
+// setNextProtos sets the application protocols that the Web server offers
+// via ALPN, depending on whether HTTP/2 is enabled.
+func (e *Enclave) setNextProtos() {
+	if e.cfg.EnableHTTP2 {
+		e.httpSrv.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+		return
+	}
+	e.httpSrv.TLSConfig.NextProtos = []string{"http/1.1"}
+	// A non-nil, empty map disables net/http's built-in HTTP/2 support.
+	e.httpSrv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+}
+
+// timeout returns the given default if the configured timeout is unset, and
+// zero, i.e., no timeout, if the configured timeout is negative.
+func timeout(configured, def time.Duration) time.Duration {
+	switch {
+	case configured == 0:
+		return def
+	case configured < 0:
+		return 0
+	}
+	return configured
 }
 
-// setCertFingerprint takes as input a PEM-encoded certificate and extracts its
-// SHA-256 fingerprint.  We need the certificate's fingerprint because we embed
-// it in attestation documents, to bind the enclave's certificate to the
-// attestation document.
+// setFingerprint sets the given fingerprint field of the enclave to the given
+// value.  Changes of the certificate's fingerprint are published as
+// configured.
+func (e *Enclave) setFingerprint(field *[sha256.Size]byte, fpr [sha256.Size]byte) {
+	e.fprLock.Lock()
+	*field = fpr
+	e.fprLock.Unlock()
+	if field == &e.certFpr {
+		e.publishFingerprint(fpr)
+	}
+}
+
+// CertificateFingerprint returns the SHA-256 fingerprint of the enclave's
+// certificate, which the enclave embeds in its attestation documents.  The
+// boolean is false if the fingerprint isn't set yet, which is the case
+// before Start provisioned the certificate.  With ACME, the certificate is
+// provisioned in the background, so the fingerprint may be set some time
+// after Start began serving.
+func (e *Enclave) CertificateFingerprint() ([sha256.Size]byte, bool) {
+	e.fprLock.RLock()
+	defer e.fprLock.RUnlock()
+	return e.certFpr, e.certFpr != [sha256.Size]byte{}
+}
+
+// setCertFingerprint takes as input a PEM-encoded certificate and sets our
+// certificate fingerprint to its SHA-256 fingerprint.  We need the
+// certificate's fingerprint because we embed it in attestation documents, to
+// bind the enclave's certificate to the attestation document.
 func (e *Enclave) setCertFingerprint(rawData []byte) error {
-	rest := []byte{}
-	for rest != nil {
-		block, rest := pem.Decode(rawData)
+	fpr, err := e.certFingerprint(rawData)
+	if err != nil {
+		return err
+	}
+	e.setFingerprint(&e.certFpr, fpr)
+	e.log("Set SHA-256 fingerprint of server's certificate to: %x", fpr[:])
+	return nil
+}
+
+// certFingerprint takes as input a PEM-encoded certificate bundle and returns
+// the SHA-256 fingerprint of the first certificate that isn't a CA.
+func (e *Enclave) certFingerprint(rawData []byte) ([sha256.Size]byte, error) {
+	cert, err := e.leafCert(rawData)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(cert.Raw), nil
+}
+
+// leafCert takes as input a PEM-encoded certificate bundle and returns the
+// first certificate that isn't a CA.
+func (e *Enclave) leafCert(rawData []byte) (*x509.Certificate, error) {
+	maxBlocks := e.cfg.MaxPEMBlocks
+	if maxBlocks <= 0 {
+		maxBlocks = defaultMaxPEMBlocks
+	}
+	for i := 0; ; i++ {
+		if i == maxBlocks {
+			return nil, fmt.Errorf("certificate bundle exceeds maximum of %d PEM blocks", maxBlocks)
+		}
+		var block *pem.Block
+		block, rawData = pem.Decode(rawData)
 		if block == nil {
-			return errors.New("pem.Decode failed because it didn't find PEM data in the input we provided")
+			if i == 0 {
+				return nil, errors.New("pem.Decode failed because it didn't find PEM data in the input we provided")
+			}
+			return nil, errors.New("found no certificate that isn't a CA")
 		}
 		if block.Type == "CERTIFICATE" {
 			cert, err := x509.ParseCertificate(block.Bytes)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			if !cert.IsCA {
-				e.certFpr = sha256.Sum256(cert.Raw)
-				e.log("Set SHA-256 fingerprint of server's certificate to: %x", e.certFpr[:])
-				return nil
+				return cert, nil
 			}
 		}
-		rawData = rest
 	}
-	return nil
 }
 
-// AddRoute adds an HTTP handler for the given HTTP method and pattern.
-func (e *Enclave) AddRoute(method, pattern string, handlerFn http.HandlerFunc) {
+// recordCertRotation records metrics about the outcome of provisioning the
+// given certificate.
+func (e *Enclave) recordCertRotation(cert *x509.Certificate, err error) {
+	e.metrics.IncCounter(MetricCertRotationAttempts)
+	if err != nil {
+		e.metrics.IncCounter(MetricCertRotationFailures)
+		return
+	}
+	e.metrics.IncCounter(MetricCertRotationSuccesses)
+	e.metrics.SetGauge(MetricCertExpiry, float64(cert.NotAfter.Unix()))
+}
+
+// AddRoute adds an HTTP handler for the given HTTP method and pattern.  An
+// error is returned if a handler was already registered for the given method
+// and pattern, including our built-in routes.  Note that built-in routes are
+// registered in Start, so a collision with an application route that is added
+// before Start makes Start fail.  The method must be one of the http.Method*
+// constants; like in HTTP itself, methods are case-sensitive.
+func (e *Enclave) AddRoute(method, pattern string, handlerFn http.HandlerFunc) error {
+	if !isKnownMethod(method) {
+		return fmt.Errorf("unknown HTTP method %q (methods are case-sensitive)", method)
+	}
+	if !e.methodAllowed(method) {
+		return fmt.Errorf("HTTP method %s is not allowed", method)
+	}
+	if err := e.claimRoute(method, pattern); err != nil {
+		return err
+	}
+
 	switch method {
 	case http.MethodGet:
 		e.router.Get(pattern, handlerFn)
@@ -293,4 +1541,32 @@ func (e *Enclave) AddRoute(method, pattern string, handlerFn http.HandlerFunc) {
 	case http.MethodTrace:
 		e.router.Trace(pattern, handlerFn)
 	}
+	return nil
+}
+
+// isKnownMethod returns true if the given method is one of the standard HTTP
+// methods that AddRoute can register handlers for.
+func isKnownMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodConnect,
+		http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// methodAllowed returns true if AddRoute may register handlers for the given
+// HTTP method.
+func (e *Enclave) methodAllowed(method string) bool {
+	allowed := e.cfg.AllowedMethods
+	if allowed == nil {
+		allowed = defaultAllowedMethods
+	}
+	for _, m := range allowed {
+		if m == method {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,743 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func serve(e *Enclave, method, target string) *http.Response {
+	rec := httptest.NewRecorder()
+	e.router.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	return rec.Result()
+}
+
+func TestSystemPrefix(t *testing.T) {
+	e := NewEnclave(&Config{SystemPrefix: "/system"})
+	mwCalled := false
+	e.UseOnSystem(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mwCalled = true
+			next.ServeHTTP(w, r)
+		})
+	})
+	if err := e.AddRoute(http.MethodGet, "/app", func(w http.ResponseWriter, r *http.Request) {}); err != nil {
+		t.Fatalf("failed to add route: %v", err)
+	}
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+
+	// The attestation endpoint complains about the missing nonce, which tells
+	// us that the route exists.
+	expect(t, serve(e, http.MethodGet, "/system/attestation"), http.StatusBadRequest, errNoNonce)
+	if !mwCalled {
+		t.Fatal("expected system middleware to be called")
+	}
+
+	mwCalled = false
+	expect(t, serve(e, http.MethodGet, "/attestation"), http.StatusNotFound, "")
+	expect(t, serve(e, http.MethodGet, "/app"), http.StatusOK, "")
+	if mwCalled {
+		t.Fatal("expected system middleware to not be called for application route")
+	}
+}
+
+func TestNoSystemPrefix(t *testing.T) {
+	e := NewEnclave(&Config{})
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	expect(t, serve(e, http.MethodGet, "/attestation"), http.StatusBadRequest, errNoNonce)
+}
+
+func TestBadSystemPrefix(t *testing.T) {
+	e := NewEnclave(&Config{SystemPrefix: "system"})
+	if err := e.registerSystemRoutes(); err == nil {
+		t.Fatal("expected error for system prefix without leading slash")
+	}
+}
+
+func TestDuplicateRoute(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {}
+	e := NewEnclave(&Config{})
+	if err := e.AddRoute(http.MethodGet, "/app", handler); err != nil {
+		t.Fatalf("failed to add route: %v", err)
+	}
+	if err := e.AddRoute(http.MethodGet, "/app", handler); err == nil {
+		t.Fatal("expected error when adding duplicate route")
+	}
+	// The same pattern with a different method is fine.
+	if err := e.AddRoute(http.MethodPost, "/app", handler); err != nil {
+		t.Fatalf("failed to add route: %v", err)
+	}
+
+	// An application route that collides with a built-in route.
+	if err := e.AddRoute(http.MethodGet, "/attestation", handler); err != nil {
+		t.Fatalf("failed to add route: %v", err)
+	}
+	if err := e.registerSystemRoutes(); err == nil {
+		t.Fatal("expected error when built-in route collides with application route")
+	}
+
+	// With a system prefix, there is no collision.
+	e = NewEnclave(&Config{SystemPrefix: "/system"})
+	if err := e.AddRoute(http.MethodGet, "/attestation", handler); err != nil {
+		t.Fatalf("failed to add route: %v", err)
+	}
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+}
+
+func TestRootResponse(t *testing.T) {
+	// Without a configured response, the root path results in a 404.
+	e := NewEnclave(&Config{})
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	expect(t, serve(e, http.MethodGet, "/"), http.StatusNotFound, "")
+
+	e = NewEnclave(&Config{RootResponse: &RootResponse{
+		ContentType: "text/plain",
+		Body:        "Hello from the enclave",
+	}})
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	resp := serve(e, http.MethodGet, "/")
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain" {
+		t.Fatalf("expected content type %q but got %q", "text/plain", ct)
+	}
+	expect(t, resp, http.StatusOK, "Hello from the enclave")
+
+	e = NewEnclave(&Config{RootResponse: &RootResponse{
+		StatusCode: http.StatusFound,
+		Location:   "https://example.com/docs",
+	}})
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	resp = serve(e, http.MethodGet, "/")
+	expect(t, resp, http.StatusFound, "")
+	if loc := resp.Header.Get("Location"); loc != "https://example.com/docs" {
+		t.Fatalf("expected location %q but got %q", "https://example.com/docs", loc)
+	}
+}
+
+func TestListenContextID(t *testing.T) {
+	var gotContextID, gotPort uint32
+	origListen := listenVsock
+	defer func() { listenVsock = origListen }()
+	listenVsock = func(contextID, port uint32) (net.Listener, error) {
+		gotContextID, gotPort = contextID, port
+		return net.Listen("tcp", "127.0.0.1:0")
+	}
+
+	e := NewEnclave(&Config{Port: 8443, ContextID: 16})
+	l, err := e.listen(uint32(e.cfg.Port))
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	_ = l.Close()
+	if gotContextID != 16 || gotPort != 8443 {
+		t.Fatalf("expected listener for 16:8443 but got %d:%d", gotContextID, gotPort)
+	}
+
+	for _, contextID := range []uint32{1, 2} {
+		if err := validateContextID(contextID); err == nil {
+			t.Fatalf("expected error for reserved context ID %d", contextID)
+		}
+	}
+	for _, contextID := range []uint32{0, 3, 16} {
+		if err := validateContextID(contextID); err != nil {
+			t.Fatalf("expected context ID %d to be valid but got: %v", contextID, err)
+		}
+	}
+}
+
+func TestUseOnAttestation(t *testing.T) {
+	e := NewEnclave(&Config{})
+	mwCalled := false
+	e.UseOnAttestation(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mwCalled = true
+			next.ServeHTTP(w, r)
+		})
+	})
+	if err := e.AddRoute(http.MethodGet, "/app", func(w http.ResponseWriter, r *http.Request) {}); err != nil {
+		t.Fatalf("failed to add route: %v", err)
+	}
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+
+	expect(t, serve(e, http.MethodGet, "/app"), http.StatusOK, "")
+	if mwCalled {
+		t.Fatal("expected attestation middleware to not be called for application route")
+	}
+	expect(t, serve(e, http.MethodGet, "/attestation"), http.StatusBadRequest, errNoNonce)
+	if !mwCalled {
+		t.Fatal("expected attestation middleware to be called")
+	}
+}
+
+func TestUse(t *testing.T) {
+	e := NewEnclave(&Config{})
+	if err := e.AddRoute(http.MethodGet, "/app", func(w http.ResponseWriter, r *http.Request) {}); err != nil {
+		t.Fatalf("failed to add route: %v", err)
+	}
+	// Global middlewares may be added after routes.
+	e.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	// Applications can compose groups with their own middlewares.
+	authCalled := false
+	e.Router().Group(func(r chi.Router) {
+		r.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				authCalled = true
+				next.ServeHTTP(w, r)
+			})
+		})
+		r.Get("/private", func(w http.ResponseWriter, r *http.Request) {})
+	})
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+
+	for target, status := range map[string]int{
+		"/app":         http.StatusOK,
+		"/private":     http.StatusOK,
+		"/attestation": http.StatusBadRequest,
+		"/nonexistent": http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		e.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		expect(t, rec.Result(), status, "")
+		if rec.Header().Get("Access-Control-Allow-Origin") != "*" {
+			t.Fatalf("expected global middleware to apply to %s", target)
+		}
+	}
+	if !authCalled {
+		t.Fatal("expected group middleware to be called")
+	}
+}
+
+func TestMaxPEMBlocks(t *testing.T) {
+	key := newTestKey(t)
+	caCert := newTestCert(t, "ca", true, key, key, nil)
+	leafCert := newTestCert(t, "leaf", false, key, key, caCert)
+	bundle := func(numCAs int) []byte {
+		buf := new(bytes.Buffer)
+		for i := 0; i < numCAs; i++ {
+			_ = pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+		}
+		_ = pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: leafCert.Raw})
+		return buf.Bytes()
+	}
+
+	e := NewEnclave(&Config{})
+	if err := e.setCertFingerprint(bundle(10)); err != nil {
+		t.Fatalf("failed to set certificate fingerprint: %v", err)
+	}
+	if e.certFpr != sha256.Sum256(leafCert.Raw) {
+		t.Fatal("expected fingerprint of leaf certificate")
+	}
+
+	// The leaf certificate comes too late in an oversized bundle.
+	e = NewEnclave(&Config{})
+	if err := e.setCertFingerprint(bundle(defaultMaxPEMBlocks)); err == nil {
+		t.Fatal("expected error for oversized certificate bundle")
+	}
+
+	e = NewEnclave(&Config{MaxPEMBlocks: 5})
+	if err := e.setCertFingerprint(bundle(10)); err == nil {
+		t.Fatal("expected error for certificate bundle that exceeds configured limit")
+	}
+	e = NewEnclave(&Config{MaxPEMBlocks: 11})
+	if err := e.setCertFingerprint(bundle(10)); err != nil {
+		t.Fatalf("failed to set certificate fingerprint: %v", err)
+	}
+}
+
+func TestLeafCertInChain(t *testing.T) {
+	rootKey, intKey, leafKey := newTestKey(t), newTestKey(t), newTestKey(t)
+	rootCert := newTestCert(t, "root", true, rootKey, rootKey, nil)
+	intCert := newTestCert(t, "intermediate", true, intKey, rootKey, rootCert)
+	leafCert := newTestCert(t, "leaf", false, leafKey, intKey, intCert)
+	encode := func(certs ...*x509.Certificate) []byte {
+		buf := new(bytes.Buffer)
+		for _, cert := range certs {
+			_ = pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		}
+		return buf.Bytes()
+	}
+
+	// The fingerprint is taken over the leaf, wherever it is in the chain.
+	for _, chain := range [][]byte{
+		encode(leafCert, intCert, rootCert),
+		encode(intCert, leafCert, rootCert),
+		encode(rootCert, intCert, leafCert),
+	} {
+		e := NewEnclave(&Config{})
+		if err := e.setCertFingerprint(chain); err != nil {
+			t.Fatalf("failed to set certificate fingerprint: %v", err)
+		}
+		if e.certFpr != sha256.Sum256(leafCert.Raw) {
+			t.Fatal("expected fingerprint of leaf certificate")
+		}
+	}
+
+	// Non-certificate blocks, like the private key in autocert's cache, are
+	// skipped.
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("key")}),
+		encode(intCert, leafCert)...)
+	if cert, err := NewEnclave(&Config{}).leafCert(chain); err != nil || !cert.Equal(leafCert) {
+		t.Fatalf("expected leaf certificate but got: %v", err)
+	}
+
+	// Bundles without leaf certificate are rejected.
+	if _, err := NewEnclave(&Config{}).leafCert(encode(intCert, rootCert)); err == nil ||
+		!strings.Contains(err.Error(), "no certificate that isn't a CA") {
+		t.Fatalf("expected error for bundle without leaf but got: %v", err)
+	}
+	if _, err := NewEnclave(&Config{}).leafCert([]byte("not PEM")); err == nil {
+		t.Fatal("expected error for input without PEM data")
+	}
+}
+
+func TestAllowedMethods(t *testing.T) {
+	h := func(w http.ResponseWriter, r *http.Request) {}
+
+	e := NewEnclave(&Config{})
+	for _, method := range []string{http.MethodTrace, http.MethodConnect} {
+		if err := e.AddRoute(method, "/app", h); err == nil {
+			t.Fatalf("expected %s to be blocked by default", method)
+		}
+	}
+	if err := e.AddRoute(http.MethodPut, "/app", h); err != nil {
+		t.Fatalf("expected PUT to be allowed by default: %v", err)
+	}
+	expect(t, serve(e, http.MethodPut, "/app"), http.StatusOK, "")
+
+	e = NewEnclave(&Config{AllowedMethods: []string{http.MethodGet, http.MethodTrace}})
+	if err := e.AddRoute(http.MethodPost, "/app", h); err == nil {
+		t.Fatal("expected POST to be blocked")
+	}
+	if err := e.AddRoute(http.MethodTrace, "/app", h); err != nil {
+		t.Fatalf("expected TRACE to be allowed: %v", err)
+	}
+	expect(t, serve(e, http.MethodTrace, "/app"), http.StatusOK, "")
+}
+
+func TestUnknownMethod(t *testing.T) {
+	h := func(w http.ResponseWriter, r *http.Request) {}
+
+	// Unknown methods are rejected even if they are allowed, and so are
+	// lowercase versions of known methods.
+	e := NewEnclave(&Config{AllowedMethods: []string{"FOO", "get", http.MethodGet}})
+	for _, method := range []string{"FOO", "get", ""} {
+		err := e.AddRoute(method, "/app", h)
+		if err == nil || !strings.Contains(err.Error(), "unknown HTTP method") {
+			t.Fatalf("expected error for unknown method %q but got: %v", method, err)
+		}
+	}
+
+	// Rejected methods don't claim the route.
+	if err := e.AddRoute(http.MethodGet, "/app", h); err != nil {
+		t.Fatalf("failed to add route: %v", err)
+	}
+	expect(t, serve(e, http.MethodGet, "/app"), http.StatusOK, "")
+}
+
+func TestACMEPort(t *testing.T) {
+	gotPort := make(chan uint32, 1)
+	origListen := listenVsock
+	defer func() { listenVsock = origListen }()
+	listenVsock = func(contextID, port uint32) (net.Listener, error) {
+		gotPort <- port
+		return nil, errors.New("address already in use")
+	}
+
+	for configured, expected := range map[int]uint32{0: 80, 8080: 8080} {
+		e := NewEnclave(&Config{ACMEPort: configured, Logger: &fakeLogger{}})
+		e.serveHTTP01(&http.Server{Handler: http.NotFoundHandler()})
+		if port := <-gotPort; port != expected {
+			t.Fatalf("expected HTTP-01 listener on port %d but got %d", expected, port)
+		}
+	}
+
+	// The ACME port must not collide with the main port.
+	for _, cfg := range []*Config{
+		{FQDN: "example.com", UseACME: true, Port: 80},
+		{FQDN: "example.com", UseACME: true, Port: 8443, ACMEPort: 8443},
+	} {
+		if err := NewEnclave(cfg).Start(); err == nil || !strings.Contains(err.Error(), "must differ") {
+			t.Fatalf("expected error for colliding ports but got: %v", err)
+		}
+	}
+}
+
+func TestACMEDirectoryURL(t *testing.T) {
+	for configured, expected := range map[string]string{
+		"":                    acme.LetsEncryptURL,
+		LetsEncryptStagingURL: LetsEncryptStagingURL,
+		"https://ca.internal/acme/acme/directory": "https://ca.internal/acme/acme/directory",
+	} {
+		e := NewEnclave(&Config{FQDN: "example.com", ACMEDirectoryURL: configured})
+		m := e.newCertManager(autocert.DirCache(t.TempDir()))
+		if m.Client == nil || m.Client.DirectoryURL != expected {
+			t.Fatalf("expected directory %q but got %+v", expected, m.Client)
+		}
+		if d := newDNS01Issuer(e, nil); d.client.DirectoryURL != expected {
+			t.Fatalf("expected DNS-01 directory %q but got %q", expected, d.client.DirectoryURL)
+		}
+	}
+}
+
+func TestACMEEmail(t *testing.T) {
+	e := NewEnclave(&Config{FQDN: "example.com", ACMEEmail: "admin@example.com"})
+	if m := e.newCertManager(autocert.DirCache(t.TempDir())); m.Email != "admin@example.com" {
+		t.Fatalf("expected email %q but got %q", "admin@example.com", m.Email)
+	}
+
+	for _, email := range []string{"admin", "admin@", "Admin <admin@example.com>", "admin@example.com, x@example.com"} {
+		if err := validateEmail(email); err == nil {
+			t.Fatalf("expected error for email %q", email)
+		}
+	}
+	e = NewEnclave(&Config{FQDN: "example.com", UseACME: true, ACMEEmail: "admin"})
+	if err := e.Start(); err == nil || !strings.Contains(err.Error(), "email") {
+		t.Fatalf("expected error for invalid email but got: %v", err)
+	}
+}
+
+func TestLastBackgroundError(t *testing.T) {
+	origListen := listenVsock
+	defer func() { listenVsock = origListen }()
+	listenVsock = func(contextID, port uint32) (net.Listener, error) {
+		return nil, errors.New("address already in use")
+	}
+
+	e := NewEnclave(&Config{Logger: &fakeLogger{}})
+	if err := e.LastBackgroundError(); err != nil {
+		t.Fatalf("expected no background error but got: %v", err)
+	}
+	// The HTTP-01 listener fails in the background.
+	done := make(chan struct{})
+	go func() {
+		e.serveHTTP01(&http.Server{Handler: http.NotFoundHandler()})
+		close(done)
+	}()
+	<-done
+	if err := e.LastBackgroundError(); err == nil {
+		t.Fatal("expected background error")
+	}
+}
+
+func TestCloseAfterFailedStart(t *testing.T) {
+	// setupAcme creates its cache directory in the working directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get working directory: %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("failed to change working directory: %v", err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+
+	origListen := listenVsock
+	defer func() { listenVsock = origListen }()
+	http01Started := make(chan struct{})
+	listenVsock = func(contextID, port uint32) (net.Listener, error) {
+		if port == 80 {
+			defer close(http01Started)
+			return net.Listen("tcp", "127.0.0.1:0")
+		}
+		return nil, errors.New("address already in use")
+	}
+
+	baseline := runtime.NumGoroutine()
+	e := NewEnclave(&Config{FQDN: "example.com", Port: 443, UseACME: true, NSMWorkers: 4, Logger: &fakeLogger{}})
+	// Mimic Start, which provisions the certificate and then fails to bind
+	// its listener.
+	if err := e.setupAcme(); err != nil {
+		t.Fatalf("failed to set up ACME: %v", err)
+	}
+	if _, err := e.listen(uint32(e.cfg.Port)); err == nil {
+		t.Fatal("expected listener to fail")
+	}
+	<-http01Started
+	if runtime.NumGoroutine() <= baseline {
+		t.Fatal("expected background goroutines")
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatalf("failed to close enclave: %v", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("failed to close enclave twice: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d goroutines after Close but got %d", baseline, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := e.LastBackgroundError(); err != nil {
+		t.Fatalf("expected no background error but got: %v", err)
+	}
+}
+
+func TestShutdownWithoutStart(t *testing.T) {
+	e := NewEnclave(&Config{})
+	if err := e.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shut down enclave that never started: %v", err)
+	}
+	if err := e.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shut down enclave twice: %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	e := NewEnclave(&Config{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- e.httpSrv.Serve(l)
+	}()
+	// Wait until the server accepts connections.
+	for {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			_ = c.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		t.Fatalf("failed to shut down enclave: %v", err)
+	}
+	if err := <-serveErr; err != http.ErrServerClosed {
+		t.Fatalf("expected %v but got: %v", http.ErrServerClosed, err)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("expected listener to be closed")
+	}
+	select {
+	case <-e.done:
+	default:
+		t.Fatal("expected background goroutines to be stopped")
+	}
+}
+
+func TestCertificateFingerprint(t *testing.T) {
+	e := NewEnclave(&Config{FQDN: "example.com"})
+	if _, ok := e.CertificateFingerprint(); ok {
+		t.Fatal("expected fingerprint to be unset before certificate is provisioned")
+	}
+	if err := e.genSelfSignedCert(); err != nil {
+		t.Fatalf("failed to create self-signed certificate: %v", err)
+	}
+	fpr, ok := e.CertificateFingerprint()
+	if !ok {
+		t.Fatal("expected fingerprint to be set")
+	}
+	expected := sha256.Sum256(e.httpSrv.TLSConfig.Certificates[0].Certificate[0])
+	if fpr != expected {
+		t.Fatalf("expected fingerprint %x but got %x", expected, fpr)
+	}
+}
+
+func TestFingerprintUpdateRace(t *testing.T) {
+	e := NewEnclave(&Config{FQDN: "example.com"})
+	e.attester = &switchableAttester{doc: []byte("attestation document")}
+	e.setFingerprint(&e.certFpr, [sha256.Size]byte{1})
+	handler := e.getAttestationHandler()
+	target := "/attestation?nonce=" + strings.Repeat("a", nonceLen)
+
+	// Fingerprint updates run concurrently with requests, which the race
+	// detector checks.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("expected status code %d but got %d", http.StatusOK, rec.Code)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			e.setFingerprint(&e.certFpr, [sha256.Size]byte{byte(i + 2)})
+		}(i)
+	}
+	wg.Wait()
+
+	// The handler binds the latest fingerprint rather than the one it saw
+	// when it was created.
+	fpr, _ := e.CertificateFingerprint()
+	att := &fakeAttester{doc: []byte("attestation document")}
+	e.attester = att
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	expect(t, rec.Result(), http.StatusOK, "")
+	if !bytes.HasPrefix(att.userData, fpr[:]) {
+		t.Fatalf("expected fingerprint %x in user data but got %x", fpr, att.userData)
+	}
+}
+
+func TestDisableAttestation(t *testing.T) {
+	e := NewEnclave(&Config{DisableAttestation: true})
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	expect(t, serve(e, http.MethodGet, "/attestation?nonce=0123456789abcdef0123456789abcdef01234567"), http.StatusNotFound, "")
+	expect(t, serve(e, http.MethodPost, "/attestation"), http.StatusNotFound, "")
+
+	// The application may use the path for its own endpoint.
+	e = NewEnclave(&Config{DisableAttestation: true})
+	if err := e.AddRoute(http.MethodGet, "/attestation", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}); err != nil {
+		t.Fatalf("failed to add route: %v", err)
+	}
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	expect(t, serve(e, http.MethodGet, "/attestation"), http.StatusTeapot, "")
+}
+
+func TestCertValidity(t *testing.T) {
+	for configured, expected := range map[time.Duration]time.Duration{
+		0:                   defaultCertValidity,
+		24 * time.Hour:      24 * time.Hour,
+		21 * 24 * time.Hour: 21 * 24 * time.Hour,
+	} {
+		e := NewEnclave(&Config{FQDN: "example.com", CertValidity: configured})
+		if err := e.genSelfSignedCert(); err != nil {
+			t.Fatalf("failed to create self-signed certificate: %v", err)
+		}
+		leaf := e.httpSrv.TLSConfig.Certificates[0].Leaf
+		if validity := leaf.NotAfter.Sub(leaf.NotBefore); validity < expected-time.Minute || validity > expected+time.Minute {
+			t.Fatalf("expected validity of %s but got %s", expected, validity)
+		}
+	}
+
+	e := NewEnclave(&Config{FQDN: "example.com", CertValidity: -time.Hour})
+	if err := e.Start(); err == nil || !strings.Contains(err.Error(), "validity") {
+		t.Fatalf("expected error for negative validity but got: %v", err)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	e := NewEnclave(&Config{})
+	if e.httpSrv.ReadHeaderTimeout != defaultReadHeaderTimeout ||
+		e.httpSrv.ReadTimeout != defaultReadTimeout ||
+		e.httpSrv.WriteTimeout != defaultWriteTimeout ||
+		e.httpSrv.IdleTimeout != defaultIdleTimeout {
+		t.Fatal("expected default timeouts")
+	}
+	e = NewEnclave(&Config{ReadTimeout: time.Minute, WriteTimeout: -1})
+	if e.httpSrv.ReadTimeout != time.Minute {
+		t.Fatalf("expected read timeout of %s but got %s", time.Minute, e.httpSrv.ReadTimeout)
+	}
+	if e.httpSrv.WriteTimeout != 0 {
+		t.Fatalf("expected disabled write timeout but got %s", e.httpSrv.WriteTimeout)
+	}
+
+	// A client that never finishes its headers gets disconnected.
+	e = NewEnclave(&Config{ReadHeaderTimeout: 50 * time.Millisecond})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		_ = e.httpSrv.Serve(l)
+	}()
+	defer func() {
+		_ = e.httpSrv.Close()
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n")); err != nil {
+		t.Fatalf("failed to write partial request: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatalf("expected server to close connection but got: %v", err)
+	}
+}
+
+func TestGenSelfSignedCertFailure(t *testing.T) {
+	origMarshal := marshalPrivateKey
+	defer func() { marshalPrivateKey = origMarshal }()
+	marshalPrivateKey = func(interface{}) ([]byte, error) {
+		return nil, errors.New("marshalling failed")
+	}
+
+	// The failure must be returned instead of terminating the process.
+	e := NewEnclave(&Config{FQDN: "example.com"})
+	if err := e.genSelfSignedCert(); err == nil || !strings.Contains(err.Error(), "marshalling failed") {
+		t.Fatalf("expected error for failed key marshalling but got: %v", err)
+	}
+	if _, ok := e.CertificateFingerprint(); ok {
+		t.Fatal("expected no certificate fingerprint after failure")
+	}
+}
+
+func TestSANs(t *testing.T) {
+	e := NewEnclave(&Config{
+		FQDN: "example.com",
+		SANs: []string{"internal.example", "EXAMPLE.com", "10.0.0.1", "::1"},
+	})
+	if err := e.genSelfSignedCert(); err != nil {
+		t.Fatalf("failed to create self-signed certificate: %v", err)
+	}
+	leaf := e.httpSrv.TLSConfig.Certificates[0].Leaf
+	for _, name := range []string{"example.com", "internal.example", "10.0.0.1", "::1"} {
+		if err := leaf.VerifyHostname(name); err != nil {
+			t.Fatalf("expected certificate to be valid for %s but got: %v", name, err)
+		}
+	}
+	if len(leaf.DNSNames) != 2 || len(leaf.IPAddresses) != 2 {
+		t.Fatalf("expected 2 DNS names and 2 IP addresses but got %v and %v", leaf.DNSNames, leaf.IPAddresses)
+	}
+	if err := leaf.VerifyHostname("other.example"); err == nil {
+		t.Fatal("expected certificate to be invalid for other.example")
+	}
+}
@@ -0,0 +1,71 @@
+// Package enclaveotel traces an enclave's attestation requests with
+// OpenTelemetry.  It lives in its own module, so applications that don't use
+// OpenTelemetry don't depend on it.
+package enclaveotel
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	enclaveutils "github.com/brave-experiments/nitro-enclave-utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the spans' instrumentation library.
+const instrumentationName = "github.com/brave-experiments/nitro-enclave-utils"
+
+// tracer implements enclaveutils.Tracer on top of an OpenTelemetry tracer.
+type tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// NewTracer returns a Tracer for Config.Tracer that records spans using the
+// given tracer provider.  The spans are children of the spans whose context
+// the given propagator extracts from the requests' headers.  If the
+// propagator is nil, the W3C Trace Context propagator is used, i.e., the
+// parent span comes from the "traceparent" header.
+func NewTracer(provider trace.TracerProvider, propagator propagation.TextMapPropagator) enclaveutils.Tracer {
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+	return &tracer{
+		tracer:     provider.Tracer(instrumentationName),
+		propagator: propagator,
+	}
+}
+
+// StartSpan implements enclaveutils.Tracer.
+func (t *tracer) StartSpan(ctx context.Context, name string, header http.Header) (context.Context, enclaveutils.Span) {
+	ctx = t.propagator.Extract(ctx, propagation.HeaderCarrier(header))
+	ctx, s := t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+	return ctx, span{s}
+}
+
+// span implements enclaveutils.Span on top of an OpenTelemetry span.
+type span struct {
+	trace.Span
+}
+
+// SetAttribute implements enclaveutils.Span.  Values other than strings,
+// ints, and float64s are recorded as strings.
+func (s span) SetAttribute(key string, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		s.SetAttributes(attribute.String(key, v))
+	case int:
+		s.SetAttributes(attribute.Int(key, v))
+	case float64:
+		s.SetAttributes(attribute.Float64(key, v))
+	default:
+		s.SetAttributes(attribute.String(key, fmt.Sprint(v)))
+	}
+}
+
+// End implements enclaveutils.Span.
+func (s span) End() {
+	s.Span.End()
+}
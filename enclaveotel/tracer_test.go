@@ -0,0 +1,72 @@
+package enclaveotel
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	enclaveutils "github.com/brave-experiments/nitro-enclave-utils"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	parentTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentSpanID  = "00f067aa0ba902b7"
+)
+
+func TestTracer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := NewTracer(provider, nil)
+
+	header := http.Header{}
+	header.Set("traceparent", "00-"+parentTraceID+"-"+parentSpanID+"-01")
+	ctx, span := tracer.StartSpan(context.Background(), "GET /attestation", header)
+	span.SetAttribute(enclaveutils.AttrNonceLength, 20)
+	span.SetAttribute(enclaveutils.AttrNSMLatency, 0.5)
+	span.SetAttribute(enclaveutils.AttrResult, "success")
+	span.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected one span but got %d", len(spans))
+	}
+	s := spans[0]
+	if s.Parent().TraceID().String() != parentTraceID || s.Parent().SpanID().String() != parentSpanID ||
+		!s.Parent().IsRemote() {
+		t.Fatalf("expected remote parent from traceparent header but got %v", s.Parent())
+	}
+	if s.SpanContext().TraceID().String() != parentTraceID {
+		t.Fatal("expected span to continue the parent's trace")
+	}
+	if s.SpanKind() != trace.SpanKindServer || s.Name() != "GET /attestation" {
+		t.Fatalf("expected server span named after request but got %v span %q", s.SpanKind(), s.Name())
+	}
+	if trace.SpanFromContext(ctx).SpanContext().SpanID() != s.SpanContext().SpanID() {
+		t.Fatal("expected returned context to contain the span")
+	}
+
+	expected := map[attribute.Key]attribute.Value{
+		enclaveutils.AttrNonceLength: attribute.IntValue(20),
+		enclaveutils.AttrNSMLatency:  attribute.Float64Value(0.5),
+		enclaveutils.AttrResult:      attribute.StringValue("success"),
+	}
+	for _, kv := range s.Attributes() {
+		if v, exists := expected[kv.Key]; exists && v == kv.Value {
+			delete(expected, kv.Key)
+		}
+	}
+	if len(expected) != 0 {
+		t.Fatalf("expected attributes %v in %v", expected, s.Attributes())
+	}
+
+	// Without a traceparent header, the span is a root span.
+	_, span = tracer.StartSpan(context.Background(), "GET /attestation", http.Header{})
+	span.End()
+	if parent := recorder.Ended()[1].Parent(); parent.IsValid() {
+		t.Fatalf("expected root span but got parent %v", parent)
+	}
+}
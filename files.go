@@ -0,0 +1,187 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Domain separation prefixes of the file manifest's Merkle tree, which
+// prevent a leaf from being passed off as an interior node and vice versa.
+const (
+	manifestLeafPrefix     = 0x00
+	manifestInteriorPrefix = 0x01
+)
+
+var errNoFiles = errors.New("no files to attest")
+
+// FileEntry is a file in a FileManifest.
+type FileEntry struct {
+	// Path is the file's path as given to AttestFiles.
+	Path string `json:"path"`
+	// SHA256 is the SHA-256 hash of the file's contents.
+	SHA256 []byte `json:"sha256"`
+}
+
+// FileManifest lists the files that were attested by AttestFiles, sorted by
+// path, and the Merkle root that binds them.
+//
+// The root is computed as follows.  Each entry's leaf hash is
+//
+//	SHA-256(0x00 || uint64be(len(path)) || path || sha256(contents))
+//
+// where the length is in bytes.  Leaves are ordered by path.  The tree is
+// built bottom-up: adjacent nodes are combined into SHA-256(0x01 || left ||
+// right), and the last node of a level with an odd number of nodes is carried
+// up to the next level unchanged.  The root is the single node that remains.
+type FileManifest struct {
+	Files []FileEntry `json:"files"`
+	Root  []byte      `json:"root"`
+}
+
+// FileAttestation is returned by AttestFiles.  Document is an attestation
+// document whose user data is the enclave's user data (i.e., the SHA-256
+// fingerprint of its certificate, followed by its binary's hash if
+// Config.BinaryHashInUserData is set), followed by the manifest's 32-byte
+// root.
+type FileAttestation struct {
+	Manifest FileManifest `json:"manifest"`
+	Document []byte       `json:"document"`
+}
+
+// AttestFiles hashes the files at the given paths, builds a FileManifest of
+// them, and asks the hypervisor for an attestation document that contains the
+// given nonce and binds the manifest's root to the enclave's certificate; see
+// FileAttestation.  Verifiers check the document with Verify, check that its
+// user data starts with the fingerprint of the certificate that the enclave
+// presented, and then call the manifest's Verify method with the document's
+// user data, which confirms exactly which file contents the enclave saw.
+// With ACME, AttestFiles returns ErrCertificateNotReady until the certificate
+// is provisioned.
+func (e *Enclave) AttestFiles(nonce []byte, paths []string) (*FileAttestation, error) {
+	manifest, err := buildFileManifest(paths)
+	if err != nil {
+		return nil, err
+	}
+	userData, err := e.readyUserData(false)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := e.attestDoc(nonce, append(userData, manifest.Root...), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to attest files: %w", err)
+	}
+	return &FileAttestation{Manifest: *manifest, Document: doc}, nil
+}
+
+// buildFileManifest hashes the files at the given paths and returns their
+// manifest.
+func buildFileManifest(paths []string) (*FileManifest, error) {
+	if len(paths) == 0 {
+		return nil, errNoFiles
+	}
+	files := make([]FileEntry, 0, len(paths))
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if seen[path] {
+			return nil, fmt.Errorf("duplicate file %q", path)
+		}
+		seen[path] = true
+		hash, err := sha256File(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, FileEntry{Path: path, SHA256: hash})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	m := &FileManifest{Files: files}
+	m.Root = m.ComputeRoot()
+	return m, nil
+}
+
+// sha256File returns the SHA-256 hash of the contents of the file at the
+// given path.
+func sha256File(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("failed to hash %s: %v", path, err)
+	}
+	return h.Sum(nil), nil
+}
+
+// ComputeRoot computes the Merkle root of the manifest's files as described
+// in FileManifest's documentation.  It returns nil if the manifest lists no
+// files.
+func (m *FileManifest) ComputeRoot() []byte {
+	if len(m.Files) == 0 {
+		return nil
+	}
+	level := make([][]byte, len(m.Files))
+	for i, f := range m.Files {
+		level[i] = manifestLeaf(f)
+	}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i+1 < len(level); i += 2 {
+			h := sha256.New()
+			h.Write([]byte{manifestInteriorPrefix})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		if len(level)%2 == 1 {
+			next = append(next, level[len(level)-1])
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// Verify returns an error if the manifest's files aren't sorted by path, if
+// its root doesn't match its files, or if the given user data of a verified
+// attestation document doesn't end with the root, preceded by at least a
+// certificate fingerprint.  Callers must check the fingerprint themselves.
+func (m *FileManifest) Verify(userData []byte) error {
+	for i := 1; i < len(m.Files); i++ {
+		if m.Files[i-1].Path >= m.Files[i].Path {
+			return errors.New("manifest's files aren't sorted by path")
+		}
+	}
+	root := m.ComputeRoot()
+	if root == nil {
+		return errNoFiles
+	}
+	if !bytes.Equal(root, m.Root) {
+		return errors.New("manifest's root doesn't match its files")
+	}
+	if len(userData) < sha256.Size+len(root) || !bytes.HasSuffix(userData, root) {
+		return errors.New("manifest's root doesn't match document's user data")
+	}
+	return nil
+}
+
+// manifestLeaf returns the leaf hash of the given file entry.
+func manifestLeaf(f FileEntry) []byte {
+	var pathLen [8]byte
+	binary.BigEndian.PutUint64(pathLen[:], uint64(len(f.Path)))
+	h := sha256.New()
+	h.Write([]byte{manifestLeafPrefix})
+	h.Write(pathLen[:])
+	h.Write([]byte(f.Path))
+	h.Write(f.SHA256)
+	return h.Sum(nil)
+}
@@ -0,0 +1,93 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+}
+
+func TestAttestFiles(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for _, name := range []string{"c", "a", "b"} {
+		path := filepath.Join(dir, name)
+		writeTestFile(t, path, "contents of "+name)
+		paths = append(paths, path)
+	}
+
+	e := newFakeEnclave(&Config{})
+	att, err := e.AttestFiles([]byte("nonce"), paths)
+	if err != nil {
+		t.Fatalf("Failed to attest files: %v", err)
+	}
+	if len(att.Document) == 0 {
+		t.Fatal("Expected attestation document.")
+	}
+	if len(att.Manifest.Files) != 3 || att.Manifest.Files[0].Path != paths[1] {
+		t.Fatalf("Expected three files sorted by path but got: %v", att.Manifest.Files)
+	}
+
+	// The manifest's root must be bound to the enclave's certificate via the
+	// document's user data.
+	userData := e.attester.(*fakeAttester).userData
+	if !bytes.Equal(userData, append(e.userData(), att.Manifest.Root...)) {
+		t.Fatal("Expected user data to be the certificate's fingerprint followed by the root.")
+	}
+	if err := att.Manifest.Verify(userData); err != nil {
+		t.Fatalf("Failed to verify manifest: %v", err)
+	}
+	if err := att.Manifest.Verify(make([]byte, 64)); err == nil {
+		t.Fatal("Expected error for mismatching user data but got none.")
+	}
+	if err := att.Manifest.Verify(att.Manifest.Root); err == nil {
+		t.Fatal("Expected error for user data without fingerprint but got none.")
+	}
+
+	// Tampering with the manifest must be detected.
+	tampered := att.Manifest
+	tampered.Files = append([]FileEntry{}, att.Manifest.Files...)
+	tampered.Files[0].SHA256 = make([]byte, 32)
+	if err := tampered.Verify(userData); err == nil {
+		t.Fatal("Expected error for tampered manifest but got none.")
+	}
+
+	// Changing a file must change the root.
+	writeTestFile(t, paths[0], "new contents")
+	att2, err := e.AttestFiles([]byte("nonce"), paths)
+	if err != nil {
+		t.Fatalf("Failed to attest files: %v", err)
+	}
+	if bytes.Equal(att.Manifest.Root, att2.Manifest.Root) {
+		t.Fatal("Expected root to change after changing a file.")
+	}
+
+	// With ACME, there's no certificate to bind the files to until it's
+	// provisioned.
+	acme := newFakeEnclave(&Config{UseACME: true})
+	if _, err := acme.AttestFiles([]byte("nonce"), paths); err != ErrCertificateNotReady {
+		t.Fatalf("Expected %v but got %v.", ErrCertificateNotReady, err)
+	}
+
+	// Attestation failures keep their cause.
+	failing := newFakeEnclave(&Config{})
+	failing.attester = &fakeAttester{err: syscall.EBUSY}
+	if _, err := failing.AttestFiles([]byte("nonce"), paths); !errors.Is(err, ErrAttestationFailed) {
+		t.Fatalf("Expected %v but got %v.", ErrAttestationFailed, err)
+	}
+
+	if _, err := e.AttestFiles([]byte("nonce"), nil); err == nil {
+		t.Fatal("Expected error for no files but got none.")
+	}
+	if _, err := e.AttestFiles([]byte("nonce"), []string{filepath.Join(dir, "missing")}); err == nil {
+		t.Fatal("Expected error for missing file but got none.")
+	}
+}
@@ -0,0 +1,85 @@
+package enclaveutils
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FingerprintFormat determines how the enclave writes its certificate's
+// fingerprint to Config.FingerprintFile and Config.FingerprintSink.
+type FingerprintFormat int
+
+const (
+	// FingerprintHex is lowercase hex without separators.  This is the
+	// default.
+	FingerprintHex FingerprintFormat = iota
+	// FingerprintColonHex is uppercase hex with colons between bytes, as
+	// printed by "openssl x509 -fingerprint".
+	FingerprintColonHex
+	// FingerprintBase64 is standard Base64.
+	FingerprintBase64
+)
+
+// formatFingerprint returns the given fingerprint in the given format,
+// followed by a newline.
+func formatFingerprint(fpr [sha256.Size]byte, format FingerprintFormat) string {
+	switch format {
+	case FingerprintColonHex:
+		parts := make([]string, len(fpr))
+		for i, b := range fpr {
+			parts[i] = fmt.Sprintf("%02X", b)
+		}
+		return strings.Join(parts, ":") + "\n"
+	case FingerprintBase64:
+		return base64.StdEncoding.EncodeToString(fpr[:]) + "\n"
+	default:
+		return hex.EncodeToString(fpr[:]) + "\n"
+	}
+}
+
+// publishFingerprint writes the given certificate fingerprint to the
+// configured file and sink, if any.  The enclave calls it whenever its
+// certificate changes.
+func (e *Enclave) publishFingerprint(fpr [sha256.Size]byte) {
+	out := formatFingerprint(fpr, e.cfg.FingerprintFormat)
+	if e.cfg.FingerprintFile != "" {
+		if err := writeFileAtomically(e.cfg.FingerprintFile, []byte(out)); err != nil {
+			e.setBackgroundError(fmt.Errorf("failed to write certificate fingerprint: %v", err))
+		}
+	}
+	if e.cfg.FingerprintSink != nil {
+		if _, err := e.cfg.FingerprintSink.Write([]byte(out)); err != nil {
+			e.setBackgroundError(fmt.Errorf("failed to write certificate fingerprint to sink: %v", err))
+		}
+	}
+}
+
+// writeFileAtomically writes the given data to a temporary file in the same
+// directory as the given path, and then renames it, so readers never see a
+// partially written file.
+func writeFileAtomically(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
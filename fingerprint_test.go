@@ -0,0 +1,63 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFingerprintFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fingerprint")
+	e := NewEnclave(&Config{FQDN: "example.com", FingerprintFile: path})
+	for i := 0; i < 2; i++ {
+		// The second iteration rotates the certificate.
+		if err := e.genSelfSignedCert(); err != nil {
+			t.Fatalf("failed to create self-signed certificate: %v", err)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read fingerprint file: %v", err)
+		}
+		served := sha256.Sum256(e.httpSrv.TLSConfig.Certificates[0].Certificate[0])
+		if expected := hex.EncodeToString(served[:]) + "\n"; string(content) != expected {
+			t.Fatalf("expected fingerprint file to contain %q but got %q", expected, content)
+		}
+	}
+	if err := e.LastBackgroundError(); err != nil {
+		t.Fatalf("expected no background error but got: %v", err)
+	}
+}
+
+func TestFingerprintSink(t *testing.T) {
+	sink := &bytes.Buffer{}
+	e := NewEnclave(&Config{FQDN: "example.com", FingerprintSink: sink, FingerprintFormat: FingerprintColonHex})
+	if err := e.genSelfSignedCert(); err != nil {
+		t.Fatalf("failed to create self-signed certificate: %v", err)
+	}
+	served := sha256.Sum256(e.httpSrv.TLSConfig.Certificates[0].Certificate[0])
+	line := strings.TrimSuffix(sink.String(), "\n")
+	if raw, _ := hex.DecodeString(strings.ReplaceAll(line, ":", "")); !bytes.Equal(raw, served[:]) {
+		t.Fatalf("expected sink to receive fingerprint %x but got %q", served, sink.String())
+	}
+	if len(line) != 3*sha256.Size-1 || line != strings.ToUpper(line) {
+		t.Fatalf("expected colon-separated uppercase hex but got %q", line)
+	}
+}
+
+func TestFormatFingerprint(t *testing.T) {
+	var fpr [sha256.Size]byte
+	fpr[0] = 0xab
+	for format, prefix := range map[FingerprintFormat]string{
+		FingerprintHex:      "ab00",
+		FingerprintColonHex: "AB:00:",
+		FingerprintBase64:   "qwAA",
+	} {
+		if out := formatFingerprint(fpr, format); !strings.HasPrefix(out, prefix) || !strings.HasSuffix(out, "\n") {
+			t.Errorf("expected format %d to start with %q but got %q", format, prefix, out)
+		}
+	}
+}
@@ -3,18 +3,29 @@ module github.com/brave-experiments/nitro-enclave-utils
 go 1.17
 
 require (
+	github.com/fxamacker/cbor/v2 v2.3.0
 	github.com/go-chi/chi/v5 v5.0.7
 	github.com/hf/nsm v0.0.0-20211106132757-1ae65a6a69ae
-	github.com/mdlayher/vsock v0.0.0-20210303205602-10d591861736
+	github.com/mdlayher/vsock v1.1.1
 	github.com/milosgajdos/tenus v0.0.3
+	github.com/prometheus/client_golang v1.11.1
 	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
-	golang.org/x/sys v0.0.0-20211209171907-798191bca915
+	golang.org/x/net v0.0.0-20201021035429-f5854403a974
+	golang.org/x/sys v0.0.0-20220204135822-1c1b9b1eba6a
 )
 
 require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
 	github.com/docker/libcontainer v2.2.1+incompatible // indirect
-	github.com/fxamacker/cbor/v2 v2.3.0 // indirect
+	github.com/golang/protobuf v1.4.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/mdlayher/socket v0.2.0 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.26.0 // indirect
+	github.com/prometheus/procfs v0.6.0 // indirect
 	github.com/x448/float16 v0.8.4 // indirect
-	golang.org/x/net v0.0.0-20201021035429-f5854403a974 // indirect
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
 	golang.org/x/text v0.3.6 // indirect
+	google.golang.org/protobuf v1.26.0-rc.1 // indirect
 )
@@ -0,0 +1,124 @@
+package enclaveutils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	keyIDLen = 16
+	// preparedKeyLifetime is the time after which prepared key exchanges
+	// that weren't completed are discarded.
+	preparedKeyLifetime = 5 * time.Minute
+
+	errUnknownKeyID = "unknown or expired key ID"
+)
+
+var errNoPreparedKey = errors.New(errUnknownKeyID)
+
+type preparedKey struct {
+	priv, pub []byte
+	expires   time.Time
+}
+
+// keyStore keeps track of the key exchanges that were prepared by
+// PrepareKeyExchange.
+type keyStore struct {
+	sync.Mutex
+	keys map[string]*preparedKey
+}
+
+// add stores the given key, and prunes expired keys while at it.
+func (s *keyStore) add(id string, key *preparedKey) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.keys == nil {
+		s.keys = make(map[string]*preparedKey)
+	}
+	now := time.Now()
+	for id, key := range s.keys {
+		if now.After(key.expires) {
+			delete(s.keys, id)
+		}
+	}
+	s.keys[id] = key
+}
+
+// get returns the key with the given ID, or nil if the key doesn't exist or
+// has expired.  If remove is set, the key is removed from the store.
+func (s *keyStore) get(id string, remove bool) *preparedKey {
+	s.Lock()
+	defer s.Unlock()
+
+	key, exists := s.keys[id]
+	if !exists {
+		return nil
+	}
+	expired := time.Now().After(key.expires)
+	if remove || expired {
+		delete(s.keys, id)
+	}
+	if expired {
+		return nil
+	}
+	return key
+}
+
+// PrepareKeyExchange generates an X25519 key pair for a key exchange with a
+// client, and stores it under a random ID.  Both the ID and the public value
+// are returned.  The client then requests an attestation document with the
+// ID as "key_id" (in the URL query of GET requests or in the JSON body of
+// POST requests), which makes the enclave bind the prepared public value to
+// the document's public_key field.  Because each client refers to its own key
+// by ID, concurrent key exchanges cannot get mixed up.  Finally, the enclave
+// calls CompleteKeyExchange with the client's public value.
+//
+// Prepared key exchanges that aren't completed within five minutes are
+// discarded.
+func (e *Enclave) PrepareKeyExchange() (keyID string, publicKey []byte, err error) {
+	priv, pub, err := GenerateDHKey(DHGroupX25519)
+	if err != nil {
+		return "", nil, err
+	}
+	rawID := make([]byte, keyIDLen)
+	if _, err := rand.Read(rawID); err != nil {
+		return "", nil, fmt.Errorf("failed to generate key ID: %v", err)
+	}
+	keyID = hex.EncodeToString(rawID)
+	e.keys.add(keyID, &preparedKey{
+		priv:    priv,
+		pub:     pub,
+		expires: time.Now().Add(preparedKeyLifetime),
+	})
+	return keyID, pub, nil
+}
+
+// CompleteKeyExchange derives a key from the private value that was prepared
+// under the given ID and the client's public value, like DeriveDHKey does.
+// The prepared key pair is discarded afterwards, so each prepared key
+// exchange can be completed only once.
+func (e *Enclave) CompleteKeyExchange(keyID string, peerPub []byte) ([]byte, error) {
+	key := e.keys.get(keyID, true)
+	if key == nil {
+		return nil, errNoPreparedKey
+	}
+	return DeriveDHKey(DHGroupX25519, key.priv, peerPub)
+}
+
+// preparedPublicKey returns the public value that was prepared under the
+// given ID.  An empty ID yields no public value.
+func (e *Enclave) preparedPublicKey(keyID string) ([]byte, error) {
+	if keyID == "" {
+		return nil, nil
+	}
+	key := e.keys.get(keyID, false)
+	if key == nil {
+		return nil, errNoPreparedKey
+	}
+	return key.pub, nil
+}
@@ -0,0 +1,95 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPrepareKeyExchangeConcurrently(t *testing.T) {
+	e := newFakeEnclave(&Config{})
+	const n = 50
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+		pubs = make(map[string][]byte)
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, pub, err := e.PrepareKeyExchange()
+			if err != nil {
+				t.Errorf("failed to prepare key exchange: %v", err)
+				return
+			}
+			lock.Lock()
+			pubs[id] = pub
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+	if len(pubs) != n {
+		t.Fatalf("expected %d distinct key IDs but got %d", n, len(pubs))
+	}
+
+	// Each ID must bind its own public value to the document.
+	handler := e.getAttestationHandler()
+	nonce := strings.Repeat("a", nonceLen)
+	for id, pub := range pubs {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/attestation?nonce="+nonce+"&key_id="+id, nil))
+		expect(t, rec.Result(), http.StatusOK, "")
+		if !bytes.Equal(e.attester.(*fakeAttester).publicKey, pub) {
+			t.Fatalf("expected public value of key %s in document", id)
+		}
+	}
+}
+
+func TestCompleteKeyExchange(t *testing.T) {
+	e := newFakeEnclave(&Config{})
+	id, pub, err := e.PrepareKeyExchange()
+	if err != nil {
+		t.Fatalf("failed to prepare key exchange: %v", err)
+	}
+
+	// The key ID also works in POST requests.
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/attestation",
+		strings.NewReader(`{"nonce":"`+strings.Repeat("a", nonceLen)+`","key_id":"`+id+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	e.getAttestationHandler()(rec, req)
+	expect(t, rec.Result(), http.StatusOK, "")
+	if !bytes.Equal(e.attester.(*fakeAttester).publicKey, pub) {
+		t.Fatal("expected prepared public value in document")
+	}
+
+	clientPriv, clientPub, err := GenerateDHKey(DHGroupX25519)
+	if err != nil {
+		t.Fatalf("failed to generate client key: %v", err)
+	}
+	encKey, err := e.CompleteKeyExchange(id, clientPub)
+	if err != nil {
+		t.Fatalf("failed to complete key exchange: %v", err)
+	}
+	clientKey, err := DeriveDHKey(DHGroupX25519, clientPriv, pub)
+	if err != nil {
+		t.Fatalf("failed to derive client's key: %v", err)
+	}
+	if !bytes.Equal(encKey, clientKey) {
+		t.Fatal("expected enclave and client to derive the same key")
+	}
+
+	// A key exchange can only be completed once, after which its ID is
+	// unknown.
+	if _, err := e.CompleteKeyExchange(id, clientPub); err == nil {
+		t.Fatal("expected error for completed key exchange")
+	}
+	rec = httptest.NewRecorder()
+	e.getAttestationHandler()(rec, httptest.NewRequest(http.MethodGet,
+		"/attestation?nonce="+strings.Repeat("a", nonceLen)+"&key_id="+id, nil))
+	expect(t, rec.Result(), http.StatusBadRequest, errUnknownKeyID)
+}
@@ -0,0 +1,41 @@
+package enclaveutils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+)
+
+// KeyType determines the key algorithm of the enclave's self-signed
+// certificates.
+type KeyType int
+
+const (
+	// KeyECDSAP256 is ECDSA with curve P-256.  This is the default.
+	KeyECDSAP256 KeyType = iota
+	// KeyECDSAP384 is ECDSA with curve P-384.
+	KeyECDSAP384
+	// KeyRSA2048 is RSA with a 2048-bit modulus.
+	KeyRSA2048
+	// KeyRSA3072 is RSA with a 3072-bit modulus.
+	KeyRSA3072
+)
+
+// generateKey generates a private key of the given type.
+func generateKey(keyType KeyType) (crypto.Signer, error) {
+	switch keyType {
+	case KeyECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	default:
+		return nil, fmt.Errorf("unsupported key type %d", keyType)
+	}
+}
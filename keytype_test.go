@@ -0,0 +1,56 @@
+package enclaveutils
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func TestKeyType(t *testing.T) {
+	for keyType, check := range map[KeyType]func(interface{}) bool{
+		KeyECDSAP256: func(pub interface{}) bool {
+			k, ok := pub.(*ecdsa.PublicKey)
+			return ok && k.Curve.Params().BitSize == 256
+		},
+		KeyECDSAP384: func(pub interface{}) bool {
+			k, ok := pub.(*ecdsa.PublicKey)
+			return ok && k.Curve.Params().BitSize == 384
+		},
+		KeyRSA2048: func(pub interface{}) bool {
+			k, ok := pub.(*rsa.PublicKey)
+			return ok && k.N.BitLen() == 2048
+		},
+		KeyRSA3072: func(pub interface{}) bool {
+			k, ok := pub.(*rsa.PublicKey)
+			return ok && k.N.BitLen() == 3072
+		},
+	} {
+		e := NewEnclave(&Config{FQDN: "example.com", KeyType: keyType})
+		if err := e.genSelfSignedCert(); err != nil {
+			t.Fatalf("failed to create self-signed certificate with key type %d: %v", keyType, err)
+		}
+		leaf := e.httpSrv.TLSConfig.Certificates[0].Leaf
+		if !check(leaf.PublicKey) {
+			t.Fatalf("unexpected public key %T for key type %d", leaf.PublicKey, keyType)
+		}
+
+		// The certificate is usable for TLS.
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			_ = tls.Server(serverConn, e.httpSrv.TLSConfig).Handshake()
+			_ = serverConn.Close()
+		}()
+		tlsConn := tls.Client(clientConn, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatalf("failed to complete TLS handshake with key type %d: %v", keyType, err)
+		}
+		_ = tlsConn.Close()
+	}
+
+	e := NewEnclave(&Config{FQDN: "example.com", KeyType: KeyType(42)})
+	if err := e.genSelfSignedCert(); err == nil {
+		t.Fatal("expected error for unsupported key type")
+	}
+}
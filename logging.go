@@ -0,0 +1,75 @@
+package enclaveutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// LogLevel represents the severity of a log message.
+type LogLevel string
+
+const (
+	LevelDebug LogLevel = "debug"
+	LevelInfo  LogLevel = "info"
+	LevelError LogLevel = "error"
+)
+
+// Logger is the interface that the enclave uses to emit log messages.
+type Logger interface {
+	Log(level LogLevel, msg string)
+}
+
+// stdLogger writes log messages via the standard library's log package.  This
+// is the default logger.
+type stdLogger struct{}
+
+func (stdLogger) Log(level LogLevel, msg string) {
+	log.Print(msg)
+}
+
+// requestLogger adapts a Logger to chi's request logging middleware.
+type requestLogger struct {
+	Logger
+}
+
+func (l requestLogger) Print(v ...interface{}) {
+	l.Log(LevelInfo, fmt.Sprint(v...))
+}
+
+// jsonLogger writes log messages as newline-delimited JSON.
+type jsonLogger struct {
+	sync.Mutex
+	enc *json.Encoder
+}
+
+// jsonLogLine represents a single line of a jsonLogger's output.
+type jsonLogLine struct {
+	Time  string   `json:"time"`
+	Level LogLevel `json:"level"`
+	Msg   string   `json:"msg"`
+}
+
+// NewJSONLogger returns a Logger that writes each log message as a JSON object
+// on its own line (NDJSON) to the given writer, e.g., a vsock connection to a
+// log aggregator on the host.  Each object contains the fields "time" (in RFC
+// 3339 format, UTC), "level", and "msg".  The logger is safe for concurrent
+// use.
+func NewJSONLogger(w io.Writer) Logger {
+	return &jsonLogger{enc: json.NewEncoder(w)}
+}
+
+func (l *jsonLogger) Log(level LogLevel, msg string) {
+	l.Lock()
+	defer l.Unlock()
+
+	// There's nowhere to report a failed write, so we ignore the error.
+	_ = l.enc.Encode(jsonLogLine{
+		Time:  time.Now().UTC().Format(time.RFC3339Nano),
+		Level: level,
+		Msg:   msg,
+	})
+}
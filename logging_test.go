@@ -0,0 +1,63 @@
+package enclaveutils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestJSONLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	e := NewEnclave(&Config{Debug: true, Logger: NewJSONLogger(buf)})
+	e.log("Assigned address to %s interface.", "lo")
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	_ = serve(e, http.MethodGet, "/attestation")
+
+	lines := 0
+	s := bufio.NewScanner(buf)
+	for s.Scan() {
+		lines++
+		var l map[string]interface{}
+		if err := json.Unmarshal(s.Bytes(), &l); err != nil {
+			t.Fatalf("expected line %d to be valid JSON but got %v: %q", lines, err, s.Text())
+		}
+		for _, field := range []string{"time", "level", "msg"} {
+			if _, exists := l[field]; !exists {
+				t.Fatalf("expected line %d to contain field %q", lines, field)
+			}
+		}
+		if _, err := time.Parse(time.RFC3339Nano, l["time"].(string)); err != nil {
+			t.Fatalf("failed to parse time of line %d: %v", lines, err)
+		}
+		if lines == 1 && l["msg"] != "Assigned address to lo interface." {
+			t.Fatalf("unexpected message: %q", l["msg"])
+		}
+	}
+	// We expect our own log message and the request log.
+	if lines != 2 {
+		t.Fatalf("expected 2 log lines but got %d", lines)
+	}
+}
+
+func TestConfiguredLogger(t *testing.T) {
+	// Without a configured logger, the enclave uses the standard library's.
+	e := NewEnclave(&Config{})
+	if _, ok := e.logger.(stdLogger); !ok {
+		t.Fatalf("expected default logger but got %T", e.logger)
+	}
+
+	// The configured logger also receives the NSM attester's messages.
+	logger := &fakeLogger{}
+	e = NewEnclave(&Config{Logger: logger})
+	if e.logger != logger {
+		t.Fatal("expected enclave to use configured logger")
+	}
+	if a, ok := e.attester.(nsmAttester); !ok || a.logger != logger {
+		t.Fatal("expected NSM attester to use configured logger")
+	}
+}
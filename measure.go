@@ -0,0 +1,55 @@
+package enclaveutils
+
+import (
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// selfExePath points to the binary that is currently executing.  Tests
+// override this variable to hash a file of their choosing.
+var selfExePath = "/proc/self/exe"
+
+// MeasureBinary returns a SHA-384 hash over the binary that is currently
+// executing.  SHA-384 matches the digest that the NSM uses for its PCRs, so the
+// result can be extended into a PCR as-is.  The hash lets verifiers confirm
+// the exact binary that is running, even if the enclave image contains more
+// than just the binary.
+//
+// Note that the hash is computed over the file that /proc/self/exe refers to
+// at the time of the call, and not over the process's memory.  The hash
+// therefore neither covers shared libraries nor configuration files, and it
+// only carries meaning if the code that computes it is trustworthy in the
+// first place, i.e., it is covered by the enclave image's PCRs.
+func MeasureBinary() ([]byte, error) {
+	return hashFile(selfExePath)
+}
+
+// hashFile returns a SHA-384 hash over the file at the given path.  The file
+// is streamed into the hash function, so we don't need to fit large binaries
+// into memory.
+func hashFile(path string) ([]byte, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open binary: %v", err)
+	}
+	defer func() {
+		_ = fd.Close()
+	}()
+
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat binary: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, errors.New("binary is not a regular file")
+	}
+
+	h := sha512.New384()
+	if _, err := io.Copy(h, fd); err != nil {
+		return nil, fmt.Errorf("failed to read binary: %v", err)
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,41 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMeasureBinary(t *testing.T) {
+	content := []byte("not really an ELF binary")
+	path := filepath.Join(t.TempDir(), "exe")
+	if err := ioutil.WriteFile(path, content, 0700); err != nil {
+		t.Fatalf("failed to write mock binary: %v", err)
+	}
+
+	origPath := selfExePath
+	defer func() { selfExePath = origPath }()
+
+	selfExePath = path
+	hash, err := MeasureBinary()
+	if err != nil {
+		t.Fatalf("failed to measure binary: %v", err)
+	}
+	expected := sha512.Sum384(content)
+	if !bytes.Equal(hash, expected[:]) {
+		t.Fatalf("expected hash %x but got %x", expected, hash)
+	}
+
+	selfExePath = filepath.Join(t.TempDir(), "does-not-exist")
+	if _, err := MeasureBinary(); err == nil {
+		t.Fatal("expected error when measuring non-existent binary")
+	}
+
+	selfExePath = os.TempDir()
+	if _, err := MeasureBinary(); err == nil {
+		t.Fatal("expected error when measuring a directory")
+	}
+}
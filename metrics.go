@@ -0,0 +1,70 @@
+package enclaveutils
+
+// Names of the metrics that the enclave records.
+const (
+	// MetricAttestationRequests counts requests to the attestation endpoint.
+	// MetricAttestationBadNonces and MetricAttestationNSMErrors count the
+	// requests among them that failed because of an invalid nonce and
+	// because the NSM didn't produce a document, respectively.
+	MetricAttestationRequests  = "attestation_requests"
+	MetricAttestationBadNonces = "attestation_bad_nonces"
+	MetricAttestationNSMErrors = "attestation_nsm_errors"
+	// MetricNSMLatency is a histogram of the time it takes the NSM to
+	// produce an attestation document, in seconds.  It's only recorded by
+	// implementations of HistogramMetrics.
+	MetricNSMLatency = "nsm_latency_seconds"
+
+	// MetricAttestationWriteErrors counts attestation responses that could
+	// not be written to the client, e.g., because the client disconnected.
+	MetricAttestationWriteErrors = "attestation_write_errors"
+
+	// MetricCertRotationAttempts, MetricCertRotationSuccesses, and
+	// MetricCertRotationFailures count the attempts to provision a new
+	// certificate, i.e., self-signed certificates that the enclave generates
+	// and ACME certificates that the enclave picks up, and their outcome.
+	MetricCertRotationAttempts  = "cert_rotation_attempts"
+	MetricCertRotationSuccesses = "cert_rotation_successes"
+	MetricCertRotationFailures  = "cert_rotation_failures"
+	// MetricCertExpiry is a gauge that contains the expiry time of the most
+	// recently provisioned certificate, in seconds since the Unix epoch.  We
+	// export the time of expiry rather than the time until expiry, which
+	// would be stale as soon as it's recorded; the latter is the difference
+	// between the gauge and the current time.
+	MetricCertExpiry = "cert_expiry_timestamp_seconds"
+
+	// MetricRejectedConnections counts connections that the enclave closed
+	// because Config.MaxConnections was reached.
+	MetricRejectedConnections = "rejected_connections"
+
+	// MetricSelfCheckFailures counts failed periodic self-checks; see
+	// Config.SelfCheckInterval.
+	MetricSelfCheckFailures = "self_check_failures"
+)
+
+// Metrics is the interface that the enclave uses to record metrics.
+// Applications implement it to forward metrics to their monitoring system.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	IncCounter(name string)
+	SetGauge(name string, value float64)
+}
+
+// HistogramMetrics is implemented by Metrics that also record histograms.
+type HistogramMetrics interface {
+	Metrics
+	ObserveHistogram(name string, value float64)
+}
+
+// noopMetrics discards all metrics.  This is the default.
+type noopMetrics struct{}
+
+func (noopMetrics) IncCounter(name string)              {}
+func (noopMetrics) SetGauge(name string, value float64) {}
+
+// observeHistogram records the given value in the given histogram, if the
+// enclave's metrics support histograms.
+func (e *Enclave) observeHistogram(name string, value float64) {
+	if m, ok := e.metrics.(HistogramMetrics); ok {
+		m.ObserveHistogram(name, value)
+	}
+}
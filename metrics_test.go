@@ -0,0 +1,150 @@
+package enclaveutils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// fakeMetrics records the metrics that the enclave reports.
+type fakeMetrics struct {
+	sync.Mutex
+	counters map[string]int
+	gauges   map[string]float64
+}
+
+func newFakeMetrics() *fakeMetrics {
+	return &fakeMetrics{counters: make(map[string]int), gauges: make(map[string]float64)}
+}
+
+func (m *fakeMetrics) IncCounter(name string) {
+	m.Lock()
+	defer m.Unlock()
+	m.counters[name]++
+}
+
+func (m *fakeMetrics) SetGauge(name string, value float64) {
+	m.Lock()
+	defer m.Unlock()
+	m.gauges[name] = value
+}
+
+func (m *fakeMetrics) gauge(name string) float64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.gauges[name]
+}
+
+func (m *fakeMetrics) counter(name string) int {
+	m.Lock()
+	defer m.Unlock()
+	return m.counters[name]
+}
+
+// fakeLogger records the messages that the enclave logs.
+type fakeLogger struct {
+	sync.Mutex
+	levels []LogLevel
+	msgs   []string
+}
+
+func (l *fakeLogger) Log(level LogLevel, msg string) {
+	l.Lock()
+	defer l.Unlock()
+	l.levels = append(l.levels, level)
+	l.msgs = append(l.msgs, msg)
+}
+
+// failingWriter is a ResponseWriter whose writes fail, like the writes to a
+// client that disconnected.
+type failingWriter struct {
+	header http.Header
+}
+
+func (w *failingWriter) Header() http.Header         { return w.header }
+func (w *failingWriter) WriteHeader(statusCode int)  {}
+func (w *failingWriter) Write(b []byte) (int, error) { return 0, errors.New("broken pipe") }
+
+func TestAttestationWriteError(t *testing.T) {
+	metrics, logger := newFakeMetrics(), &fakeLogger{}
+	e := newFakeEnclave(&Config{Metrics: metrics, Logger: logger})
+	req := httptest.NewRequest(http.MethodGet, "/attestation?nonce="+strings.Repeat("a", nonceLen), nil)
+
+	e.getAttestationHandler()(&failingWriter{header: make(http.Header)}, req)
+	if got := metrics.counter(MetricAttestationWriteErrors); got != 1 {
+		t.Fatalf("expected 1 write error but got %d", got)
+	}
+	if len(logger.msgs) != 1 || logger.levels[0] != LevelError || !strings.Contains(logger.msgs[0], "broken pipe") {
+		t.Fatalf("expected write error to be logged but got %q", logger.msgs)
+	}
+
+	// Successful writes are not counted.
+	e.getAttestationHandler()(httptest.NewRecorder(), req)
+	if got := metrics.counter(MetricAttestationWriteErrors); got != 1 {
+		t.Fatalf("expected 1 write error but got %d", got)
+	}
+}
+
+func TestCertRotationMetrics(t *testing.T) {
+	metrics := newFakeMetrics()
+	e := NewEnclave(&Config{
+		FQDN:            "example.com",
+		AttestationFQDN: "attest.example.com",
+		Metrics:         metrics,
+		Logger:          &fakeLogger{},
+	})
+	if err := e.genSelfSignedCert(); err != nil {
+		t.Fatalf("failed to create self-signed certificates: %v", err)
+	}
+	if got := metrics.counter(MetricCertRotationAttempts); got != 2 {
+		t.Fatalf("expected 2 rotation attempts but got %d", got)
+	}
+	if got := metrics.counter(MetricCertRotationSuccesses); got != 2 {
+		t.Fatalf("expected 2 successful rotations but got %d", got)
+	}
+	expiry := e.httpSrv.TLSConfig.Certificates[0].Leaf.NotAfter
+	if got := metrics.gauge(MetricCertExpiry); got != float64(expiry.Unix()) {
+		t.Fatalf("expected expiry gauge %d but got %f", expiry.Unix(), got)
+	}
+
+	// An ACME certificate shows up in the cache, but it's broken.
+	cache := autocert.DirCache(t.TempDir())
+	if err := cache.Put(context.Background(), "example.com", []byte("not a certificate")); err != nil {
+		t.Fatalf("failed to populate cache: %v", err)
+	}
+	e.waitForCachedCert(cache, "example.com", &e.certFpr)
+	if got := metrics.counter(MetricCertRotationAttempts); got != 3 {
+		t.Fatalf("expected 3 rotation attempts but got %d", got)
+	}
+	if got := metrics.counter(MetricCertRotationFailures); got != 1 {
+		t.Fatalf("expected 1 failed rotation but got %d", got)
+	}
+}
+
+func TestAttestationMetrics(t *testing.T) {
+	metrics := newFakeMetrics()
+	e := newFakeEnclave(&Config{Metrics: metrics})
+	handler := e.getAttestationHandler()
+	valid := strings.Repeat("a", nonceLen)
+	for _, nonce := range []string{valid, "foobar", valid} {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/attestation?nonce="+nonce, nil))
+	}
+	e.attester = &fakeAttester{err: errors.New("NSM failure")}
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/attestation?nonce="+valid, nil))
+
+	for name, expected := range map[string]int{
+		MetricAttestationRequests:  4,
+		MetricAttestationBadNonces: 1,
+		MetricAttestationNSMErrors: 1,
+	} {
+		if got := metrics.counter(name); got != expected {
+			t.Fatalf("expected %d for %s but got %d", expected, name, got)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package enclaveutils
+
+import (
+	"errors"
+	"net/http"
+	"syscall"
+
+	"github.com/hf/nsm/response"
+)
+
+const (
+	// nsmRetryAfter is the value of the Retry-After header, in seconds, that
+	// we return if the NSM is temporarily unavailable.
+	nsmRetryAfter = "1"
+
+	errNSMUnavailable    = "hypervisor is temporarily unavailable; retry later"
+	errNSMRejectedParams = "hypervisor rejected attestation request parameters"
+)
+
+// nsmError represents an error code that the NSM device returned.
+type nsmError struct {
+	code response.ErrorCode
+}
+
+func (e *nsmError) Error() string {
+	return string(e.code)
+}
+
+// writeAttestationError responds to a failed attestation request with an
+// HTTP status code that reflects the given error.  Transient failures (e.g., a
+// busy NSM device) result in 503 and a Retry-After header, which allows
+// clients to retry, and so does a certificate that isn't provisioned yet.
+// Requests that the NSM rejected as invalid result in 400, and requests whose
+// empty user data the enclave refuses to attest result in 422.  All other
+// failures result in 500.
+func writeAttestationError(w http.ResponseWriter, err error) {
+	var nsmErr *nsmError
+	switch {
+	case errors.Is(err, syscall.EBUSY),
+		errors.Is(err, syscall.EAGAIN),
+		errors.Is(err, syscall.EINTR),
+		errors.Is(err, syscall.ENOENT),
+		errors.Is(err, errAttestationTimeout):
+		// ENOENT means that the NSM device isn't available (yet), and a
+		// timeout means that our worker pool is saturated.
+		w.Header().Set("Retry-After", nsmRetryAfter)
+		http.Error(w, errNSMUnavailable, http.StatusServiceUnavailable)
+	case errors.Is(err, ErrCertificateNotReady):
+		w.Header().Set("Retry-After", nsmRetryAfter)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, ErrEmptyUserData):
+		// The enclave refuses to attest empty user data as per its
+		// EmptyUserDataPolicy.  Retrying won't help.
+		http.Error(w, errEmptyUserData, http.StatusUnprocessableEntity)
+	case errors.As(err, &nsmErr) &&
+		(nsmErr.code == response.ECInvalidArgument || nsmErr.code == response.ECInputTooLarge):
+		http.Error(w, errNSMRejectedParams, http.StatusBadRequest)
+	default:
+		http.Error(w, errFailedAttestation, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,86 @@
+package enclaveutils
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hf/nsm/response"
+)
+
+func TestAttestationErrors(t *testing.T) {
+	target := "/attestation?nonce=" + strings.Repeat("a", nonceLen)
+	cases := []struct {
+		err        error
+		statusCode int
+		errMsg     string
+		retry      bool
+	}{
+		{
+			err:        fmt.Errorf("failed to open NSM session: %w", &os.PathError{Op: "open", Path: "/dev/nsm", Err: syscall.EBUSY}),
+			statusCode: http.StatusServiceUnavailable,
+			errMsg:     errNSMUnavailable,
+			retry:      true,
+		},
+		{
+			err:        fmt.Errorf("failed to open NSM session: %w", &os.PathError{Op: "open", Path: "/dev/nsm", Err: syscall.ENOENT}),
+			statusCode: http.StatusServiceUnavailable,
+			errMsg:     errNSMUnavailable,
+			retry:      true,
+		},
+		{
+			err:        fmt.Errorf("NSM device did not return an attestation: %w", syscall.EAGAIN),
+			statusCode: http.StatusServiceUnavailable,
+			errMsg:     errNSMUnavailable,
+			retry:      true,
+		},
+		{
+			err:        fmt.Errorf("NSM device did not return an attestation: %w", syscall.EINTR),
+			statusCode: http.StatusServiceUnavailable,
+			errMsg:     errNSMUnavailable,
+			retry:      true,
+		},
+		{
+			err:        &nsmError{code: response.ECInvalidArgument},
+			statusCode: http.StatusBadRequest,
+			errMsg:     errNSMRejectedParams,
+		},
+		{
+			err:        &nsmError{code: response.ECInputTooLarge},
+			statusCode: http.StatusBadRequest,
+			errMsg:     errNSMRejectedParams,
+		},
+		{
+			err:        &nsmError{code: response.ECInternalError},
+			statusCode: http.StatusInternalServerError,
+			errMsg:     errFailedAttestation,
+		},
+		{
+			err:        &nsmError{code: response.ECBufferTooSmall},
+			statusCode: http.StatusInternalServerError,
+			errMsg:     errFailedAttestation,
+		},
+		{
+			err:        errors.New("NSM device did not return an attestation"),
+			statusCode: http.StatusInternalServerError,
+			errMsg:     errFailedAttestation,
+		},
+	}
+
+	for _, c := range cases {
+		e := NewEnclave(&Config{})
+		e.attester = &fakeAttester{err: c.err}
+		rec := httptest.NewRecorder()
+		e.getAttestationHandler()(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		resp := rec.Result()
+		if got := resp.Header.Get("Retry-After"); (got != "") != c.retry {
+			t.Fatalf("%v: unexpected Retry-After header %q", c.err, got)
+		}
+		expect(t, resp, c.statusCode, c.errMsg)
+	}
+}
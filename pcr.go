@@ -0,0 +1,157 @@
+package enclaveutils
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	// pcrWatchBufSize is the number of PCR values that a watcher's channel
+	// buffers before we start dropping old values.
+	pcrWatchBufSize = 8
+)
+
+// pcrDevice abstracts the NSM's PCR operations, which allows tests to replace
+// the NSM with a fake.
+type pcrDevice interface {
+	extendPCR(index uint16, data []byte) ([]byte, error)
+	describePCRs() (map[uint][]byte, error)
+}
+
+// nsmPCRDevice performs PCR operations using the NSM device.
+type nsmPCRDevice struct{}
+
+func (nsmPCRDevice) extendPCR(index uint16, data []byte) ([]byte, error) {
+	return extendPCR(index, data)
+}
+
+func (nsmPCRDevice) describePCRs() (map[uint][]byte, error) {
+	return describePCRs()
+}
+
+// pcrWatchers keeps track of the channels that get notified when a PCR
+// changes.
+type pcrWatchers struct {
+	sync.Mutex
+	chans map[uint][]chan []byte
+	// closed is set once the enclave closed, which closes all channels.
+	closed bool
+}
+
+// ExtendPCR extends the PCR at the given index with the given data, and
+// returns the PCR's new value.  The new value is also sent to all channels
+// that were obtained by calling WatchPCR for the given index.
+func (e *Enclave) ExtendPCR(index uint16, data []byte) ([]byte, error) {
+	value, err := e.pcrs.extendPCR(index, data)
+	if err != nil {
+		return nil, err
+	}
+	e.watchers.notify(uint(index), value)
+	return value, nil
+}
+
+// PCRs returns the current values of all of the enclave's PCRs, as reported
+// by the NSM, keyed by index.  PCRs 0, 1, and 2 contain the measurements of
+// the enclave image, kernel, and application, which lets operators confirm
+// which image is running before clients attest it.
+func (e *Enclave) PCRs() (map[uint][]byte, error) {
+	pcrs, err := e.pcrs.describePCRs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe PCRs: %v", err)
+	}
+	return pcrs, nil
+}
+
+// logImagePCRs logs the values of PCRs 0, 1, and 2 in debug mode.
+func (e *Enclave) logImagePCRs() {
+	pcrs, err := e.PCRs()
+	if err != nil {
+		e.log("Failed to log PCRs: %v", err)
+		return
+	}
+	for index := uint(0); index <= 2; index++ {
+		e.log("PCR%d: %x", index, pcrs[index])
+	}
+}
+
+// WatchPCR returns a channel that receives the new value of the PCR at the
+// given index whenever ExtendPCR is called for that index.  The channel is
+// buffered and sending to it never blocks: if the receiver falls behind, the
+// oldest buffered values are dropped in favor of new ones.  WatchPCR also
+// returns a function that stops the watcher and closes its channel, which
+// callers must call once they're no longer interested in the PCR.  Closing or
+// shutting down the enclave closes all channels.
+func (e *Enclave) WatchPCR(index uint) (<-chan []byte, func()) {
+	e.watchers.Lock()
+	defer e.watchers.Unlock()
+
+	c := make(chan []byte, pcrWatchBufSize)
+	if e.watchers.closed {
+		close(c)
+		return c, func() {}
+	}
+	if e.watchers.chans == nil {
+		e.watchers.chans = make(map[uint][]chan []byte)
+	}
+	e.watchers.chans[index] = append(e.watchers.chans[index], c)
+	return c, func() { e.watchers.remove(index, c) }
+}
+
+// remove stops notifying the given channel of changes to the PCR at the given
+// index, and closes the channel.  Removing a channel that was already removed
+// has no effect.
+func (w *pcrWatchers) remove(index uint, c chan []byte) {
+	w.Lock()
+	defer w.Unlock()
+
+	chans := w.chans[index]
+	for i := range chans {
+		if chans[i] == c {
+			w.chans[index] = append(chans[:i:i], chans[i+1:]...)
+			if len(w.chans[index]) == 0 {
+				delete(w.chans, index)
+			}
+			close(c)
+			return
+		}
+	}
+}
+
+// closeAll closes all channels, and makes subsequently created watchers'
+// channels start out closed.
+func (w *pcrWatchers) closeAll() {
+	w.Lock()
+	defer w.Unlock()
+
+	for _, chans := range w.chans {
+		for _, c := range chans {
+			close(c)
+		}
+	}
+	w.chans = nil
+	w.closed = true
+}
+
+func (w *pcrWatchers) notify(index uint, value []byte) {
+	w.Lock()
+	defer w.Unlock()
+
+	for _, c := range w.chans[index] {
+		// Each watcher gets its own copy, so watchers cannot interfere with
+		// each other.
+		v := append([]byte{}, value...)
+		select {
+		case c <- v:
+		default:
+			// The buffer is full.  Drop the oldest value to make room.
+			select {
+			case <-c:
+			default:
+			}
+			select {
+			case c <- v:
+			default:
+			}
+		}
+	}
+}
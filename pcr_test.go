@@ -0,0 +1,138 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"testing"
+)
+
+// fakePCRDevice emulates the NSM's PCRs in memory.
+type fakePCRDevice struct {
+	pcrs map[uint16][]byte
+}
+
+func (f *fakePCRDevice) extendPCR(index uint16, data []byte) ([]byte, error) {
+	if f.pcrs == nil {
+		f.pcrs = make(map[uint16][]byte)
+	}
+	old, exists := f.pcrs[index]
+	if !exists {
+		old = make([]byte, sha512.Size384)
+	}
+	newValue := sha512.Sum384(append(old, data...))
+	f.pcrs[index] = newValue[:]
+	return newValue[:], nil
+}
+
+func (f *fakePCRDevice) describePCRs() (map[uint][]byte, error) {
+	pcrs := make(map[uint][]byte)
+	for index := uint16(0); index < 32; index++ {
+		value, exists := f.pcrs[index]
+		if !exists {
+			value = make([]byte, sha512.Size384)
+		}
+		pcrs[uint(index)] = value
+	}
+	return pcrs, nil
+}
+
+func TestPCRs(t *testing.T) {
+	logger := &fakeLogger{}
+	e := NewEnclave(&Config{Debug: true, Logger: logger})
+	e.pcrs = &fakePCRDevice{}
+	value, err := e.ExtendPCR(1, []byte("kernel"))
+	if err != nil {
+		t.Fatalf("failed to extend PCR: %v", err)
+	}
+
+	pcrs, err := e.PCRs()
+	if err != nil {
+		t.Fatalf("failed to get PCRs: %v", err)
+	}
+	if len(pcrs) != 32 {
+		t.Fatalf("expected 32 PCRs but got %d", len(pcrs))
+	}
+	if !bytes.Equal(pcrs[1], value) || !bytes.Equal(pcrs[0], make([]byte, sha512.Size384)) {
+		t.Fatal("expected PCRs to reflect the device's values")
+	}
+
+	// In debug mode, the image's PCRs get logged.
+	e.logImagePCRs()
+	expected := fmt.Sprintf("PCR1: %x", value)
+	found := false
+	for _, msg := range logger.msgs {
+		if msg == expected {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected log message %q but got %q", expected, logger.msgs)
+	}
+}
+
+func TestWatchPCR(t *testing.T) {
+	e := NewEnclave(&Config{})
+	e.pcrs = &fakePCRDevice{}
+
+	c16, _ := e.WatchPCR(16)
+	c17, stop17 := e.WatchPCR(17)
+
+	value, err := e.ExtendPCR(16, []byte("foo"))
+	if err != nil {
+		t.Fatalf("failed to extend PCR: %v", err)
+	}
+	select {
+	case got := <-c16:
+		if !bytes.Equal(got, value) {
+			t.Fatalf("expected PCR value %x but got %x", value, got)
+		}
+	default:
+		t.Fatal("expected watcher of PCR 16 to receive new value")
+	}
+	select {
+	case <-c17:
+		t.Fatal("expected watcher of PCR 17 to receive nothing")
+	default:
+	}
+
+	// Extending more often than the watcher's buffer can hold must neither
+	// block nor lose the latest value.
+	for i := 0; i < pcrWatchBufSize*2; i++ {
+		if value, err = e.ExtendPCR(16, []byte("bar")); err != nil {
+			t.Fatalf("failed to extend PCR: %v", err)
+		}
+	}
+	var last []byte
+	for len(c16) > 0 {
+		last = <-c16
+	}
+	if !bytes.Equal(last, value) {
+		t.Fatalf("expected latest PCR value %x but got %x", value, last)
+	}
+
+	// Stopped watchers' channels are closed and no longer notified.
+	stop17()
+	stop17()
+	if _, ok := <-c17; ok {
+		t.Fatal("expected stopped watcher's channel to be closed")
+	}
+	if _, exists := e.watchers.chans[17]; exists {
+		t.Fatal("expected stopped watcher to be removed")
+	}
+	if _, err := e.ExtendPCR(17, []byte("foo")); err != nil {
+		t.Fatalf("failed to extend PCR: %v", err)
+	}
+
+	// Closing the enclave closes the remaining channels, and those of
+	// subsequent watchers.
+	_ = e.Close()
+	if _, ok := <-c16; ok {
+		t.Fatal("expected watcher's channel to be closed with the enclave")
+	}
+	c18, stop18 := e.WatchPCR(18)
+	if _, ok := <-c18; ok {
+		t.Fatal("expected new watcher's channel to be closed after the enclave closed")
+	}
+	stop18()
+}
@@ -0,0 +1,93 @@
+package enclaveutils
+
+import (
+	"errors"
+	"time"
+)
+
+// defaultNSMTimeout is the time that an attestation request waits for the
+// worker pool unless configured otherwise.
+const defaultNSMTimeout = 10 * time.Second
+
+var (
+	errAttestationTimeout = errors.New("timed out waiting for attestation worker")
+	errPoolClosed         = errors.New("attestation worker pool is closed")
+)
+
+// attestJob represents an attestation request that is submitted to an
+// attesterPool.
+type attestJob struct {
+	nonce, userData, publicKey []byte
+	// result is buffered, so workers never block on jobs whose submitter gave
+	// up.
+	result chan attestResult
+}
+
+type attestResult struct {
+	doc []byte
+	err error
+}
+
+// attesterPool is an attester that hands attestation requests to a fixed
+// number of workers, each of which talks to the wrapped attester.  This caps
+// the concurrency of NSM requests, regardless of how many HTTP requests we
+// serve concurrently.
+type attesterPool struct {
+	jobs    chan attestJob
+	timeout time.Duration
+	done    <-chan struct{}
+}
+
+// newAttesterPool starts the given number of workers that hand attestation
+// requests to the given attester.  Requests that take longer than the given
+// timeout, including the time they wait for a worker, fail with
+// errAttestationTimeout.  The workers run until the given channel is closed.
+func newAttesterPool(inner attester, size int, timeout time.Duration, done <-chan struct{}) *attesterPool {
+	if timeout <= 0 {
+		timeout = defaultNSMTimeout
+	}
+	p := &attesterPool{
+		jobs:    make(chan attestJob),
+		timeout: timeout,
+		done:    done,
+	}
+	for i := 0; i < size; i++ {
+		go func() {
+			for {
+				select {
+				case job := <-p.jobs:
+					doc, err := inner.attest(job.nonce, job.userData, job.publicKey)
+					job.result <- attestResult{doc: doc, err: err}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	return p
+}
+
+func (p *attesterPool) attest(nonce, userData, publicKey []byte) ([]byte, error) {
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	job := attestJob{
+		nonce:     nonce,
+		userData:  userData,
+		publicKey: publicKey,
+		result:    make(chan attestResult, 1),
+	}
+	select {
+	case p.jobs <- job:
+	case <-timer.C:
+		return nil, errAttestationTimeout
+	case <-p.done:
+		return nil, errPoolClosed
+	}
+	select {
+	case res := <-job.result:
+		return res.doc, res.err
+	case <-timer.C:
+		return nil, errAttestationTimeout
+	}
+}
@@ -0,0 +1,85 @@
+package enclaveutils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowAttester blocks each attestation request until release is closed, and
+// keeps track of the maximum number of concurrent requests.
+type slowAttester struct {
+	sync.Mutex
+	release       chan struct{}
+	active, maxed int
+}
+
+func (a *slowAttester) attest(nonce, userData, publicKey []byte) ([]byte, error) {
+	a.Lock()
+	a.active++
+	if a.active > a.maxed {
+		a.maxed = a.active
+	}
+	a.Unlock()
+
+	<-a.release
+
+	a.Lock()
+	a.active--
+	a.Unlock()
+	return []byte("attestation document"), nil
+}
+
+func TestAttesterPoolConcurrency(t *testing.T) {
+	a := &slowAttester{release: make(chan struct{})}
+	p := newAttesterPool(a, 2, time.Minute, nil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := p.attest(nil, nil, nil)
+			errs <- err
+		}()
+	}
+	// Give the requests a chance to pile up before letting them through.
+	time.Sleep(50 * time.Millisecond)
+	close(a.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("failed to attest: %v", err)
+		}
+	}
+	if a.maxed != 2 {
+		t.Fatalf("expected at most 2 concurrent requests but got %d", a.maxed)
+	}
+}
+
+func TestAttesterPoolTimeout(t *testing.T) {
+	a := &slowAttester{release: make(chan struct{})}
+	defer close(a.release)
+
+	e := NewEnclave(&Config{})
+	e.attester = newAttesterPool(a, 1, 20*time.Millisecond, nil)
+
+	// The first request occupies the only worker and times out while waiting
+	// for the NSM.  The second one times out while waiting for a worker.
+	target := "/attestation?nonce=" + strings.Repeat("a", nonceLen)
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		e.getAttestationHandler()(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		resp := rec.Result()
+		if resp.Header.Get("Retry-After") == "" {
+			t.Fatal("expected Retry-After header")
+		}
+		expect(t, resp, http.StatusServiceUnavailable, errNSMUnavailable)
+	}
+}
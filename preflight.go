@@ -0,0 +1,75 @@
+package enclaveutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// preflightTimeout bounds the DNS lookup of the ACME pre-flight check.
+const preflightTimeout = 10 * time.Second
+
+// nsmPreflightTimeout bounds the NSM pre-flight check.  Tests override this
+// variable.
+var nsmPreflightTimeout = 10 * time.Second
+
+// hostResolver abstracts DNS lookups, which allows tests to replace the
+// resolver.  *net.Resolver implements this interface.
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// checkACMEPreflight checks that the given FQDN resolves to at least one
+// publicly routable address.  Let's Encrypt's HTTP-01 challenge fails
+// otherwise, but only after a while and with an opaque error.
+func (e *Enclave) checkACMEPreflight(fqdn string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+
+	addrs, err := e.resolver.LookupHost(ctx, fqdn)
+	if err != nil {
+		return fmt.Errorf("ACME pre-flight check failed: %s does not resolve: %v", fqdn, err)
+	}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		if !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+			!ip.IsLinkLocalUnicast() && !ip.IsMulticast() {
+			return nil
+		}
+	}
+	return fmt.Errorf("ACME pre-flight check failed: %s resolves to no publicly routable address: %v", fqdn, addrs)
+}
+
+// checkNSMPreflight asks the NSM for an attestation document, so that Start
+// fails if the NSM device is missing or doesn't respond.  Otherwise, the
+// problem would only surface once a client requests an attestation document.
+func (e *Enclave) checkNSMPreflight() error {
+	_, rawNonce, err := GenerateNonce()
+	if err != nil {
+		return err
+	}
+	result := make(chan error, 1)
+	go func() {
+		_, err := e.attester.attest(rawNonce, nil, nil)
+		result <- err
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(nsmPreflightTimeout):
+		return fmt.Errorf("NSM pre-flight check failed: NSM didn't respond within %s", nsmPreflightTimeout)
+	}
+	if errors.Is(err, syscall.ENOENT) {
+		return fmt.Errorf("NSM pre-flight check failed (set Config.SkipNSMPreflight "+
+			"when running outside an enclave): %w", err)
+	}
+	if err != nil {
+		return fmt.Errorf("NSM pre-flight check failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package enclaveutils
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, exists := f[host]
+	if !exists {
+		return nil, errors.New("no such host")
+	}
+	return addrs, nil
+}
+
+func TestACMEPreflight(t *testing.T) {
+	e := NewEnclave(&Config{})
+	e.resolver = fakeResolver{
+		"public.example.com":  {"10.0.0.1", "93.184.216.34"},
+		"private.example.com": {"127.0.0.1", "192.168.1.1", "fe80::1"},
+	}
+
+	if err := e.checkACMEPreflight("public.example.com"); err != nil {
+		t.Fatalf("Expected no error for resolvable FQDN but got: %v", err)
+	}
+	if err := e.checkACMEPreflight("private.example.com"); err == nil {
+		t.Fatal("Expected error for FQDN without public address but got none.")
+	}
+	if err := e.checkACMEPreflight("unresolvable.example.com"); err == nil {
+		t.Fatal("Expected error for unresolvable FQDN but got none.")
+	}
+}
+
+func TestNSMPreflight(t *testing.T) {
+	e := newFakeEnclave(&Config{})
+	if err := e.checkNSMPreflight(); err != nil {
+		t.Fatalf("expected pre-flight check to succeed but got: %v", err)
+	}
+	if len(e.attester.(*fakeAttester).nonce) != nonceLen/2 {
+		t.Fatal("expected pre-flight check to use a random nonce")
+	}
+
+	e.attester = &fakeAttester{err: errors.New("NSM failure")}
+	if err := e.checkNSMPreflight(); err == nil || !strings.Contains(err.Error(), "NSM failure") {
+		t.Fatalf("expected NSM error but got: %v", err)
+	}
+
+	origTimeout := nsmPreflightTimeout
+	defer func() { nsmPreflightTimeout = origTimeout }()
+	nsmPreflightTimeout = 10 * time.Millisecond
+	release := make(chan struct{})
+	defer close(release)
+	e.attester = &slowAttester{release: release}
+	if err := e.checkNSMPreflight(); err == nil || !strings.Contains(err.Error(), "didn't respond") {
+		t.Fatalf("expected timeout but got: %v", err)
+	}
+}
+
+func TestNSMPreflightWithoutNSM(t *testing.T) {
+	if _, err := os.Stat("/dev/nsm"); err == nil {
+		t.Skip("test requires a system without NSM device")
+	}
+	e := NewEnclave(&Config{FQDN: "example.com", Port: 8443, Transport: TransportTCP, Logger: &fakeLogger{}})
+	err := e.Start()
+	if err == nil || !strings.Contains(err.Error(), "SkipNSMPreflight") {
+		t.Fatalf("expected pre-flight check to fail but got: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package enclaveutils
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Names and labels of the collectors that PrometheusMetrics registers up
+// front.  Requests that failed because of an invalid nonce and because the
+// NSM didn't produce a document are counted in a single counter, labeled by
+// reason.
+const (
+	promAttestationRequests = MetricAttestationRequests + "_total"
+	promAttestationFailures = "attestation_failures_total"
+	promReasonBadNonce      = "bad_nonce"
+	promReasonNSMError      = "nsm_error"
+)
+
+// histogramBuckets are the upper bounds of the buckets of PrometheusMetrics'
+// histograms, in seconds.  NSM requests usually take a few milliseconds.
+var histogramBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// PrometheusMetrics records the enclave's metrics in Prometheus collectors.
+// Config.MetricsEnabled makes the enclave use it unless Config.Metrics is
+// set.  Counters get the conventional "_total" suffix, e.g.,
+// attestation_requests_total.  Failed attestation requests are counted in
+// attestation_failures_total, labeled by reason, and the NSM's latency is
+// recorded in the histogram nsm_latency_seconds.  Other metrics are
+// registered when they are first recorded.
+//
+// The collectors are registered on the given registerer, so applications can
+// serve the enclave's metrics along with their own.  Several enclaves may
+// share a registerer, in which case they share the collectors, too.
+type PrometheusMetrics struct {
+	registerer prometheus.Registerer
+	gatherer   prometheus.Gatherer
+	requests   prometheus.Counter
+	failures   *prometheus.CounterVec
+	latency    prometheus.Histogram
+
+	mu         sync.Mutex
+	counters   map[string]prometheus.Counter
+	gauges     map[string]prometheus.Gauge
+	histograms map[string]prometheus.Histogram
+}
+
+// NewPrometheusMetrics returns a PrometheusMetrics whose collectors are
+// registered on the given registerer.  If the registerer is nil, the
+// collectors are registered on a new, private registry.  The returned
+// metrics serve the registry via ServeHTTP if the registerer also
+// implements prometheus.Gatherer, which *prometheus.Registry does.
+func NewPrometheusMetrics(reg prometheus.Registerer) (*PrometheusMetrics, error) {
+	if reg == nil {
+		reg = prometheus.NewRegistry()
+	}
+	m := &PrometheusMetrics{
+		registerer: reg,
+		counters:   make(map[string]prometheus.Counter),
+		gauges:     make(map[string]prometheus.Gauge),
+		histograms: make(map[string]prometheus.Histogram),
+	}
+	m.gatherer, _ = reg.(prometheus.Gatherer)
+
+	requests, err := m.register(prometheus.NewCounter(prometheus.CounterOpts{
+		Name: promAttestationRequests,
+		Help: "Number of requests to the attestation endpoint.",
+	}))
+	if err != nil {
+		return nil, err
+	}
+	failures, err := m.register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: promAttestationFailures,
+		Help: "Number of failed requests to the attestation endpoint, by reason.",
+	}, []string{"reason"}))
+	if err != nil {
+		return nil, err
+	}
+	latency, err := m.register(prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    MetricNSMLatency,
+		Help:    "Time it takes the NSM to produce an attestation document, in seconds.",
+		Buckets: histogramBuckets,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	m.requests = requests.(prometheus.Counter)
+	m.failures = failures.(*prometheus.CounterVec)
+	m.latency = latency.(prometheus.Histogram)
+	return m, nil
+}
+
+// register registers the given collector, or returns the collector that was
+// already registered in its place, e.g., by another enclave.
+func (m *PrometheusMetrics) register(c prometheus.Collector) (prometheus.Collector, error) {
+	err := m.registerer.Register(c)
+	var exists prometheus.AlreadyRegisteredError
+	if errors.As(err, &exists) {
+		return exists.ExistingCollector, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// IncCounter increments the given counter.
+func (m *PrometheusMetrics) IncCounter(name string) {
+	switch name {
+	case MetricAttestationRequests:
+		m.requests.Inc()
+		return
+	case MetricAttestationBadNonces:
+		m.failures.WithLabelValues(promReasonBadNonce).Inc()
+		return
+	case MetricAttestationNSMErrors:
+		m.failures.WithLabelValues(promReasonNSMError).Inc()
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, exists := m.counters[name]
+	if !exists {
+		c = prometheus.NewCounter(prometheus.CounterOpts{Name: name + "_total", Help: name})
+		if registered, err := m.register(c); err == nil {
+			c = registered.(prometheus.Counter)
+		}
+		m.counters[name] = c
+	}
+	c.Inc()
+}
+
+// SetGauge sets the given gauge to the given value.
+func (m *PrometheusMetrics) SetGauge(name string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, exists := m.gauges[name]
+	if !exists {
+		g = prometheus.NewGauge(prometheus.GaugeOpts{Name: name, Help: name})
+		if registered, err := m.register(g); err == nil {
+			g = registered.(prometheus.Gauge)
+		}
+		m.gauges[name] = g
+	}
+	g.Set(value)
+}
+
+// ObserveHistogram records the given value in the given histogram.
+func (m *PrometheusMetrics) ObserveHistogram(name string, value float64) {
+	if name == MetricNSMLatency {
+		m.latency.Observe(value)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, exists := m.histograms[name]
+	if !exists {
+		h = prometheus.NewHistogram(prometheus.HistogramOpts{Name: name, Help: name, Buckets: histogramBuckets})
+		if registered, err := m.register(h); err == nil {
+			h = registered.(prometheus.Histogram)
+		}
+		m.histograms[name] = h
+	}
+	h.Observe(value)
+}
+
+// ServeHTTP serves the metrics of the registry on which the collectors are
+// registered in Prometheus's exposition format.  It responds with a 501 if
+// the registerer that was passed to NewPrometheusMetrics can't be gathered.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.gatherer == nil {
+		http.Error(w, errMetricsNotGatherable, http.StatusNotImplemented)
+		return
+	}
+	promhttp.HandlerFor(m.gatherer, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+const errMetricsNotGatherable = "metrics registerer doesn't implement prometheus.Gatherer"
@@ -0,0 +1,100 @@
+package enclaveutils
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	e := newFakeEnclave(&Config{MetricsEnabled: true})
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	expect(t, serve(e, http.MethodGet, "/attestation?nonce="+strings.Repeat("a", nonceLen)), http.StatusOK, "")
+	expect(t, serve(e, http.MethodGet, "/attestation?nonce=foobar"), http.StatusBadRequest, errBadNonceFormat)
+	e.metrics.SetGauge(MetricCertExpiry, 1.5)
+
+	resp := serve(e, http.MethodGet, "/metrics")
+	expect(t, resp, http.StatusOK, "")
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read metrics: %v", err)
+	}
+	for _, line := range []string{
+		"# TYPE attestation_requests_total counter\nattestation_requests_total 2\n",
+		"attestation_failures_total{reason=\"bad_nonce\"} 1\n",
+		"# TYPE cert_expiry_timestamp_seconds gauge\ncert_expiry_timestamp_seconds 1.5\n",
+		"# TYPE nsm_latency_seconds histogram\n",
+		"nsm_latency_seconds_bucket{le=\"+Inf\"} 1\n",
+		"nsm_latency_seconds_count 1\n",
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Fatalf("expected %q in metrics but got:\n%s", line, body)
+		}
+	}
+
+	// Metrics that can't be served are a configuration error.
+	e = NewEnclave(&Config{MetricsEnabled: true, Metrics: newFakeMetrics()})
+	if err := e.registerSystemRoutes(); err == nil {
+		t.Fatal("expected error for metrics that don't implement http.Handler")
+	}
+	if err := NewEnclave(&Config{
+		MetricsEnabled:    true,
+		MetricsRegisterer: prometheus.WrapRegistererWithPrefix("app_", prometheus.NewRegistry()),
+	}).registerSystemRoutes(); err == nil {
+		t.Fatal("expected error for registerer that can't be gathered")
+	}
+}
+
+func TestPrometheusMetricsSharedRegistry(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	appCounter := prometheus.NewCounter(prometheus.CounterOpts{Name: "app_requests_total"})
+	reg.MustRegister(appCounter)
+	appCounter.Inc()
+
+	// Two enclaves share the registry and therefore the collectors.
+	for i := 0; i < 2; i++ {
+		e := newFakeEnclave(&Config{MetricsEnabled: true, MetricsRegisterer: reg})
+		if e.metricsErr != nil {
+			t.Fatalf("failed to set up metrics: %v", e.metricsErr)
+		}
+		e.metrics.IncCounter(MetricAttestationNSMErrors)
+		e.metrics.IncCounter(MetricCertRotationAttempts)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			name := family.GetName()
+			for _, label := range m.GetLabel() {
+				name += "/" + label.GetValue()
+			}
+			values[name] = m.GetCounter().GetValue()
+		}
+	}
+	for name, expected := range map[string]float64{
+		"app_requests_total":                   1,
+		"attestation_failures_total/nsm_error": 2,
+		"cert_rotation_attempts_total":         2,
+	} {
+		if values[name] != expected {
+			t.Errorf("expected %s to be %v but got %v", name, expected, values[name])
+		}
+	}
+
+	// A conflicting collector in the application's registry is an error.
+	reg = prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "attestation_requests_total"}))
+	e := NewEnclave(&Config{MetricsEnabled: true, MetricsRegisterer: reg})
+	if err := e.registerSystemRoutes(); err == nil || !strings.Contains(err.Error(), "failed to register metrics") {
+		t.Fatalf("expected registration error but got: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package enclaveutils
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	errTooManyRequests = "too many attestation requests; retry later"
+
+	// maxRateLimitBuckets is the number of per-client token buckets above
+	// which the limiter forgets clients whose buckets are full again, which
+	// bounds the limiter's memory.
+	maxRateLimitBuckets = 10000
+)
+
+// RateLimiter decides whether requests to the attestation endpoints may
+// proceed.  Implementations must be safe for concurrent use.
+type RateLimiter interface {
+	// Allow returns true if the given request may proceed.  Otherwise, it
+	// returns false and the time after which the client may retry.
+	Allow(r *http.Request) (bool, time.Duration)
+}
+
+// RateLimit configures the enclave's built-in rate limiter, which is a token
+// bucket that holds up to Burst tokens and is refilled at Rate tokens per
+// second.  Each request takes a token.  By default, all clients share a
+// single bucket, which is the most useful setting if requests reach the
+// enclave through a proxy on the parent EC2 instance: all requests then come
+// from the same vsock peer.  PerClient gives each client its own bucket
+// instead, keyed by the request's remote address without the port.
+type RateLimit struct {
+	Rate      float64
+	Burst     int
+	PerClient bool
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// tokenBucketLimiter is the RateLimiter that Config.AttestationRateLimit
+// asks for.
+type tokenBucketLimiter struct {
+	sync.Mutex
+	cfg     RateLimit
+	now     func() time.Time
+	buckets map[string]*bucket
+}
+
+func newTokenBucketLimiter(cfg RateLimit) *tokenBucketLimiter {
+	return &tokenBucketLimiter{
+		cfg:     cfg,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the bucket of the client that sent the given
+// request.
+func (l *tokenBucketLimiter) Allow(r *http.Request) (bool, time.Duration) {
+	key := ""
+	if l.cfg.PerClient {
+		key = clientKey(r)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	if len(l.buckets) >= maxRateLimitBuckets {
+		l.forgetFullBuckets(now)
+	}
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: float64(l.cfg.Burst), last: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.cfg.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// refill adds the tokens that accrued since the bucket was last refilled.
+func (l *tokenBucketLimiter) refill(b *bucket, now time.Time) {
+	b.tokens = math.Min(float64(l.cfg.Burst), b.tokens+now.Sub(b.last).Seconds()*l.cfg.Rate)
+	b.last = now
+}
+
+// forgetFullBuckets deletes the buckets that are full again, i.e., those of
+// clients that were idle for a while.  Forgetting them is harmless because
+// new clients start with a full bucket.
+func (l *tokenBucketLimiter) forgetFullBuckets(now time.Time) {
+	for key, b := range l.buckets {
+		if l.refill(b, now); b.tokens >= float64(l.cfg.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientKey returns the remote address of the given request without its
+// port, e.g., "vm(3)" for vsock peers.
+func clientKey(r *http.Request) string {
+	if i := strings.LastIndexByte(r.RemoteAddr, ':'); i >= 0 {
+		return r.RemoteAddr[:i]
+	}
+	return r.RemoteAddr
+}
+
+// limitRate returns a middleware that rejects requests that the given limiter
+// doesn't allow with a 429 and a Retry-After header.
+func limitRate(limiter RateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok, retryAfter := limiter.Allow(r); !ok {
+				seconds := int(math.Ceil(retryAfter.Seconds()))
+				if seconds < 1 {
+					seconds = 1
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				http.Error(w, errTooManyRequests, http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// check returns an error if the rate limit can't be enforced.
+func (cfg RateLimit) check() error {
+	if cfg.Rate <= 0 || cfg.Burst < 1 {
+		return errors.New("attestation rate limit needs a positive rate and burst")
+	}
+	return nil
+}
+
+// rateLimiter returns the rate limiter for the attestation endpoints, or nil
+// if none is configured.
+func (e *Enclave) rateLimiter() RateLimiter {
+	if e.cfg.AttestationRateLimiter != nil {
+		return e.cfg.AttestationRateLimiter
+	}
+	if e.cfg.AttestationRateLimit != nil {
+		return newTokenBucketLimiter(*e.cfg.AttestationRateLimit)
+	}
+	return nil
+}
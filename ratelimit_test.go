@@ -0,0 +1,111 @@
+package enclaveutils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newTokenBucketLimiter(RateLimit{Rate: 2, Burst: 3})
+	l.now = func() time.Time { return now }
+	req := func(remoteAddr string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/attestation", nil)
+		r.RemoteAddr = remoteAddr
+		return r
+	}
+
+	// Clients share the bucket by default.
+	for i, addr := range []string{"vm(3):1000", "vm(3):1001", "vm(4):1000"} {
+		if ok, _ := l.Allow(req(addr)); !ok {
+			t.Fatalf("expected request %d to be allowed", i)
+		}
+	}
+	ok, retryAfter := l.Allow(req("vm(5):1000"))
+	if ok {
+		t.Fatal("expected request to exceed burst")
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Fatalf("expected to retry after %s but got %s", 500*time.Millisecond, retryAfter)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.Allow(req("vm(3):1000")); !ok {
+		t.Fatal("expected request to be allowed after refill")
+	}
+
+	// Per-client buckets ignore the port.
+	l = newTokenBucketLimiter(RateLimit{Rate: 1, Burst: 1, PerClient: true})
+	l.now = func() time.Time { return now }
+	if ok, _ := l.Allow(req("vm(3):1000")); !ok {
+		t.Fatal("expected first request of client to be allowed")
+	}
+	if ok, _ := l.Allow(req("vm(3):1001")); ok {
+		t.Fatal("expected second request of client to be rejected")
+	}
+	if ok, _ := l.Allow(req("vm(4):1000")); !ok {
+		t.Fatal("expected first request of other client to be allowed")
+	}
+
+	// Idle clients are forgotten once there are too many.
+	now = now.Add(time.Minute)
+	for len(l.buckets) < maxRateLimitBuckets {
+		l.buckets[strings.Repeat("x", len(l.buckets)+1)] = &bucket{tokens: 1, last: now}
+	}
+	_, _ = l.Allow(req("vm(5):1000"))
+	if len(l.buckets) != 1 {
+		t.Fatalf("expected idle buckets to be forgotten but got %d", len(l.buckets))
+	}
+}
+
+// fixedLimiter allows a fixed number of requests.
+type fixedLimiter struct {
+	remaining int
+}
+
+func (l *fixedLimiter) Allow(r *http.Request) (bool, time.Duration) {
+	if l.remaining == 0 {
+		return false, 1500 * time.Millisecond
+	}
+	l.remaining--
+	return true, 0
+}
+
+func TestAttestationRateLimit(t *testing.T) {
+	target := "/attestation?nonce=" + strings.Repeat("a", nonceLen)
+	e := newFakeEnclave(&Config{AttestationRateLimit: &RateLimit{Rate: 0.001, Burst: 1}})
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	expect(t, serve(e, http.MethodGet, target), http.StatusOK, "")
+	resp := serve(e, http.MethodGet, target)
+	expect(t, resp, http.StatusTooManyRequests, errTooManyRequests)
+	if got := resp.Header.Get("Retry-After"); got != "1000" {
+		t.Fatalf("expected Retry-After of 1000 but got %q", got)
+	}
+
+	// A custom limiter replaces the built-in one.
+	e = newFakeEnclave(&Config{
+		AttestationRateLimit:   &RateLimit{Rate: 0.001, Burst: 1},
+		AttestationRateLimiter: &fixedLimiter{remaining: 2},
+	})
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	expect(t, serve(e, http.MethodGet, target), http.StatusOK, "")
+	expect(t, serve(e, http.MethodGet, target), http.StatusOK, "")
+	resp = serve(e, http.MethodGet, target)
+	expect(t, resp, http.StatusTooManyRequests, errTooManyRequests)
+	if got := resp.Header.Get("Retry-After"); got != "2" {
+		t.Fatalf("expected Retry-After of 2 but got %q", got)
+	}
+
+	for _, limit := range []RateLimit{{Rate: 1}, {Burst: 1}, {Rate: -1, Burst: 1}} {
+		e = NewEnclave(&Config{AttestationRateLimit: &limit})
+		if err := e.Start(); err == nil || !strings.Contains(err.Error(), "rate limit") {
+			t.Fatalf("expected error for rate limit %+v but got: %v", limit, err)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package enclaveutils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const errNotReady = "enclave failed to produce a valid attestation document"
+
+// errSelfVerification means that the enclave obtained an attestation document
+// that doesn't verify, e.g., because its PCRs changed.  Unlike failures to
+// obtain a document, which may be transient, that doesn't go away.
+var errSelfVerification = errors.New("failed to verify attestation document")
+
+// readinessRetryInterval is the minimum time between the attempts to obtain
+// an attestation document that requests to the unauthenticated readiness
+// endpoint trigger while the enclave isn't ready.
+var readinessRetryInterval = time.Second
+
+// selfAttest asks the hypervisor for an attestation document that binds the
+// enclave's certificate, and verifies it using the enclave's verification
+// options.  If verification succeeds, the enclave is marked as ready.  With
+// ACME, the function returns ErrCertificateNotReady until the certificate is
+// provisioned.
+func (e *Enclave) selfAttest() error {
+	_, rawNonce, err := GenerateNonce()
+	if err != nil {
+		return err
+	}
+	userData, err := e.readyUserData(false)
+	if err != nil {
+		return err
+	}
+	rawDoc, err := e.attestDoc(rawNonce, userData, nil)
+	if err != nil {
+		return fmt.Errorf("failed to obtain attestation document: %w", err)
+	}
+	if _, err := Verify(rawDoc, e.verifyOpts); err != nil {
+		return fmt.Errorf("%w: %v", errSelfVerification, err)
+	}
+	atomic.StoreUint32(&e.ready, 1)
+	return nil
+}
+
+// runSelfChecks calls selfCheck at the given interval until the enclave is
+// closed or a document fails to verify.  The function blocks, so it's meant
+// to run in a goroutine.
+func (e *Enclave) runSelfChecks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		}
+		if err := e.selfCheck(); err != nil {
+			return
+		}
+	}
+}
+
+// selfCheck obtains and verifies an attestation document.  If the document
+// doesn't verify, the enclave is permanently marked as not ready, and the
+// error is returned.  If the enclave fails to obtain a document, e.g.,
+// because the NSM is busy or the certificate isn't provisioned yet, the
+// enclave is marked as not ready until a later check succeeds.
+func (e *Enclave) selfCheck() error {
+	err := e.selfAttest()
+	if err == nil {
+		return nil
+	}
+	e.metrics.IncCounter(MetricSelfCheckFailures)
+	if errors.Is(err, errSelfVerification) {
+		atomic.StoreUint32(&e.selfCheckFailed, 1)
+		e.logError("Periodic self-check failed; marking enclave as not ready: %v", err)
+		return err
+	}
+	atomic.StoreUint32(&e.ready, 0)
+	e.logError("Periodic self-check failed; retrying: %v", err)
+	return nil
+}
+
+// Names of the built-in readiness checks.
+const (
+	CheckCertificate = "certificate"
+	CheckAttestation = "attestation"
+)
+
+const (
+	errNoCertificate  = "certificate not provisioned yet"
+	errDuplicateCheck = "readiness check already exists"
+	// checkOK is the status of a passed readiness check.
+	checkOK = "ok"
+)
+
+// ReadinessStatus is the JSON body of the /readyz endpoint's responses.
+type ReadinessStatus struct {
+	Ready bool `json:"ready"`
+	// Checks maps the name of each readiness check to "ok" if it passed,
+	// and to the reason if it failed.
+	Checks map[string]string `json:"checks"`
+}
+
+// readinessCheck is a readiness check that an application added.
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+// AddReadinessCheck adds a check with the given name to the /readyz
+// endpoint, which reports the enclave as ready only if all checks pass.  The
+// check is called for each request to the endpoint, so it should be cheap.
+// The built-in checks are CheckCertificate and CheckAttestation; adding a
+// check whose name is taken results in an error.
+func (e *Enclave) AddReadinessCheck(name string, check func() error) error {
+	e.readinessLock.Lock()
+	defer e.readinessLock.Unlock()
+	if name == CheckCertificate || name == CheckAttestation {
+		return errors.New(errDuplicateCheck)
+	}
+	for _, c := range e.readinessChecks {
+		if c.name == name {
+			return errors.New(errDuplicateCheck)
+		}
+	}
+	e.readinessChecks = append(e.readinessChecks, readinessCheck{name: name, check: check})
+	return nil
+}
+
+// checkAttestation returns an error unless the enclave has produced a valid
+// attestation document.  Start makes the first attempt; until an attempt
+// succeeds, calls make another attempt, at most once per
+// readinessRetryInterval, so probes can't flood the hypervisor.  Success is
+// cached, so a ready enclave doesn't talk to the hypervisor.  If a periodic
+// self-check obtained a document that doesn't verify, the check fails for
+// good.
+func (e *Enclave) checkAttestation() error {
+	if atomic.LoadUint32(&e.selfCheckFailed) == 1 {
+		return errors.New(errNotReady)
+	}
+	if atomic.LoadUint32(&e.ready) == 0 {
+		now := time.Now().UnixNano()
+		last := atomic.LoadInt64(&e.lastReadinessAttempt)
+		if now-last < int64(readinessRetryInterval) ||
+			!atomic.CompareAndSwapInt64(&e.lastReadinessAttempt, last, now) {
+			return errors.New(errNotReady)
+		}
+		if err := e.selfAttest(); err != nil {
+			e.log("Readiness check failed: %v", err)
+			return errors.New(errNotReady)
+		}
+	}
+	return nil
+}
+
+// readiness runs all readiness checks and returns their result.
+func (e *Enclave) readiness() ReadinessStatus {
+	status := ReadinessStatus{Ready: true, Checks: make(map[string]string)}
+	record := func(name string, err error) {
+		if err != nil {
+			status.Ready = false
+			status.Checks[name] = err.Error()
+		} else {
+			status.Checks[name] = checkOK
+		}
+	}
+
+	var certErr error
+	if _, ok := e.CertificateFingerprint(); !ok {
+		certErr = errors.New(errNoCertificate)
+	}
+	record(CheckCertificate, certErr)
+	record(CheckAttestation, e.checkAttestation())
+
+	e.readinessLock.Lock()
+	checks := append([]readinessCheck{}, e.readinessChecks...)
+	e.readinessLock.Unlock()
+	for _, c := range checks {
+		record(c.name, c.check())
+	}
+	return status
+}
+
+// getReadinessHandler returns a HandlerFunc that runs the readiness checks and
+// responds with their result in JSON; see ReadinessStatus.  The status code
+// is 200 if all checks passed, and 503 otherwise.
+func (e *Enclave) getReadinessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := e.readiness()
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(status)
+	}
+}
+
+// getLivenessHandler returns a HandlerFunc that always responds with 200,
+// which tells orchestrators that the enclave is serving.
+func (e *Enclave) getLivenessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, checkOK)
+	}
+}
@@ -0,0 +1,271 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// expectReadiness requests the enclave's readiness endpoint and checks the
+// response's status code and the statuses of the given checks.
+func expectReadiness(t *testing.T, e *Enclave, statusCode int, checks map[string]string) {
+	t.Helper()
+	resp := serve(e, http.MethodGet, "/readyz")
+	expect(t, resp, statusCode, "")
+	var status ReadinessStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("failed to decode readiness status: %v", err)
+	}
+	if status.Ready != (statusCode == http.StatusOK) {
+		t.Fatalf("expected ready=%v but got %v", statusCode == http.StatusOK, status.Ready)
+	}
+	for name, expected := range checks {
+		if got := status.Checks[name]; got != expected {
+			t.Fatalf("expected status %q for check %q but got %q", expected, name, got)
+		}
+	}
+}
+
+var attestationNotReady = map[string]string{CheckAttestation: errNotReady}
+
+var attestationReady = map[string]string{CheckAttestation: checkOK}
+
+func TestReadiness(t *testing.T) {
+	defer func(interval time.Duration) {
+		readinessRetryInterval = interval
+	}(readinessRetryInterval)
+	readinessRetryInterval = 0
+
+	pki := newTestPKI(t)
+	e := NewEnclave(&Config{EnableReadiness: true})
+	e.verifyOpts.Roots = pki.roots
+	e.certFpr = [32]byte{1}
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+
+	// A failing NSM keeps the enclave from becoming ready.
+	e.attester = &fakeAttester{err: errors.New("NSM unavailable")}
+	if err := e.selfAttest(); !errors.Is(err, ErrAttestationFailed) {
+		t.Fatalf("expected %v but got %v", ErrAttestationFailed, err)
+	}
+	expectReadiness(t, e, http.StatusServiceUnavailable, attestationNotReady)
+	expectReadiness(t, e, http.StatusServiceUnavailable, attestationNotReady)
+
+	// So does an invalid attestation document.
+	e.attester = &fakeAttester{doc: []byte("not an attestation document")}
+	expectReadiness(t, e, http.StatusServiceUnavailable, attestationNotReady)
+
+	e.attester = &fakeAttester{doc: pki.sign(t, newTestDocument())}
+	expectReadiness(t, e, http.StatusOK, attestationReady)
+
+	// Readiness is cached.
+	e.attester = &fakeAttester{err: errors.New("NSM unavailable")}
+	expectReadiness(t, e, http.StatusOK, attestationReady)
+
+	// With ACME, documents must bind the certificate's fingerprint, so
+	// the enclave isn't ready before the certificate is provisioned.
+	e = NewEnclave(&Config{EnableReadiness: true, UseACME: true})
+	e.verifyOpts.Roots = pki.roots
+	a := &fakeAttester{doc: pki.sign(t, newTestDocument())}
+	e.attester = a
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	if err := e.selfAttest(); !errors.Is(err, ErrCertificateNotReady) {
+		t.Fatalf("expected %v but got %v", ErrCertificateNotReady, err)
+	}
+	expectReadiness(t, e, http.StatusServiceUnavailable, attestationNotReady)
+	if a.userData != nil {
+		t.Fatal("expected no document to be requested without certificate")
+	}
+	e.setFingerprint(&e.certFpr, [32]byte{1})
+	expectReadiness(t, e, http.StatusOK, attestationReady)
+	if !bytes.Equal(a.userData, e.userData()) {
+		t.Fatal("expected document to bind the certificate's fingerprint")
+	}
+}
+
+func TestReadinessRetryInterval(t *testing.T) {
+	pki := newTestPKI(t)
+	e := NewEnclave(&Config{EnableReadiness: true})
+	e.verifyOpts.Roots = pki.roots
+	e.certFpr = [32]byte{1}
+	a := &countingAttester{err: errors.New("NSM unavailable")}
+	e.attester = a
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+
+	// Probes of a not-ready enclave don't reach the hypervisor more than
+	// once per interval.
+	for i := 0; i < 5; i++ {
+		expectReadiness(t, e, http.StatusServiceUnavailable, attestationNotReady)
+	}
+	if a.calls != 1 {
+		t.Fatalf("expected 1 attestation attempt but got %d", a.calls)
+	}
+}
+
+// switchableAttester returns the document or error that was last set, and is
+// safe for concurrent use.
+type switchableAttester struct {
+	sync.Mutex
+	doc []byte
+	err error
+}
+
+func (a *switchableAttester) attest(nonce, userData, publicKey []byte) ([]byte, error) {
+	a.Lock()
+	defer a.Unlock()
+	return a.doc, a.err
+}
+
+func (a *switchableAttester) set(doc []byte) {
+	a.Lock()
+	defer a.Unlock()
+	a.doc, a.err = doc, nil
+}
+
+func (a *switchableAttester) setErr(err error) {
+	a.Lock()
+	defer a.Unlock()
+	a.doc, a.err = nil, err
+}
+
+func TestPeriodicSelfCheck(t *testing.T) {
+	pki := newTestPKI(t)
+	doc := newTestDocument()
+	metrics := newFakeMetrics()
+	e := NewEnclave(&Config{
+		EnableReadiness: true,
+		ExpectedPCRs:    doc.PCRs,
+		Metrics:         metrics,
+		Logger:          &fakeLogger{},
+	})
+	defer func() {
+		_ = e.Close()
+	}()
+	e.verifyOpts.Roots = pki.roots
+	e.certFpr = [32]byte{1}
+	att := &switchableAttester{doc: pki.sign(t, doc)}
+	e.attester = att
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	expectReadiness(t, e, http.StatusOK, attestationReady)
+
+	go e.runSelfChecks(10 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	expectReadiness(t, e, http.StatusOK, attestationReady)
+
+	// An unexpected PCR change trips the check.
+	tampered := newTestDocument()
+	tampered.PCRs[2] = bytes.Repeat([]byte{0xff}, 48)
+	att.set(pki.sign(t, tampered))
+	deadline := time.Now().Add(5 * time.Second)
+	for metrics.counter(MetricSelfCheckFailures) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected self-check to fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectReadiness(t, e, http.StatusServiceUnavailable, attestationNotReady)
+
+	// The enclave doesn't recover, even if the PCRs change back.
+	att.set(pki.sign(t, newTestDocument()))
+	expectReadiness(t, e, http.StatusServiceUnavailable, attestationNotReady)
+}
+
+func TestPeriodicSelfCheckTransientFailure(t *testing.T) {
+	pki := newTestPKI(t)
+	doc := newTestDocument()
+	metrics := newFakeMetrics()
+	e := NewEnclave(&Config{
+		EnableReadiness: true,
+		ExpectedPCRs:    doc.PCRs,
+		Metrics:         metrics,
+		Logger:          &fakeLogger{},
+	})
+	defer func() {
+		_ = e.Close()
+	}()
+	e.verifyOpts.Roots = pki.roots
+	e.certFpr = [32]byte{1}
+	att := &switchableAttester{}
+	att.setErr(syscall.EBUSY)
+	e.attester = att
+
+	go e.runSelfChecks(10 * time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for metrics.counter(MetricSelfCheckFailures) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected self-check to fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A busy NSM doesn't mark the enclave as not ready for good, and the
+	// self-checks keep running, so the next successful one makes the
+	// enclave ready.
+	att.set(pki.sign(t, doc))
+	for atomic.LoadUint32(&e.ready) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected self-check to recover")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadUint32(&e.selfCheckFailed) != 0 {
+		t.Fatal("expected transient failure not to be latched")
+	}
+}
+
+func TestReadinessChecks(t *testing.T) {
+	pki := newTestPKI(t)
+	e := NewEnclave(&Config{EnableReadiness: true})
+	e.verifyOpts.Roots = pki.roots
+	e.attester = &fakeAttester{doc: pki.sign(t, newTestDocument())}
+	dbErr := errors.New("database unreachable")
+	if err := e.AddReadinessCheck("database", func() error { return dbErr }); err != nil {
+		t.Fatalf("failed to add readiness check: %v", err)
+	}
+	for _, name := range []string{"database", CheckCertificate, CheckAttestation} {
+		if err := e.AddReadinessCheck(name, func() error { return nil }); err == nil {
+			t.Fatalf("expected error for duplicate check %q", name)
+		}
+	}
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+
+	// Each check's status tells operators what's blocking.
+	expectReadiness(t, e, http.StatusServiceUnavailable, map[string]string{
+		CheckCertificate: errNoCertificate,
+		CheckAttestation: checkOK,
+		"database":       "database unreachable",
+	})
+	e.setFingerprint(&e.certFpr, [32]byte{1})
+	expectReadiness(t, e, http.StatusServiceUnavailable, map[string]string{
+		CheckCertificate: checkOK,
+		"database":       "database unreachable",
+	})
+	dbErr = nil
+	expectReadiness(t, e, http.StatusOK, map[string]string{
+		CheckCertificate: checkOK,
+		CheckAttestation: checkOK,
+		"database":       checkOK,
+	})
+
+	// Liveness doesn't depend on readiness.
+	e = NewEnclave(&Config{EnableReadiness: true})
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	expect(t, serve(e, http.MethodGet, "/healthz"), http.StatusOK, checkOK)
+}
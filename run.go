@@ -0,0 +1,98 @@
+package enclaveutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultShutdownGracePeriod = 10 * time.Second
+	maxShutdownGracePeriod     = 5 * time.Minute
+)
+
+var errShutdownForced = errors.New("grace period expired before requests finished")
+
+// notifySignals relays the signals that make Run shut down the enclave to the
+// given channel.  Tests override this variable to simulate signals.
+var notifySignals = func(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+}
+
+// stopSignals undoes notifySignals.
+var stopSignals = func(c chan<- os.Signal) {
+	signal.Stop(c)
+}
+
+// startEnclave starts the given enclave.  Tests override this variable
+// because Start only works inside enclaves.
+var startEnclave = func(e *Enclave) error {
+	return e.Start()
+}
+
+// Run starts the enclave like Start does, and blocks until either Start fails
+// or the process receives SIGTERM or SIGINT.  Upon receiving a signal, Run
+// stops accepting new connections and drains in-flight requests for up to
+// Config.ShutdownGracePeriod.  If requests are still in flight once the grace
+// period expires, Run forcibly closes their connections and returns an error.
+// Run logs each phase of the shutdown regardless of whether debug mode is
+// enabled, so operators can tell a clean shutdown from a forced one.
+//
+// Orchestrators typically send SIGKILL some time after SIGTERM, so the grace
+// period should be shorter than that timeout.
+func (e *Enclave) Run() error {
+	sigs := make(chan os.Signal, 1)
+	notifySignals(sigs)
+	defer stopSignals(sigs)
+
+	startErr := make(chan error, 1)
+	go func() {
+		startErr <- startEnclave(e)
+	}()
+
+	select {
+	case err := <-startErr:
+		return err
+	case sig := <-sigs:
+		return e.shutdown(fmt.Sprintf("Received %s", sig))
+	}
+}
+
+// shutdown gracefully shuts down the enclave.  The given reason explains
+// what triggered the shutdown and is logged.
+func (e *Enclave) shutdown(reason string) error {
+	grace := e.shutdownGracePeriod()
+	e.logger.Log(LevelInfo, fmt.Sprintf("%s; draining in-flight requests for up to %s.", reason, grace))
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	err := e.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		e.logger.Log(LevelError, "Grace period expired; forcibly closing remaining connections.")
+		_ = e.Close()
+		return errShutdownForced
+	}
+	if err != nil {
+		return err
+	}
+	e.logger.Log(LevelInfo, "Shut down gracefully.")
+	return nil
+}
+
+// shutdownGracePeriod returns the configured grace period, bounded to
+// (0, maxShutdownGracePeriod].
+func (e *Enclave) shutdownGracePeriod() time.Duration {
+	grace := e.cfg.ShutdownGracePeriod
+	if grace <= 0 {
+		return defaultShutdownGracePeriod
+	}
+	if grace > maxShutdownGracePeriod {
+		return maxShutdownGracePeriod
+	}
+	return grace
+}
@@ -0,0 +1,176 @@
+package enclaveutils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// runTestEnclave runs an enclave whose only route blocks until the given
+// channel is closed, and waits until a request to that route is in flight.
+// It returns a channel that delivers simulated signals to Run, and a channel
+// that receives Run's return value.
+func runTestEnclave(t *testing.T, e *Enclave, release chan struct{}) (chan<- os.Signal, <-chan error) {
+	entered := make(chan struct{})
+	if err := e.AddRoute(http.MethodGet, "/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	}); err != nil {
+		t.Fatalf("Failed to add route: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	sigsChan := make(chan chan<- os.Signal, 1)
+	origNotify, origStop, origStart := notifySignals, stopSignals, startEnclave
+	t.Cleanup(func() {
+		notifySignals, stopSignals, startEnclave = origNotify, origStop, origStart
+	})
+	notifySignals = func(c chan<- os.Signal) { sigsChan <- c }
+	stopSignals = func(c chan<- os.Signal) {}
+	startEnclave = func(e *Enclave) error { return e.httpSrv.Serve(l) }
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- e.Run()
+	}()
+	sigs := <-sigsChan
+
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/slow")
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	<-entered
+
+	return sigs, runErr
+}
+
+func TestRunGracefulShutdown(t *testing.T) {
+	logger := &fakeLogger{}
+	e := NewEnclave(&Config{Logger: logger, ShutdownGracePeriod: 5 * time.Second})
+	release := make(chan struct{})
+	sigs, runErr := runTestEnclave(t, e, release)
+
+	sigs <- syscall.SIGTERM
+	// Give Run a chance to start draining before the request finishes.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if err := <-runErr; err != nil {
+		t.Fatalf("Expected graceful shutdown but got: %v", err)
+	}
+
+	logger.Lock()
+	defer logger.Unlock()
+	if len(logger.msgs) != 2 ||
+		!strings.Contains(logger.msgs[0], "draining") ||
+		!strings.Contains(logger.msgs[1], "gracefully") {
+		t.Fatalf("Expected draining and shutdown messages but got: %v", logger.msgs)
+	}
+}
+
+func TestRunForcedShutdown(t *testing.T) {
+	logger := &fakeLogger{}
+	grace := 100 * time.Millisecond
+	e := NewEnclave(&Config{Logger: logger, ShutdownGracePeriod: grace})
+	release := make(chan struct{})
+	defer close(release)
+	sigs, runErr := runTestEnclave(t, e, release)
+
+	start := time.Now()
+	sigs <- syscall.SIGTERM
+	if err := <-runErr; err != errShutdownForced {
+		t.Fatalf("Expected error %v but got: %v", errShutdownForced, err)
+	}
+	if elapsed := time.Since(start); elapsed < grace || elapsed > 5*time.Second {
+		t.Fatalf("Expected shutdown after grace period of %s but took %s.", grace, elapsed)
+	}
+
+	logger.Lock()
+	defer logger.Unlock()
+	if len(logger.msgs) != 2 ||
+		!strings.Contains(logger.msgs[0], "draining") ||
+		!strings.Contains(logger.msgs[1], "forcibly") ||
+		logger.levels[1] != LevelError {
+		t.Fatalf("Expected draining and forcing messages but got: %v", logger.msgs)
+	}
+}
+
+func TestShutdownGracePeriod(t *testing.T) {
+	for configured, expected := range map[time.Duration]time.Duration{
+		0:               defaultShutdownGracePeriod,
+		-time.Second:    defaultShutdownGracePeriod,
+		time.Second:     time.Second,
+		time.Hour:       maxShutdownGracePeriod,
+		2 * time.Minute: 2 * time.Minute,
+	} {
+		e := NewEnclave(&Config{ShutdownGracePeriod: configured})
+		if got := e.shutdownGracePeriod(); got != expected {
+			t.Errorf("Expected grace period %s for %s but got %s.", expected, configured, got)
+		}
+	}
+}
+
+func TestStartContext(t *testing.T) {
+	if _, err := os.Stat("/dev/nsm"); err == nil {
+		t.Skip("test requires a system without NSM device")
+	}
+	origListenTCP := listenTCP
+	defer func() { listenTCP = origListenTCP }()
+	listening := make(chan struct{}, 1)
+	listenTCP = func(port uint32) (net.Listener, error) {
+		select {
+		case listening <- struct{}{}:
+		default:
+		}
+		return net.Listen("tcp", "127.0.0.1:0")
+	}
+
+	logger := &fakeLogger{}
+	e := NewEnclave(&Config{FQDN: "example.com", Port: 8443, Transport: TransportTCP, SkipNSMPreflight: true, Logger: logger})
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- e.StartContext(ctx) }()
+	select {
+	case <-listening:
+	case err := <-errs:
+		t.Fatalf("Failed to start enclave: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for listener.")
+	}
+
+	cancel()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("Expected graceful shutdown but got: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for StartContext to return.")
+	}
+	logger.Lock()
+	defer logger.Unlock()
+	if len(logger.msgs) == 0 || !strings.Contains(strings.Join(logger.msgs, "\n"), "Context done (context canceled); draining") {
+		t.Fatalf("Expected draining message but got: %v", logger.msgs)
+	}
+
+	// A context that is done before the enclave starts stops it right away,
+	// and errors that have nothing to do with the context are passed on.
+	e = NewEnclave(&Config{FQDN: "example.com", Port: 8443, Transport: TransportTCP, SkipNSMPreflight: true, Logger: &fakeLogger{}})
+	if err := e.StartContext(ctx); err != nil {
+		t.Fatalf("Expected immediate shutdown but got: %v", err)
+	}
+	e = NewEnclave(&Config{CertValidity: -time.Hour, Logger: &fakeLogger{}})
+	if err := e.StartContext(context.Background()); err == nil || errors.Is(err, http.ErrServerClosed) {
+		t.Fatalf("Expected configuration error but got: %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	sessionIDHeader        = "X-Session-ID"
+	sessionTimestampHeader = "X-Session-Timestamp"
+	sessionMACHeader       = "X-Session-MAC"
+	sessionKeyLen          = 32
+	sessionIDLen           = 16
+	// defaultSessionLifetime is the lifetime of a session key unless
+	// configured otherwise.
+	defaultSessionLifetime = time.Hour
+	// sessionMaxSkew is the maximum difference between a request's timestamp
+	// and our clock.
+	sessionMaxSkew = time.Minute
+
+	// maxSessionBodySize is the maximum size of the bodies of requests that
+	// RequireSession authenticates.
+	maxSessionBodySize = 1 << 20
+
+	errFailedSession   = "failed to create session"
+	errBodyTooLarge    = "request body too large"
+	errUnauthenticated = "request lacks valid session authentication"
+)
+
+// Session is returned by the session endpoint.  It contains a fresh HMAC key
+// that the client uses to authenticate subsequent requests to routes that are
+// protected by RequireSession, which saves the client from having to attest
+// the enclave for each request.
+//
+// The session key is bound to the enclave by the attestation document: the
+// document's user data consists of the enclave's usual user data, followed by
+// the SHA-256 hash of the session key.  Clients must verify the document and
+// check that the hash matches the key before using the key.
+//
+// Session keys are not renewed.  Once a key expires, the client requests a
+// new session, which rotates the key.
+type Session struct {
+	ID string `json:"id"`
+	// Key is the hex-encoded HMAC-SHA256 key.
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+	// Document is the Base64-encoded attestation document.
+	Document string `json:"document"`
+}
+
+type session struct {
+	key     []byte
+	expires time.Time
+}
+
+// sessionStore keeps track of the sessions that the enclave handed out.
+type sessionStore struct {
+	sync.Mutex
+	sessions map[string]*session
+}
+
+// add stores the given session, and prunes expired sessions while at it.
+func (s *sessionStore) add(id string, sess *session) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.sessions == nil {
+		s.sessions = make(map[string]*session)
+	}
+	now := time.Now()
+	for id, sess := range s.sessions {
+		if now.After(sess.expires) {
+			delete(s.sessions, id)
+		}
+	}
+	s.sessions[id] = sess
+}
+
+// get returns the key of the session with the given ID, or nil if the
+// session doesn't exist or has expired.
+func (s *sessionStore) get(id string) []byte {
+	s.Lock()
+	defer s.Unlock()
+
+	sess, exists := s.sessions[id]
+	if !exists || time.Now().After(sess.expires) {
+		return nil
+	}
+	return sess.key
+}
+
+// getSessionHandler returns a HandlerFunc that creates a new session for the
+// nonce in the URL query parameters, and returns the session together with an
+// attestation document that binds the session key to the enclave.
+func (e *Enclave) getSessionHandler() http.HandlerFunc {
+	lifetime := e.cfg.SessionLifetime
+	if lifetime == 0 {
+		lifetime = defaultSessionLifetime
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, rawNonce, err := e.parseNonce(r)
+		if err == nil {
+			err = e.checkNonceEntropy(rawNonce)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		key := make([]byte, sessionKeyLen)
+		rawID := make([]byte, sessionIDLen)
+		if _, err := rand.Read(key); err != nil {
+			http.Error(w, errFailedSession, http.StatusInternalServerError)
+			return
+		}
+		if _, err := rand.Read(rawID); err != nil {
+			http.Error(w, errFailedSession, http.StatusInternalServerError)
+			return
+		}
+		keyHash := sha256.Sum256(key)
+
+		userData, err := e.readyUserData(false)
+		if err != nil {
+			writeAttestationError(w, err)
+			return
+		}
+		rawDoc, err := e.attestDoc(rawNonce, append(userData, keyHash[:]...), nil)
+		if err != nil {
+			writeAttestationError(w, err)
+			return
+		}
+
+		id := hex.EncodeToString(rawID)
+		expires := time.Now().Add(lifetime)
+		e.sessions.add(id, &session{key: key, expires: expires})
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(Session{
+			ID:       id,
+			Key:      hex.EncodeToString(key),
+			Expires:  expires,
+			Document: base64.StdEncoding.EncodeToString(rawDoc),
+		})
+	}
+}
+
+// RequireSession is a middleware that rejects requests that aren't
+// authenticated with a valid session key.  See SignSessionRequest for how
+// clients authenticate requests.  Note that a captured request can be
+// replayed as long as its timestamp is within one minute of our clock.
+//
+// The middleware reads the request's body to authenticate it, so it rejects
+// bodies larger than 1 MiB with a 413.
+func (e *Enclave) RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := e.sessions.get(r.Header.Get(sessionIDHeader))
+		if key == nil {
+			http.Error(w, errUnauthenticated, http.StatusUnauthorized)
+			return
+		}
+		timestamp, err := strconv.ParseInt(r.Header.Get(sessionTimestampHeader), 10, 64)
+		if err != nil {
+			http.Error(w, errUnauthenticated, http.StatusUnauthorized)
+			return
+		}
+		skew := time.Since(time.Unix(timestamp, 0))
+		if skew > sessionMaxSkew || skew < -sessionMaxSkew {
+			http.Error(w, errUnauthenticated, http.StatusUnauthorized)
+			return
+		}
+		mac, err := hex.DecodeString(r.Header.Get(sessionMACHeader))
+		if err != nil {
+			http.Error(w, errUnauthenticated, http.StatusUnauthorized)
+			return
+		}
+
+		// Read the body to authenticate it, and restore it for the next
+		// handler.
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSessionBodySize))
+		if err != nil {
+			// The reader fails once it read the maximum size.
+			if len(body) == maxSessionBodySize {
+				http.Error(w, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, errBadForm, http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		expected := sessionMAC(key, r.Method, r.URL.RequestURI(), timestamp, body)
+		if !hmac.Equal(mac, expected) {
+			http.Error(w, errUnauthenticated, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SignSessionRequest authenticates the given request with the given session
+// ID and hex-encoded session key, as obtained from the session endpoint.  The
+// request's body, if any, must be given separately because it is covered by
+// the authentication tag.
+func SignSessionRequest(req *http.Request, id, key string, body []byte) error {
+	rawKey, err := hex.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("failed to decode session key: %v", err)
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set(sessionIDHeader, id)
+	req.Header.Set(sessionTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(sessionMACHeader, hex.EncodeToString(
+		sessionMAC(rawKey, req.Method, req.URL.RequestURI(), timestamp, body)))
+	return nil
+}
+
+// sessionMAC computes the HMAC-SHA256 authentication tag of a request.  The
+// tag covers the request's method, URI, timestamp, and the SHA-256 hash of
+// its body, separated by newlines.
+func sessionMAC(key []byte, method, uri string, timestamp int64, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%x", method, uri, timestamp, bodyHash)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,135 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newSession(t *testing.T, e *Enclave) Session {
+	t.Helper()
+	nonce, _, err := GenerateNonce()
+	if err != nil {
+		t.Fatalf("failed to generate nonce: %v", err)
+	}
+	resp := serve(e, http.MethodGet, "/attestation/session?nonce="+nonce)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	var s Session
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		t.Fatalf("failed to decode session: %v", err)
+	}
+	return s
+}
+
+func newSessionEnclave(t *testing.T) (*Enclave, *fakeAttester) {
+	t.Helper()
+	e := NewEnclave(&Config{EnableSessions: true})
+	a := &fakeAttester{doc: []byte("attestation document")}
+	e.attester = a
+	err := e.AddRoute(http.MethodPost, "/protected", e.RequireSession(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		})).ServeHTTP)
+	if err != nil {
+		t.Fatalf("failed to add route: %v", err)
+	}
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	return e, a
+}
+
+func TestSessionBinding(t *testing.T) {
+	e, a := newSessionEnclave(t)
+	s := newSession(t, e)
+
+	key, err := hex.DecodeString(s.Key)
+	if err != nil {
+		t.Fatalf("failed to decode session key: %v", err)
+	}
+	keyHash := sha256.Sum256(key)
+	expected := append(e.userData(), keyHash[:]...)
+	if !bytes.Equal(a.userData, expected) {
+		t.Fatal("expected user data to contain the session key's hash")
+	}
+	if s.ID == "" {
+		t.Fatal("expected non-empty session ID")
+	}
+	if time.Until(s.Expires) > defaultSessionLifetime {
+		t.Fatal("expected session to expire within the default lifetime")
+	}
+
+	// Each session must come with a fresh key.
+	if newSession(t, e).Key == s.Key {
+		t.Fatal("expected different sessions to have different keys")
+	}
+}
+
+func TestSessionAuthentication(t *testing.T) {
+	e, _ := newSessionEnclave(t)
+	s := newSession(t, e)
+	body := []byte("request body")
+
+	send := func(id, key string, signed, sent []byte) int {
+		req := httptest.NewRequest(http.MethodPost, "/protected?foo=bar", bytes.NewReader(sent))
+		if id != "" {
+			if err := SignSessionRequest(req, id, key, signed); err != nil {
+				t.Fatalf("failed to sign request: %v", err)
+			}
+		}
+		rec := httptest.NewRecorder()
+		e.router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := send(s.ID, s.Key, body, body); code != http.StatusOK {
+		t.Fatalf("expected authenticated request to succeed but got %d", code)
+	}
+	if code := send("", "", nil, body); code != http.StatusUnauthorized {
+		t.Fatalf("expected unauthenticated request to fail but got %d", code)
+	}
+	if code := send(s.ID, s.Key, body, []byte("tampered body")); code != http.StatusUnauthorized {
+		t.Fatalf("expected request with tampered body to fail but got %d", code)
+	}
+	if code := send(s.ID, hex.EncodeToString(make([]byte, sessionKeyLen)), body, body); code != http.StatusUnauthorized {
+		t.Fatalf("expected request with wrong key to fail but got %d", code)
+	}
+	if code := send("unknown", s.Key, body, body); code != http.StatusUnauthorized {
+		t.Fatalf("expected request with unknown session to fail but got %d", code)
+	}
+
+	// Bodies are read into memory, so their size is limited.
+	maxBody := make([]byte, maxSessionBodySize)
+	if code := send(s.ID, s.Key, maxBody, maxBody); code != http.StatusOK {
+		t.Fatalf("expected request with maximum body size to succeed but got %d", code)
+	}
+	tooLarge := make([]byte, maxSessionBodySize+1)
+	if code := send(s.ID, s.Key, tooLarge, tooLarge); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected request with too large body to fail with 413 but got %d", code)
+	}
+
+	// Stale timestamps must be rejected.
+	req := httptest.NewRequest(http.MethodPost, "/protected", bytes.NewReader(body))
+	if err := SignSessionRequest(req, s.ID, s.Key, body); err != nil {
+		t.Fatalf("failed to sign request: %v", err)
+	}
+	req.Header.Set(sessionTimestampHeader, "0")
+	rec := httptest.NewRecorder()
+	e.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected request with stale timestamp to fail but got %d", rec.Code)
+	}
+
+	// Once the session expires, its key must no longer work.
+	e.sessions.sessions[s.ID].expires = time.Now().Add(-time.Second)
+	if code := send(s.ID, s.Key, body, body); code != http.StatusUnauthorized {
+		t.Fatalf("expected request with expired session to fail but got %d", code)
+	}
+}
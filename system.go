@@ -2,12 +2,15 @@ package enclaveutils
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"os"
+	"sync"
 	"unsafe"
 
 	"github.com/hf/nsm"
 	"github.com/hf/nsm/request"
+	"github.com/mdlayher/vsock"
 	"github.com/milosgajdos/tenus"
 	"golang.org/x/sys/unix"
 )
@@ -17,11 +20,125 @@ const (
 	seedSize   = 2048
 )
 
+// listenVsock returns a vsock listener for the given port.  If the given
+// context ID is zero, the listener is bound to the local context ID.  Tests
+// override this variable because vsock is unavailable outside enclaves.
+var listenVsock = func(contextID, port uint32) (net.Listener, error) {
+	if contextID == 0 {
+		return vsock.Listen(port, nil)
+	}
+	return vsock.ListenContextID(contextID, port, nil)
+}
+
+// dialVsock dials the given vsock context ID and port.  Tests override this
+// variable because vsock is unavailable outside enclaves.
+var dialVsock = func(contextID, port uint32) (net.Conn, error) {
+	return vsock.Dial(contextID, port, nil)
+}
+
+// validateContextID returns an error if the given vsock context ID cannot be
+// used for listening inside an enclave.  Zero stands for the local context ID
+// and is therefore valid.
+func validateContextID(contextID uint32) error {
+	switch contextID {
+	case vsock.Local, vsock.Host:
+		return fmt.Errorf("context ID %d is reserved", contextID)
+	}
+	return nil
+}
+
+// Bootstrap steps that succeeded, which makes SeedEntropyPool and AssignLoAddr
+// idempotent.  For the loopback interface, we remember the addresses and MTU
+// that we applied, so later calls only apply what's missing.
+var (
+	bootstrapLock  sync.Mutex
+	entropySeeded  bool
+	loAddrAssigned bool
+	loAddrs        = make(map[string]bool)
+	loMTU          int
+)
+
+// SeedEntropyPool seeds the system's entropy pool with random bytes from the
+// NSM.  Start does this too, but init code that needs randomness before
+// creating an Enclave can call this function early.  Once seeding succeeded,
+// subsequent calls, including the one in Start, do nothing.
+func SeedEntropyPool() error {
+	return runBootstrapStep(&entropySeeded, seedEntropyPool)
+}
+
+// defaultLoAddrs are the addresses that AssignLoAddr assigns to the loopback
+// interface.
+var defaultLoAddrs = []string{"127.0.0.1/8"}
+
+// AssignLoAddr assigns 127.0.0.1/8 to the loopback interface and brings the
+// interface up.  Like SeedEntropyPool, it may be called before Start, which
+// then skips the step.
+func AssignLoAddr() error {
+	return ConfigureLoopback(defaultLoAddrs, 0)
+}
+
+// ConfigureLoopback works like AssignLoAddr, but assigns the given addresses
+// in CIDR notation, e.g., "::1/128" for services that bind to the IPv6
+// loopback address, and sets the interface's MTU unless the given MTU is
+// zero.  Start calls it with Config.LoopbackAddrs and Config.LoopbackMTU.
+// Addresses and an MTU that an earlier call to AssignLoAddr or
+// ConfigureLoopback applied are not applied again, so an application may
+// call AssignLoAddr early, and Start still adds the configured addresses.
+func ConfigureLoopback(addrs []string, mtu int) error {
+	bootstrapLock.Lock()
+	defer bootstrapLock.Unlock()
+
+	var missing []string
+	for _, addr := range addrs {
+		if !loAddrs[addr] {
+			missing = append(missing, addr)
+		}
+	}
+	if mtu == loMTU {
+		mtu = 0
+	}
+	if loAddrAssigned && len(missing) == 0 && mtu == 0 {
+		return nil
+	}
+	err := assignLoAddr(missing, mtu)
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("failed to configure lo interface, which requires CAP_NET_ADMIN: %w", err)
+	}
+	if err != nil {
+		return err
+	}
+	loAddrAssigned = true
+	for _, addr := range missing {
+		loAddrs[addr] = true
+	}
+	if mtu != 0 {
+		loMTU = mtu
+	}
+	return nil
+}
+
+// runBootstrapStep runs the given step unless done is true, and sets done if
+// the step succeeds.
+func runBootstrapStep(done *bool, step func() error) error {
+	bootstrapLock.Lock()
+	defer bootstrapLock.Unlock()
+
+	if *done {
+		return nil
+	}
+	if err := step(); err != nil {
+		return err
+	}
+	*done = true
+	return nil
+}
+
 // seedEntropyPool obtains cryptographically secure random bytes from the
 // Nitro's NSM and uses them to initialize seedDevice with seedSize bytes.  If
 // we don't do that, our system is going to start with no entropy, which means
-// that calls to /dev/(u)random will block.
-func seedEntropyPool() error {
+// that calls to /dev/(u)random will block.  Tests override this variable
+// because the NSM is unavailable outside enclaves.
+var seedEntropyPool = func() error {
 	s, err := nsm.OpenDefaultSession()
 	if err != nil {
 		return err
@@ -74,25 +191,95 @@ func seedEntropyPool() error {
 	return nil
 }
 
-// assignLoAddr assigns an IP address to the loopback interface, which is
-// necessary because Nitro enclaves don't do that out-of-the-box.  We need the
-// loopback interface because we run a simple TCP proxy that listens on
-// 127.0.0.1:1080 and converts AF_INET to AF_VSOCK.
-func assignLoAddr() error {
-	addrStr := "127.0.0.1/8"
+// assignLoAddr assigns the given addresses to the loopback interface, sets
+// the interface's MTU unless the given MTU is zero, and brings the interface
+// up.  This is necessary because Nitro enclaves don't do that out-of-the-box.
+// We need the loopback interface because we run a simple TCP proxy that
+// listens on 127.0.0.1:1080 and converts AF_INET to AF_VSOCK.  Addresses that
+// the interface already has are skipped, e.g., the IPv6 loopback address,
+// which some kernels assign automatically.  Tests override this variable.
+var assignLoAddr = func(addrs []string, mtu int) error {
 	l, err := tenus.NewLinkFrom("lo")
 	if err != nil {
 		return err
 	}
-	addr, network, err := net.ParseCIDR(addrStr)
-	if err != nil {
-		return err
+	if mtu != 0 {
+		if err = l.SetLinkMTU(mtu); err != nil {
+			return err
+		}
 	}
-	if err = l.SetLinkIp(addr, network); err != nil {
-		return err
+	for _, addrStr := range addrs {
+		addr, network, err := net.ParseCIDR(addrStr)
+		if err != nil {
+			return err
+		}
+		if err = l.SetLinkIp(addr, network); err != nil && !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("failed to assign %s: %w", addrStr, err)
+		}
 	}
 	if err = l.SetLinkUp(); err != nil {
 		return err
 	}
 	return nil
 }
+
+// extendPCR asks the NSM to extend the PCR at the given index with the given
+// data, and returns the PCR's new value.
+func extendPCR(index uint16, data []byte) ([]byte, error) {
+	s, err := nsm.OpenDefaultSession()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+
+	// We ignore the error because of a bug that will return an error despite
+	// having obtained a response:
+	// https://github.com/hf/nsm/issues/2
+	res, _ := s.Send(&request.ExtendPCR{
+		Index: index,
+		Data:  data,
+	})
+	if res.Error != "" {
+		return nil, errors.New(string(res.Error))
+	}
+	if res.ExtendPCR == nil {
+		return nil, errors.New("no ExtendPCR part in NSM's response")
+	}
+
+	return res.ExtendPCR.Data, nil
+}
+
+// describePCRs asks the NSM device for the number of PCRs and returns the
+// values of all of them.
+func describePCRs() (map[uint][]byte, error) {
+	s, err := nsm.OpenDefaultSession()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+
+	// As in extendPCR, we ignore errors and check the response instead.
+	res, _ := s.Send(&request.DescribeNSM{})
+	if res.Error != "" {
+		return nil, errors.New(string(res.Error))
+	}
+	if res.DescribeNSM == nil {
+		return nil, errors.New("no DescribeNSM part in NSM's response")
+	}
+	pcrs := make(map[uint][]byte, res.DescribeNSM.MaxPCRs)
+	for index := uint16(0); index < res.DescribeNSM.MaxPCRs; index++ {
+		res, _ := s.Send(&request.DescribePCR{Index: index})
+		if res.Error != "" {
+			return nil, fmt.Errorf("failed to describe PCR %d: %s", index, res.Error)
+		}
+		if res.DescribePCR == nil {
+			return nil, errors.New("no DescribePCR part in NSM's response")
+		}
+		pcrs[uint(index)] = res.DescribePCR.Data
+	}
+	return pcrs, nil
+}
@@ -0,0 +1,164 @@
+package enclaveutils
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// stubBootstrap replaces the bootstrap steps with stubs that count their
+// invocations, and resets the steps' idempotency flags.
+func stubBootstrap(t *testing.T) (seeds, assigns *int) {
+	seeds, assigns = new(int), new(int)
+	origSeed, origAssign := seedEntropyPool, assignLoAddr
+	t.Cleanup(func() {
+		seedEntropyPool, assignLoAddr = origSeed, origAssign
+		entropySeeded, loAddrAssigned = false, false
+		loAddrs, loMTU = make(map[string]bool), 0
+	})
+	seedEntropyPool = func() error { *seeds++; return nil }
+	assignLoAddr = func(addrs []string, mtu int) error { *assigns++; return nil }
+	entropySeeded, loAddrAssigned = false, false
+	loAddrs, loMTU = make(map[string]bool), 0
+	return seeds, assigns
+}
+
+func TestBootstrapStepsRunOnce(t *testing.T) {
+	seeds, assigns := stubBootstrap(t)
+	for i := 0; i < 2; i++ {
+		if err := SeedEntropyPool(); err != nil {
+			t.Fatalf("Failed to seed entropy pool: %v", err)
+		}
+		if err := AssignLoAddr(); err != nil {
+			t.Fatalf("Failed to assign lo address: %v", err)
+		}
+	}
+
+	// Start must skip the steps that were already performed.  We make it
+	// fail once it tries to listen, which is after bootstrapping.
+	t.Setenv("HTTP_PROXY", os.Getenv("HTTP_PROXY"))
+	t.Setenv("HTTPS_PROXY", os.Getenv("HTTPS_PROXY"))
+	origListen := listenVsock
+	defer func() { listenVsock = origListen }()
+	listenVsock = func(contextID, port uint32) (net.Listener, error) {
+		return nil, errors.New("no vsock")
+	}
+	e := NewEnclave(&Config{FQDN: "example.com", Port: 8443})
+	defer func() {
+		_ = e.Close()
+	}()
+	if err := e.Start(); err == nil {
+		t.Fatal("Expected Start to fail but it didn't.")
+	}
+
+	if *seeds != 1 || *assigns != 1 {
+		t.Fatalf("Expected each step to run once but got %d seeds and %d assignments.", *seeds, *assigns)
+	}
+}
+
+func TestBootstrapStepRetriesAfterFailure(t *testing.T) {
+	seeds, _ := stubBootstrap(t)
+	seedEntropyPool = func() error { *seeds++; return errors.New("NSM unavailable") }
+	if err := SeedEntropyPool(); err == nil {
+		t.Fatal("Expected error but got none.")
+	}
+	seedEntropyPool = func() error { *seeds++; return nil }
+	if err := SeedEntropyPool(); err != nil {
+		t.Fatalf("Failed to seed entropy pool: %v", err)
+	}
+	if *seeds != 2 {
+		t.Fatalf("Expected failed step to be retried but it ran %d times.", *seeds)
+	}
+}
+
+func TestConfigureLoopback(t *testing.T) {
+	stubBootstrap(t)
+	var gotAddrs []string
+	var gotMTU int
+	assignLoAddr = func(addrs []string, mtu int) error {
+		gotAddrs, gotMTU = addrs, mtu
+		return syscall.EPERM
+	}
+	err := AssignLoAddr()
+	if err == nil || !strings.Contains(err.Error(), "CAP_NET_ADMIN") || !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("Expected missing capability error but got: %v", err)
+	}
+	if len(gotAddrs) != 1 || gotAddrs[0] != "127.0.0.1/8" || gotMTU != 0 {
+		t.Fatalf("Expected default configuration but got %v and MTU %d.", gotAddrs, gotMTU)
+	}
+
+	// Start applies the configured addresses and MTU.
+	assignLoAddr = func(addrs []string, mtu int) error {
+		gotAddrs, gotMTU = addrs, mtu
+		return nil
+	}
+	origListen := listenVsock
+	defer func() { listenVsock = origListen }()
+	listenVsock = func(contextID, port uint32) (net.Listener, error) {
+		return nil, errors.New("no vsock")
+	}
+	e := NewEnclave(&Config{
+		FQDN:          "example.com",
+		Port:          8443,
+		LoopbackAddrs: []string{"127.0.0.1/8", "::1/128"},
+		LoopbackMTU:   9001,
+	})
+	defer func() {
+		_ = e.Close()
+	}()
+	if err = e.Start(); err == nil {
+		t.Fatal("Expected Start to fail but it didn't.")
+	}
+	if len(gotAddrs) != 2 || gotAddrs[1] != "::1/128" || gotMTU != 9001 {
+		t.Fatalf("Expected configured addresses and MTU but got %v and MTU %d.", gotAddrs, gotMTU)
+	}
+}
+
+func TestConfigureLoopbackAfterAssignLoAddr(t *testing.T) {
+	stubBootstrap(t)
+	var calls [][]string
+	var mtus []int
+	assignLoAddr = func(addrs []string, mtu int) error {
+		calls, mtus = append(calls, addrs), append(mtus, mtu)
+		return nil
+	}
+	if err := AssignLoAddr(); err != nil {
+		t.Fatalf("Failed to assign lo address: %v", err)
+	}
+
+	// Start must still apply the configured IPv6 address and MTU, but not
+	// the IPv4 address that is already assigned.
+	origListen := listenVsock
+	defer func() { listenVsock = origListen }()
+	listenVsock = func(contextID, port uint32) (net.Listener, error) {
+		return nil, errors.New("no vsock")
+	}
+	cfg := &Config{
+		FQDN:             "example.com",
+		Port:             8443,
+		LoopbackAddrs:    []string{"127.0.0.1/8", "::1/128"},
+		LoopbackMTU:      9001,
+		SkipNSMPreflight: true,
+	}
+	e := NewEnclave(cfg)
+	defer func() {
+		_ = e.Close()
+	}()
+	if err := e.Start(); err == nil {
+		t.Fatal("Expected Start to fail but it didn't.")
+	}
+	if len(calls) != 2 || len(calls[1]) != 1 || calls[1][0] != "::1/128" || mtus[1] != 9001 {
+		t.Fatalf("Expected IPv6 address and MTU to be applied but got %v and MTUs %v.", calls, mtus)
+	}
+
+	// Once everything is applied, there's nothing left to do.
+	if err := ConfigureLoopback(cfg.LoopbackAddrs, cfg.LoopbackMTU); err != nil {
+		t.Fatalf("Failed to configure loopback: %v", err)
+	}
+	if len(calls) != 2 {
+		t.Fatalf("Expected no further changes but got %v.", calls)
+	}
+}
@@ -0,0 +1,85 @@
+package enclaveutils
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// FingerprintVector is a test vector that ties a certificate to its SHA-256
+// fingerprint, as the enclave computes it and binds it to its attestation
+// documents.  Clients in other languages can use the vectors in
+// testdata/fingerprint_vectors.json to check that their fingerprint
+// computation matches ours.
+type FingerprintVector struct {
+	// Seed is the 32-byte Ed25519 seed from which the certificate's key is
+	// derived.
+	Seed []byte `json:"seed"`
+	// FQDN is the certificate's subject alternative name.
+	FQDN string `json:"fqdn"`
+	// NotBefore is the start of the certificate's validity period, which
+	// lasts for the default certificate validity.
+	NotBefore time.Time `json:"not_before"`
+	// Certificate is the DER-encoded certificate.
+	Certificate []byte `json:"certificate"`
+	// Fingerprint is the SHA-256 hash of Certificate, in each of the
+	// supported fingerprint formats.
+	Fingerprint      string `json:"fingerprint"`
+	FingerprintColon string `json:"fingerprint_colon"`
+	FingerprintB64   string `json:"fingerprint_base64"`
+}
+
+// NewFingerprintVector deterministically creates a self-signed certificate
+// from the given seed, FQDN, and start of validity, and returns it together
+// with its fingerprint.  Unlike the enclave's own certificates, which use
+// ECDSA keys and random serial numbers, the vector's certificate uses an
+// Ed25519 key and a serial number derived from the seed, so that the same
+// input always results in the same certificate.
+func NewFingerprintVector(seed []byte, fqdn string, notBefore time.Time) (*FingerprintVector, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("seed must be %d bytes but is %d", ed25519.SeedSize, len(seed))
+	}
+	if fqdn == "" {
+		return nil, errors.New("FQDN must not be empty")
+	}
+	privateKey := ed25519.NewKeyFromSeed(seed)
+	notBefore = notBefore.UTC().Truncate(time.Second)
+
+	serial := sha256.Sum256(seed)
+	template := x509.Certificate{
+		SerialNumber: new(big.Int).SetBytes(serial[:16]),
+		Subject: pkix.Name{
+			Organization: []string{certificateOrg},
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(defaultCertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	template.DNSNames, template.IPAddresses = subjectAltNames(fqdn, nil)
+
+	// Ed25519 signatures are deterministic, so CreateCertificate doesn't use
+	// its source of randomness.
+	derBytes, err := x509.CreateCertificate(nil, &template, &template, privateKey.Public(), privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %v", err)
+	}
+	fpr := sha256.Sum256(derBytes)
+	trim := func(s string) string { return s[:len(s)-1] }
+
+	return &FingerprintVector{
+		Seed:             seed,
+		FQDN:             fqdn,
+		NotBefore:        notBefore,
+		Certificate:      derBytes,
+		Fingerprint:      trim(formatFingerprint(fpr, FingerprintHex)),
+		FingerprintColon: trim(formatFingerprint(fpr, FingerprintColonHex)),
+		FingerprintB64:   trim(formatFingerprint(fpr, FingerprintBase64)),
+	}, nil
+}
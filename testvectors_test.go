@@ -0,0 +1,82 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var updateVectors = flag.Bool("update-vectors", false, "regenerate testdata/fingerprint_vectors.json")
+
+var vectorsFile = filepath.Join("testdata", "fingerprint_vectors.json")
+
+// vectorInputs returns the inputs from which the vectors in vectorsFile are
+// created.
+func vectorInputs() []FingerprintVector {
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return []FingerprintVector{
+		{Seed: make([]byte, 32), FQDN: "example.com", NotBefore: notBefore},
+		{Seed: bytes.Repeat([]byte{0x42}, 32), FQDN: "enclave.example.com", NotBefore: notBefore},
+		{Seed: bytes.Repeat([]byte{0xff}, 32), FQDN: "127.0.0.1", NotBefore: notBefore.AddDate(1, 0, 0)},
+	}
+}
+
+func TestFingerprintVectors(t *testing.T) {
+	var vectors []*FingerprintVector
+	for _, in := range vectorInputs() {
+		v, err := NewFingerprintVector(in.Seed, in.FQDN, in.NotBefore)
+		if err != nil {
+			t.Fatalf("failed to create vector: %v", err)
+		}
+		vectors = append(vectors, v)
+	}
+
+	if *updateVectors {
+		data, err := json.MarshalIndent(vectors, "", "  ")
+		if err != nil {
+			t.Fatalf("failed to marshal vectors: %v", err)
+		}
+		if err := ioutil.WriteFile(vectorsFile, append(data, '\n'), 0644); err != nil {
+			t.Fatalf("failed to write vectors: %v", err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(vectorsFile)
+	if err != nil {
+		t.Fatalf("failed to read vectors: %v", err)
+	}
+	var expected []*FingerprintVector
+	if err := json.Unmarshal(data, &expected); err != nil {
+		t.Fatalf("failed to unmarshal vectors: %v", err)
+	}
+	if !reflect.DeepEqual(vectors, expected) {
+		t.Fatalf("vectors in %s no longer hold", vectorsFile)
+	}
+
+	// The enclave's own fingerprint computation must agree with the vectors.
+	e := NewEnclave(&Config{})
+	for _, v := range expected {
+		fpr, err := e.certFingerprint(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: v.Certificate}))
+		if err != nil {
+			t.Fatalf("failed to compute fingerprint: %v", err)
+		}
+		if got := formatFingerprint(fpr, FingerprintHex); got != v.Fingerprint+"\n" {
+			t.Fatalf("expected fingerprint %s but got %s", v.Fingerprint, got)
+		}
+	}
+}
+
+func TestNewFingerprintVectorErrors(t *testing.T) {
+	if _, err := NewFingerprintVector(make([]byte, 16), "example.com", time.Now()); err == nil {
+		t.Fatal("expected error for short seed")
+	}
+	if _, err := NewFingerprintVector(make([]byte, 32), "", time.Now()); err == nil {
+		t.Fatal("expected error for empty FQDN")
+	}
+}
@@ -0,0 +1,90 @@
+package enclaveutils
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Attributes of the spans that the enclave records for attestation requests.
+const (
+	// AttrNonceLength is the length of the request's raw nonce in bytes.
+	AttrNonceLength = "attestation.nonce_length"
+	// AttrNSMLatency is the time in seconds that the NSM took to issue the
+	// document.  It's missing if the request failed before reaching the
+	// NSM.
+	AttrNSMLatency = "attestation.nsm_latency_seconds"
+	// AttrResult is "success" if the enclave returned a document, and
+	// "failure" otherwise.
+	AttrResult = "attestation.result"
+	// AttrStatusCode is the response's HTTP status code.
+	AttrStatusCode = "http.status_code"
+)
+
+// Tracer is the interface that the enclave uses to trace attestation
+// requests.  The enclaveotel package, a separate module, implements it on top
+// of an OpenTelemetry TracerProvider, which keeps this module free of the
+// dependency.  Applications may also implement it to forward spans to other
+// tracing systems.  Implementations must be safe for concurrent use.
+type Tracer interface {
+	// StartSpan starts a span with the given name.  The span is a child of
+	// the span whose context the given request headers carry (e.g., in
+	// the W3C "traceparent" header), if any, or of the span in the given
+	// context.  The returned context contains the new span.
+	StartSpan(ctx context.Context, name string, header http.Header) (context.Context, Span)
+}
+
+// Span is a span that a Tracer started.
+type Span interface {
+	// SetAttribute sets the attribute with the given key to the given
+	// value, which is a string, an int, or a float64.
+	SetAttribute(key string, value interface{})
+	End()
+}
+
+// noopSpan discards all attributes.  Handlers use it if tracing is disabled.
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) End()                                       {}
+
+// spanKey is the context key under which traceAttestation stores the span of
+// an attestation request.
+type spanKey struct{}
+
+// spanFromContext returns the attestation span in the given context, or a
+// no-op span if there is none.
+func spanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return noopSpan{}
+}
+
+// traceAttestation wraps the given attestation handler so that it records a
+// span per request if Config.Tracer is set.  The handler adds its own
+// attributes via spanFromContext.
+func (e *Enclave) traceAttestation(next http.HandlerFunc) http.HandlerFunc {
+	if e.cfg.Tracer == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := e.cfg.Tracer.StartSpan(r.Context(), r.Method+" "+r.URL.Path, r.Header)
+		defer span.End()
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next(ww, r.WithContext(context.WithValue(ctx, spanKey{}, span)))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		result := "success"
+		if status >= http.StatusBadRequest {
+			result = "failure"
+		}
+		span.SetAttribute(AttrResult, result)
+		span.SetAttribute(AttrStatusCode, status)
+	}
+}
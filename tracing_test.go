@@ -0,0 +1,77 @@
+package enclaveutils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeTracer records the spans that the enclave starts.
+type fakeTracer struct {
+	sync.Mutex
+	spans []*fakeSpan
+}
+
+type fakeSpan struct {
+	name   string
+	parent string
+	attrs  map[string]interface{}
+	ended  bool
+}
+
+func (t *fakeTracer) StartSpan(ctx context.Context, name string, header http.Header) (context.Context, Span) {
+	t.Lock()
+	defer t.Unlock()
+	span := &fakeSpan{name: name, parent: header.Get("traceparent"), attrs: make(map[string]interface{})}
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+func (s *fakeSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *fakeSpan) End()                                       { s.ended = true }
+
+func TestTraceAttestation(t *testing.T) {
+	tracer := &fakeTracer{}
+	e := newFakeEnclave(&Config{Tracer: tracer})
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	get := func(target string) {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("traceparent", traceparent)
+		e.router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	get("/attestation?nonce=" + strings.Repeat("a", nonceLen))
+	get("/attestation?nonce=foobar")
+	if len(tracer.spans) != 2 {
+		t.Fatalf("expected 2 spans but got %d", len(tracer.spans))
+	}
+
+	span := tracer.spans[0]
+	if span.name != "GET /attestation" || span.parent != traceparent || !span.ended {
+		t.Fatalf("unexpected span: %+v", span)
+	}
+	if span.attrs[AttrNonceLength] != nonceLen/2 {
+		t.Fatalf("expected nonce length %d but got %v", nonceLen/2, span.attrs[AttrNonceLength])
+	}
+	if latency, ok := span.attrs[AttrNSMLatency].(float64); !ok || latency < 0 {
+		t.Fatalf("expected NSM latency but got %v", span.attrs[AttrNSMLatency])
+	}
+	if span.attrs[AttrResult] != "success" || span.attrs[AttrStatusCode] != http.StatusOK {
+		t.Fatalf("expected successful result but got %v", span.attrs)
+	}
+
+	// Requests that fail before reaching the NSM have no latency.
+	span = tracer.spans[1]
+	if span.attrs[AttrResult] != "failure" || span.attrs[AttrStatusCode] != http.StatusBadRequest {
+		t.Fatalf("expected failed result but got %v", span.attrs)
+	}
+	if _, exists := span.attrs[AttrNSMLatency]; exists {
+		t.Fatal("expected no NSM latency for rejected request")
+	}
+}
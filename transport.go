@@ -0,0 +1,26 @@
+package enclaveutils
+
+import (
+	"fmt"
+	"net"
+)
+
+// Transport determines how the enclave listens for connections.
+type Transport int
+
+const (
+	// TransportVsock listens on vsock, which is the only way to reach an
+	// enclave.  This is the default.
+	TransportVsock Transport = iota
+	// TransportTCP listens on TCP, which lets the enclave's code run outside
+	// an enclave for development and testing.  Clients can't attest an
+	// enclave that uses this transport.  Without an NSM device, set
+	// Config.SkipNSMPreflight as well.
+	TransportTCP
+)
+
+// listenTCP returns a TCP listener for the given port on all interfaces.
+// Tests override this variable to avoid binding to well-known ports.
+var listenTCP = func(port uint32) (net.Listener, error) {
+	return net.Listen("tcp", fmt.Sprintf(":%d", port))
+}
@@ -0,0 +1,120 @@
+package enclaveutils
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransportTCP(t *testing.T) {
+	if _, err := os.Stat("/dev/nsm"); err == nil {
+		t.Skip("test requires a system without NSM device")
+	}
+	origListenTCP, origListenVsock := listenTCP, listenVsock
+	defer func() { listenTCP, listenVsock = origListenTCP, origListenVsock }()
+	listenVsock = func(contextID, port uint32) (net.Listener, error) {
+		return nil, errors.New("vsock is unavailable")
+	}
+	addrs := make(chan string, 1)
+	var gotPort uint32
+	listenTCP = func(port uint32) (net.Listener, error) {
+		gotPort = port
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err == nil {
+			addrs <- l.Addr().String()
+		}
+		return l, err
+	}
+
+	// Start skips the enclave-specific bootstrap steps, which would fail
+	// outside an enclave, and listens on TCP.
+	e := NewEnclave(&Config{FQDN: "example.com", Port: 8443, Transport: TransportTCP, SkipNSMPreflight: true, Logger: &fakeLogger{}})
+	errs := make(chan error, 1)
+	go func() { errs <- e.Start() }()
+	var addr string
+	select {
+	case addr = <-addrs:
+	case err := <-errs:
+		t.Fatalf("failed to start enclave: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for listener")
+	}
+	defer e.Close()
+	if gotPort != 8443 {
+		t.Fatalf("expected listener on port 8443 but got %d", gotPort)
+	}
+
+	// Without an NSM device, the attestation endpoint says so.
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + addr + "/attestation?nonce=" + strings.Repeat("a", nonceLen))
+	if err != nil {
+		t.Fatalf("failed to request attestation: %v", err)
+	}
+	defer resp.Body.Close()
+	expect(t, resp, http.StatusNotImplemented, errNoNSM)
+}
+
+func TestHTTP2(t *testing.T) {
+	if _, err := os.Stat("/dev/nsm"); err == nil {
+		t.Skip("test requires a system without NSM device")
+	}
+	origListenTCP := listenTCP
+	defer func() { listenTCP = origListenTCP }()
+
+	for enabled, expected := range map[bool]string{true: "h2", false: "http/1.1"} {
+		addrs := make(chan string, 1)
+		listenTCP = func(port uint32) (net.Listener, error) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err == nil {
+				addrs <- l.Addr().String()
+			}
+			return l, err
+		}
+		e := NewEnclave(&Config{FQDN: "example.com", Port: 8443, Transport: TransportTCP, SkipNSMPreflight: true, EnableHTTP2: enabled, Logger: &fakeLogger{}})
+		if err := e.AddRoute(http.MethodGet, "/proto", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.Proto))
+		}); err != nil {
+			t.Fatalf("failed to add route: %v", err)
+		}
+		errs := make(chan error, 1)
+		go func() { errs <- e.Start() }()
+		var addr string
+		select {
+		case addr = <-addrs:
+		case err := <-errs:
+			t.Fatalf("failed to start enclave: %v", err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for listener")
+		}
+
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		if proto := conn.ConnectionState().NegotiatedProtocol; proto != expected {
+			t.Errorf("expected protocol %q with HTTP/2 enabled=%v but got %q", expected, enabled, proto)
+		}
+		conn.Close()
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+		resp, err := client.Get("https://" + addr + "/proto")
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		expectedProto := "HTTP/1.1"
+		if enabled {
+			expectedProto = "HTTP/2.0"
+		}
+		expect(t, resp, http.StatusOK, expectedProto)
+		resp.Body.Close()
+		e.Close()
+	}
+}
@@ -0,0 +1,85 @@
+package enclaveutils
+
+import "errors"
+
+// EmptyUserDataPolicy determines what the enclave does if it's about to
+// request an attestation document that binds neither user data nor a public
+// key, e.g., because the enclave's certificate isn't provisioned yet.
+type EmptyUserDataPolicy int
+
+const (
+	// AllowEmptyUserData requests the document anyway.  This is the default.
+	AllowEmptyUserData EmptyUserDataPolicy = iota
+	// RejectEmptyUserData makes the request fail.  If the enclave's ACME
+	// certificate isn't provisioned yet, the attestation endpoint responds
+	// with a 503, so clients can retry once there's something to bind.
+	// Otherwise, it responds with a 422.
+	RejectEmptyUserData
+	// DefaultEmptyUserData replaces the user data with Config.DefaultUserData.
+	// If the latter is empty, this policy acts like RejectEmptyUserData.
+	DefaultEmptyUserData
+)
+
+var (
+	// ErrEmptyUserData means that the enclave refused to attest empty user
+	// data; see EmptyUserDataPolicy.
+	ErrEmptyUserData = errors.New(errEmptyUserData)
+	// ErrCertificateNotReady means that the enclave's ACME certificate
+	// isn't provisioned yet, so there's no fingerprint to attest.
+	ErrCertificateNotReady = errors.New("enclave certificate isn't ready yet; retry later")
+)
+
+const errEmptyUserData = "refusing to attest empty user data"
+
+// attestDoc asks the enclave's attester for an attestation document, after
+// applying the enclave's EmptyUserDataPolicy.  User data counts as empty if
+// it has no bytes or only zero bytes, which is what the enclave's user data
+// looks like before its certificate is provisioned.  If the policy rejects
+// empty user data because the enclave's ACME certificate isn't provisioned
+// yet, attestDoc returns ErrCertificateNotReady instead of ErrEmptyUserData.
+// If the given public key is nil, the enclave's own public key is used, if
+// any; see PublicKey.
+func (e *Enclave) attestDoc(nonce, userData, publicKey []byte) ([]byte, error) {
+	if publicKey == nil {
+		var err error
+		if publicKey, err = e.PublicKey(); err != nil {
+			return nil, err
+		}
+	}
+	if isEmpty(userData) && len(publicKey) == 0 {
+		switch e.cfg.EmptyUserData {
+		case RejectEmptyUserData:
+			return nil, e.emptyUserDataError()
+		case DefaultEmptyUserData:
+			if len(e.cfg.DefaultUserData) == 0 {
+				return nil, e.emptyUserDataError()
+			}
+			userData = e.cfg.DefaultUserData
+		}
+	}
+	doc, err := e.attester.attest(nonce, userData, publicKey)
+	if err != nil {
+		return nil, &attestationError{err: err}
+	}
+	return doc, nil
+}
+
+// emptyUserDataError returns the error for rejected empty user data:
+// ErrCertificateNotReady if the enclave uses ACME and its certificate isn't
+// provisioned yet, which is only temporary, and ErrEmptyUserData otherwise.
+func (e *Enclave) emptyUserDataError() error {
+	if _, err := e.readyUserData(false); err != nil {
+		return err
+	}
+	return ErrEmptyUserData
+}
+
+// isEmpty returns true if the given byte slice is empty or all zero.
+func isEmpty(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEmptyUserDataPolicy(t *testing.T) {
+	target := "/attestation?nonce=" + strings.Repeat("a", nonceLen)
+	get := func(e *Enclave) *http.Response {
+		rec := httptest.NewRecorder()
+		e.getAttestationHandler()(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec.Result()
+	}
+
+	// Our certificate isn't provisioned, so the user data is all zero.
+	e := newFakeEnclave(&Config{})
+	expect(t, get(e), http.StatusOK, "")
+	if !bytes.Equal(e.attester.(*fakeAttester).userData, make([]byte, 32)) {
+		t.Fatal("expected all-zero user data to be attested by default")
+	}
+
+	// Rejecting empty user data is deliberate, so clients shouldn't retry.
+	e = newFakeEnclave(&Config{EmptyUserData: RejectEmptyUserData})
+	resp := get(e)
+	if resp.Header.Get("Retry-After") != "" {
+		t.Fatal("expected no Retry-After header")
+	}
+	expect(t, resp, http.StatusUnprocessableEntity, errEmptyUserData)
+
+	// With ACME, empty user data means that our certificate isn't
+	// provisioned yet, which clients can wait out.
+	e = newFakeEnclave(&Config{EmptyUserData: RejectEmptyUserData, UseACME: true})
+	if _, err := e.attestDoc([]byte("nonce"), nil, nil); err != ErrCertificateNotReady {
+		t.Fatalf("expected %v but got %v", ErrCertificateNotReady, err)
+	}
+	resp = get(e)
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatal("expected Retry-After header")
+	}
+	expect(t, resp, http.StatusServiceUnavailable, ErrCertificateNotReady.Error())
+
+	e = newFakeEnclave(&Config{EmptyUserData: DefaultEmptyUserData, DefaultUserData: []byte("default")})
+	expect(t, get(e), http.StatusOK, "")
+	if !bytes.Equal(e.attester.(*fakeAttester).userData, []byte("default")) {
+		t.Fatal("expected default user data to be attested")
+	}
+
+	e = newFakeEnclave(&Config{EmptyUserData: DefaultEmptyUserData})
+	expect(t, get(e), http.StatusUnprocessableEntity, errEmptyUserData)
+
+	// Non-empty user data and public keys are unaffected by the policy.
+	e = newFakeEnclave(&Config{EmptyUserData: RejectEmptyUserData})
+	e.certFpr[0] = 0x01
+	expect(t, get(e), http.StatusOK, "")
+	e = newFakeEnclave(&Config{EmptyUserData: RejectEmptyUserData})
+	if _, err := e.attestDoc([]byte("nonce"), nil, []byte("public key")); err != nil {
+		t.Fatalf("expected document with public key to be attested: %v", err)
+	}
+	if _, err := e.attestDoc([]byte("nonce"), nil, nil); err != ErrEmptyUserData {
+		t.Fatalf("expected %v but got %v", ErrEmptyUserData, err)
+	}
+}
@@ -0,0 +1,93 @@
+package enclaveutils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// Validate returns an error if the configuration is invalid.  Start calls
+// Validate before it does anything else, but applications may call it
+// earlier, e.g., right after parsing their configuration, to fail before
+// setting up the enclave's routes.
+func (cfg *Config) Validate() error {
+	var err error
+	if cfg.Transport == TransportVsock {
+		if err = validateContextID(cfg.ContextID); err != nil {
+			return err
+		}
+	}
+	for _, addr := range cfg.LoopbackAddrs {
+		if _, _, err = net.ParseCIDR(addr); err != nil {
+			return fmt.Errorf("invalid loopback address: %v", err)
+		}
+	}
+	if cfg.LoopbackMTU < 0 {
+		return errors.New("loopback MTU must not be negative")
+	}
+	if _, _, err = cfg.nonceRange(); err != nil {
+		return err
+	}
+	if cfg.CertValidity < 0 {
+		return errors.New("certificate validity must be positive")
+	}
+	if err = cfg.checkACMEFallback(); err != nil {
+		return err
+	}
+	if cfg.AttestationRateLimit != nil {
+		if err = cfg.AttestationRateLimit.check(); err != nil {
+			return err
+		}
+	}
+	if cfg.GenerateAttestationKey && len(cfg.AttestationPublicKey) > 0 {
+		return errors.New("cannot both set and generate an attestation key")
+	}
+	if cfg.ACMEEmail != "" {
+		if err = validateEmail(cfg.ACMEEmail); err != nil {
+			return err
+		}
+	}
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		return fmt.Errorf("port %d is not in the range 1 to 65535", cfg.Port)
+	}
+	// Both self-signed and ACME certificates are issued for the FQDN.
+	if cfg.FQDN == "" {
+		return errors.New("FQDN must be set")
+	}
+	if cfg.SOCKSProxy != "" {
+		if err = validateProxyURL(cfg.SOCKSProxy); err != nil {
+			return err
+		}
+	}
+	acmePort := cfg.ACMEPort
+	if acmePort == 0 {
+		acmePort = defaultACMEPort
+	}
+	if cfg.UseACME && cfg.ACMEDNSSolver == nil && acmePort == cfg.Port {
+		return fmt.Errorf("ACME port and main port must differ but are both %d", cfg.Port)
+	}
+	return nil
+}
+
+// validateProxyURL returns an error if the given proxy URL lacks a scheme or
+// host, e.g., because it's missing the "socks5://" prefix.
+func validateProxyURL(proxy string) error {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return fmt.Errorf("failed to parse SOCKS proxy URL: %v", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("SOCKS proxy URL %q needs a scheme and host, e.g., socks5://127.0.0.1:1080", proxy)
+	}
+	return nil
+}
+
+// loopbackAddrs returns the addresses that Start assigns to the loopback
+// interface.
+func (cfg *Config) loopbackAddrs() []string {
+	if len(cfg.LoopbackAddrs) == 0 {
+		return defaultLoAddrs
+	}
+	return cfg.LoopbackAddrs
+}
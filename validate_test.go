@@ -0,0 +1,43 @@
+package enclaveutils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := func() *Config {
+		return &Config{FQDN: "example.com", Port: 8443, SOCKSProxy: "socks5://127.0.0.1:1080", ContextID: 4}
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("expected valid config but got: %v", err)
+	}
+
+	for expected, modify := range map[string]func(*Config){
+		"range":            func(cfg *Config) { cfg.Port = 0 },
+		"1 to 65535":       func(cfg *Config) { cfg.Port = 65536 },
+		"FQDN":             func(cfg *Config) { cfg.FQDN = "" },
+		"scheme":           func(cfg *Config) { cfg.SOCKSProxy = "localhost" },
+		"parse":            func(cfg *Config) { cfg.SOCKSProxy = "socks5://[::1" },
+		"reserved":         func(cfg *Config) { cfg.ContextID = 2 },
+		"validity":         func(cfg *Config) { cfg.CertValidity = -1 },
+		"must differ":      func(cfg *Config) { cfg.UseACME, cfg.Port = true, defaultACMEPort },
+		"email":            func(cfg *Config) { cfg.ACMEEmail = "not an email" },
+		"ACME fallback":    func(cfg *Config) { cfg.ACMEFallbackSelfSigned = true },
+		"loopback address": func(cfg *Config) { cfg.LoopbackAddrs = []string{"::1"} },
+		"MTU":              func(cfg *Config) { cfg.LoopbackMTU = -1 },
+	} {
+		cfg := valid()
+		modify(cfg)
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error containing %q but got: %v", expected, err)
+		}
+	}
+
+	// Start refuses invalid configs.
+	cfg := valid()
+	cfg.Port = 0
+	if err := NewEnclave(cfg).Start(); err == nil || !strings.Contains(err.Error(), "port 0") {
+		t.Fatalf("expected port error but got: %v", err)
+	}
+}
@@ -0,0 +1,465 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// awsNitroRootCert is the root certificate of AWS's Nitro Enclaves PKI, as
+// published at:
+// https://docs.aws.amazon.com/enclaves/latest/user/verify-root.html
+// Its SHA-256 fingerprint is:
+// 641A0321A3E244EFE456463195D606317ED7CDCC3C1756E09893F3C68F79BB5B
+const awsNitroRootCert = `-----BEGIN CERTIFICATE-----
+MIICETCCAZagAwIBAgIRAPkxdWgbkK/hHUbMtOTn+FYwCgYIKoZIzj0EAwMwSTEL
+MAkGA1UEBhMCVVMxDzANBgNVBAoMBkFtYXpvbjEMMAoGA1UECwwDQVdTMRswGQYD
+VQQDDBJhd3Mubml0cm8tZW5jbGF2ZXMwHhcNMTkxMDI4MTMyODA1WhcNNDkxMDI4
+MTQyODA1WjBJMQswCQYDVQQGEwJVUzEPMA0GA1UECgwGQW1hem9uMQwwCgYDVQQL
+DANBV1MxGzAZBgNVBAMMEmF3cy5uaXRyby1lbmNsYXZlczB2MBAGByqGSM49AgEG
+BSuBBAAiA2IABPwCVOumCMHzaHDimtqQvkY4MpJzbolL//Zy2YlES1BR5TSksfbb
+48C8WBoyt7F2Bw7eEtaaP+ohG2bnUs990d0JX28TcPQXCEPZ3BABIeTPYwEoCWZE
+h8l5YoQwTcU/9KNCMEAwDwYDVR0TAQH/BAUwAwEB/zAdBgNVHQ4EFgQUkCW1DdkF
+R+eWw5b6cp3PmanfS5YwDgYDVR0PAQH/BAQDAgGGMAoGCCqGSM49BAMDA2kAMGYC
+MQCjfy+Rocm9Xue4YnwWmNJVA44fA0P5W2OpYow9OYCVRaEevL8uO1XYru5xtMPW
+rfMCMQCi85sWBbJwKKXdS6BptQFuZbT73o/gBh1qUxl/nNr12UO8Yfwr6wPLb+6N
+IwLz3/Y=
+-----END CERTIFICATE-----`
+
+const (
+	defaultAllowedSkew = time.Minute
+	// coseHeaderAlg is the label of the algorithm in a COSE header.
+	coseHeaderAlg = 1
+)
+
+// COSE algorithm identifiers of the ECDSA signature algorithms that Verify
+// supports, as defined in Section 8.1 of RFC 8152.  AWS uses ES384.
+const (
+	COSEAlgES256 = -7
+	COSEAlgES384 = -35
+	COSEAlgES512 = -36
+)
+
+// coseAlgorithm contains the curve and hash function that belong to a COSE
+// ECDSA algorithm.
+type coseAlgorithm struct {
+	curve elliptic.Curve
+	hash  func([]byte) []byte
+}
+
+var coseAlgorithms = map[int]coseAlgorithm{
+	COSEAlgES256: {elliptic.P256(), func(b []byte) []byte { h := sha256.Sum256(b); return h[:] }},
+	COSEAlgES384: {elliptic.P384(), func(b []byte) []byte { h := sha512.Sum384(b); return h[:] }},
+	COSEAlgES512: {elliptic.P521(), func(b []byte) []byte { h := sha512.Sum512(b); return h[:] }},
+}
+
+// VerifyOptions determines how Verify checks an attestation document.
+type VerifyOptions struct {
+	// Roots contains the certificates that the document's certificate chain
+	// must lead to.  If nil, AWS's Nitro Enclaves root certificate is used.
+	Roots *x509.CertPool
+	// Now returns the time that is used to check the validity of the
+	// document's certificate chain and the document's age.  If nil, time.Now
+	// is used.
+	Now func() time.Time
+	// AllowedSkew is the maximum clock skew that we tolerate between the
+	// document's issuer and us.  It applies to the validity period of the
+	// document's certificate chain, to the document's timestamp, and to
+	// MaxAge.  If zero, the skew defaults to one minute.  A negative value
+	// tolerates no skew.
+	AllowedSkew time.Duration
+	// MaxAge, if non-zero, is the maximum age of the document, based on its
+	// timestamp.
+	MaxAge time.Duration
+	// ExpectedPCRs maps PCR indices to the values that the document must
+	// contain for the given PCRs.  PCRs that are absent from the map are
+	// ignored.
+	ExpectedPCRs map[uint][]byte
+	// PinnedIntermediates contains SHA-256 fingerprints of intermediate
+	// certificates.  If set, the document's verified certificate chain must
+	// contain at least one of these intermediates.  Note that AWS rotates its
+	// intermediates, so pinning requires keeping this list up to date.
+	PinnedIntermediates [][sha256.Size]byte
+	// AllowedAlgorithms contains the COSE algorithms (e.g., COSEAlgES384)
+	// that the document's protected header may specify.  Documents that use
+	// any other algorithm are rejected, which prevents algorithm
+	// substitution.  If empty, only ES384 is allowed.
+	AllowedAlgorithms []int
+	// ExpectedPublicKey, if set, must equal the document's public_key field.
+	// Clients that perform an attested key exchange set it to the enclave's
+	// public value that they negotiated, e.g., over the same TLS connection,
+	// which prevents the enclave from binding the document to a key that the
+	// client didn't negotiate.
+	ExpectedPublicKey []byte
+	// Cache, if set, makes DialAndVerify skip the attestation request for
+	// enclaves whose certificate was verified recently; see VerifierCache.
+	// Verify ignores it.
+	Cache *VerifierCache
+}
+
+// AttestationResult contains the claims of an attestation document that
+// passed verification.
+type AttestationResult struct {
+	ModuleID  string
+	Digest    string
+	Timestamp time.Time
+	PCRs      map[uint][]byte
+	PublicKey []byte
+	UserData  []byte
+	Nonce     []byte
+	// Certificate is the document's signing certificate.
+	Certificate *x509.Certificate
+	// Chain is the verified certificate chain, starting with Certificate and
+	// ending with the root certificate.
+	Chain []*x509.Certificate
+}
+
+// coseSign1 represents a COSE_Sign1 structure as defined in RFC 8152.  The
+// Nitro hypervisor wraps its attestation documents in this structure.
+type coseSign1 struct {
+	_           struct{} `cbor:",toarray"`
+	Protected   []byte
+	Unprotected cbor.RawMessage
+	Payload     []byte
+	Signature   []byte
+}
+
+// attestationDocument represents the payload of an attestation document, as
+// documented at:
+// https://github.com/aws/aws-nitro-enclaves-nsm-api/blob/main/docs/attestation_process.md
+type attestationDocument struct {
+	ModuleID    string          `cbor:"module_id"`
+	Digest      string          `cbor:"digest"`
+	Timestamp   uint64          `cbor:"timestamp"`
+	PCRs        map[uint][]byte `cbor:"pcrs"`
+	Certificate []byte          `cbor:"certificate"`
+	CABundle    [][]byte        `cbor:"cabundle"`
+	PublicKey   []byte          `cbor:"public_key"`
+	UserData    []byte          `cbor:"user_data"`
+	Nonce       []byte          `cbor:"nonce"`
+}
+
+// Verify takes as input a raw attestation document and verifies it according
+// to the given options.  Verification entails checking that the document's
+// certificate chain leads to a trusted root, that the document's signature
+// was made by the chain's leaf certificate, and that the document's PCRs have
+// the expected values.  If verification succeeds, the document's claims are
+// returned.
+func Verify(doc []byte, opts VerifyOptions) (*AttestationResult, error) {
+	msg, payload, err := decodeDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := verifyCertChain(payload, opts)
+	if err != nil {
+		return nil, err
+	}
+	leaf := chain[0]
+	timestamp := payload.timestamp()
+	if err := verifyTimestamp(timestamp, opts); err != nil {
+		return nil, err
+	}
+	if err := verifySignature(msg, leaf, opts.AllowedAlgorithms); err != nil {
+		return nil, err
+	}
+	if err := verifyPCRs(payload.PCRs, opts.ExpectedPCRs); err != nil {
+		return nil, err
+	}
+	if opts.ExpectedPublicKey != nil && !bytes.Equal(payload.PublicKey, opts.ExpectedPublicKey) {
+		return nil, errors.New("document's public key does not match expected public key")
+	}
+
+	return &AttestationResult{
+		ModuleID:  payload.ModuleID,
+		Digest:    payload.Digest,
+		Timestamp: timestamp,
+		PCRs:      payload.PCRs,
+		PublicKey: payload.PublicKey,
+		UserData:  payload.UserData,
+		Nonce:     payload.Nonce,
+
+		Certificate: leaf,
+		Chain:       chain,
+	}, nil
+}
+
+// VerifyAttestation verifies the given raw attestation document, as returned
+// by the enclave's attestation endpoint after Base64 decoding, using the given
+// root certificates (AWS's root certificate if nil).  In addition, it checks
+// that the document contains the expected nonce, and that its user data
+// starts with the expected SHA-256 hash of the enclave's certificate.  Both
+// must be non-empty, so documents without a nonce, which could be replayed,
+// are rejected.  Use Verify for more control over verification, e.g., to
+// check PCRs.
+func VerifyAttestation(doc []byte, expectedNonce, expectedCertHash []byte, roots *x509.CertPool) (*AttestationResult, error) {
+	res, err := Verify(doc, VerifyOptions{Roots: roots})
+	if err != nil {
+		return nil, err
+	}
+	if len(expectedNonce) == 0 || !bytes.Equal(res.Nonce, expectedNonce) {
+		return nil, errors.New("document's nonce does not match expected nonce")
+	}
+	if len(expectedCertHash) == 0 || !bytes.HasPrefix(res.UserData, expectedCertHash) {
+		return nil, errors.New("document's user data does not match expected certificate hash")
+	}
+	return res, nil
+}
+
+// timestamp returns the document's timestamp, which is in milliseconds since
+// the Unix epoch.
+func (d *attestationDocument) timestamp() time.Time {
+	return time.Unix(0, int64(d.Timestamp)*int64(time.Millisecond))
+}
+
+// decodeDocument decodes the given raw attestation document without verifying
+// it.
+func decodeDocument(doc []byte) (*coseSign1, *attestationDocument, error) {
+	var msg coseSign1
+	if err := cbor.Unmarshal(doc, &msg); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode COSE_Sign1 structure: %v", err)
+	}
+	var payload attestationDocument
+	if err := cbor.Unmarshal(msg.Payload, &payload); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode attestation document: %v", err)
+	}
+	return &msg, &payload, nil
+}
+
+// VerifyBase64 works like Verify, but takes as input a Base64-encoded
+// attestation document, as returned by the enclave's attestation endpoint.
+// Surrounding whitespace (e.g., the trailing newline that the endpoint emits)
+// is ignored.  Both standard and URL-safe Base64 are accepted, with or without
+// padding.
+func VerifyBase64(b64 string, opts VerifyOptions) (*AttestationResult, error) {
+	b64 = strings.TrimSpace(b64)
+	// Normalize URL-safe Base64 to standard Base64 without padding.
+	b64 = strings.NewReplacer("-", "+", "_", "/").Replace(b64)
+	b64 = strings.TrimRight(b64, "=")
+	doc, err := base64.RawStdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode Base64-encoded document: %v", err)
+	}
+	return Verify(doc, opts)
+}
+
+// verifyCertChain checks that the document's certificate chains to one of the
+// trusted roots, and returns the verified chain, starting with the document's
+// certificate.
+func verifyCertChain(payload *attestationDocument, opts VerifyOptions) ([]*x509.Certificate, error) {
+	leaf, err := x509.ParseCertificate(payload.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse document's certificate: %v", err)
+	}
+	// Determine the period in which all certificates are valid.
+	notBefore, notAfter := leaf.NotBefore, leaf.NotAfter
+	intermediates := x509.NewCertPool()
+	for _, rawCert := range payload.CABundle {
+		cert, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate in CA bundle: %v", err)
+		}
+		intermediates.AddCert(cert)
+		if cert.NotBefore.After(notBefore) {
+			notBefore = cert.NotBefore
+		}
+		if cert.NotAfter.Before(notAfter) {
+			notAfter = cert.NotAfter
+		}
+	}
+
+	roots := opts.Roots
+	if roots == nil {
+		roots = x509.NewCertPool()
+		block, _ := pem.Decode([]byte(awsNitroRootCert))
+		rootCert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse AWS root certificate: %v", err)
+		}
+		roots.AddCert(rootCert)
+	}
+	// If we're slightly outside the validity period, we tolerate the skew by
+	// verifying the chain at the closest point in time that is inside the
+	// validity period.
+	verifyTime, skew := opts.now(), opts.skew()
+	if verifyTime.Before(notBefore) && notBefore.Sub(verifyTime) <= skew {
+		verifyTime = notBefore
+	}
+	if verifyTime.After(notAfter) && verifyTime.Sub(notAfter) <= skew {
+		verifyTime = notAfter
+	}
+
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   verifyTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify document's certificate chain: %v", err)
+	}
+	if len(opts.PinnedIntermediates) > 0 {
+		chain := pinnedChain(chains, opts.PinnedIntermediates)
+		if chain == nil {
+			return nil, errors.New("document's certificate chain contains no pinned intermediate")
+		}
+		return chain, nil
+	}
+	return chains[0], nil
+}
+
+// verifyTimestamp checks that the given document timestamp is neither in the
+// future nor older than the maximum age, modulo the allowed clock skew.
+func verifyTimestamp(timestamp time.Time, opts VerifyOptions) error {
+	now, skew := opts.now(), opts.skew()
+	if timestamp.Sub(now) > skew {
+		return fmt.Errorf("document's timestamp %s is in the future", timestamp)
+	}
+	if opts.MaxAge != 0 && now.Sub(timestamp) > opts.MaxAge+skew {
+		return fmt.Errorf("document's timestamp %s exceeds maximum age of %s", timestamp, opts.MaxAge)
+	}
+	return nil
+}
+
+func (opts *VerifyOptions) now() time.Time {
+	if opts.Now != nil {
+		return opts.Now()
+	}
+	return time.Now()
+}
+
+func (opts *VerifyOptions) skew() time.Duration {
+	if opts.AllowedSkew == 0 {
+		return defaultAllowedSkew
+	}
+	if opts.AllowedSkew < 0 {
+		return 0
+	}
+	return opts.AllowedSkew
+}
+
+// pinnedChain returns the first of the given chains that contains an
+// intermediate certificate whose fingerprint is among the given pins, or nil
+// if there is no such chain.  The first element of each chain is the leaf and
+// the last is the root, neither of which counts as an intermediate.
+func pinnedChain(chains [][]*x509.Certificate, pins [][sha256.Size]byte) []*x509.Certificate {
+	for _, chain := range chains {
+		for i := 1; i < len(chain)-1; i++ {
+			fpr := sha256.Sum256(chain[i].Raw)
+			for _, pin := range pins {
+				if fpr == pin {
+					return chain
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// verifySignature checks the COSE_Sign1 signature over the attestation
+// document.  The Nitro hypervisor signs its documents using ECDSA over the
+// curve P-384 with SHA-384 (i.e., COSE's ES384).  The algorithm in the
+// document's protected header must be among the given allowed algorithms
+// (ES384 if empty), and must match the certificate's key.
+func verifySignature(msg *coseSign1, cert *x509.Certificate, allowed []int) error {
+	alg, err := coseAlg(msg.Protected)
+	if err != nil {
+		return err
+	}
+	if len(allowed) == 0 {
+		allowed = []int{COSEAlgES384}
+	}
+	isAllowed := false
+	for _, a := range allowed {
+		if a == alg {
+			isAllowed = true
+		}
+	}
+	algorithm, supported := coseAlgorithms[alg]
+	if !isAllowed || !supported {
+		return fmt.Errorf("document's signature algorithm %d is not allowed", alg)
+	}
+
+	pubKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || pubKey.Curve != algorithm.curve {
+		return fmt.Errorf("document's certificate does not contain a %s public key", algorithm.curve.Params().Name)
+	}
+
+	// The signature is computed over the Sig_structure that is defined in
+	// Section 4.4 of RFC 8152.
+	sigStruct, err := cbor.Marshal([]interface{}{
+		"Signature1",
+		msg.Protected,
+		[]byte{},
+		msg.Payload,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode signature structure: %v", err)
+	}
+
+	// An ECDSA signature is the concatenation of r and s, each as long as the
+	// curve's order, e.g., 48 bytes for P-384.
+	n := (algorithm.curve.Params().BitSize + 7) / 8
+	if len(msg.Signature) != 2*n {
+		return fmt.Errorf("unexpected signature length of %d bytes", len(msg.Signature))
+	}
+	r := new(big.Int).SetBytes(msg.Signature[:n])
+	s := new(big.Int).SetBytes(msg.Signature[n:])
+	if !ecdsa.Verify(pubKey, algorithm.hash(sigStruct), r, s) {
+		return errors.New("document's signature is invalid")
+	}
+	return nil
+}
+
+// coseAlg extracts the algorithm from the given serialized COSE protected
+// header.
+func coseAlg(protected []byte) (int, error) {
+	var header map[int]cbor.RawMessage
+	if err := cbor.Unmarshal(protected, &header); err != nil {
+		return 0, fmt.Errorf("failed to decode protected header: %v", err)
+	}
+	rawAlg, exists := header[coseHeaderAlg]
+	if !exists {
+		return 0, errors.New("protected header contains no algorithm")
+	}
+	var alg int
+	if err := cbor.Unmarshal(rawAlg, &alg); err != nil {
+		return 0, fmt.Errorf("failed to decode algorithm in protected header: %v", err)
+	}
+	return alg, nil
+}
+
+// verifyPCRs checks that the given PCRs contain the expected values.  PCRs
+// are checked in ascending order, so the returned error names the PCR with
+// the lowest index that doesn't match.
+func verifyPCRs(actual, expected map[uint][]byte) error {
+	indices := make([]uint, 0, len(expected))
+	for index := range expected {
+		indices = append(indices, index)
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+
+	for _, index := range indices {
+		value, exists := actual[index]
+		if !exists {
+			return fmt.Errorf("PCR %d is missing from document", index)
+		}
+		if !bytes.Equal(value, expected[index]) {
+			return fmt.Errorf("PCR %d has value %x but expected %x", index, value, expected[index])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,432 @@
+package enclaveutils
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// testPKI mimics AWS's Nitro Enclaves PKI, consisting of a root, an
+// intermediate, and a leaf certificate that signs attestation documents.
+type testPKI struct {
+	roots    *x509.CertPool
+	leafKey  *ecdsa.PrivateKey
+	leafCert []byte
+	cabundle [][]byte
+}
+
+func newTestCert(t *testing.T, cn string, isCA bool, pubKey, parentKey *ecdsa.PrivateKey, parent *x509.Certificate) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if parent == nil {
+		parent = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &pubKey.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return cert
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return key
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	rootKey, intKey, leafKey := newTestKey(t), newTestKey(t), newTestKey(t)
+	rootCert := newTestCert(t, "root", true, rootKey, rootKey, nil)
+	intCert := newTestCert(t, "intermediate", true, intKey, rootKey, rootCert)
+	leafCert := newTestCert(t, "leaf", false, leafKey, intKey, intCert)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+	return &testPKI{
+		roots:    roots,
+		leafKey:  leafKey,
+		leafCert: leafCert.Raw,
+		cabundle: [][]byte{rootCert.Raw, intCert.Raw},
+	}
+}
+
+func newTestDocument() *attestationDocument {
+	return &attestationDocument{
+		ModuleID:  "i-0123456789abcdef0-enc0123456789abcdef",
+		Digest:    "SHA384",
+		Timestamp: uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+		PCRs: map[uint][]byte{
+			0: bytes.Repeat([]byte{0x00}, 48),
+			1: bytes.Repeat([]byte{0x01}, 48),
+			2: bytes.Repeat([]byte{0x02}, 48),
+		},
+		UserData: []byte("user data"),
+		Nonce:    []byte("nonce"),
+	}
+}
+
+// sign turns the given attestation document into a COSE_Sign1 structure that
+// is signed by the PKI's leaf certificate.
+func (p *testPKI) sign(t *testing.T, doc *attestationDocument) []byte {
+	doc.Certificate = p.leafCert
+	doc.CABundle = p.cabundle
+	payload, err := cbor.Marshal(doc)
+	if err != nil {
+		t.Fatalf("failed to encode attestation document: %v", err)
+	}
+	protected, err := cbor.Marshal(map[int]int{1: COSEAlgES384})
+	if err != nil {
+		t.Fatalf("failed to encode protected header: %v", err)
+	}
+	sigStruct, err := cbor.Marshal([]interface{}{"Signature1", protected, []byte{}, payload})
+	if err != nil {
+		t.Fatalf("failed to encode signature structure: %v", err)
+	}
+	hash := sha512.Sum384(sigStruct)
+	r, s, err := ecdsa.Sign(rand.Reader, p.leafKey, hash[:])
+	if err != nil {
+		t.Fatalf("failed to sign attestation document: %v", err)
+	}
+	sig := make([]byte, 96)
+	r.FillBytes(sig[:48])
+	s.FillBytes(sig[48:])
+
+	rawDoc, err := cbor.Marshal(&coseSign1{
+		Protected:   protected,
+		Unprotected: cbor.RawMessage{0xa0}, // An empty map.
+		Payload:     payload,
+		Signature:   sig,
+	})
+	if err != nil {
+		t.Fatalf("failed to encode COSE_Sign1 structure: %v", err)
+	}
+	return rawDoc
+}
+
+func TestVerify(t *testing.T) {
+	pki := newTestPKI(t)
+	doc := newTestDocument()
+	rawDoc := pki.sign(t, doc)
+
+	res, err := Verify(rawDoc, VerifyOptions{Roots: pki.roots})
+	if err != nil {
+		t.Fatalf("failed to verify valid document: %v", err)
+	}
+	if res.ModuleID != doc.ModuleID {
+		t.Fatalf("expected module ID %q but got %q", doc.ModuleID, res.ModuleID)
+	}
+	if !bytes.Equal(res.Nonce, doc.Nonce) || !bytes.Equal(res.UserData, doc.UserData) {
+		t.Fatal("expected nonce and user data to match document")
+	}
+
+	// The document must not verify against AWS's root certificate.
+	if _, err := Verify(rawDoc, VerifyOptions{}); err == nil {
+		t.Fatal("expected verification against AWS root to fail")
+	}
+
+	// Tamper with the signature.
+	rawDoc[len(rawDoc)-1] ^= 0xff
+	if _, err := Verify(rawDoc, VerifyOptions{Roots: pki.roots}); err == nil {
+		t.Fatal("expected verification of tampered document to fail")
+	}
+}
+
+func TestVerifyAttestation(t *testing.T) {
+	pki := newTestPKI(t)
+	certHash := sha256.Sum256([]byte("certificate"))
+	doc := newTestDocument()
+	doc.UserData = certHash[:]
+	rawDoc := pki.sign(t, doc)
+
+	res, err := VerifyAttestation(rawDoc, doc.Nonce, certHash[:], pki.roots)
+	if err != nil {
+		t.Fatalf("failed to verify valid attestation: %v", err)
+	}
+	if res.ModuleID != doc.ModuleID || len(res.PCRs) != len(doc.PCRs) || res.Timestamp.IsZero() {
+		t.Fatal("expected result to contain document's claims")
+	}
+
+	if _, err := VerifyAttestation(rawDoc, []byte("other nonce"), certHash[:], pki.roots); err == nil {
+		t.Fatal("expected error for unexpected nonce")
+	}
+	// Documents without a nonce are replayable, so an empty expected nonce
+	// must not match them.
+	nonce := doc.Nonce
+	doc.Nonce = nil
+	nonceless := pki.sign(t, doc)
+	doc.Nonce = nonce
+	for _, nonce := range [][]byte{nil, {}} {
+		if _, err := VerifyAttestation(nonceless, nonce, certHash[:], pki.roots); err == nil {
+			t.Fatal("expected error for missing nonce")
+		}
+	}
+	otherHash := sha256.Sum256([]byte("other certificate"))
+	if _, err := VerifyAttestation(rawDoc, doc.Nonce, otherHash[:], pki.roots); err == nil {
+		t.Fatal("expected error for unexpected certificate hash")
+	}
+	if _, err := VerifyAttestation(rawDoc, doc.Nonce, nil, pki.roots); err == nil {
+		t.Fatal("expected error for missing certificate hash")
+	}
+	if _, err := VerifyAttestation(rawDoc, doc.Nonce, certHash[:], nil); err == nil {
+		t.Fatal("expected verification against AWS root to fail")
+	}
+}
+
+func TestVerifyCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	rawDoc := pki.sign(t, newTestDocument())
+
+	res, err := Verify(rawDoc, VerifyOptions{Roots: pki.roots})
+	if err != nil {
+		t.Fatalf("failed to verify valid document: %v", err)
+	}
+	if res.Certificate == nil || !bytes.Equal(res.Certificate.Raw, pki.leafCert) {
+		t.Fatal("expected result's certificate to match document's certificate")
+	}
+	// The chain consists of the leaf, the intermediate, and the root.
+	if len(res.Chain) != 3 {
+		t.Fatalf("expected chain of length 3 but got %d", len(res.Chain))
+	}
+	if res.Chain[0] != res.Certificate {
+		t.Fatal("expected chain to start with the document's certificate")
+	}
+	if !bytes.Equal(res.Chain[1].Raw, pki.cabundle[1]) {
+		t.Fatal("expected chain to contain the intermediate certificate")
+	}
+	root := res.Chain[2]
+	if !bytes.Equal(root.Raw, pki.cabundle[0]) {
+		t.Fatal("expected chain to end with the root certificate")
+	}
+	if err := res.Chain[1].CheckSignatureFrom(root); err != nil {
+		t.Fatalf("expected intermediate to be signed by root: %v", err)
+	}
+}
+
+func TestVerifyAlgorithm(t *testing.T) {
+	pki := newTestPKI(t)
+	rawDoc := pki.sign(t, newTestDocument())
+	if _, err := Verify(rawDoc, VerifyOptions{Roots: pki.roots}); err != nil {
+		t.Fatalf("failed to verify ES384 document: %v", err)
+	}
+	if _, err := Verify(rawDoc, VerifyOptions{Roots: pki.roots, AllowedAlgorithms: []int{COSEAlgES256}}); err == nil {
+		t.Fatal("expected error for ES384 document if only ES256 is allowed")
+	}
+
+	// Replace the document's protected header.
+	withProtected := func(header interface{}) []byte {
+		var msg coseSign1
+		if err := cbor.Unmarshal(rawDoc, &msg); err != nil {
+			t.Fatalf("failed to decode document: %v", err)
+		}
+		protected, err := cbor.Marshal(header)
+		if err != nil {
+			t.Fatalf("failed to encode protected header: %v", err)
+		}
+		msg.Protected = protected
+		tampered, err := cbor.Marshal(&msg)
+		if err != nil {
+			t.Fatalf("failed to encode document: %v", err)
+		}
+		return tampered
+	}
+	for _, c := range []struct {
+		header  interface{}
+		allowed []int
+	}{
+		{map[int]int{1: COSEAlgES256}, nil},
+		{map[int]int{1: COSEAlgES256}, []int{COSEAlgES256, COSEAlgES384}},
+		{map[int]int{1: -257}, []int{-257}}, // RS256 is unsupported.
+		{map[int]string{1: "none"}, nil},
+		{map[int]int{}, nil},
+	} {
+		if _, err := Verify(withProtected(c.header), VerifyOptions{Roots: pki.roots, AllowedAlgorithms: c.allowed}); err == nil {
+			t.Fatalf("expected error for protected header %v", c.header)
+		}
+	}
+}
+
+func TestVerifyExpectedPCRs(t *testing.T) {
+	pki := newTestPKI(t)
+	rawDoc := pki.sign(t, newTestDocument())
+
+	// Exact match of a subset of PCRs.
+	if _, err := Verify(rawDoc, VerifyOptions{
+		Roots: pki.roots,
+		ExpectedPCRs: map[uint][]byte{
+			0: bytes.Repeat([]byte{0x00}, 48),
+			2: bytes.Repeat([]byte{0x02}, 48),
+		},
+	}); err != nil {
+		t.Fatalf("expected matching PCRs to verify but got: %v", err)
+	}
+
+	// Mismatch.
+	_, err := Verify(rawDoc, VerifyOptions{
+		Roots: pki.roots,
+		ExpectedPCRs: map[uint][]byte{
+			0: bytes.Repeat([]byte{0x00}, 48),
+			1: bytes.Repeat([]byte{0xff}, 48),
+			2: bytes.Repeat([]byte{0xff}, 48),
+		},
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), "PCR 1 ") {
+		t.Fatalf("expected error naming PCR 1 but got: %v", err)
+	}
+
+	// Missing register.
+	_, err = Verify(rawDoc, VerifyOptions{
+		Roots:        pki.roots,
+		ExpectedPCRs: map[uint][]byte{8: bytes.Repeat([]byte{0x00}, 48)},
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), "PCR 8 ") {
+		t.Fatalf("expected error naming PCR 8 but got: %v", err)
+	}
+}
+
+func TestVerifyExpectedPublicKey(t *testing.T) {
+	pki := newTestPKI(t)
+	doc := newTestDocument()
+	doc.PublicKey = bytes.Repeat([]byte{0x42}, 32)
+	rawDoc := pki.sign(t, doc)
+
+	if _, err := Verify(rawDoc, VerifyOptions{
+		Roots:             pki.roots,
+		ExpectedPublicKey: bytes.Repeat([]byte{0x42}, 32),
+	}); err != nil {
+		t.Fatalf("expected matching public key to verify but got: %v", err)
+	}
+	if _, err := Verify(rawDoc, VerifyOptions{
+		Roots:             pki.roots,
+		ExpectedPublicKey: bytes.Repeat([]byte{0x43}, 32),
+	}); err == nil {
+		t.Fatal("expected error for mismatched public key")
+	}
+
+	// A document without public key must not match an expected key.
+	rawDoc = pki.sign(t, newTestDocument())
+	if _, err := Verify(rawDoc, VerifyOptions{
+		Roots:             pki.roots,
+		ExpectedPublicKey: bytes.Repeat([]byte{0x42}, 32),
+	}); err == nil {
+		t.Fatal("expected error for document without public key")
+	}
+}
+
+func TestVerifyPinnedIntermediates(t *testing.T) {
+	pki := newTestPKI(t)
+	rawDoc := pki.sign(t, newTestDocument())
+	intFpr := sha256.Sum256(pki.cabundle[1])
+	rootFpr := sha256.Sum256(pki.cabundle[0])
+	otherFpr := sha256.Sum256(newTestPKI(t).cabundle[1])
+
+	if _, err := Verify(rawDoc, VerifyOptions{
+		Roots:               pki.roots,
+		PinnedIntermediates: [][sha256.Size]byte{otherFpr, intFpr},
+	}); err != nil {
+		t.Fatalf("expected pinned intermediate to verify but got: %v", err)
+	}
+
+	if _, err := Verify(rawDoc, VerifyOptions{
+		Roots:               pki.roots,
+		PinnedIntermediates: [][sha256.Size]byte{otherFpr},
+	}); err == nil {
+		t.Fatal("expected error for chain without pinned intermediate")
+	}
+
+	// The root is not an intermediate.
+	if _, err := Verify(rawDoc, VerifyOptions{
+		Roots:               pki.roots,
+		PinnedIntermediates: [][sha256.Size]byte{rootFpr},
+	}); err == nil {
+		t.Fatal("expected error when pinning the root certificate")
+	}
+}
+
+func TestVerifyBase64(t *testing.T) {
+	pki := newTestPKI(t)
+	rawDoc := pki.sign(t, newTestDocument())
+	opts := VerifyOptions{Roots: pki.roots}
+
+	for _, b64 := range []string{
+		base64.StdEncoding.EncodeToString(rawDoc),
+		base64.StdEncoding.EncodeToString(rawDoc) + "\n",
+		" " + base64.StdEncoding.EncodeToString(rawDoc) + "\r\n",
+		base64.URLEncoding.EncodeToString(rawDoc),
+		base64.RawURLEncoding.EncodeToString(rawDoc) + "\n",
+	} {
+		if _, err := VerifyBase64(b64, opts); err != nil {
+			t.Fatalf("failed to verify Base64-encoded document %q: %v", b64, err)
+		}
+	}
+
+	if _, err := VerifyBase64("not Base64!", opts); err == nil {
+		t.Fatal("expected error for invalid Base64")
+	}
+}
+
+func TestVerifyAllowedSkew(t *testing.T) {
+	pki := newTestPKI(t)
+	doc := newTestDocument()
+	rawDoc := pki.sign(t, doc)
+	timestamp := time.Unix(0, int64(doc.Timestamp)*int64(time.Millisecond))
+	leaf, err := x509.ParseCertificate(pki.leafCert)
+	if err != nil {
+		t.Fatalf("failed to parse leaf certificate: %v", err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		now    time.Time
+		skew   time.Duration
+		maxAge time.Duration
+		valid  bool
+	}{
+		{"timestamp within skew", timestamp.Add(-30 * time.Second), 0, 0, true},
+		{"timestamp in future", timestamp.Add(-2 * time.Minute), 0, 0, false},
+		{"timestamp at custom skew", timestamp.Add(-5 * time.Minute), 5 * time.Minute, 0, true},
+		{"no skew", timestamp.Add(-time.Second), -1, 0, false},
+		{"age within skew", timestamp.Add(5*time.Minute + 30*time.Second), 0, 5 * time.Minute, true},
+		{"age exceeds skew", timestamp.Add(7 * time.Minute), 0, 5 * time.Minute, false},
+		{"expired cert within skew", leaf.NotAfter.Add(30 * time.Second), 0, 0, true},
+		{"expired cert", leaf.NotAfter.Add(2 * time.Minute), 0, 0, false},
+	} {
+		now := test.now
+		_, err := Verify(rawDoc, VerifyOptions{
+			Roots:       pki.roots,
+			Now:         func() time.Time { return now },
+			AllowedSkew: test.skew,
+			MaxAge:      test.maxAge,
+		})
+		if test.valid && err != nil {
+			t.Errorf("%s: expected document to verify but got: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected document to not verify", test.name)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package enclaveutils
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+const modulePath = "github.com/brave-experiments/nitro-enclave-utils"
+
+// AppMetadata describes the application that runs in the enclave.  It is
+// returned by the /version endpoint and must not contain secrets.
+type AppMetadata struct {
+	Version string `json:"version,omitempty"`
+	Commit  string `json:"commit,omitempty"`
+}
+
+// VersionInfo is returned by the /version endpoint.
+type VersionInfo struct {
+	// PackageVersion is the version of this package, as recorded in the
+	// binary's build info.
+	PackageVersion string       `json:"package_version"`
+	GoVersion      string       `json:"go_version"`
+	App            *AppMetadata `json:"app,omitempty"`
+}
+
+// packageVersion returns the version of this package that the running binary
+// was built with, or "unknown" if the binary lacks build info.
+func packageVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Path == modulePath && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+// getVersionHandler returns a HandlerFunc that responds with the enclave's
+// VersionInfo in JSON.
+func (e *Enclave) getVersionHandler() http.HandlerFunc {
+	info := VersionInfo{
+		PackageVersion: packageVersion(),
+		GoVersion:      runtime.Version(),
+		App:            e.cfg.AppMetadata,
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(info)
+	}
+}
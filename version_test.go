@@ -0,0 +1,41 @@
+package enclaveutils
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	e := NewEnclave(&Config{
+		EnableVersion: true,
+		AppMetadata:   &AppMetadata{Version: "1.2.3", Commit: "0123abc"},
+	})
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+
+	resp := serve(e, http.MethodGet, "/version")
+	expect(t, resp, http.StatusOK, "")
+	var info VersionInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatalf("failed to decode version info: %v", err)
+	}
+	if info.GoVersion != runtime.Version() {
+		t.Fatalf("expected Go version %q but got %q", runtime.Version(), info.GoVersion)
+	}
+	if info.PackageVersion == "" {
+		t.Fatal("expected non-empty package version")
+	}
+	if info.App == nil || info.App.Version != "1.2.3" || info.App.Commit != "0123abc" {
+		t.Fatalf("unexpected app metadata: %+v", info.App)
+	}
+
+	// The endpoint is off by default.
+	e = NewEnclave(&Config{})
+	if err := e.registerSystemRoutes(); err != nil {
+		t.Fatalf("failed to register system routes: %v", err)
+	}
+	expect(t, serve(e, http.MethodGet, "/version"), http.StatusNotFound, "")
+}